@@ -0,0 +1,368 @@
+package c2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"time"
+)
+
+// ClientState describes whether a client is still probing
+type ClientState string
+
+const (
+	// ClientStateHealthy means the client probes as often as it announced
+	ClientStateHealthy ClientState = "healthy"
+	// ClientStateLate means the client missed a few probes
+	ClientStateLate ClientState = "late"
+	// ClientStateLost means the client missed so many probes it is considered offline
+	ClientStateLost ClientState = "lost"
+
+	// ClientStateOnline is the former name of ClientStateHealthy.
+	//
+	// Deprecated: use ClientStateHealthy.
+	ClientStateOnline = ClientStateHealthy
+)
+
+// EventType identifies the kind of a server event
+type EventType string
+
+const (
+	// EventClientSeen is emitted when a client registers or returns after being late or lost
+	EventClientSeen EventType = "client_seen"
+	// EventClientLate is emitted when a client missed a few probes
+	EventClientLate EventType = "client_late"
+	// EventClientLost is emitted when a client stops probing
+	EventClientLost EventType = "client_lost"
+	// EventClientEvicted is emitted when a lost client is forgotten after the retention period
+	EventClientEvicted EventType = "client_evicted"
+	// EventResultReceived is emitted when a client returns the result of a job
+	EventResultReceived EventType = "result_received"
+	// EventJobUpdated is emitted whenever a job changes state
+	EventJobUpdated EventType = "job_updated"
+	// EventRolloutUpdated is emitted when a rollout finishes a batch or ends
+	EventRolloutUpdated EventType = "rollout_updated"
+	// EventJobOutput is emitted when a running command streamed output
+	EventJobOutput EventType = "job_output"
+	// EventTransferUpdated is emitted when a file transfer copied a chunk or ends
+	EventTransferUpdated EventType = "transfer_updated"
+)
+
+// Event describes something that happened on the server
+type Event struct {
+	Type     EventType  `json:"type"`
+	Time     time.Time  `json:"time"`
+	ClientID string     `json:"client_id"`
+	Job      *Job       `json:"job,omitempty"`
+	Output   *JobOutput `json:"output,omitempty"`
+	Rollout  *Rollout   `json:"rollout,omitempty"`
+	Transfer *Transfer  `json:"transfer,omitempty"`
+}
+
+var (
+	// ErrUnknownClient is returned when a client identifier was never seen
+	ErrUnknownClient = errors.New("unknown client")
+	// ErrUnknownJob is returned when a job ID does not exist
+	ErrUnknownJob = errors.New("unknown job")
+	// ErrServerRunning is returned when Run is called on a running server
+	ErrServerRunning = errors.New("server already running")
+	// ErrInvalidJob is returned for malformed job options
+	ErrInvalidJob = errors.New("invalid job")
+)
+
+// maintenanceInterval is how often expiry and liveness checks run
+const maintenanceInterval = 1 * time.Second
+
+// Run receives client messages until ctx is cancelled or Stop is called
+func (s *Server) Run(ctx context.Context) error {
+	if !s.running.CompareAndSwap(false, true) {
+		return ErrServerRunning
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer s.closeStore()
+	defer s.closeAudit()
+
+	if s.config.HTTPAddress != "" {
+		listener, err := net.Listen("tcp", s.config.HTTPAddress)
+		if err != nil {
+			s.running.Store(false)
+			return fmt.Errorf("server: failed to listen for HTTP API: %w", err)
+		}
+		go s.serveHTTP(ctx, listener)
+	}
+
+	// Closing the socket unblocks the pending read immediately
+	go func() {
+		select {
+		case <-s.stopCh:
+		case <-ctx.Done():
+		}
+		cancel()
+		s.closeListeners()
+		if s.tlsListener != nil {
+			s.tlsListener.Close()
+			s.closeStreams()
+		}
+	}()
+
+	if s.tlsListener != nil {
+		go s.streamAcceptLoop(ctx)
+	}
+	go s.maintenanceLoop(ctx)
+	if s.alerts != nil {
+		go s.alertLoop(ctx)
+	}
+	s.udpListenLoop(ctx)
+	return nil
+}
+
+// Stop terminates Run and the console
+func (s *Server) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+	})
+}
+
+// Start runs the server with the interactive console until the console exits or Stop is called.
+// The error of a failing console script is returned.
+func (s *Server) Start() error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Run(context.Background())
+	}()
+
+	// Start console processing automatically
+	consoleErr := make(chan error, 1)
+	go func() {
+		consoleErr <- s.StartConsole()
+		s.Stop()
+	}()
+
+	if err := <-errCh; err != nil {
+		return err
+	}
+	select {
+	case err := <-consoleErr:
+		return err
+	default:
+		return nil
+	}
+}
+
+// StartConsole runs the console until the operator quits. The commands of a configured
+// script run without prompting instead and the first one failing is returned as an error.
+// Standard input is only read as a script when the script is -.
+func (s *Server) StartConsole() error {
+	console := NewConsole(s)
+	switch {
+	case s.config.ConsoleScript == "-":
+		return console.RunScript(os.Stdin)
+	case s.config.ConsoleScript != "":
+		f, err := os.Open(s.config.ConsoleScript)
+		if err != nil {
+			return fmt.Errorf("server: failed to open console script: %w", err)
+		}
+		defer f.Close()
+		return console.RunScript(f)
+	}
+	console.Run()
+	return nil
+}
+
+// Enqueue queues a command for a client on behalf of the system operator and returns the created job
+func (s *Server) Enqueue(clientID string, cmd string) (*Job, error) {
+	return s.EnqueueAs(SystemOperator, clientID, cmd)
+}
+
+// EnqueueAs queues a command for a client on behalf of operator and returns the created job.
+// ErrForbidden is returned if the roles of operator do not permit the command on the client,
+// ErrInvalidOperation if it names a built-in operation that does not exist or is malformed.
+func (s *Server) EnqueueAs(operator string, clientID string, cmd string) (*Job, error) {
+	return s.EnqueueWith(operator, clientID, cmd, JobOptions{})
+}
+
+// EnqueueWith queues a command for a client on behalf of operator like EnqueueAs,
+// running it with the given options
+func (s *Server) EnqueueWith(operator string, clientID string, cmd string, opts JobOptions) (*Job, error) {
+	return s.enqueueAs(operator, clientID, cmd, opts, nil)
+}
+
+// enqueueAs authorizes and queues a command with the payload sent along with it
+func (s *Server) enqueueAs(operator string, clientID string, cmd string, opts JobOptions, data []byte) (*Job, error) {
+	if opts.Timeout < 0 {
+		return nil, fmt.Errorf("server: %w: timeout must not be negative", ErrInvalidJob)
+	}
+	cmd, err := normalizeCommand(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// Clients the operator may not see are unknown to it, as on the read endpoints
+	_, exists := s.Client(clientID)
+	if exists {
+		err = s.authorizeCommand(operator, clientID, cmd)
+	}
+	if !exists || (err != nil && !s.canView(operator, clientID)) {
+		return nil, fmt.Errorf("server: %w: %s", ErrUnknownClient, clientID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.enqueueJobData(operator, clientID, cmd, opts, data), nil
+}
+
+// CancelJob cancels a job on behalf of operator. Queued jobs are cancelled at once,
+// the client is asked to kill commands already sent to it. Only the operator who
+// queued the job or an admin may cancel it.
+func (s *Server) CancelJob(operator string, id uint64) (Job, error) {
+	job, exists := s.Job(id)
+	if !exists {
+		return Job{}, fmt.Errorf("server: %w: %d", ErrUnknownJob, id)
+	}
+	if operator != job.Operator {
+		if err := s.authorizeAdmin(operator, AuditCancelJob, job.ClientID); err != nil {
+			return Job{}, err
+		}
+	}
+
+	job, ok := s.cancelJob(job.ClientID, id)
+	if !ok {
+		// Finished jobs stay as they are
+		job, _ = s.Job(id)
+		return job, nil
+	}
+	s.audit(AuditEntry{Action: AuditCancelJob, Operator: operator, ClientID: job.ClientID, JobID: id, Command: job.Command})
+	return job, nil
+}
+
+// cancelJob cancels a queued job or asks the client to kill a sent one
+func (s *Server) cancelJob(clientID string, id uint64) (Job, bool) {
+	return s.updateJob(clientID, id, func(job *Job) {
+		if job.State == JobStateQueued {
+			job.State = JobStateCancelled
+			job.FinishedAt = time.Now()
+		} else {
+			job.CancelRequested = true
+		}
+	})
+}
+
+// Wait blocks until the job finishes or ctx is done and returns its final snapshot
+func (s *Server) Wait(ctx context.Context, jobID uint64) (*Job, error) {
+	s.jobsMu.Lock()
+	job, exists := s.jobs[jobID]
+	if !exists {
+		s.jobsMu.Unlock()
+		return nil, fmt.Errorf("server: %w: %d", ErrUnknownJob, jobID)
+	}
+	if job.Finished() {
+		snapshot := *job
+		s.jobsMu.Unlock()
+		return &snapshot, nil
+	}
+	done := s.jobDone[jobID]
+	s.jobsMu.Unlock()
+
+	select {
+	case <-done:
+		job, _ := s.Job(jobID)
+		return &job, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Clients returns snapshots of all known clients sorted by identifier
+func (s *Server) Clients() []ClientInfo {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+
+	clients := make([]ClientInfo, 0, len(s.clients))
+	for _, client := range s.clients {
+		clients = append(clients, *client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Identifier < clients[j].Identifier
+	})
+	return clients
+}
+
+// Client returns a snapshot of the client with the given identifier
+func (s *Server) Client(identifier string) (ClientInfo, bool) {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+
+	client, exists := s.clients[identifier]
+	if !exists {
+		return ClientInfo{}, false
+	}
+	return *client, true
+}
+
+// Subscribe returns a channel receiving server events and a function to cancel the subscription.
+// Events are dropped for subscribers whose buffer is full.
+func (s *Server) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+
+	s.subsMu.Lock()
+	s.nextSubID++
+	id := s.nextSubID
+	s.subscribers[id] = ch
+	s.subsMu.Unlock()
+
+	return ch, func() {
+		s.subsMu.Lock()
+		defer s.subsMu.Unlock()
+		if _, exists := s.subscribers[id]; exists {
+			delete(s.subscribers, id)
+			close(ch)
+		}
+	}
+}
+
+// emit delivers an event to all subscribers without blocking
+func (s *Server) emit(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+	for _, ch := range s.subscribers {
+		select {
+		case ch <- event:
+		default:
+			s.config.Logger.Debugf("server: dropped %s event for slow subscriber", event.Type)
+		}
+	}
+}
+
+// maintenanceLoop expires jobs, tracks client liveness and prunes history until ctx is done
+func (s *Server) maintenanceLoop(ctx context.Context) {
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+	lastPrune := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.jobsMu.Lock()
+			s.expireJobs(now)
+			s.unlockJobs()
+			s.updateLiveness(now)
+			if now.Sub(lastPrune) >= storeSeenInterval {
+				s.pruneHistory(now)
+				s.rateLimiter.prune(now)
+				s.reportDrops()
+				lastPrune = now
+			}
+		}
+	}
+}
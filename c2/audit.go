@@ -0,0 +1,290 @@
+package c2
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditAction names what an audit entry records
+type AuditAction string
+
+const (
+	// AuditEnqueue records an operator queueing a command
+	AuditEnqueue AuditAction = "enqueue"
+	// AuditJobFinished records the outcome of a job
+	AuditJobFinished AuditAction = "job_finished"
+	// AuditApproveEnrolment records an operator approving a client key
+	AuditApproveEnrolment AuditAction = "approve_enrolment"
+	// AuditRejectEnrolment records an operator rejecting a client key
+	AuditRejectEnrolment AuditAction = "reject_enrolment"
+	// AuditRotateKey records an operator rotating a client key
+	AuditRotateKey AuditAction = "rotate_key"
+	// AuditCancelJob records an operator cancelling a job
+	AuditCancelJob AuditAction = "cancel_job"
+)
+
+// SystemOperator is the operator recorded for actions taken through the library API
+const SystemOperator = "system"
+
+// ErrAuditTampered is returned when the audit log does not match its hash chain
+var ErrAuditTampered = errors.New("audit log tampered")
+
+// AuditEntry is one record of the audit log
+type AuditEntry struct {
+	Seq        uint64      `json:"seq"`
+	Time       time.Time   `json:"time"`
+	Action     AuditAction `json:"action"`
+	Operator   string      `json:"operator,omitempty"`
+	ClientID   string      `json:"client_id,omitempty"`
+	JobID      uint64      `json:"job_id,omitempty"`
+	Command    string      `json:"command,omitempty"`
+	State      JobState    `json:"state,omitempty"`
+	ExitCode   *int        `json:"exit_code,omitempty"`
+	ResultHash string      `json:"result_hash,omitempty"`
+	Detail     string      `json:"detail,omitempty"`
+	// PrevHash commits the entry to its predecessor
+	PrevHash string `json:"prev_hash"`
+	// Hash covers every other field of the entry
+	Hash string `json:"hash"`
+}
+
+// auditHead is the last entry of the log, kept beside it to detect truncation
+type auditHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// AuditLog appends hash-chained entries to a JSON-lines file
+type AuditLog struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+	head auditHead
+}
+
+// HashResult returns the hash recorded for the outcome of a job
+func HashResult(exitCode int, output string, errText string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%s\x00%s", exitCode, output, errText)))
+	return hex.EncodeToString(sum[:])
+}
+
+// hash computes the hash of an entry over all fields but Hash
+func (e AuditEntry) hash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// OpenAuditLog opens or creates the audit log at path after verifying its chain
+func OpenAuditLog(path string) (*AuditLog, error) {
+	head, err := verifyAuditLog(path)
+	if err != nil {
+		return nil, err
+	}
+	// Catch up with an entry written just before a crash
+	if recorded, err := readAuditHead(path); err == nil && recorded != head {
+		if err := writeAuditHead(path, head); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("audit: failed to open log: %w", err)
+	}
+	return &AuditLog{path: path, file: file, head: head}, nil
+}
+
+// Append chains entry to the log and writes it durably
+func (l *AuditLog) Append(entry AuditEntry) (AuditEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return AuditEntry{}, errors.New("audit: closed")
+	}
+
+	entry.Seq = l.head.Seq + 1
+	entry.Time = entry.Time.UTC()
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	entry.PrevHash = l.head.Hash
+	hash, err := entry.hash()
+	if err != nil {
+		return AuditEntry{}, fmt.Errorf("audit: failed to encode entry: %w", err)
+	}
+	entry.Hash = hash
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return AuditEntry{}, fmt.Errorf("audit: failed to encode entry: %w", err)
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return AuditEntry{}, fmt.Errorf("audit: failed to write entry: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return AuditEntry{}, fmt.Errorf("audit: failed to sync log: %w", err)
+	}
+
+	l.head = auditHead{Seq: entry.Seq, Hash: entry.Hash}
+	if err := writeAuditHead(l.path, l.head); err != nil {
+		return AuditEntry{}, err
+	}
+	return entry, nil
+}
+
+// Head returns the sequence number and hash of the last entry, for anchoring outside the server
+func (l *AuditLog) Head() (uint64, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.head.Seq, l.head.Hash
+}
+
+// Close closes the log
+func (l *AuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// VerifyAuditLog checks the hash chain of the audit log at path and returns the number
+// of entries. Edited, removed or reordered entries and truncation are reported as ErrAuditTampered.
+// One valid entry past the recorded head is accepted, a crash can leave it unrecorded.
+func VerifyAuditLog(path string) (uint64, error) {
+	head, err := verifyAuditLog(path)
+	return head.Seq, err
+}
+
+// verifyAuditLog checks the log at path and returns its last entry
+func verifyAuditLog(path string) (auditHead, error) {
+	var head auditHead
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// A missing log is only fine if it never had entries
+		if _, err := readAuditHead(path); err == nil {
+			return head, fmt.Errorf("%w: log missing", ErrAuditTampered)
+		}
+		return head, nil
+	}
+	if err != nil {
+		return head, fmt.Errorf("audit: failed to open log: %w", err)
+	}
+	defer file.Close()
+
+	// previous is the entry before head, where the head file is left by a crash between
+	// writing an entry and recording it as the head
+	var previous auditHead
+	reader := bufio.NewReader(file)
+	for {
+		line, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return head, fmt.Errorf("audit: failed to read log: %w", err)
+		}
+
+		var entry AuditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return head, fmt.Errorf("%w: entry after %d is malformed", ErrAuditTampered, head.Seq)
+		}
+		if entry.Seq != head.Seq+1 || entry.PrevHash != head.Hash {
+			return head, fmt.Errorf("%w: entry %d does not follow entry %d", ErrAuditTampered, entry.Seq, head.Seq)
+		}
+		if hash, err := entry.hash(); err != nil || hash != entry.Hash {
+			return head, fmt.Errorf("%w: entry %d was modified", ErrAuditTampered, entry.Seq)
+		}
+		previous, head = head, auditHead{Seq: entry.Seq, Hash: entry.Hash}
+	}
+
+	// Entries cut from the end still form a valid chain, the head file catches that
+	recorded, err := readAuditHead(path)
+	if err != nil && !os.IsNotExist(err) {
+		return head, fmt.Errorf("audit: failed to read head: %w", err)
+	}
+	if err == nil && recorded != head && (head.Seq == 0 || recorded != previous) {
+		return head, fmt.Errorf("%w: log ends at entry %d but %d were written", ErrAuditTampered, head.Seq, recorded.Seq)
+	}
+	return head, nil
+}
+
+// readAuditHead reads the head file kept beside the log
+func readAuditHead(path string) (auditHead, error) {
+	var head auditHead
+	data, err := os.ReadFile(path + ".head")
+	if err != nil {
+		return head, err
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		return head, err
+	}
+	return head, nil
+}
+
+// writeAuditHead replaces the head file kept beside the log
+func writeAuditHead(path string, head auditHead) error {
+	data, err := json.Marshal(head)
+	if err != nil {
+		return fmt.Errorf("audit: failed to encode head: %w", err)
+	}
+	if err := writeFileAtomic(path+".head", data, 0600); err != nil {
+		return fmt.Errorf("audit: failed to write head: %w", err)
+	}
+	return nil
+}
+
+// audit appends an entry to the audit log, if one is configured
+func (s *Server) audit(entry AuditEntry) {
+	if s.auditLog == nil {
+		return
+	}
+	if _, err := s.auditLog.Append(entry); err != nil {
+		s.config.Logger.Errorf("server: failed to write audit entry %s: %v", entry.Action, err)
+	}
+}
+
+// auditJobFinished records the outcome of a finished job
+func (s *Server) auditJobFinished(job Job) {
+	exitCode := job.ExitCode
+	s.audit(AuditEntry{
+		Time:       job.FinishedAt,
+		Action:     AuditJobFinished,
+		Operator:   job.Operator,
+		ClientID:   job.ClientID,
+		JobID:      job.ID,
+		Command:    job.Command,
+		State:      job.State,
+		ExitCode:   &exitCode,
+		ResultHash: HashResult(job.ExitCode, job.Output, job.Error),
+	})
+}
+
+// closeAudit closes the audit log, if one is configured
+func (s *Server) closeAudit() {
+	if s.auditLog == nil {
+		return
+	}
+	if err := s.auditLog.Close(); err != nil {
+		s.config.Logger.Errorf("server: failed to close audit log: %v", err)
+	}
+}
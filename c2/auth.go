@@ -0,0 +1,301 @@
+package c2
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"time"
+)
+
+// EnrolmentPolicy defines how the server treats probes from unknown identities
+type EnrolmentPolicy string
+
+const (
+	// EnrolmentManual records unknown identities for operator approval
+	EnrolmentManual EnrolmentPolicy = "manual"
+	// EnrolmentAuto pins the public key presented at first contact
+	EnrolmentAuto EnrolmentPolicy = "auto"
+)
+
+const (
+	// maxClockSkew is how far a message timestamp may drift from server time
+	maxClockSkew = 5 * time.Minute
+	// replayWindowSpan is how far behind the newest timestamp a message may arrive
+	replayWindowSpan = 30 * time.Second
+	// maxPendingEnrolments bounds the number of unknown identities kept for review
+	maxPendingEnrolments = 256
+)
+
+var (
+	// ErrEnrolmentPending is returned while an identity awaits operator approval
+	ErrEnrolmentPending = errors.New("enrolment pending approval")
+	// ErrBadSignature is returned when a message fails its identity proof
+	ErrBadSignature = errors.New("invalid message signature")
+	// ErrReplay is returned when a message was already seen or is outside the replay window
+	ErrReplay = errors.New("message replayed or outside replay window")
+)
+
+// EnrolmentRequest represents an unknown identity waiting for operator approval
+type EnrolmentRequest struct {
+	Identifier  string            `json:"identifier"`
+	PublicKey   ed25519.PublicKey `json:"public_key"`
+	Fingerprint string            `json:"fingerprint"`
+	SourceIP    net.Addr          `json:"source_ip"`
+	FirstSeen   time.Time         `json:"first_seen"`
+	LastSeen    time.Time         `json:"last_seen"`
+	Attempts    int               `json:"attempts"`
+	// Conflict is set when the identifier is already pinned to a different key
+	Conflict bool `json:"conflict,omitempty"`
+}
+
+// replayWindow tracks recently accepted message timestamps for one identity
+type replayWindow struct {
+	highest int64
+	seen    map[int64]struct{}
+}
+
+// GenerateIdentity creates a new Ed25519 signing key for a client
+func GenerateIdentity() (ed25519.PrivateKey, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("auth: failed to generate identity: %w", err)
+	}
+	return priv, nil
+}
+
+// LoadOrCreateIdentity loads a PEM encoded Ed25519 key from path, creating it if missing
+func LoadOrCreateIdentity(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "PRIVATE KEY" {
+			return nil, fmt.Errorf("auth: %s does not contain a PEM private key", path)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("auth: failed to parse identity: %w", err)
+		}
+		priv, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("auth: %s is not an Ed25519 key", path)
+		}
+		return priv, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("auth: failed to read identity: %w", err)
+	}
+
+	priv, err := GenerateIdentity()
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("auth: failed to marshal identity: %w", err)
+	}
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, pemData, 0600); err != nil {
+		return nil, fmt.Errorf("auth: failed to write identity: %w", err)
+	}
+	return priv, nil
+}
+
+// Fingerprint returns a short printable fingerprint of a public key
+func Fingerprint(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// signingBytes returns the canonical byte representation covered by the signature
+func (m *Message) signingBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("c2-msg-v1")
+	buf.WriteByte(byte(m.Type))
+	writeField(&buf, []byte(m.Identifier))
+	binary.Write(&buf, binary.BigEndian, m.Timestamp)
+	writeField(&buf, m.PublicKey)
+	binary.Write(&buf, binary.BigEndian, m.KeyEpoch)
+	binary.Write(&buf, binary.BigEndian, m.MessageID)
+	binary.Write(&buf, binary.BigEndian, m.FragmentIndex)
+	binary.Write(&buf, binary.BigEndian, m.FragmentCount)
+	writeField(&buf, m.Payload)
+	if m.Capabilities != 0 {
+		buf.WriteByte(byte(m.Capabilities))
+	}
+	return buf.Bytes()
+}
+
+// writeField writes a length-prefixed byte field
+func writeField(buf *bytes.Buffer, field []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(field)))
+	buf.Write(field)
+}
+
+// sign stamps the message with a timestamp and signs it with the given key
+func (m *Message) sign(key ed25519.PrivateKey, timestamp int64) {
+	m.Timestamp = timestamp
+	m.Signature = ed25519.Sign(key, m.signingBytes())
+}
+
+// verify checks the message signature against the given public key
+func (m *Message) verify(pub ed25519.PublicKey) bool {
+	if len(pub) != ed25519.PublicKeySize || len(m.Signature) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(pub, m.signingBytes(), m.Signature)
+}
+
+// check reports whether timestamp ts is fresh and records it as seen
+func (w *replayWindow) check(ts int64, now time.Time) bool {
+	if d := now.Sub(time.Unix(0, ts)); d > maxClockSkew || d < -maxClockSkew {
+		return false
+	}
+	if ts <= w.highest-int64(replayWindowSpan) {
+		return false
+	}
+	if _, dup := w.seen[ts]; dup {
+		return false
+	}
+
+	w.seen[ts] = struct{}{}
+	if ts > w.highest {
+		w.highest = ts
+		// Forget timestamps that fell out of the window
+		for seen := range w.seen {
+			if seen <= w.highest-int64(replayWindowSpan) {
+				delete(w.seen, seen)
+			}
+		}
+	}
+	return true
+}
+
+// authenticate verifies the identity proof of an incoming message
+func (s *Server) authenticate(msg *Message, addr net.Addr) error {
+	s.authMu.Lock()
+	defer s.authMu.Unlock()
+
+	pinned, known := s.trusted[msg.Identifier]
+	if !known {
+		// Only probes carrying a self-signed public key may start an enrolment
+		if msg.Type != MessageTypeProbe || !msg.verify(msg.PublicKey) {
+			return ErrBadSignature
+		}
+		if s.config.Enrolment != EnrolmentAuto {
+			s.recordEnrolment(msg, addr, false)
+			return ErrEnrolmentPending
+		}
+		pinned = append(ed25519.PublicKey(nil), msg.PublicKey...)
+		s.pinKey(msg.Identifier, pinned)
+		s.config.Logger.Infof("server: pinned key %s for new client %s", Fingerprint(pinned), msg.Identifier)
+	}
+
+	if !msg.verify(pinned) {
+		// A valid signature under a different key is a re-enrolment attempt
+		if msg.Type == MessageTypeProbe && msg.verify(msg.PublicKey) {
+			s.recordEnrolment(msg, addr, true)
+		}
+		return ErrBadSignature
+	}
+
+	window, exists := s.replay[msg.Identifier]
+	if !exists {
+		window = &replayWindow{seen: make(map[int64]struct{})}
+		s.replay[msg.Identifier] = window
+	}
+	if !window.check(msg.Timestamp, time.Now()) {
+		return ErrReplay
+	}
+
+	return nil
+}
+
+// pinKey trusts the public key of a client and persists it with the key state so the
+// client stays enrolled across restarts; authMu must be held
+func (s *Server) pinKey(identifier string, pub ed25519.PublicKey) {
+	s.trusted[identifier] = pub
+
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+	s.keyState(identifier).PublicKey = pub
+	s.saveKeyStates()
+}
+
+// recordEnrolment stores or refreshes a pending enrolment request; authMu must be held
+func (s *Server) recordEnrolment(msg *Message, addr net.Addr, conflict bool) {
+	req, exists := s.enrolments[msg.Identifier]
+	if !exists && len(s.enrolments) >= maxPendingEnrolments {
+		s.config.Logger.Warnf("server: dropping enrolment request from %s, too many pending", msg.Identifier)
+		return
+	}
+	if !exists || !bytes.Equal(req.PublicKey, msg.PublicKey) {
+		req = &EnrolmentRequest{
+			Identifier:  msg.Identifier,
+			PublicKey:   append(ed25519.PublicKey(nil), msg.PublicKey...),
+			Fingerprint: Fingerprint(msg.PublicKey),
+			FirstSeen:   time.Now(),
+			Conflict:    conflict,
+		}
+		s.enrolments[msg.Identifier] = req
+		s.config.Logger.Warnf("server: enrolment request from %s (%s) key %s awaiting approval",
+			msg.Identifier, addr.String(), req.Fingerprint)
+	}
+	req.SourceIP = addr
+	req.LastSeen = time.Now()
+	req.Attempts++
+}
+
+// PendingEnrolments returns the enrolment requests awaiting approval
+func (s *Server) PendingEnrolments() []EnrolmentRequest {
+	s.authMu.Lock()
+	defer s.authMu.Unlock()
+
+	requests := make([]EnrolmentRequest, 0, len(s.enrolments))
+	for _, req := range s.enrolments {
+		requests = append(requests, *req)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].FirstSeen.Before(requests[j].FirstSeen)
+	})
+	return requests
+}
+
+// ApproveEnrolment pins the key of a pending enrolment request
+func (s *Server) ApproveEnrolment(identifier string) error {
+	s.authMu.Lock()
+	defer s.authMu.Unlock()
+
+	req, exists := s.enrolments[identifier]
+	if !exists {
+		return fmt.Errorf("server: no pending enrolment for %s", identifier)
+	}
+	s.pinKey(identifier, req.PublicKey)
+	delete(s.enrolments, identifier)
+	// A new key starts a new replay history
+	delete(s.replay, identifier)
+	s.config.Logger.Infof("server: approved key %s for client %s", req.Fingerprint, identifier)
+	return nil
+}
+
+// RejectEnrolment discards a pending enrolment request
+func (s *Server) RejectEnrolment(identifier string) error {
+	s.authMu.Lock()
+	defer s.authMu.Unlock()
+
+	if _, exists := s.enrolments[identifier]; !exists {
+		return fmt.Errorf("server: no pending enrolment for %s", identifier)
+	}
+	delete(s.enrolments, identifier)
+	s.config.Logger.Infof("server: rejected enrolment for client %s", identifier)
+	return nil
+}
@@ -1,12 +1,39 @@
 package c2
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
 	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/b1gcat/core/pki"
+	"github.com/sirupsen/logrus"
 )
 
 // TestMessageEncoding tests message encoding and decoding
@@ -76,29 +103,44 @@ func TestEncryption(t *testing.T) {
 
 // TestServerClientInteraction tests basic server-client interaction
 func TestServerClientInteraction(t *testing.T) {
+	// Provision the client identity on the server
+	identity, err := GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+
+	// Client and server talk over an in-memory network
+	network := NewMemoryNetwork()
 
 	// Create server
 	server, err := NewServer(
 		WithServerKey("1234567890123456"),
-		WithServerAddress("0.0.0.0:9002"),
+		WithServerAddress("127.0.0.1:9002"),
+		WithServerPacketTransport(network),
+		WithServerTrustedClient("test-client-001", identity.Public().(ed25519.PublicKey)),
 	)
 	if err != nil {
 		t.Fatalf("Failed to create server: %v", err)
 	}
-	defer server.Stop()
+	events, unsubscribe := server.Subscribe(16)
+	defer unsubscribe()
 
-	// Start server (includes console processing automatically)
-	go server.Start()
-
-	// Give server time to start
-	time.Sleep(500 * time.Millisecond)
+	// Run the server headless until the test ends
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- server.Run(ctx)
+	}()
 
 	// Create client
 	client, err := NewClient(
 		WithClientKey("1234567890123456"),
-		WithClientAddress("localhost:9002"),
+		WithClientAddress("127.0.0.1:9002"),
+		WithClientPacketTransport(network),
 		WithClientIdentifier("test-client-001"),
 		WithClientInterval(1*time.Second),
+		WithClientSigningKey(identity),
 	)
 	if err != nil {
 		t.Fatalf("Failed to create client: %v", err)
@@ -109,22 +151,3027 @@ func TestServerClientInteraction(t *testing.T) {
 	go client.Start()
 
 	// Wait for client to send probe
-	time.Sleep(2 * time.Second)
+	select {
+	case event := <-events:
+		if event.Type != EventClientSeen || event.ClientID != "test-client-001" {
+			t.Fatalf("Expected client_seen event for test-client-001, got %+v", event)
+		}
+	case <-ctx.Done():
+		t.Fatal("Timed out waiting for client to register")
+	}
 
 	// Check if client is registered on server
-	server.clientsMu.RLock()
-	clientInfo, exists := server.clients["test-client-001"]
-	server.clientsMu.RUnlock()
+	clients := server.Clients()
+	if len(clients) != 1 || clients[0].Identifier != "test-client-001" {
+		t.Fatalf("Expected only test-client-001 to be registered, got %+v", clients)
+	}
+	if clients[0].State != ClientStateHealthy {
+		t.Errorf("Expected client to be online, got %s", clients[0].State)
+	}
 
-	if !exists {
-		t.Error("Expected client to be registered on server")
-		return
+	// Queue a command and wait for its result
+	job, err := server.Enqueue("test-client-001", "echo hello")
+	if err != nil {
+		t.Fatalf("Failed to enqueue command: %v", err)
+	}
+	done, err := server.Wait(ctx, job.ID)
+	if err != nil {
+		t.Fatalf("Failed to wait for job: %v", err)
+	}
+	if done.State != JobStateSucceeded || !strings.Contains(done.Output, "hello") {
+		t.Errorf("Expected succeeded job with output 'hello', got %s %q", done.State, done.Output)
+	}
+
+	if _, err := server.Enqueue("unknown-client", "id"); !errors.Is(err, ErrUnknownClient) {
+		t.Errorf("Expected ErrUnknownClient, got %v", err)
+	}
+
+	// Stop returns from Run
+	server.Stop()
+	select {
+	case err := <-runErr:
+		if err != nil {
+			t.Errorf("Run returned error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Run did not return after Stop")
+	}
+}
+
+// TestClientLost tests that silent clients are reported as lost
+func TestClientLost(t *testing.T) {
+	server, err := NewServer(
+		WithServerAddress("127.0.0.1:0"),
+		WithServerClientTimeout(time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.conn.Close()
+
+	events, unsubscribe := server.Subscribe(1)
+	defer unsubscribe()
+
+	now := time.Now()
+	server.clients["c1"] = &ClientInfo{Identifier: "c1", LastSeen: now.Add(-2 * time.Minute), State: ClientStateHealthy}
+	server.clients["c2"] = &ClientInfo{Identifier: "c2", LastSeen: now, State: ClientStateHealthy}
+
+	server.updateLiveness(now)
+	select {
+	case event := <-events:
+		if event.Type != EventClientLost || event.ClientID != "c1" {
+			t.Errorf("Expected client_lost event for c1, got %+v", event)
+		}
+	default:
+		t.Fatal("Expected client_lost event")
+	}
+	if client, _ := server.Client("c2"); client.State != ClientStateHealthy {
+		t.Errorf("Expected c2 to stay online, got %s", client.State)
+	}
+
+	// Lost clients are reported once
+	server.updateLiveness(now)
+	select {
+	case event := <-events:
+		t.Errorf("Unexpected event %+v", event)
+	default:
+	}
+
+	// Waiting on a job that expires returns its final state
+	job, err := server.Enqueue("c1", "id")
+	if err != nil {
+		t.Fatalf("Failed to enqueue command: %v", err)
+	}
+	server.jobsMu.Lock()
+	server.expireJobs(now.Add(server.config.JobTTL + time.Hour))
+	server.unlockJobs()
+	expired, err := server.Wait(context.Background(), job.ID)
+	if err != nil || expired.State != JobStateExpired {
+		t.Errorf("Expected expired job, got %+v, %v", expired, err)
+	}
+	if _, err := server.Wait(context.Background(), 9999); !errors.Is(err, ErrUnknownJob) {
+		t.Errorf("Expected ErrUnknownJob, got %v", err)
+	}
+}
+
+// TestAuthenticate tests identity verification and enrolment of probes
+func TestAuthenticate(t *testing.T) {
+	server, err := NewServer(WithServerAddress("127.0.0.1:0"))
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.conn.Close()
+
+	identity, _ := GenerateIdentity()
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4000}
+	probe := func(key ed25519.PrivateKey, ts int64) *Message {
+		msg := &Message{
+			Type:       MessageTypeProbe,
+			Identifier: "client-a",
+			PublicKey:  key.Public().(ed25519.PublicKey),
+		}
+		msg.sign(key, ts)
+		return msg
+	}
+
+	// Unknown identities wait for approval
+	now := time.Now().UnixNano()
+	if err := server.authenticate(probe(identity, now), addr); !errors.Is(err, ErrEnrolmentPending) {
+		t.Fatalf("Expected pending enrolment, got %v", err)
+	}
+	if pending := server.PendingEnrolments(); len(pending) != 1 || pending[0].Identifier != "client-a" {
+		t.Fatalf("Expected one pending enrolment, got %+v", pending)
+	}
+
+	if err := server.ApproveEnrolment("client-a"); err != nil {
+		t.Fatalf("Failed to approve enrolment: %v", err)
+	}
+	msg := probe(identity, now+1)
+	if err := server.authenticate(msg, addr); err != nil {
+		t.Fatalf("Expected approved probe to authenticate, got %v", err)
+	}
+
+	// Replayed messages are rejected
+	if err := server.authenticate(msg, addr); !errors.Is(err, ErrReplay) {
+		t.Errorf("Expected replay to be rejected, got %v", err)
+	}
+
+	// Tampered messages are rejected
+	tampered := probe(identity, now+2)
+	tampered.Payload = []byte("forged")
+	if err := server.authenticate(tampered, addr); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Expected tampered message to be rejected, got %v", err)
+	}
+
+	// A different key for a pinned identifier is surfaced as a conflict
+	impostor, _ := GenerateIdentity()
+	if err := server.authenticate(probe(impostor, now+3), addr); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Expected impostor to be rejected, got %v", err)
+	}
+	if pending := server.PendingEnrolments(); len(pending) != 1 || !pending[0].Conflict {
+		t.Errorf("Expected conflicting enrolment, got %+v", pending)
+	}
+}
+
+// TestKeyRotation tests per-client key derivation and in-band rotation
+func TestKeyRotation(t *testing.T) {
+	master := "master-secret-0123456789"
+	dir := t.TempDir()
+	stateFile := dir + "/keys.json"
+
+	keyA, _ := DeriveClientKey([]byte(master), "client-a", 0)
+	keyB, _ := DeriveClientKey([]byte(master), "client-b", 0)
+	if bytes.Equal(keyA, keyB) || len(keyA) != 16 {
+		t.Fatalf("Expected distinct 16-byte keys per client")
+	}
+
+	server, err := NewServer(
+		WithServerAddress("127.0.0.1:0"),
+		WithServerMasterKey(master),
+		WithServerKeyStateFile(stateFile),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.conn.Close()
+
+	client, err := NewClient(
+		WithClientKey(string(keyA)),
+		WithClientIdentifier("client-a"),
+		WithClientKeyFile(dir+"/client-key.json"),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.conn.Close()
+
+	if err := server.observeKeyEpoch("client-a", 0); err != nil {
+		t.Fatalf("Expected epoch 0 to be accepted: %v", err)
+	}
+	if err := server.RotateKey("client-a"); err != nil {
+		t.Fatalf("Failed to rotate key: %v", err)
+	}
+
+	sealed, pending, err := server.pendingRotation("client-a")
+	if err != nil || !pending {
+		t.Fatalf("Expected pending rotation, got %v %v", pending, err)
+	}
+	if err := client.handleRotateKey(sealed); err != nil {
+		t.Fatalf("Client failed to rotate key: %v", err)
+	}
+	key, epoch := client.currentKey()
+	expected, _ := DeriveClientKey([]byte(master), "client-a", 1)
+	if epoch != 1 || !bytes.Equal(key, expected) {
+		t.Fatalf("Expected client to use epoch 1 key, got epoch %d", epoch)
+	}
+
+	// Both epochs are accepted until the grace period after adoption ends
+	if err := server.observeKeyEpoch("client-a", 0); err != nil {
+		t.Errorf("Expected old epoch during pending rotation: %v", err)
+	}
+	if err := server.observeKeyEpoch("client-a", 1); err != nil {
+		t.Errorf("Expected new epoch to be accepted: %v", err)
+	}
+	if err := server.observeKeyEpoch("client-a", 0); err != nil {
+		t.Errorf("Expected old epoch within grace period: %v", err)
+	}
+	server.config.KeyGracePeriod = 0
+	if err := server.observeKeyEpoch("client-a", 0); !errors.Is(err, ErrStaleKey) {
+		t.Errorf("Expected old epoch to be rejected after grace period, got %v", err)
+	}
+
+	// Epochs survive restarts on both sides
+	restarted, err := NewServer(
+		WithServerAddress("127.0.0.1:0"),
+		WithServerMasterKey(master),
+		WithServerKeyStateFile(stateFile),
+	)
+	if err != nil {
+		t.Fatalf("Failed to restart server: %v", err)
+	}
+	defer restarted.conn.Close()
+	if _, epoch, _ := restarted.clientKey("client-a"); epoch != 1 {
+		t.Errorf("Expected restored server epoch 1, got %d", epoch)
+	}
+
+	reloaded, err := NewClient(
+		WithClientKey(string(keyA)),
+		WithClientIdentifier("client-a"),
+		WithClientKeyFile(dir+"/client-key.json"),
+	)
+	if err != nil {
+		t.Fatalf("Failed to restart client: %v", err)
+	}
+	defer reloaded.conn.Close()
+	if _, epoch := reloaded.currentKey(); epoch != 1 {
+		t.Errorf("Expected restored client epoch 1, got %d", epoch)
+	}
+}
+
+// TestFragmentation tests fragmenting, retransmitting and reassembling large payloads
+func TestFragmentation(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 4096) // 64 KiB
+	sender := newFragmenter(512)
+	receiver := newReassembler(len(payload), 30*time.Second)
+
+	var delivered []byte
+	var mu sync.Mutex
+	dropped := make(map[uint16]bool)
+	write := func(msg Message) error {
+		// Lose the first transmission of every seventh fragment
+		mu.Lock()
+		if msg.FragmentIndex%7 == 0 && !dropped[msg.FragmentIndex] {
+			dropped[msg.FragmentIndex] = true
+			mu.Unlock()
+			return nil
+		}
+		mu.Unlock()
+
+		data, complete, err := receiver.add(msg, time.Now())
+		if err != nil {
+			return err
+		}
+		if complete {
+			delivered = data
+		}
+		go sender.ack(msg.MessageID, msg.FragmentIndex)
+		return nil
+	}
+
+	msg := Message{Type: MessageTypeResult, Identifier: "client-a", Payload: payload}
+	if err := sender.send(msg, write); err != nil {
+		t.Fatalf("Failed to send fragmented message: %v", err)
+	}
+	if !bytes.Equal(delivered, payload) {
+		t.Fatalf("Expected %d reassembled bytes, got %d", len(payload), len(delivered))
+	}
+
+	// Oversized messages are rejected
+	small := newReassembler(1000, 30*time.Second)
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		_, _, err = small.add(Message{Identifier: "client-a", MessageID: 1, FragmentIndex: uint16(i), FragmentCount: 3, Payload: make([]byte, 512)}, time.Now())
+	}
+	if err == nil {
+		t.Error("Expected oversized message to be rejected")
+	}
+
+	// Incomplete messages expire
+	now := time.Now()
+	small.add(Message{Identifier: "client-a", MessageID: 2, FragmentIndex: 0, FragmentCount: 2, Payload: []byte("a")}, now)
+	_, complete, _ := small.add(Message{Identifier: "client-a", MessageID: 2, FragmentIndex: 1, FragmentCount: 2, Payload: []byte("b")}, now.Add(time.Minute))
+	if complete {
+		t.Error("Expected expired partial message to be discarded")
+	}
+
+	// Duplicates of an empty fragment are counted once
+	small.add(Message{Identifier: "client-a", MessageID: 3, FragmentIndex: 0, FragmentCount: 2}, now)
+	if _, complete, _ := small.add(Message{Identifier: "client-a", MessageID: 3, FragmentIndex: 0, FragmentCount: 2}, now); complete {
+		t.Error("Expected a duplicate empty fragment not to complete the message")
+	}
+
+	// Each identifier may only have a few incomplete messages
+	for id := uint32(10); id < 10+maxPartialMessages; id++ {
+		small.add(Message{Identifier: "client-b", MessageID: id, FragmentIndex: 0, FragmentCount: 2, Payload: []byte("a")}, now)
+	}
+	if _, _, err := small.add(Message{Identifier: "client-b", MessageID: 99, FragmentIndex: 0, FragmentCount: 2}, now); err == nil {
+		t.Error("Expected too many incomplete messages to be rejected")
+	}
+	if _, _, err := small.add(Message{Identifier: "client-c", MessageID: 99, FragmentIndex: 0, FragmentCount: 2}, now); err != nil {
+		t.Errorf("Expected other identifiers to be unaffected, got %v", err)
+	}
+}
+
+// TestJobQueue tests FIFO job delivery, result correlation and expiry
+func TestJobQueue(t *testing.T) {
+	server, err := NewServer(WithServerAddress("127.0.0.1:0"))
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.conn.Close()
+
+	first := server.enqueueJob(SystemOperator, "client-a", "uname -a")
+	second := server.enqueueJob(SystemOperator, "client-a", "df -h")
+
+	job, ok := server.nextJob("client-a")
+	if !ok || job.ID != first.ID || job.State != JobStateSent {
+		t.Fatalf("Expected first job to be sent, got %+v", job)
+	}
+	if _, ok := server.nextJob("client-a"); ok {
+		t.Fatal("Expected second job to wait for the first to finish")
+	}
+
+	// Running jobs are sent again once their result is overdue, in case it was lost
+	server.updateJob("client-a", first.ID, func(job *Job) { job.State = JobStateRunning })
+	if _, ok := server.nextJob("client-a"); ok {
+		t.Fatal("Expected a running job not to be sent again right away")
+	}
+	server.updateJob("client-a", first.ID, func(job *Job) { job.SentAt = job.SentAt.Add(-jobResendAfter) })
+	if job, ok := server.nextJob("client-a"); !ok || job.ID != first.ID || job.State != JobStateRunning || job.Attempts != 2 {
+		t.Fatalf("Expected running job to be sent again, got %+v", job)
+	}
+
+	// Results are correlated by job ID and client
+	if _, ok := server.updateJob("client-b", first.ID, func(job *Job) { job.State = JobStateSucceeded }); ok {
+		t.Error("Expected result from another client to be ignored")
+	}
+	server.updateJob("client-a", first.ID, func(job *Job) {
+		job.State = JobStateFailed
+		job.ExitCode = 2
+	})
+	if job, _ := server.Job(first.ID); job.State != JobStateFailed || job.ExitCode != 2 {
+		t.Errorf("Expected first job to be failed with exit code 2, got %+v", job)
 	}
 
-	if clientInfo.Identifier != "test-client-001" {
-		t.Errorf("Expected client identifier 'test-client-001', got '%s'", clientInfo.Identifier)
+	job, ok = server.nextJob("client-a")
+	if !ok || job.ID != second.ID {
+		t.Fatalf("Expected second job to be sent, got %+v", job)
 	}
 
-	// Give client time to process
-	time.Sleep(1 * time.Second)
+	// Running jobs whose client vanished time out on the server too
+	timed := server.enqueueJobData(SystemOperator, "client-b", "sleep 60", JobOptions{Timeout: time.Second}, nil)
+	server.nextJob("client-b")
+	server.updateJob("client-b", timed.ID, func(job *Job) {
+		job.State = JobStateRunning
+		job.StartedAt = time.Now().Add(-time.Second - jobTimeoutGrace)
+	})
+	server.nextJob("client-b")
+	if job, _ := server.Job(timed.ID); job.State != JobStateTimedOut || job.Error == "" {
+		t.Errorf("Expected running job past its timeout to time out, got %+v", job)
+	}
+
+	// Unfinished jobs expire after their time to live
+	server.config.JobTTL = 0
+	if jobs := server.Jobs("client-a"); len(jobs) != 2 || jobs[1].State != JobStateExpired {
+		t.Errorf("Expected second job to expire, got %+v", jobs)
+	}
+	if server.queuedJobs("client-a") != 0 {
+		t.Error("Expected expired job to leave the queue")
+	}
+}
+
+// TestFitResult tests truncation of results to the maximum size
+func TestFitResult(t *testing.T) {
+	res := CommandResult{JobID: 1, Output: strings.Repeat("\x00ab", 1000)}
+	fitResult(&res, 512)
+	data, _ := json.Marshal(res)
+	if len(data) > 512 || !strings.HasSuffix(res.Output, truncatedSuffix) {
+		t.Errorf("Expected truncated result within 512 bytes, got %d", len(data))
+	}
+}
+
+// TestClientRun tests cancellation, restart and probe scheduling of the client
+func TestClientRun(t *testing.T) {
+	// Nothing listens here, so every probe goes unconfirmed
+	client, err := NewClient(
+		WithClientAddress("127.0.0.1:9"),
+		WithClientInterval(100*time.Millisecond),
+		WithClientMaxBackoff(time.Second),
+		WithClientFastPollInterval(10*time.Millisecond),
+		WithClientJitter(0),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	for run := 0; run < 2; run++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- client.Run(ctx)
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		if err := client.Run(context.Background()); !errors.Is(err, ErrClientRunning) {
+			t.Errorf("Expected ErrClientRunning, got %v", err)
+		}
+
+		// Alternate between cancelling the context and calling Stop
+		start := time.Now()
+		if run == 0 {
+			cancel()
+		} else {
+			client.Stop()
+		}
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Run returned error: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Run did not return after cancellation")
+		}
+		if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+			t.Errorf("Run took %s to return", elapsed)
+		}
+		cancel()
+	}
+
+	// Unreachable servers are probed exponentially less often
+	for failures, want := range []time.Duration{
+		100 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond,
+		400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second,
+	} {
+		if got := client.nextDelay(failures); got != want {
+			t.Errorf("Expected delay %s after %d failures, got %s", want, failures, got)
+		}
+	}
+
+	// Jobs in flight switch to fast polling
+	client.activeJobs.Add(1)
+	if got := client.nextDelay(0); got != 10*time.Millisecond {
+		t.Errorf("Expected fast poll delay, got %s", got)
+	}
+	client.activeJobs.Add(-1)
+
+	for i := 0; i < 100; i++ {
+		if d := jitter(time.Second, 0.2); d < 800*time.Millisecond || d > 1200*time.Millisecond {
+			t.Fatalf("Jittered delay %s outside 20%% spread", d)
+		}
+	}
+
+	if _, err := NewClient(WithClientJitter(1.5)); err == nil {
+		t.Error("Expected invalid jitter to be rejected")
+	}
+}
+
+// TestHTTPAPI tests authentication, client listing, job queueing and event streaming over HTTP
+func TestHTTPAPI(t *testing.T) {
+	if _, err := NewServer(WithServerAddress("127.0.0.1:0"), WithServerHTTPAddress(":0")); err == nil {
+		t.Error("Expected HTTP API without tokens to be rejected")
+	}
+
+	server, err := NewServer(
+		WithServerAddress("127.0.0.1:0"),
+		WithServerHTTPAddress(":0"),
+		WithServerAPIToken("alice", "secret-token"),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.conn.Close()
+	if !strings.HasPrefix(server.config.HTTPAddress, "127.0.0.1:") {
+		t.Errorf("Expected HTTP API bound to localhost, got %s", server.config.HTTPAddress)
+	}
+
+	server.clients["c1"] = &ClientInfo{
+		Identifier: "c1",
+		SourceIP:   &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000},
+		LastSeen:   time.Now(),
+		State:      ClientStateHealthy,
+	}
+
+	api := httptest.NewServer(server.HTTPHandler())
+	defer api.Close()
+
+	do := func(method, path, token, body string) *http.Response {
+		req, err := http.NewRequest(method, api.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to build request: %v", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request %s %s failed: %v", method, path, err)
+		}
+		return resp
+	}
+	decode := func(resp *http.Response, v interface{}) {
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+	}
+
+	// Requests need a valid token
+	for _, token := range []string{"", "wrong"} {
+		resp := do("GET", "/api/v1/clients", token, "")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for token %q, got %d", token, resp.StatusCode)
+		}
+	}
+
+	// The OpenAPI description is public
+	resp := do("GET", "/api/v1/openapi.json", "", "")
+	var spec map[string]interface{}
+	decode(resp, &spec)
+	if spec["openapi"] == nil {
+		t.Error("Expected OpenAPI document")
+	}
+
+	var clients []map[string]interface{}
+	decode(do("GET", "/api/v1/clients", "secret-token", ""), &clients)
+	if len(clients) != 1 || clients[0]["identifier"] != "c1" || clients[0]["source_ip"] != "10.0.0.1:4000" {
+		t.Errorf("Unexpected clients %v", clients)
+	}
+
+	resp = do("POST", "/api/v1/clients/unknown/jobs", "secret-token", `{"command":"id"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown client, got %d", resp.StatusCode)
+	}
+	resp = do("POST", "/api/v1/clients/c1/jobs", "secret-token", `{"command":""}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for empty command, got %d", resp.StatusCode)
+	}
+
+	// Follow the events of c1 while queueing a job
+	events := do("GET", "/api/v1/events?client=c1", "secret-token", "")
+	defer events.Body.Close()
+
+	resp = do("POST", "/api/v1/clients/c1/jobs", "secret-token", `{"command":"uname -a"}`)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d", resp.StatusCode)
+	}
+	var job Job
+	decode(resp, &job)
+	if job.State != JobStateQueued || job.Command != "uname -a" {
+		t.Errorf("Unexpected job %+v", job)
+	}
+
+	// Finish the job while a request waits for it
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		server.updateJob("c1", job.ID, func(job *Job) {
+			job.State = JobStateSucceeded
+			job.Output = "Linux"
+		})
+	}()
+	var finished Job
+	decode(do("GET", fmt.Sprintf("/api/v1/jobs/%d?wait=5s", job.ID), "secret-token", ""), &finished)
+	if finished.State != JobStateSucceeded || finished.Output != "Linux" {
+		t.Errorf("Expected finished job, got %+v", finished)
+	}
+
+	reader := bufio.NewReader(events.Body)
+	var states []JobState
+	for len(states) < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read event stream: %v", err)
+		}
+		data, ok := strings.CutPrefix(strings.TrimSpace(line), "data: ")
+		if !ok {
+			continue
+		}
+		var event Event
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("Failed to decode event: %v", err)
+		}
+		states = append(states, event.Job.State)
+	}
+	if states[0] != JobStateQueued || states[1] != JobStateSucceeded {
+		t.Errorf("Expected queued then succeeded events, got %v", states)
+	}
+}
+
+// TestFileStore tests the append-only log, its compaction and crash recovery
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.jsonl")
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000}
+	store.PutClient(ClientInfo{Identifier: "c1", SourceIP: addr, LastSeen: time.Now(), AssignedGroups: []string{"canary"}})
+	store.PutClient(ClientInfo{Identifier: "c2", LastSeen: time.Now()})
+	store.DeleteClient("c2")
+	for i := 0; i < 2000; i++ {
+		store.PutJob(Job{ID: 1, ClientID: "c1", Command: "id", State: JobStateQueued, Attempts: i})
+	}
+	store.PutJob(Job{ID: 2, ClientID: "c1", Command: "uptime", State: JobStateSucceeded, Output: "up"})
+	store.DeleteJob(3)
+	store.Close()
+
+	// Superseded records are compacted away
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines > compactMinRecords {
+		t.Errorf("Expected compacted log, got %d lines", lines)
+	}
+
+	// A half written record from a crash is ignored
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"op":"job","job":{"id":4`)
+	f.Close()
+
+	store, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store.Close()
+
+	clients, jobs, err := store.Load()
+	if err != nil {
+		t.Fatalf("Failed to load store: %v", err)
+	}
+	if len(clients) != 1 || clients[0].Identifier != "c1" || clients[0].SourceIP.String() != addr.String() ||
+		!slices.Equal(clients[0].AssignedGroups, []string{"canary"}) {
+		t.Errorf("Unexpected clients %+v", clients)
+	}
+	if len(jobs) != 2 || jobs[0].Attempts != 1999 || jobs[1].Output != "up" {
+		t.Errorf("Unexpected jobs %+v", jobs)
+	}
+
+	// Corruption before the end of the log is an error
+	os.WriteFile(path, []byte("garbage\n"+string(data)), 0600)
+	if _, err := OpenFileStore(path); err == nil {
+		t.Error("Expected corrupt log to be rejected")
+	}
+}
+
+// TestServerRestore tests that clients and jobs survive a server restart
+func TestServerRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.jsonl")
+	newServer := func() *Server {
+		server, err := NewServer(
+			WithServerAddress("127.0.0.1:0"),
+			WithServerStateFile(path),
+			WithServerRetention(time.Hour),
+		)
+		if err != nil {
+			t.Fatalf("Failed to create server: %v", err)
+		}
+		return server
+	}
+
+	server := newServer()
+	now := time.Now()
+	for id, seen := range map[string]time.Time{"c1": now, "c2": now.Add(-2 * time.Hour)} {
+		client := ClientInfo{Identifier: id, LastSeen: seen, State: ClientStateHealthy}
+		server.clients[id] = &client
+		server.persistClient(client)
+	}
+	old, _ := server.Enqueue("c1", "whoami")
+	server.updateJob("c1", old.ID, func(job *Job) {
+		job.State = JobStateSucceeded
+		job.FinishedAt = now.Add(-2 * time.Hour)
+	})
+	done, _ := server.Enqueue("c1", "hostname")
+	server.updateJob("c1", done.ID, func(job *Job) {
+		job.State = JobStateSucceeded
+		job.Output = "host"
+		job.FinishedAt = now
+	})
+	queued, _ := server.Enqueue("c1", "uptime")
+	withData := server.enqueueJobData(SystemOperator, "c1", OperationPrefix+"file_write", JobOptions{}, []byte("chunk"))
+	server.conn.Close()
+	server.closeStore()
+
+	server = newServer()
+	defer server.conn.Close()
+	defer server.closeStore()
+
+	// Clients and jobs beyond the retention period are dropped
+	if _, exists := server.Client("c2"); exists {
+		t.Error("Expected client outside retention to be dropped")
+	}
+	if _, exists := server.Job(old.ID); exists {
+		t.Error("Expected job outside retention to be dropped")
+	}
+	if client, exists := server.Client("c1"); !exists || client.State != ClientStateHealthy {
+		t.Errorf("Expected c1 restored online, got %+v", client)
+	}
+	if job, _ := server.Job(done.ID); job.Output != "host" {
+		t.Errorf("Expected finished job output restored, got %+v", job)
+	}
+	if next, ok := server.nextJob("c1"); !ok || next.ID != queued.ID {
+		t.Errorf("Expected queued job %d to be sent next, got %+v", queued.ID, next)
+	}
+
+	// Payloads are not stored, so jobs that carried one cannot be sent again
+	if job, _ := server.Job(withData.ID); job.State != JobStateExpired || job.Error == "" {
+		t.Errorf("Expected job with a payload to expire, got %+v", job)
+	}
+	if server.queuedJobs("c1") != 1 {
+		t.Errorf("Expected only job %d queued, got %d", queued.ID, server.queuedJobs("c1"))
+	}
+
+	// Job IDs continue after the restored ones
+	if job, _ := server.Enqueue("c1", "id"); job.ID <= withData.ID {
+		t.Errorf("Expected new job ID after %d, got %d", withData.ID, job.ID)
+	}
+}
+
+// TestAuditLog tests the hash chain of the audit log and detection of tampering
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	server, err := NewServer(WithServerAddress("127.0.0.1:0"), WithServerAuditFile(path))
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	server.clients["c1"] = &ClientInfo{Identifier: "c1", LastSeen: time.Now(), State: ClientStateHealthy}
+
+	job, err := server.EnqueueAs("alice", "c1", "cat /etc/hostname")
+	if err != nil {
+		t.Fatalf("Failed to enqueue command: %v", err)
+	}
+	server.updateJob("c1", job.ID, func(job *Job) {
+		job.State = JobStateSucceeded
+		job.Output = "host"
+		job.FinishedAt = time.Now()
+	})
+	console := &Console{server: server, out: io.Discard, operator: "console:bob"}
+	console.Execute("execute c1 id")
+	server.conn.Close()
+	server.closeAudit()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 audit entries, got %d", len(lines))
+	}
+	var finished AuditEntry
+	json.Unmarshal([]byte(lines[1]), &finished)
+	if finished.Action != AuditJobFinished || finished.Operator != "alice" || finished.JobID != job.ID ||
+		finished.ResultHash != HashResult(0, "host", "") {
+		t.Errorf("Unexpected audit entry %+v", finished)
+	}
+	var queued AuditEntry
+	json.Unmarshal([]byte(lines[2]), &queued)
+	if queued.Action != AuditEnqueue || queued.Operator != "console:bob" || queued.Command != "id" {
+		t.Errorf("Unexpected audit entry %+v", queued)
+	}
+
+	if n, err := VerifyAuditLog(path); err != nil || n != 3 {
+		t.Fatalf("Expected intact log of 3 entries, got %d, %v", n, err)
+	}
+
+	// The log continues its chain after a restart
+	log, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen audit log: %v", err)
+	}
+	if _, err := log.Append(AuditEntry{Action: AuditRotateKey, Operator: "carol", ClientID: "c1"}); err != nil {
+		t.Fatalf("Failed to append audit entry: %v", err)
+	}
+	log.Close()
+
+	// A crash between writing an entry and its head leaves the log one entry ahead
+	staleHead, _ := os.ReadFile(path + ".head")
+	log, _ = OpenAuditLog(path)
+	log.Append(AuditEntry{Action: AuditRotateKey, Operator: "carol", ClientID: "c2"})
+	log.Close()
+	os.WriteFile(path+".head", staleHead, 0600)
+	if log, err = OpenAuditLog(path); err != nil {
+		t.Fatalf("Expected log with an unrecorded last entry to open, got %v", err)
+	}
+	if seq, _ := log.Head(); seq != 5 {
+		t.Errorf("Expected the head to roll forward to entry 5, got %d", seq)
+	}
+	log.Close()
+	if recorded, _ := readAuditHead(path); recorded.Seq != 5 {
+		t.Errorf("Expected the head file to record entry 5, got %d", recorded.Seq)
+	}
+	data, _ = os.ReadFile(path)
+
+	tamper := map[string]string{
+		"edited":    strings.Replace(string(data), "cat /etc/hostname", "cat /etc/shadow", 1),
+		"removed":   strings.Replace(string(data), lines[1]+"\n", "", 1),
+		"truncated": strings.Join(lines, "\n") + "\n",
+	}
+	for name, content := range tamper {
+		os.WriteFile(path, []byte(content), 0600)
+		if _, err := VerifyAuditLog(path); !errors.Is(err, ErrAuditTampered) {
+			t.Errorf("Expected %s log to be detected, got %v", name, err)
+		}
+		if _, err := NewServer(WithServerAddress("127.0.0.1:0"), WithServerAuditFile(path)); err == nil {
+			t.Errorf("Expected server to refuse %s audit log", name)
+		}
+	}
+}
+
+// TestAccessControl tests operator roles, client groups and auditing of denied actions
+func TestAccessControl(t *testing.T) {
+	if _, err := NewServer(WithServerAddress("127.0.0.1:0"), WithServerOperator("eve", "", "missing")); err == nil {
+		t.Error("Expected operator with unknown role to be rejected")
+	}
+	if _, err := NewServer(WithServerAddress("127.0.0.1:0"), WithServerRole(Role{Name: "bad", Allow: []string{"("}})); err == nil {
+		t.Error("Expected invalid pattern to be rejected")
+	}
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	server, err := NewServer(
+		WithServerAddress("127.0.0.1:0"),
+		WithServerAuditFile(path),
+		WithServerClientGroup("web", "web-*"),
+		WithServerClientGroup("db", "db-*"),
+		WithServerRole(Role{Name: "web-readonly", Groups: []string{"web"}, Allow: []string{`^(uptime|df -h)$`}}),
+		WithServerRole(Role{Name: "db-admin", Groups: []string{"db"}, Deny: []string{`\brm\b`}, Admin: true}),
+		WithServerRole(Role{Name: "web-status", Groups: []string{"web"}, Allow: []string{`^systemctl status( \S+)?`}}),
+		WithServerOperator("alice", "alice-token", "web-readonly"),
+		WithServerOperator("bob", "", "web-readonly", "db-admin"),
+		WithServerOperator("carol", "", "web-status"),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.conn.Close()
+	for _, id := range []string{"web-1", "db-1"} {
+		server.clients[id] = &ClientInfo{Identifier: id, Groups: server.groupsFor(id, nil), State: ClientStateHealthy}
+	}
+	if groups := server.clients["web-1"].Groups; len(groups) != 1 || groups[0] != "web" {
+		t.Errorf("Expected web-1 in group web, got %v", groups)
+	}
+
+	tests := []struct {
+		operator string
+		client   string
+		command  string
+		allowed  bool
+	}{
+		{"alice", "web-1", "uptime", true},
+		{"alice", "web-1", "uptime; reboot", false},
+		{"alice", "db-1", "uptime", false},
+		{"bob", "db-1", "psql -c 'select 1'", true},
+		{"bob", "db-1", "rm -rf /var/lib/db", false},
+		{"bob", "web-1", "df -h", true},
+		{"mallory", "web-1", "uptime", false},
+		{"carol", "web-1", "systemctl status nginx", true},
+		{"carol", "web-1", "systemctl status nginx; rm -rf /", false},
+		{SystemOperator, "db-1", "rm -rf /tmp/cache", true},
+	}
+	for _, tt := range tests {
+		_, err := server.EnqueueAs(tt.operator, tt.client, tt.command)
+		if tt.allowed && err != nil {
+			t.Errorf("Expected %s to run %q on %s, got %v", tt.operator, tt.command, tt.client, err)
+		}
+		// Clients outside the scope of the operator are unknown to it
+		denial := ErrForbidden
+		if !server.canView(tt.operator, tt.client) {
+			denial = ErrUnknownClient
+		}
+		if !tt.allowed && !errors.Is(err, denial) {
+			t.Errorf("Expected %s to be denied %q on %s with %v, got %v", tt.operator, tt.command, tt.client, denial, err)
+		}
+	}
+
+	// Administrative console commands need an admin role
+	var out bytes.Buffer
+	console := &Console{server: server, out: &out, operator: "alice"}
+	console.Execute("rotate-key web-1")
+	if !strings.Contains(out.String(), ErrForbidden.Error()) {
+		t.Errorf("Expected console to refuse rotate-key, got %q", out.String())
+	}
+	console.Execute("execute db-1 uptime")
+	if server.queuedJobs("db-1") != 2 {
+		t.Errorf("Expected console execute to be denied")
+	}
+
+	// The HTTP API maps denials to 403, and clients out of scope look like unknown ones
+	api := httptest.NewServer(server.HTTPHandler())
+	defer api.Close()
+	post := func(clientID string, command string) int {
+		req, _ := http.NewRequest("POST", api.URL+"/api/v1/clients/"+clientID+"/jobs", strings.NewReader(`{"command":"`+command+`"}`))
+		req.Header.Set("Authorization", "Bearer alice-token")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := post("web-1", "reboot"); status != http.StatusForbidden {
+		t.Errorf("Expected 403, got %d", status)
+	}
+	if hidden, missing := post("db-1", "uptime"), post("db-9", "uptime"); hidden != http.StatusNotFound || missing != http.StatusNotFound {
+		t.Errorf("Expected 404 for hidden and unknown clients, got %d and %d", hidden, missing)
+	}
+
+	// Operators only see the clients their roles may target and their jobs
+	get := func(path string, v interface{}) int {
+		req, _ := http.NewRequest("GET", api.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer alice-token")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		if v != nil {
+			json.NewDecoder(resp.Body).Decode(v)
+		}
+		return resp.StatusCode
+	}
+	var clients []clientResponse
+	if get("/api/v1/clients", &clients); len(clients) != 1 || clients[0].Identifier != "web-1" {
+		t.Errorf("Expected alice to only see web-1, got %+v", clients)
+	}
+	var jobs []Job
+	if get("/api/v1/jobs", &jobs); len(jobs) == 0 || slices.ContainsFunc(jobs, func(job Job) bool { return job.ClientID != "web-1" }) {
+		t.Errorf("Expected alice to only see jobs of web-1, got %+v", jobs)
+	}
+	dbJob := server.Jobs("db-1")[0]
+	for _, path := range []string{"/api/v1/clients/db-1", "/api/v1/clients/db-1/jobs", fmt.Sprintf("/api/v1/jobs/%d", dbJob.ID)} {
+		if status := get(path, nil); status != http.StatusNotFound {
+			t.Errorf("Expected %s to be hidden from alice, got %d", path, status)
+		}
+	}
+	if server.canViewEvent("alice", Event{Type: EventJobOutput, ClientID: "db-1"}) || !server.canViewEvent("bob", Event{Type: EventJobOutput, ClientID: "db-1"}) {
+		t.Error("Expected events of db-1 to be shown to bob only")
+	}
+
+	// Every denial is on the audit trail
+	server.closeAudit()
+	data, _ := os.ReadFile(path)
+	if denied := strings.Count(string(data), `"action":"denied"`); denied != 9 {
+		t.Errorf("Expected 9 denied entries in audit log, got %d", denied)
+	}
+}
+
+// TestCommandPolicy tests the local command policy and execution limits of clients
+func TestCommandPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	os.WriteFile(path, []byte(`{
+		"allow": ["uptime", "echo [a-z ]+", "sleep [0-9]+"],
+		"forbidden_paths": ["/etc/shadow"],
+		"max_runtime": "200ms",
+		"max_output": 8
+	}`), 0600)
+
+	policy, err := LoadCommandPolicy(path)
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+	for cmd, allowed := range map[string]bool{
+		"uptime":               true,
+		"echo hello":           true,
+		"uptime; rm -rf /":     false,
+		"echo hello && reboot": false,
+		"cat /etc/passwd":      false,
+		"echo x /etc/shadow":   false,
+	} {
+		if err := policy.check(cmd); (err == nil) != allowed {
+			t.Errorf("Expected %q allowed=%v, got %v", cmd, allowed, err)
+		}
+	}
+	// With run-as, only the listed operations are permitted
+	runAs := &CommandPolicy{RunAs: "nobody", Operations: []string{"sysinfo"}}
+	for cmd, allowed := range map[string]bool{
+		"uptime":                    true,
+		OperationPrefix + "sysinfo": true,
+		OperationPrefix + "tail_log path=/var/log/syslog": false,
+	} {
+		if err := runAs.check(cmd); (err == nil) != allowed {
+			t.Errorf("Expected %q allowed=%v with run-as, got %v", cmd, allowed, err)
+		}
+	}
+	var unrestricted *CommandPolicy
+	if err := unrestricted.check("anything"); err != nil {
+		t.Errorf("Expected no policy to allow every command, got %v", err)
+	}
+
+	// Invalid or missing policies prevent the client from starting
+	invalid := filepath.Join(t.TempDir(), "invalid.json")
+	os.WriteFile(invalid, []byte(`{"max_runtime": "soon"}`), 0600)
+	if _, err := NewClient(WithClientPolicyFile(invalid)); err == nil {
+		t.Error("Expected invalid policy to be rejected")
+	}
+	if _, err := NewClient(WithClientPolicyFile(filepath.Join(t.TempDir(), "missing.json"))); err == nil {
+		t.Error("Expected missing policy to be rejected")
+	}
+
+	if limited := policy.limitOutput("hello world"); limited != "hello wo"+truncatedSuffix {
+		t.Errorf("Expected output limited to 8 bytes, got %q", limited)
+	}
+
+	// Commands are killed at the runtime limit
+	client := &Client{config: &Config{}, policy: policy}
+	var res CommandResult
+	start := time.Now()
+	client.runCommand(context.Background(), CommandRequest{Command: "sleep 5"}, &res)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected command to be killed after 200ms, ran %s", elapsed)
+	}
+	if !strings.Contains(res.Error, "timed out") {
+		t.Errorf("Expected timeout error, got %+v", res)
+	}
+
+	// Violations reach the server as rejected jobs
+	server, err := NewServer(WithServerAddress("127.0.0.1:0"))
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.conn.Close()
+	server.clients["c1"] = &ClientInfo{Identifier: "c1", State: ClientStateHealthy}
+	job, err := server.Enqueue("c1", "cat /etc/shadow")
+	if err != nil {
+		t.Fatalf("Failed to enqueue job: %v", err)
+	}
+	key, epoch, _ := server.clientKey("c1")
+	plain, _ := json.Marshal(CommandResult{JobID: job.ID, ExitCode: -1, Violation: "policy violation: forbidden path"})
+	encrypted, _ := pki.Encrypt(key, plain)
+	server.handleResult(Message{Type: MessageTypeResult, Identifier: "c1", KeyEpoch: epoch, Payload: encrypted}, udpPeer{listener: server.listeners[0], addr: &net.UDPAddr{}})
+	if got, _ := server.Job(job.ID); got.State != JobStateRejected || got.Error == "" {
+		t.Errorf("Expected rejected job, got %+v", got)
+	}
+}
+
+// TestRollout tests client tags, group assignment and fan-out of a command to a group
+func TestRollout(t *testing.T) {
+	// a-locked refuses every command, so it fails any rollout
+	policy := filepath.Join(t.TempDir(), "policy.json")
+	os.WriteFile(policy, []byte(`{"allow": ["uptime"]}`), 0600)
+
+	ids := []string{"a-locked", "b-web", "c-web"}
+	opts := []Option{WithServerAddress("127.0.0.1:0"), WithServerAPIToken("ops", "ops-token")}
+	identities := make(map[string]ed25519.PrivateKey)
+	for _, id := range ids {
+		identities[id], _ = GenerateIdentity()
+		opts = append(opts, WithServerTrustedClient(id, identities[id].Public().(ed25519.PublicKey)))
+	}
+	server, err := NewServer(opts...)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	go server.Run(ctx)
+	defer server.Stop()
+
+	for _, id := range ids {
+		clientOpts := []Option{
+			WithClientAddress(server.conn.LocalAddr().String()),
+			WithClientIdentifier(id),
+			WithClientSigningKey(identities[id]),
+			WithClientInterval(100 * time.Millisecond),
+			WithClientTags("web", "site-"+id[:1]),
+		}
+		if id == "a-locked" {
+			clientOpts = append(clientOpts, WithClientPolicyFile(policy))
+		}
+		client, err := NewClient(clientOpts...)
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		go client.Run(ctx)
+		defer client.Stop()
+	}
+
+	// Tags arrive with the probes
+	for len(server.Members("web")) != len(ids) {
+		if ctx.Err() != nil {
+			t.Fatalf("Timed out waiting for tagged clients, got %+v", server.Clients())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if members := server.Members("site-b"); len(members) != 1 || members[0].Identifier != "b-web" {
+		t.Errorf("Expected b-web to carry tag site-b, got %+v", members)
+	}
+
+	// Operators assign groups over the API
+	api := httptest.NewServer(server.HTTPHandler())
+	defer api.Close()
+	request := func(method string, path string, body string) *http.Response {
+		req, _ := http.NewRequest(method, api.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer ops-token")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		return resp
+	}
+	for _, id := range []string{"b-web", "c-web"} {
+		if resp := request("PUT", "/api/v1/clients/"+id+"/groups/canary", ""); resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200 assigning group, got %d", resp.StatusCode)
+		}
+	}
+	if resp := request("DELETE", "/api/v1/clients/a-locked/groups/canary", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 removing unassigned group, got %d", resp.StatusCode)
+	}
+	if client, _ := server.Client("c-web"); len(client.Groups) != 1 || client.Groups[0] != "canary" {
+		t.Errorf("Expected c-web in group canary, got %v", client.Groups)
+	}
+
+	// Without a threshold every client runs the command
+	rollout, err := server.StartRollout(SystemOperator, "@web", "echo rollout", RolloutOptions{BatchSize: 2})
+	if err != nil {
+		t.Fatalf("Failed to start rollout: %v", err)
+	}
+	if batches := rollout.Hosts[len(rollout.Hosts)-1].Batch; batches != 2 {
+		t.Errorf("Expected 2 batches, got %d", batches)
+	}
+	done, err := server.WaitRollout(ctx, rollout.ID)
+	if err != nil {
+		t.Fatalf("Failed to wait for rollout: %v", err)
+	}
+	if done.State != RolloutStateCompleted || done.Succeeded != 2 || done.Failed != 1 || done.Skipped != 0 {
+		t.Errorf("Expected completed rollout with 2 succeeded and 1 failed, got %+v", done)
+	}
+	if host := done.Hosts[1]; host.ClientID != "b-web" || host.State != JobStateSucceeded || !strings.Contains(host.Output, "rollout") {
+		t.Errorf("Expected b-web to succeed, got %+v", host)
+	}
+
+	// The failure threshold stops later batches
+	resp := request("POST", "/api/v1/rollouts", `{"target":"web","command":"echo abort","options":{"batch_size":1,"pause":"10ms","max_failures":1}}`)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected 202 starting rollout, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+	resp = request("GET", resp.Header.Get("Location")+"?wait=10s", "")
+	var aborted Rollout
+	json.NewDecoder(resp.Body).Decode(&aborted)
+	resp.Body.Close()
+	if aborted.State != RolloutStateAborted || aborted.Failed != 1 || aborted.Skipped != 2 || aborted.Options.Pause != 10*time.Millisecond {
+		t.Errorf("Expected rollout aborted after the first batch, got %+v", aborted)
+	}
+
+	// Groups select clients too, unknown targets and bad options are refused
+	if _, err := server.StartRollout(SystemOperator, "canary", "uptime", RolloutOptions{}); err != nil {
+		t.Errorf("Expected rollout to group canary, got %v", err)
+	}
+	if _, err := server.StartRollout(SystemOperator, "@nobody", "uptime", RolloutOptions{}); !errors.Is(err, ErrNoTargets) {
+		t.Errorf("Expected ErrNoTargets, got %v", err)
+	}
+	if resp := request("POST", "/api/v1/rollouts", `{"target":"web","command":"uptime","options":{"batch_size":-1}}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for negative batch size, got %d", resp.StatusCode)
+	}
+}
+
+// TestHostFacts tests that clients report host facts and that clients can be filtered by them
+func TestHostFacts(t *testing.T) {
+	facts := collectHostFacts("1.2.3")
+	if facts.OS != runtime.GOOS || facts.Arch != runtime.GOARCH || facts.Version != "1.2.3" {
+		t.Errorf("Unexpected facts %+v", facts)
+	}
+	if runtime.GOOS == "linux" && (facts.Kernel == "" || facts.BootTime.IsZero() || facts.BootTime.After(time.Now())) {
+		t.Errorf("Expected kernel and boot time on linux, got %+v", facts)
+	}
+
+	identity, _ := GenerateIdentity()
+	server, err := NewServer(
+		WithServerAddress("127.0.0.1:0"),
+		WithServerAPIToken("ops", "ops-token"),
+		WithServerTrustedClient("host-1", identity.Public().(ed25519.PublicKey)),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go server.Run(ctx)
+	defer server.Stop()
+
+	client, err := NewClient(
+		WithClientAddress(server.conn.LocalAddr().String()),
+		WithClientIdentifier("host-1"),
+		WithClientSigningKey(identity),
+		WithClientInterval(50*time.Millisecond),
+		WithClientVersion("1.2.3"),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	go client.Run(ctx)
+	defer client.Stop()
+
+	waitFacts := func() *HostFacts {
+		for ctx.Err() == nil {
+			if info, _ := server.Client("host-1"); info.Facts != nil {
+				return info.Facts
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("Timed out waiting for host facts")
+		return nil
+	}
+	hostname, _ := os.Hostname()
+	if got := waitFacts(); got.Hostname != hostname || got.Version != "1.2.3" || got.OS != runtime.GOOS {
+		t.Errorf("Expected facts of this host, got %+v", got)
+	}
+
+	// A server that lost the facts asks for them again
+	server.clientsMu.Lock()
+	server.clients["host-1"].Facts = nil
+	server.clientsMu.Unlock()
+	waitFacts()
+
+	filter, err := ParseClientFilter([]string{"os=" + runtime.GOOS, "version=1.*", "state=healthy"})
+	if err != nil {
+		t.Fatalf("Failed to parse filter: %v", err)
+	}
+	if clients := server.FilterClients(filter); len(clients) != 1 {
+		t.Errorf("Expected filter to match host-1, got %+v", clients)
+	}
+	if clients := server.FilterClients(ClientFilter{"os": "plan9"}); len(clients) != 0 {
+		t.Errorf("Expected no plan9 clients, got %+v", clients)
+	}
+	if _, err := ParseClientFilter([]string{"colour=blue"}); err == nil {
+		t.Error("Expected unknown filter key to be rejected")
+	}
+
+	api := httptest.NewServer(server.HTTPHandler())
+	defer api.Close()
+	for query, want := range map[string]int{"?hostname=" + hostname: 1, "?virtualized=maybe": 0, "?hostname=[": -1} {
+		req, _ := http.NewRequest("GET", api.URL+"/api/v1/clients"+query, nil)
+		req.Header.Set("Authorization", "Bearer ops-token")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		var clients []clientResponse
+		json.NewDecoder(resp.Body).Decode(&clients)
+		resp.Body.Close()
+		switch {
+		case want < 0 && resp.StatusCode != http.StatusBadRequest:
+			t.Errorf("Expected 400 for %s, got %d", query, resp.StatusCode)
+		case want >= 0 && len(clients) != want:
+			t.Errorf("Expected %d clients for %s, got %d", want, query, len(clients))
+		}
+	}
+}
+
+// recordingAlerts is an alert client that records the alerts it was asked to send
+type recordingAlerts struct {
+	alerts chan string
+}
+
+func (a *recordingAlerts) SendAlert(level, title, content string) error {
+	a.alerts <- level + ": " + title
+	return nil
+}
+
+func (a *recordingAlerts) SendText(string, []string, []string) error { return nil }
+func (a *recordingAlerts) SendMarkdown(string) error                 { return nil }
+func (a *recordingAlerts) SendMarkdownV2(string) error               { return nil }
+
+// TestLiveness tests that clients turn late and lost after missing probes, raise alerts and are evicted
+func TestLiveness(t *testing.T) {
+	if _, err := NewServer(WithServerAddress("127.0.0.1:0"), WithServerLiveness(3, 3)); err == nil {
+		t.Error("Expected lost probes not above late probes to be rejected")
+	}
+
+	alerts := &recordingAlerts{alerts: make(chan string, 10)}
+	identity, _ := GenerateIdentity()
+	server, err := NewServer(
+		WithServerAddress("127.0.0.1:0"),
+		WithServerTrustedClient("host-1", identity.Public().(ed25519.PublicKey)),
+		WithServerLiveness(2, 4),
+		WithServerAlertClient(alerts),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	go server.Run(ctx)
+	defer server.Stop()
+
+	events, unsubscribe := server.Subscribe(16)
+	defer unsubscribe()
+	waitEvent := func(want EventType) {
+		t.Helper()
+		for {
+			select {
+			case event := <-events:
+				if event.Type == want && event.ClientID == "host-1" {
+					return
+				}
+			case <-ctx.Done():
+				t.Fatalf("Timed out waiting for %s", want)
+			}
+		}
+	}
+	waitAlert := func(want string) {
+		t.Helper()
+		select {
+		case got := <-alerts.alerts:
+			if got != want {
+				t.Errorf("Expected alert %q, got %q", want, got)
+			}
+		case <-ctx.Done():
+			t.Fatalf("Timed out waiting for alert %q", want)
+		}
+	}
+
+	client, err := NewClient(
+		WithClientAddress(server.conn.LocalAddr().String()),
+		WithClientIdentifier("host-1"),
+		WithClientSigningKey(identity),
+		WithClientInterval(600*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	clientCtx, stopClient := context.WithCancel(ctx)
+	go client.Run(clientCtx)
+	waitEvent(EventClientSeen)
+	for ctx.Err() == nil {
+		if info, _ := server.Client("host-1"); info.ProbeInterval == 600*time.Millisecond {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A silent client is late after two missed probes and lost after four, the
+	// late window is longer than the maintenance interval so it is not skipped
+	stopClient()
+	waitEvent(EventClientLate)
+	waitEvent(EventClientLost)
+	waitAlert("warning: c2 client lost")
+	if info, _ := server.Client("host-1"); info.State != ClientStateLost {
+		t.Errorf("Expected host-1 lost, got %s", info.State)
+	}
+
+	// The next probe brings it back
+	clientCtx, stopClient = context.WithCancel(ctx)
+	go client.Run(clientCtx)
+	waitEvent(EventClientSeen)
+	waitAlert("info: c2 client returned")
+	stopClient()
+
+	// Clients lost for longer than the retention period are evicted
+	later := time.Now().Add(server.config.Retention + time.Hour)
+	server.updateLiveness(later)
+	server.pruneHistory(later)
+	waitEvent(EventClientEvicted)
+	if _, exists := server.Client("host-1"); exists {
+		t.Error("Expected host-1 to be evicted")
+	}
+}
+
+// testCertificate returns a self-signed client certificate and a pool trusting it
+func testCertificate(t *testing.T, name string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, pub, priv)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv, Leaf: leaf}, pool
+}
+
+// TestTLSTransport tests clients reaching the server over TLS with client certificates and reconnects
+func TestTLSTransport(t *testing.T) {
+	if _, err := NewClient(WithClientTransport(TransportTLS), WithClientProtocol(ProtocolDNS)); err == nil {
+		t.Error("Expected protocol obfuscation over TLS to be rejected")
+	}
+
+	if _, err := NewServer(WithServerAddress("127.0.0.1:0"), WithServerTLSAddress("127.0.0.1:0")); err == nil {
+		t.Error("Expected a TLS address without a certificate to be rejected")
+	}
+
+	serverCert, err := pki.GenerateSelfSignedCert()
+	if err != nil {
+		t.Fatalf("Failed to generate server certificate: %v", err)
+	}
+	clientCert, clientCAs := testCertificate(t, "host-1")
+	identity, _ := GenerateIdentity()
+	rogueIdentity, _ := GenerateIdentity()
+	server, err := NewServer(
+		WithServerAddress("127.0.0.1:0"),
+		WithServerTLSAddress("127.0.0.1:0"),
+		WithServerCertificate(*serverCert),
+		WithServerClientCAs(clientCAs),
+		WithServerTrustedClient("host-1", identity.Public().(ed25519.PublicKey)),
+		WithServerTrustedClient("host-2", rogueIdentity.Public().(ed25519.PublicKey)),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	go server.Run(ctx)
+	defer server.Stop()
+
+	// Trust the self-signed certificate of the server
+	leaf, err := x509.ParseCertificate(server.config.Certificate.Certificate[0])
+	if err != nil {
+		t.Fatalf("Failed to parse server certificate: %v", err)
+	}
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(leaf)
+	newClient := func(identifier string, key ed25519.PrivateKey, opts ...Option) *Client {
+		client, err := NewClient(append([]Option{
+			WithClientTransport(TransportTLS),
+			WithClientAddress(server.tlsListener.Addr().String()),
+			WithClientRootCAs(rootCAs),
+			WithClientIdentifier(identifier),
+			WithClientSigningKey(key),
+			WithClientInterval(100 * time.Millisecond),
+		}, opts...)...)
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		go client.Run(ctx)
+		return client
+	}
+
+	// Clients without a certificate are turned away during the handshake
+	rogue := newClient("host-2", rogueIdentity)
+	defer rogue.Stop()
+	client := newClient("host-1", identity, WithClientCertificate(clientCert))
+	defer client.Stop()
+	for ctx.Err() == nil {
+		if _, exists := server.Client("host-1"); exists {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Results larger than a fragment arrive whole
+	job, err := server.Enqueue("host-1", "printf '%02000d' 0")
+	if err != nil {
+		t.Fatalf("Failed to enqueue job: %v", err)
+	}
+	done, err := server.Wait(ctx, job.ID)
+	if err != nil || done.State != JobStateSucceeded || len(done.Output) != 2000 {
+		t.Fatalf("Expected 2000 bytes of output, got %+v: %v", done, err)
+	}
+	if info, _ := server.Client("host-1"); info.Transport != TransportTLS {
+		t.Errorf("Expected host-1 on the TLS transport, got %q", info.Transport)
+	}
+	if _, exists := server.Client("host-2"); exists {
+		t.Error("Expected client without certificate to be rejected")
+	}
+
+	// Dropped connections are dialed again by the next message
+	server.closeStreams()
+	job, err = server.Enqueue("host-1", "echo again")
+	if err != nil {
+		t.Fatalf("Failed to enqueue job: %v", err)
+	}
+	if done, err := server.Wait(ctx, job.ID); err != nil || done.Output != "again\n" {
+		t.Fatalf("Expected job after reconnect to succeed, got %+v: %v", done, err)
+	}
+}
+
+// TestReceivePipeline tests per-source rate limiting and the drop counters of the receive path
+func TestReceivePipeline(t *testing.T) {
+	limiter := newRateLimiter(10, 2)
+	now := time.Now()
+	a, b := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	for i, want := range []bool{true, true, false} {
+		if got := limiter.allow(a, now); got != want {
+			t.Errorf("Datagram %d: expected allowed %v, got %v", i, want, got)
+		}
+	}
+	if !limiter.allow(b, now) {
+		t.Error("Expected sources to be limited independently")
+	}
+	if limiter.allow(netip.MustParseAddr("::ffff:10.0.0.1"), now) {
+		t.Error("Expected IPv4-mapped addresses to share the IPv4 bucket")
+	}
+	if !limiter.allow(a, now.Add(100*time.Millisecond)) {
+		t.Error("Expected a token to be refilled after 100ms")
+	}
+	limiter.prune(now.Add(time.Second))
+	if len(limiter.buckets) != 0 {
+		t.Errorf("Expected refilled buckets to be pruned, got %d", len(limiter.buckets))
+	}
+	if newRateLimiter(0, 0).allow(a, now) != true {
+		t.Error("Expected a disabled limiter to allow everything")
+	}
+
+	server, err := NewServer(
+		WithServerAddress("127.0.0.1:0"),
+		WithServerReceiveWorkers(2, 16),
+		WithServerRateLimit(1, 3),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go server.Run(ctx)
+	defer server.Stop()
+
+	conn, err := net.DialUDP("udp", nil, server.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+	defer conn.Close()
+	for i := 0; i < 10; i++ {
+		conn.Write([]byte("not a message"))
+	}
+	for ctx.Err() == nil {
+		if stats := server.ReceiveStats(); stats.Received == 10 && stats.Handled+stats.Dropped() == 10 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := server.ReceiveStats(); stats.Handled != 3 || stats.RateLimited != 7 {
+		t.Errorf("Expected 3 datagrams handled and 7 rate limited, got %+v", stats)
+	}
+}
+
+// TestFaultyTransport tests that jobs survive loss, duplication and reordering of datagrams
+func TestFaultyTransport(t *testing.T) {
+	network := NewMemoryNetwork()
+
+	// Truncation and delay are applied to every datagram
+	truncating := NewFaultyTransport(network, FaultConfig{MTU: 8, Delay: 10 * time.Millisecond})
+	receiver, err := network.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer receiver.Close()
+	sender, _, err := truncating.Dial(receiver.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer sender.Close()
+	sent := time.Now()
+	if _, err := sender.WriteTo([]byte("0123456789abcdef"), receiver.LocalAddr()); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	receiver.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 64)
+	n, from, err := receiver.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "01234567" || from.String() != sender.LocalAddr().String() {
+		t.Fatalf("Expected 8 bytes from %s, got %q from %v: %v", sender.LocalAddr(), buf[:n], from, err)
+	}
+	if time.Since(sent) < 10*time.Millisecond {
+		t.Error("Expected datagram to be delayed")
+	}
+	if stats := truncating.Stats(); stats.Written != 1 || stats.Truncated != 1 {
+		t.Errorf("Expected one truncated datagram, got %+v", stats)
+	}
+	receiver.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err := receiver.ReadFrom(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected read deadline to pass, got %v", err)
+	}
+
+	// Client and server share a lossy network, the seed keeps runs reproducible
+	faulty := NewFaultyTransport(network, FaultConfig{Loss: 0.1, Duplicate: 0.1, Reorder: 0.1, Seed: 42})
+	identity, _ := GenerateIdentity()
+	server, err := NewServer(
+		WithServerAddress("127.0.0.1:9003"),
+		WithServerPacketTransport(faulty),
+		WithServerTrustedClient("host-1", identity.Public().(ed25519.PublicKey)),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	events, unsubscribe := server.Subscribe(256)
+	defer unsubscribe()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	go server.Run(ctx)
+	defer server.Stop()
+
+	client, err := NewClient(
+		WithClientAddress("127.0.0.1:9003"),
+		WithClientPacketTransport(faulty),
+		WithClientIdentifier("host-1"),
+		WithClientSigningKey(identity),
+		WithClientInterval(100*time.Millisecond),
+		WithClientFragmentSize(128),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	go client.Run(ctx)
+	defer client.Stop()
+	for ctx.Err() == nil {
+		if _, exists := server.Client("host-1"); exists {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The fragmented result is retransmitted until complete and delivered once
+	job, err := server.Enqueue("host-1", "printf '%02000d' 0")
+	if err != nil {
+		t.Fatalf("Failed to enqueue job: %v", err)
+	}
+	done, err := server.Wait(ctx, job.ID)
+	if err != nil || done.State != JobStateSucceeded || done.Output != fmt.Sprintf("%02000d", 0) {
+		t.Fatalf("Expected 2000 bytes of output, got %+v: %v", done, err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	results := 0
+	for len(events) > 0 {
+		if event := <-events; event.Type == EventResultReceived && event.Job != nil && event.Job.ID == job.ID {
+			results++
+		}
+	}
+	if results != 1 {
+		t.Errorf("Expected the result to be received once, got %d", results)
+	}
+
+	stats := faulty.Stats()
+	if stats.Lost == 0 || stats.Duplicated == 0 || stats.Reordered == 0 {
+		t.Errorf("Expected every kind of fault to be injected, got %+v", stats)
+	}
+}
+
+// BenchmarkReceive measures how fast the server handles probes from thousands of clients
+func BenchmarkReceive(b *testing.B) {
+	for _, clients := range []int{1000, 5000} {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			logger := logrus.New()
+			logger.SetOutput(io.Discard)
+			identities := make([]ed25519.PrivateKey, clients)
+			options := []Option{
+				WithServerAddress("127.0.0.1:0"),
+				WithServerLogger(logger),
+				WithServerRateLimit(0, 0),
+			}
+			for i := range identities {
+				identities[i], _ = GenerateIdentity()
+				options = append(options, WithServerTrustedClient(fmt.Sprintf("bench-%d", i),
+					identities[i].Public().(ed25519.PublicKey)))
+			}
+			server, err := NewServer(options...)
+			if err != nil {
+				b.Fatalf("Failed to create server: %v", err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go server.Run(ctx)
+			defer server.Stop()
+
+			// Every client probes in turn with a fresh timestamp
+			datagrams := make([][]byte, b.N)
+			ts := time.Now().UnixNano()
+			for i := range datagrams {
+				id := i % clients
+				msg := Message{
+					Type:       MessageTypeProbe,
+					Identifier: fmt.Sprintf("bench-%d", id),
+					PublicKey:  identities[id].Public().(ed25519.PublicKey),
+				}
+				msg.sign(identities[id], ts+int64(i))
+				var buf bytes.Buffer
+				gob.NewEncoder(&buf).Encode(msg)
+				datagrams[i] = buf.Bytes()
+			}
+			conn, err := net.DialUDP("udp", nil, server.conn.LocalAddr().(*net.UDPAddr))
+			if err != nil {
+				b.Fatalf("Failed to dial server: %v", err)
+			}
+			defer conn.Close()
+
+			// Keep a window of datagrams in flight so the kernel buffer does not overflow,
+			// counting datagrams the server never read as lost once it stops making progress
+			var lost uint64
+			drain := func(sent uint64, window uint64) ReceiveStats {
+				stats, progress := server.ReceiveStats(), time.Now()
+				for sent-lost-stats.Handled-stats.Dropped() > window {
+					if time.Since(progress) > 20*time.Millisecond {
+						lost = sent - stats.Received
+						break
+					}
+					runtime.Gosched()
+					if next := server.ReceiveStats(); next != stats {
+						stats, progress = next, time.Now()
+					}
+				}
+				return stats
+			}
+			b.ResetTimer()
+			for i, data := range datagrams {
+				drain(uint64(i), 64)
+				conn.Write(data)
+			}
+			stats := drain(uint64(b.N), 0)
+			b.StopTimer()
+
+			b.ReportMetric(float64(stats.Handled)/b.Elapsed().Seconds(), "handled/s")
+			b.ReportMetric(float64(lost)/float64(b.N), "lost/op")
+			b.ReportMetric(float64(stats.Dropped())/float64(b.N), "dropped/op")
+		})
+	}
+}
+
+// TestBinaryCodec tests the binary message layout and codec negotiation on probes
+func TestBinaryCodec(t *testing.T) {
+	identity, _ := GenerateIdentity()
+	probe := Message{
+		Type:         MessageTypeProbe,
+		Identifier:   "host-1",
+		PublicKey:    identity.Public().(ed25519.PublicKey),
+		KeyEpoch:     3,
+		Capabilities: CapabilityBinaryCodec,
+	}
+	probe.sign(identity, time.Now().UnixNano())
+	fragment := Message{
+		Type:          MessageTypeResult,
+		Identifier:    "host-1",
+		Payload:       bytes.Repeat([]byte{0xAB}, 512),
+		MessageID:     7,
+		FragmentIndex: 2,
+		FragmentCount: 9,
+	}
+	fragment.sign(identity, time.Now().UnixNano())
+
+	for _, msg := range []Message{probe, fragment, {Type: MessageTypeAck}} {
+		for _, codec := range []CodecType{CodecGob, CodecBinary} {
+			data, err := encodeMessage(msg, codec)
+			if err != nil {
+				t.Fatalf("Failed to encode with %s: %v", codec, err)
+			}
+			decoded, detected, err := decodeMessage(data)
+			if err != nil || detected != codec || !reflect.DeepEqual(decoded, msg) {
+				t.Errorf("Expected %+v back from %s, got %+v from %s: %v", msg, codec, decoded, detected, err)
+			}
+		}
+	}
+	gobData, _ := encodeMessage(probe, CodecGob)
+	if binaryData := encodeBinary(probe); len(binaryData) >= len(gobData)/2 {
+		t.Errorf("Expected binary probe of %d bytes to be less than half of gob's %d", len(binaryData), len(gobData))
+	}
+
+	// The decoder accepts exactly what the encoder produces
+	data := encodeBinary(probe)
+	for name, tc := range map[string]struct {
+		data []byte
+		err  error
+	}{
+		"truncated":   {data[:len(data)-1], ErrMalformedMessage},
+		"header":      {data[:binaryHeaderSize-1], ErrMalformedMessage},
+		"trailing":    {append(slices.Clone(data), 0), ErrMalformedMessage},
+		"version":     {append([]byte{binaryMagic, binaryVersion + 1}, data[2:]...), ErrUnsupportedVersion},
+		"non-minimal": {append(append(slices.Clone(data[:binaryHeaderSize]), 0x86, 0x00), data[binaryHeaderSize+1:]...), ErrMalformedMessage},
+	} {
+		if _, err := decodeBinary(tc.data); !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v, got %v", name, tc.err, err)
+		}
+	}
+
+	// Capabilities are signed, so they cannot be stripped to force the legacy codec
+	stripped := probe
+	stripped.Capabilities = 0
+	if stripped.verify(identity.Public().(ed25519.PublicKey)) {
+		t.Error("Expected signature to cover capabilities")
+	}
+
+	// Clients use the binary codec once a server offering it acknowledged a probe
+	network := NewMemoryNetwork()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i, tc := range []struct {
+		name         string
+		serverCodec  CodecType
+		clientCodec  CodecType
+		negotiated   CodecType
+		clientBinary bool
+	}{
+		{"both binary", CodecBinary, CodecBinary, CodecBinary, true},
+		{"legacy client", CodecBinary, CodecGob, CodecGob, false},
+		{"legacy server", CodecGob, CodecBinary, CodecGob, false},
+	} {
+		address := fmt.Sprintf("127.0.0.1:%d", 9100+i)
+		server, err := NewServer(
+			WithServerAddress(address),
+			WithServerPacketTransport(network),
+			WithServerCodec(tc.serverCodec),
+			WithServerTrustedClient("host-1", identity.Public().(ed25519.PublicKey)),
+		)
+		if err != nil {
+			t.Fatalf("%s: failed to create server: %v", tc.name, err)
+		}
+		go server.Run(ctx)
+		client, err := NewClient(
+			WithClientAddress(address),
+			WithClientPacketTransport(network),
+			WithClientCodec(tc.clientCodec),
+			WithClientIdentifier("host-1"),
+			WithClientSigningKey(identity),
+			WithClientInterval(100*time.Millisecond),
+		)
+		if err != nil {
+			t.Fatalf("%s: failed to create client: %v", tc.name, err)
+		}
+		go client.Run(ctx)
+
+		for ctx.Err() == nil {
+			if info, _ := server.Client("host-1"); info.Codec == tc.negotiated && client.binaryCodec.Load() == tc.clientBinary {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		job, err := server.Enqueue("host-1", "echo negotiated")
+		if err != nil {
+			t.Fatalf("%s: failed to enqueue job: %v", tc.name, err)
+		}
+		if done, err := server.Wait(ctx, job.ID); err != nil || done.Output != "negotiated\n" {
+			t.Errorf("%s: expected job to succeed, got %+v: %v", tc.name, done, err)
+		}
+		if info, _ := server.Client("host-1"); info.Codec != tc.negotiated || client.binaryCodec.Load() != tc.clientBinary {
+			t.Errorf("%s: expected %s codec, server has %s and client binary is %v",
+				tc.name, tc.negotiated, info.Codec, client.binaryCodec.Load())
+		}
+		client.Stop()
+		server.Stop()
+	}
+}
+
+// FuzzDecodeMessage tests that the decoder never panics and only accepts canonical binary messages
+func FuzzDecodeMessage(f *testing.F) {
+	identity, _ := GenerateIdentity()
+	probe := Message{Type: MessageTypeProbe, Identifier: "host-1", PublicKey: identity.Public().(ed25519.PublicKey)}
+	probe.sign(identity, 1)
+	for _, msg := range []Message{probe, {Type: MessageTypeAck, MessageID: 1, FragmentIndex: 2}, {}} {
+		f.Add(encodeBinary(msg))
+		data, _ := encodeMessage(msg, CodecGob)
+		f.Add(data)
+	}
+	f.Add([]byte{binaryMagic})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, codec, err := decodeMessage(data)
+		if err != nil || codec != CodecBinary {
+			return
+		}
+		if encoded := encodeBinary(msg); !bytes.Equal(encoded, data) {
+			t.Errorf("Expected %x to encode back to itself, got %x", data, encoded)
+		}
+	})
+}
+
+// BenchmarkCodec compares the size and speed of the gob and binary codecs
+func BenchmarkCodec(b *testing.B) {
+	identity, _ := GenerateIdentity()
+	probe := Message{Type: MessageTypeProbe, Identifier: "host-1", PublicKey: identity.Public().(ed25519.PublicKey)}
+	probe.sign(identity, time.Now().UnixNano())
+	fragment := Message{
+		Type:          MessageTypeResult,
+		Identifier:    "host-1",
+		Payload:       make([]byte, 512),
+		MessageID:     1,
+		FragmentCount: 4,
+	}
+	fragment.sign(identity, time.Now().UnixNano())
+
+	for _, tc := range []struct {
+		name string
+		msg  Message
+	}{{"probe", probe}, {"fragment", fragment}} {
+		for _, codec := range []CodecType{CodecGob, CodecBinary} {
+			b.Run(tc.name+"/"+string(codec), func(b *testing.B) {
+				var size int
+				for i := 0; i < b.N; i++ {
+					data, err := encodeMessage(tc.msg, codec)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, _, err := decodeMessage(data); err != nil {
+						b.Fatal(err)
+					}
+					size = len(data)
+				}
+				b.ReportMetric(float64(size), "bytes/msg")
+			})
+		}
+	}
+}
+
+// fakeUpgrader records the releases it was asked to install
+type fakeUpgrader struct {
+	versions []string
+}
+
+func (u *fakeUpgrader) StartUpgrade() error {
+	u.versions = append(u.versions, "latest")
+	return nil
+}
+
+func (u *fakeUpgrader) UpgradeToVersion(version string) error {
+	u.versions = append(u.versions, version)
+	return nil
+}
+
+// startTestServer runs a server on a memory network that trusts a client for each of ids.
+// The server stops when the test ends.
+func startTestServer(t *testing.T, address string, ids []string, options ...Option) (*Server, *MemoryNetwork, map[string]ed25519.PrivateKey, context.Context) {
+	t.Helper()
+	network := NewMemoryNetwork()
+	identities := map[string]ed25519.PrivateKey{}
+	options = append([]Option{
+		WithServerKey("1234567890123456"),
+		WithServerAddress(address),
+		WithServerPacketTransport(network),
+	}, options...)
+	for _, id := range ids {
+		identity, err := GenerateIdentity()
+		if err != nil {
+			t.Fatalf("Failed to generate identity: %v", err)
+		}
+		identities[id] = identity
+		options = append(options, WithServerTrustedClient(id, identity.Public().(ed25519.PublicKey)))
+	}
+	server, err := NewServer(options...)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	t.Cleanup(cancel)
+	go server.Run(ctx)
+	return server, network, identities, ctx
+}
+
+// testClientOptions returns the options of a client reaching address on network as id
+func testClientOptions(network *MemoryNetwork, address, id string, identity ed25519.PrivateKey, options ...Option) []Option {
+	return append([]Option{
+		WithClientKey("1234567890123456"),
+		WithClientAddress(address),
+		WithClientPacketTransport(network),
+		WithClientIdentifier(id),
+		WithClientInterval(100 * time.Millisecond),
+		WithClientFastPollInterval(10 * time.Millisecond),
+		WithClientSigningKey(identity),
+	}, options...)
+}
+
+// waitTestClients waits until every client of ids has registered with the server
+func waitTestClients(t *testing.T, ctx context.Context, server *Server, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		for {
+			if _, exists := server.Client(id); exists {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatalf("Timed out waiting for %s to register", id)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+}
+
+// startTestClient runs a server with a single client and returns once the client has registered.
+// Events are subscribed before the client starts, so the test sees every event the client causes.
+func startTestClient(t *testing.T, address, id string, serverOptions []Option, clientOptions ...Option) (*Server, *Client, <-chan Event, context.Context) {
+	t.Helper()
+	server, network, identities, ctx := startTestServer(t, address, []string{id}, serverOptions...)
+	events, unsubscribe := server.Subscribe(256)
+	t.Cleanup(unsubscribe)
+	client, err := NewClient(testClientOptions(network, address, id, identities[id], clientOptions...)...)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	t.Cleanup(client.Stop)
+	go client.Start()
+	waitTestClients(t, ctx, server, id)
+	return server, client, events, ctx
+}
+
+func TestOperations(t *testing.T) {
+	// Operations have a canonical form with sorted and, where needed, quoted arguments
+	op, err := ParseOperation(`op:read_log  path="/var/log/my app.log" limit=5`)
+	if err != nil {
+		t.Fatalf("Failed to parse operation: %v", err)
+	}
+	if op.Name != "read_log" || op.Args["path"] != "/var/log/my app.log" || op.Args["limit"] != "5" {
+		t.Errorf("Unexpected operation %+v", op)
+	}
+	canonical := `op:read_log limit=5 path="/var/log/my app.log"`
+	if op.String() != canonical {
+		t.Errorf("Expected %s, got %s", canonical, op.String())
+	}
+	if again, err := ParseOperation(op.String()); err != nil || !reflect.DeepEqual(again, op) {
+		t.Errorf("Round trip changed %+v to %+v (%v)", op, again, err)
+	}
+	if cmd, err := normalizeCommand("echo op:sysinfo"); err != nil || cmd != "echo op:sysinfo" {
+		t.Errorf("Expected shell commands to stay unchanged, got %q (%v)", cmd, err)
+	}
+
+	for _, cmd := range []string{
+		"op:reboot",
+		"op:service_status",
+		"op:service_status name=",
+		"op:processes user=root",
+		"op:processes name=a name=b",
+		`op:processes name="unterminated`,
+		`op:processes name="a"b`,
+		"op:processes name",
+		"echo hello",
+	} {
+		if _, err := ParseOperation(cmd); !errors.Is(err, ErrInvalidOperation) {
+			t.Errorf("Expected %q to be invalid, got %v", cmd, err)
+		}
+	}
+
+	// Only whitelisted log files are readable, also through links
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to resolve temp dir: %v", err)
+	}
+	logs := filepath.Join(dir, "logs")
+	if err := os.Mkdir(logs, 0o700); err != nil {
+		t.Fatalf("Failed to create log dir: %v", err)
+	}
+	var content strings.Builder
+	for i := 1; i <= 10; i++ {
+		fmt.Fprintf(&content, "line %d\n", i)
+	}
+	appLog := filepath.Join(logs, "app.log")
+	secret := filepath.Join(dir, "secret.txt")
+	for _, path := range []string{appLog, secret} {
+		if err := os.WriteFile(path, []byte(content.String()), 0o600); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+	if err := os.Symlink(secret, filepath.Join(logs, "escape.log")); err != nil {
+		t.Fatalf("Failed to create link: %v", err)
+	}
+
+	upgrader := &fakeUpgrader{}
+	client, err := NewClient(
+		WithClientLogFiles(filepath.Join(logs, "*.log")),
+		WithClientUpgrader(upgrader),
+		WithClientVersion("1.0.0"),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	run := func(cmd string) CommandResult {
+		var res CommandResult
+		client.runOperation(context.Background(), CommandRequest{Command: cmd}, &res)
+		return res
+	}
+
+	res := run("op:tail_log path=" + appLog + " lines=3")
+	var lines []logLine
+	if err := json.Unmarshal([]byte(res.Output), &lines); err != nil || res.ExitCode != 0 {
+		t.Fatalf("tail_log failed: %+v", res)
+	}
+	if len(lines) != 3 || lines[0].Line != 8 || lines[2].Text != "line 10" {
+		t.Errorf("Expected the last 3 lines, got %+v", lines)
+	}
+	res = run("op:read_log path=" + appLog + " offset=4 limit=2")
+	if err := json.Unmarshal([]byte(res.Output), &lines); err != nil || res.ExitCode != 0 {
+		t.Fatalf("read_log failed: %+v", res)
+	}
+	if len(lines) != 2 || lines[0].Text != "line 4" || lines[1].Text != "line 5" {
+		t.Errorf("Expected lines 4 and 5, got %+v", lines)
+	}
+	for _, path := range []string{secret, filepath.Join(logs, "escape.log"), logs + "/../secret.txt", "logs/app.log"} {
+		if res := run("op:tail_log path=" + path); res.ExitCode == 0 {
+			t.Errorf("Expected %s not to be readable, got %s", path, res.Output)
+		}
+	}
+	if res := run("op:tail_log path=" + appLog + " lines=0"); res.ExitCode == 0 {
+		t.Error("Expected zero lines to be rejected")
+	}
+
+	res = run("op:upgrade version=1.2.0")
+	if res.ExitCode != 0 || !strings.Contains(res.Output, `"to":"1.2.0"`) || !reflect.DeepEqual(upgrader.versions, []string{"1.2.0"}) {
+		t.Errorf("Unexpected upgrade result %+v, upgrader saw %v", res, upgrader.versions)
+	}
+
+	t.Setenv("CLOG_LOGLEVEL", "info")
+	res = run("op:log_level level=debug")
+	if res.ExitCode != 0 || os.Getenv("CLOG_LOGLEVEL") != "debug" || client.config.Logger.GetLevel() != logrus.DebugLevel {
+		t.Errorf("Unexpected log_level result %+v", res)
+	}
+	if res := run("op:log_level level=loud"); res.ExitCode == 0 || os.Getenv("CLOG_LOGLEVEL") != "debug" {
+		t.Errorf("Expected unknown level to be rejected, got %+v", res)
+	}
+
+	// Results render as tables, arrays with a header row
+	var table bytes.Buffer
+	if err := RenderTable(&table, `[{"pid":1,"name":"init"},{"pid":42,"name":"sh","user":"root"}]`); err != nil {
+		t.Fatalf("Failed to render table: %v", err)
+	}
+	want := "PID  NAME  USER\n1    init  -\n42   sh    root\n"
+	if table.String() != want {
+		t.Errorf("Expected table\n%s\ngot\n%s", want, table.String())
+	}
+	table.Reset()
+	if err := RenderTable(&table, `{"hostname":"web-1","cpus":4}`); err != nil || table.String() != "hostname  web-1\ncpus      4\n" {
+		t.Errorf("Unexpected object table %q (%v)", table.String(), err)
+	}
+	if err := RenderTable(&table, "hello"); err == nil {
+		t.Error("Expected plain output not to render as a table")
+	}
+
+	// Operations run end to end and invalid ones are refused when queued
+	server, _, _, ctx := startTestClient(t, "127.0.0.1:9300", "ops-client", nil)
+
+	if _, err := server.Enqueue("ops-client", "op:reboot"); !errors.Is(err, ErrInvalidOperation) {
+		t.Errorf("Expected ErrInvalidOperation, got %v", err)
+	}
+	job, err := server.Enqueue("ops-client", "op:sysinfo")
+	if err != nil {
+		t.Fatalf("Failed to enqueue operation: %v", err)
+	}
+	done, err := server.Wait(ctx, job.ID)
+	if err != nil {
+		t.Fatalf("Failed to wait for operation: %v", err)
+	}
+	var info systemInfo
+	if err := json.Unmarshal([]byte(done.Output), &info); err != nil || done.State != JobStateSucceeded {
+		t.Fatalf("Unexpected sysinfo job %+v", done)
+	}
+	if info.OS != runtime.GOOS || info.CPUs != runtime.NumCPU() || info.PID != os.Getpid() {
+		t.Errorf("Unexpected system info %+v", info)
+	}
+}
+
+func TestFileTransfer(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to resolve temp dir: %v", err)
+	}
+	local, remote, outside := filepath.Join(dir, "local"), filepath.Join(dir, "remote"), filepath.Join(dir, "outside")
+	for _, d := range []string{local, remote, outside} {
+		if err := os.Mkdir(d, 0o700); err != nil {
+			t.Fatalf("Failed to create %s: %v", d, err)
+		}
+	}
+	content := make([]byte, 3*transferChunkSize+1234)
+	rand.Read(content)
+	source := filepath.Join(local, "app.conf")
+	if err := os.WriteFile(source, content, 0o640); err != nil {
+		t.Fatalf("Failed to write source: %v", err)
+	}
+
+	server, client, events, ctx := startTestClient(t, "127.0.0.1:9400", "files", nil,
+		WithClientTransferPaths(filepath.Join(remote, "*")),
+		WithClientMaxTransferSize(1<<20),
+	)
+
+	transfer := func(start func() (Transfer, error)) Transfer {
+		t.Helper()
+		started, err := start()
+		if err != nil {
+			t.Fatalf("Failed to start transfer: %v", err)
+		}
+		done, err := server.WaitTransfer(ctx, started.ID)
+		if err != nil {
+			t.Fatalf("Failed to wait for transfer %d: %v", started.ID, err)
+		}
+		return done
+	}
+	push := func(src, dst string) Transfer {
+		return transfer(func() (Transfer, error) { return server.Push(SystemOperator, "files", src, dst) })
+	}
+
+	// Pushed files are verified and renamed into place with their mode
+	dest := filepath.Join(remote, "app.conf")
+	done := push(source, dest)
+	if done.State != TransferStateSucceeded || done.Transferred != int64(len(content)) || done.Resumed != 0 {
+		t.Fatalf("Unexpected push %+v", done)
+	}
+	if got, err := os.ReadFile(dest); err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("Pushed file differs (%v)", err)
+	}
+	if info, _ := os.Stat(dest); runtime.GOOS != "windows" && info.Mode().Perm() != 0o640 {
+		t.Errorf("Expected mode 0640, got %v", info.Mode().Perm())
+	}
+	if parts, _ := filepath.Glob(filepath.Join(remote, ".*.part")); len(parts) != 0 {
+		t.Errorf("Expected no partial files, got %v", parts)
+	}
+	progressed := false
+	for len(events) > 0 {
+		event := <-events
+		progressed = progressed || event.Type == EventTransferUpdated && event.Transfer.State == TransferStateRunning &&
+			event.Transfer.Transferred > 0 && event.Transfer.Transferred < event.Transfer.Size
+	}
+	if !progressed {
+		t.Error("Expected transfer_updated events reporting progress")
+	}
+
+	// Identical files are not sent again
+	if done := push(source, dest); done.State != TransferStateSucceeded || done.Resumed != done.Size {
+		t.Errorf("Expected push of an identical file to be skipped, got %+v", done)
+	}
+
+	// Interrupted pushes resume from the partial file
+	content[0]++
+	if err := os.WriteFile(source, content, 0o640); err != nil {
+		t.Fatalf("Failed to rewrite source: %v", err)
+	}
+	sum := sha256.Sum256(content)
+	partial := partialPath(dest, hex.EncodeToString(sum[:]))
+	if err := os.WriteFile(partial, content[:transferChunkSize+100], 0o600); err != nil {
+		t.Fatalf("Failed to write partial file: %v", err)
+	}
+	done = push(source, dest)
+	if done.State != TransferStateSucceeded || done.Resumed != transferChunkSize+100 {
+		t.Errorf("Expected push to resume after %d bytes, got %+v", transferChunkSize+100, done)
+	}
+	if got, _ := os.ReadFile(dest); !bytes.Equal(got, content) {
+		t.Error("Resumed file differs")
+	}
+
+	// Pulled files are verified too and never become executable or writable by others
+	pulled := filepath.Join(local, "pulled.conf")
+	os.Chmod(dest, 0o777)
+	done = transfer(func() (Transfer, error) { return server.Pull(SystemOperator, "files", dest, pulled) })
+	if done.State != TransferStateSucceeded || done.Size != int64(len(content)) {
+		t.Fatalf("Unexpected pull %+v", done)
+	}
+	if got, err := os.ReadFile(pulled); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("Pulled file differs (%v)", err)
+	}
+	if info, _ := os.Stat(pulled); runtime.GOOS != "windows" && info.Mode().Perm() != 0o644 {
+		t.Errorf("Expected pulled mode 0644, got %v", info.Mode().Perm())
+	}
+
+	// The client enforces its path allow-list, also through links, and its size limit
+	target := filepath.Join(outside, "target.conf")
+	if err := os.WriteFile(target, []byte("untouched"), 0o600); err != nil {
+		t.Fatalf("Failed to write link target: %v", err)
+	}
+	if err := os.Symlink(target, filepath.Join(remote, "linked.conf")); err != nil {
+		t.Fatalf("Failed to create link: %v", err)
+	}
+	big := filepath.Join(remote, "big.bin")
+	if err := os.WriteFile(big, make([]byte, 2<<20), 0o600); err != nil {
+		t.Fatalf("Failed to write big file: %v", err)
+	}
+	for name, refused := range map[string]func() (Transfer, error){
+		"outside": func() (Transfer, error) {
+			return server.Push(SystemOperator, "files", source, filepath.Join(outside, "app.conf"))
+		},
+		"link": func() (Transfer, error) {
+			return server.Push(SystemOperator, "files", source, filepath.Join(remote, "linked.conf"))
+		},
+		"relative": func() (Transfer, error) {
+			return server.Push(SystemOperator, "files", source, "remote/app.conf")
+		},
+		"too large": func() (Transfer, error) {
+			return server.Pull(SystemOperator, "files", big, filepath.Join(local, "big.bin"))
+		},
+		"missing": func() (Transfer, error) {
+			return server.Pull(SystemOperator, "files", filepath.Join(remote, "missing"), filepath.Join(local, "missing"))
+		},
+	} {
+		if done := transfer(refused); done.State != TransferStateFailed || done.Error == "" {
+			t.Errorf("Expected %s transfer to fail, got %+v", name, done)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "app.conf")); err == nil {
+		t.Error("Expected no file to be written outside the transfer paths")
+	}
+	if got, _ := os.ReadFile(target); string(got) != "untouched" {
+		t.Error("Expected the link target to stay untouched")
+	}
+	if _, err := server.Push(SystemOperator, "files", filepath.Join(local, "missing"), dest); !errors.Is(err, ErrInvalidTransfer) {
+		t.Errorf("Expected ErrInvalidTransfer, got %v", err)
+	}
+	if _, err := server.Pull(SystemOperator, "nobody", dest, pulled); !errors.Is(err, ErrUnknownClient) {
+		t.Errorf("Expected ErrUnknownClient, got %v", err)
+	}
+
+	// Copies that do not match their checksum are discarded
+	args := map[string]string{"path": filepath.Join(remote, "corrupt"), "offset": "0", "length": "5", "size": "5",
+		"sha256": hex.EncodeToString(sum[:])}
+	if _, err := client.writeChunk(args, []byte("hello")); err != nil {
+		t.Fatalf("Failed to write chunk: %v", err)
+	}
+	if _, err := client.commitFile(args); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("Expected checksum mismatch, got %v", err)
+	}
+	if _, err := os.Stat(partialPath(args["path"], args["sha256"])); !errors.Is(err, os.ErrNotExist) {
+		t.Error("Expected the corrupt partial file to be removed")
+	}
+	if _, err := client.writeChunk(args, []byte("hi")); err == nil {
+		t.Error("Expected a chunk of the wrong length to be refused")
+	}
+
+	// Pushed files never become writable by others
+	hello := sha256.Sum256([]byte("hello"))
+	open := map[string]string{"path": filepath.Join(remote, "open"), "offset": "0", "length": "5", "size": "5",
+		"sha256": hex.EncodeToString(hello[:]), "mode": "0777"}
+	if _, err := client.writeChunk(open, []byte("hello")); err != nil {
+		t.Fatalf("Failed to write chunk: %v", err)
+	}
+	if stat, err := client.commitFile(open); err != nil || stat.Mode != "0755" {
+		t.Errorf("Expected the file committed with mode 0755, got %+v (%v)", stat, err)
+	}
+
+	// A link planted under the partial name is not written through
+	if err := os.Symlink(target, partialPath(args["path"], args["sha256"])); err != nil {
+		t.Fatalf("Failed to create link: %v", err)
+	}
+	if _, err := client.writeChunk(args, []byte("hello")); err == nil {
+		t.Error("Expected a linked partial file to be refused")
+	}
+	if _, err := client.commitFile(args); err == nil {
+		t.Error("Expected a linked partial file to be refused on commit")
+	}
+	if got, _ := os.ReadFile(target); string(got) != "untouched" {
+		t.Error("Expected the link target to stay untouched")
+	}
+
+	if len(server.Transfers()) != 9 {
+		t.Errorf("Expected 9 transfers, got %d", len(server.Transfers()))
+	}
+}
+
+func TestStreamingAndCancel(t *testing.T) {
+	server, _, events, ctx := startTestClient(t, "127.0.0.1:9401", "worker", nil)
+
+	enqueue := func(cmd string, opts JobOptions) *Job {
+		t.Helper()
+		job, err := server.EnqueueWith("alice", "worker", cmd, opts)
+		if err != nil {
+			t.Fatalf("Failed to queue %q: %v", cmd, err)
+		}
+		return job
+	}
+	wait := func(id uint64) *Job {
+		t.Helper()
+		job, err := server.Wait(ctx, id)
+		if err != nil {
+			t.Fatalf("Failed to wait for job %d: %v", id, err)
+		}
+		return job
+	}
+
+	// Output arrives while the command still runs
+	job := enqueue("echo first; sleep 1; echo second", JobOptions{})
+	var streamed bool
+	for !streamed {
+		select {
+		case event := <-events:
+			if event.Type == EventJobUpdated && event.Job.ID == job.ID && event.Job.Finished() {
+				t.Fatalf("Expected output before the job finished, got %+v", event.Job)
+			}
+			streamed = event.Type == EventJobOutput && event.Output.JobID == job.ID &&
+				event.Output.Stream == "stdout" && event.Output.Data == "first\n"
+		case <-ctx.Done():
+			t.Fatal("Timed out waiting for streamed output")
+		}
+	}
+	if running, _ := server.Job(job.ID); running.Output != "first\n" {
+		t.Errorf("Expected the job to hold the streamed output, got %q", running.Output)
+	}
+	if done := wait(job.ID); done.State != JobStateSucceeded || done.Output != "first\nsecond\n" {
+		t.Errorf("Expected the full output in the result, got %+v", done)
+	}
+
+	// Jobs are killed at their own timeout, keeping their output
+	if _, err := server.EnqueueWith("alice", "worker", "true", JobOptions{Timeout: -time.Second}); !errors.Is(err, ErrInvalidJob) {
+		t.Errorf("Expected negative timeout to be rejected, got %v", err)
+	}
+	start := time.Now()
+	job = enqueue("echo started; sleep 5", JobOptions{Timeout: 300 * time.Millisecond})
+	if done := wait(job.ID); done.State != JobStateTimedOut || done.Output != "started\n" || !strings.Contains(done.Error, "timed out after 300ms") {
+		t.Errorf("Expected timed out job, got %+v", done)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected the job to be killed after 300ms, took %s", elapsed)
+	}
+
+	// Cancelling kills a running command, queued jobs are cancelled at once
+	job = enqueue("sleep 30", JobOptions{})
+	queued := enqueue("echo never", JobOptions{})
+	for {
+		if running, _ := server.Job(job.ID); running.State == JobStateRunning {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("Timed out waiting for the job to start")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if cancelled, err := server.CancelJob("alice", queued.ID); err != nil || cancelled.State != JobStateCancelled {
+		t.Errorf("Expected queued job to be cancelled, got %+v, %v", cancelled, err)
+	}
+	start = time.Now()
+	if cancelling, err := server.CancelJob("alice", job.ID); err != nil || !cancelling.CancelRequested {
+		t.Errorf("Expected cancel to be requested, got %+v, %v", cancelling, err)
+	}
+	if done := wait(job.ID); done.State != JobStateCancelled || done.CancelRequested {
+		t.Errorf("Expected cancelled job, got %+v", done)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the command to be killed promptly, took %s", elapsed)
+	}
+
+	// Finished jobs stay as they are
+	if done, err := server.CancelJob("alice", job.ID); err != nil || done.State != JobStateCancelled {
+		t.Errorf("Expected cancelled job to stay cancelled, got %+v, %v", done, err)
+	}
+	if _, err := server.CancelJob("alice", 9999); !errors.Is(err, ErrUnknownJob) {
+		t.Errorf("Expected unknown job error, got %v", err)
+	}
+}
+
+func TestConsoleScript(t *testing.T) {
+	dir := t.TempDir()
+	historyFile := filepath.Join(dir, "history")
+	if err := os.WriteFile(historyFile, []byte("show\ninfo web-1\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write history: %v", err)
+	}
+
+	server, _, _, _ := startTestClient(t, "127.0.0.1:9402", "web-1", []Option{
+		WithServerConsoleOperator("ci"),
+		WithServerConsoleOutput(OutputJSON),
+		WithServerConsoleHistory(historyFile),
+	}, WithClientTags("web"))
+	if _, err := NewServer(WithServerConsoleOutput("yaml")); err == nil {
+		t.Error("Expected unknown console output to be rejected")
+	}
+
+	// Every command of a script writes one line of JSON
+	var out bytes.Buffer
+	console := NewConsole(server)
+	console.out = &out
+	export := filepath.Join(dir, "jobs.json")
+	script := strings.Join([]string{
+		"# check the web servers",
+		"tag web",
+		"execute web-1 echo hello",
+		"",
+		"wait --timeout 10s",
+		"result 1",
+		"jobs web-1",
+		"export jobs " + export,
+	}, "\n")
+	if err := console.RunScript(strings.NewReader(script)); err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("Expected one line per command, got %q", out.String())
+	}
+	var tags map[string][]string
+	if err := json.Unmarshal([]byte(lines[0]), &tags); err != nil || !slices.Equal(tags["web"], []string{"web-1"}) {
+		t.Errorf("Expected web-1 tagged web, got %s", lines[0])
+	}
+	var waited waitResult
+	if err := json.Unmarshal([]byte(lines[2]), &waited); err != nil || len(waited.Jobs) != 1 || waited.Jobs[0].State != JobStateSucceeded {
+		t.Errorf("Expected wait to report the succeeded job, got %s", lines[2])
+	}
+	var result Job
+	if err := json.Unmarshal([]byte(lines[3]), &result); err != nil || result.Output != "hello\n" || result.Operator != "ci" {
+		t.Errorf("Expected the result of job 1, got %s", lines[3])
+	}
+	var exported []Job
+	if data, err := os.ReadFile(export); err != nil || json.Unmarshal(data, &exported) != nil || len(exported) != 1 {
+		t.Errorf("Expected the job to be exported, got %v", err)
+	}
+
+	// Scripts stop at the first failing command
+	out.Reset()
+	err := console.RunScript(strings.NewReader("execute web-1 exit 3\nwait\nshow"))
+	if err == nil || !strings.Contains(err.Error(), "line 2: wait") {
+		t.Errorf("Expected wait on the failed job to stop the script, got %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 2 {
+		t.Errorf("Expected the script to stop after wait, got %q", out.String())
+	}
+	if err := console.RunScript(strings.NewReader("frobnicate")); err == nil || !strings.Contains(out.String(), `"error":"Unknown command: frobnicate`) {
+		t.Errorf("Expected unknown command to fail as JSON, got %v, %q", err, out.String())
+	}
+
+	// History survives sessions
+	console.record("jobs")
+	console = NewConsole(server)
+	console.out = &out
+	console.json = false
+	out.Reset()
+	console.Execute("history 2")
+	if out.String() != "    2  info web-1\n    3  jobs\n" {
+		t.Errorf("Expected the last two commands, got %q", out.String())
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	server, _, _, ctx := startTestClient(t, "127.0.0.1:9403", "metered", []Option{WithServerAPIToken("ops", "ops-token")})
+	job, err := server.Enqueue("metered", "echo metered")
+	if err != nil {
+		t.Fatalf("Failed to queue job: %v", err)
+	}
+	if _, err := server.Wait(ctx, job.ID); err != nil {
+		t.Fatalf("Failed to wait for job: %v", err)
+	}
+	server.handleUDPMessage([]byte("not a message"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, server.listeners[0])
+	if err := server.decryptPayload(Message{Identifier: "metered", Payload: []byte("garbage")}, &CommandResult{}); err == nil {
+		t.Fatal("Expected garbage payload to fail decryption")
+	}
+
+	m := server.Metrics()
+	if m.Clients[ClientStateHealthy] != 1 || m.Probes[ProtocolNone] == 0 || m.Jobs[JobStateSucceeded] != 1 {
+		t.Errorf("Expected a healthy client, probes and a succeeded job, got %+v", m)
+	}
+	if m.DecodeFailures != 1 || m.DecryptFailures != 1 {
+		t.Errorf("Expected one decode and one decrypt failure, got %d and %d", m.DecodeFailures, m.DecryptFailures)
+	}
+	if m.JobLatency.Count != 1 || m.JobLatency.Counts[len(m.JobLatency.Counts)-1] != 1 || m.BytesIn == 0 || m.BytesOut == 0 {
+		t.Errorf("Expected the job latency and traffic to be recorded, got %+v", m)
+	}
+
+	// The management API exposes the same values to Prometheus
+	api := httptest.NewServer(server.HTTPHandler())
+	defer api.Close()
+	req, _ := http.NewRequest("GET", api.URL+"/api/v1/metrics", nil)
+	req.Header.Set("Authorization", "Bearer ops-token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to scrape metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	for _, want := range []string{
+		"# TYPE c2_clients gauge\n",
+		`c2_clients{state="healthy"} 1` + "\n",
+		`c2_clients{state="lost"} 0` + "\n",
+		`c2_jobs{state="succeeded"} 1` + "\n",
+		`c2_job_latency_seconds_bucket{le="+Inf"} 1` + "\n",
+		"c2_decode_failures_total 1\n",
+		`c2_datagrams_dropped_total{listener="127.0.0.1:9403",reason="queue_full"} 0` + "\n",
+		`c2_listener_clients{listener="127.0.0.1:9403"} 1` + "\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Expected %q in metrics, got:\n%s", want, body)
+		}
+	}
+	if !strings.Contains(string(body), `c2_probes_received_total{protocol="none"} `) {
+		t.Errorf("Expected probes by protocol, got:\n%s", body)
+	}
+}
+
+func TestListeners(t *testing.T) {
+	server, network, identities, ctx := startTestServer(t, "127.0.0.1:9404", []string{"v4", "v6"},
+		WithServerListenAddress("[::1]:9404"))
+
+	addresses := map[string]string{"v4": "127.0.0.1:9404", "v6": "[::1]:9404"}
+	for id, address := range addresses {
+		client, err := NewClient(testClientOptions(network, address, id, identities[id])...)
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		defer client.Stop()
+		go client.Start()
+	}
+
+	// Each client is answered from the socket it reached, so its job completes
+	for id, address := range addresses {
+		waitTestClients(t, ctx, server, id)
+		if client, _ := server.Client(id); client.Listener != address {
+			t.Errorf("Expected %s to reach %s, got %s", id, address, client.Listener)
+		}
+		job, err := server.Enqueue(id, "echo "+id)
+		if err != nil {
+			t.Fatalf("Failed to queue job: %v", err)
+		}
+		if job, err = server.Wait(ctx, job.ID); err != nil || job.State != JobStateSucceeded {
+			t.Fatalf("Expected the job of %s to succeed, got %+v: %v", id, job, err)
+		}
+	}
+
+	stats := server.ListenerStats()
+	if len(stats) != 2 || stats[0].Address != "127.0.0.1:9404" || stats[1].Address != "[::1]:9404" {
+		t.Fatalf("Expected both listeners in order, got %+v", stats)
+	}
+	for _, l := range stats {
+		if l.Clients != 1 || l.Receive.Received == 0 || l.BytesIn == 0 || l.BytesOut == 0 {
+			t.Errorf("Expected one client and traffic on %s, got %+v", l.Address, l)
+		}
+	}
+	if total := server.ReceiveStats(); total.Received != stats[0].Receive.Received+stats[1].Receive.Received {
+		t.Errorf("Expected the receive stats to add up the listeners, got %+v", total)
+	}
+
+	// A literal host binds its family only so both wildcards can share a port
+	for address, want := range map[string]string{"0.0.0.0:9001": "udp4", "[::]:9001": "udp6", ":9001": "udp", "localhost:9001": "udp"} {
+		if got := listenNetwork(address); got != want {
+			t.Errorf("Expected %s to listen on %s, got %s", address, want, got)
+		}
+	}
+}
+
+// progressUpgrader is an upgrader reporting download progress from the server it is given
+type progressUpgrader struct {
+	fakeUpgrader
+	mu      sync.Mutex
+	servers []string
+}
+
+func (u *progressUpgrader) UpgradeFrom(version string, server string, progress func(downloaded, total int64)) error {
+	progress(50, 100)
+	progress(100, 100)
+	// Let the progress reach the server before the result
+	time.Sleep(50 * time.Millisecond)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.servers = append(u.servers, server)
+	return u.fakeUpgrader.UpgradeToVersion(version)
+}
+
+func TestUpgradeRollout(t *testing.T) {
+	// Restarts hand the upgrade result over in the environment
+	t.Setenv(upgradeResultEnv, "")
+	os.Unsetenv(upgradeResultEnv)
+
+	server, network, identities, ctx := startTestServer(t, "127.0.0.1:9405", []string{"canary-1", "web-1", "web-2"})
+
+	upgraders := map[string]*progressUpgrader{"canary-1": {}, "web-1": {}, "web-2": {}}
+	var startClient func(id string, version string, tag string, upgrader Upgrader) (*Client, error)
+	startClient = func(id string, version string, tag string, upgrader Upgrader) (*Client, error) {
+		var client *Client
+		restart := func() error {
+			if id == "web-1" {
+				// The upgraded binary never comes up
+				os.Unsetenv(upgradeResultEnv)
+				go client.Stop()
+				return nil
+			}
+			restarted, err := startClient(id, "2.0.0", tag, &progressUpgrader{})
+			if err != nil {
+				return err
+			}
+			go client.Stop()
+			go restarted.Start()
+			return nil
+		}
+		client, err := NewClient(testClientOptions(network, "127.0.0.1:9405", id, identities[id],
+			WithClientTags(tag),
+			WithClientVersion(version),
+			WithClientUpgrader(upgrader),
+			WithClientRestart(restart),
+		)...)
+		if err != nil {
+			return nil, err
+		}
+		t.Cleanup(client.Stop)
+		return client, nil
+	}
+	for id, tag := range map[string]string{"canary-1": "canary", "web-1": "web", "web-2": "web"} {
+		client, err := startClient(id, "1.0.0", tag, upgraders[id])
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		go client.Start()
+	}
+	waitTestClients(t, ctx, server, "canary-1", "web-1", "web-2")
+
+	if _, err := server.StartUpgradeRollout(SystemOperator, []string{"@web"}, UpgradeRequest{Server: "ftp://releases"}, RolloutOptions{}); !errors.Is(err, ErrInvalidOperation) {
+		t.Errorf("Expected a non-HTTP upgrade server to be rejected, got %v", err)
+	}
+	rollout, err := server.StartUpgradeRollout(SystemOperator, []string{"@canary", "@web"},
+		UpgradeRequest{Version: "2.0.0", Server: "https://releases.example.com"},
+		RolloutOptions{BatchSize: 1, HealthCheck: 500 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to start upgrade rollout: %v", err)
+	}
+	if rollout.Target != "@canary,@web" || len(rollout.Hosts) != 3 || rollout.Hosts[0].Group != "@canary" || rollout.Hosts[2].Batch != 3 {
+		t.Fatalf("Expected the canary stage before the web stage, got %+v", rollout)
+	}
+
+	// The canary comes back upgraded, the web client that does not halts the rollout
+	done, err := server.WaitRollout(ctx, rollout.ID)
+	if err != nil {
+		t.Fatalf("Failed to wait for rollout: %v", err)
+	}
+	if done.State != RolloutStateHalted || done.Succeeded != 1 || done.Failed != 1 || done.Skipped != 1 {
+		t.Fatalf("Expected the rollout to halt after web-1, got %+v", done)
+	}
+	if done.Hosts[0].Unhealthy != "" || done.Hosts[1].ClientID != "web-1" || done.Hosts[1].Unhealthy == "" {
+		t.Errorf("Expected only web-1 to fail the health check, got %+v", done.Hosts)
+	}
+	if client, _ := server.Client("canary-1"); client.Facts == nil || client.Facts.Version != "2.0.0" {
+		t.Errorf("Expected the canary to report the new version, got %+v", client.Facts)
+	}
+
+	job, _ := server.Job(done.Hosts[0].JobID)
+	if job.State != JobStateSucceeded || !strings.Contains(job.Output, `"to":"2.0.0"`) || !strings.Contains(job.Output, `"restart":true`) {
+		t.Errorf("Unexpected upgrade job %+v", job)
+	}
+	if job.Progress == nil || job.Progress.Done != 100 || job.Progress.Total != 100 {
+		t.Errorf("Expected the download progress in the job, got %+v", job.Progress)
+	}
+	upgrader := upgraders["web-1"]
+	upgrader.mu.Lock()
+	defer upgrader.mu.Unlock()
+	if !reflect.DeepEqual(upgrader.servers, []string{"https://releases.example.com"}) || !reflect.DeepEqual(upgrader.versions, []string{"2.0.0"}) {
+		t.Errorf("Expected web-1 to upgrade to 2.0.0 from the given server, got %v and %v", upgrader.servers, upgrader.versions)
+	}
+}
+
+// TestPinnedKeysRestart tests that keys pinned at enrolment survive a server restart
+func TestPinnedKeysRestart(t *testing.T) {
+	dir := t.TempDir()
+	identity, _ := GenerateIdentity()
+	impostor, _ := GenerateIdentity()
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4000}
+	probe := func(identifier string, key ed25519.PrivateKey) *Message {
+		msg := &Message{Type: MessageTypeProbe, Identifier: identifier, PublicKey: key.Public().(ed25519.PublicKey)}
+		msg.sign(key, time.Now().UnixNano())
+		return msg
+	}
+	start := func(policy EnrolmentPolicy) *Server {
+		server, err := NewServer(
+			WithServerAddress("127.0.0.1:0"),
+			WithServerEnrolment(policy),
+			WithServerKeyStateFile(filepath.Join(dir, "keys.json")),
+			WithServerStateFile(filepath.Join(dir, "state.log")),
+		)
+		if err != nil {
+			t.Fatalf("Failed to create server: %v", err)
+		}
+		return server
+	}
+
+	// An approved client and a client pinned on first use
+	server := start(EnrolmentManual)
+	if err := server.authenticate(probe("approved", identity), addr); !errors.Is(err, ErrEnrolmentPending) {
+		t.Fatalf("Expected pending enrolment, got %v", err)
+	}
+	if err := server.ApproveEnrolment("approved"); err != nil {
+		t.Fatalf("Failed to approve enrolment: %v", err)
+	}
+	server.config.Enrolment = EnrolmentAuto
+	if err := server.authenticate(probe("pinned", identity), addr); err != nil {
+		t.Fatalf("Expected first probe to be pinned, got %v", err)
+	}
+	server.closeListeners()
+	server.closeStore()
+
+	server = start(EnrolmentAuto)
+	defer server.closeStore()
+	defer server.closeListeners()
+	for _, id := range []string{"approved", "pinned"} {
+		if err := server.authenticate(probe(id, identity), addr); err != nil {
+			t.Errorf("Expected %s to stay enrolled after a restart, got %v", id, err)
+		}
+		if err := server.authenticate(probe(id, impostor), addr); !errors.Is(err, ErrBadSignature) {
+			t.Errorf("Expected another key for %s to be rejected after a restart, got %v", id, err)
+		}
+	}
+}
+
+// blockingStore is a Store whose job writes block until released
+type blockingStore struct {
+	*FileStore
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (bs *blockingStore) PutJob(job Job) error {
+	bs.writing <- struct{}{}
+	<-bs.release
+	return bs.FileStore.PutJob(job)
+}
+
+// TestJobWritesOutsideLock tests that slow store writes do not block access to jobs
+func TestJobWritesOutsideLock(t *testing.T) {
+	fileStore, err := OpenFileStore(filepath.Join(t.TempDir(), "state.log"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	store := &blockingStore{FileStore: fileStore, writing: make(chan struct{}), release: make(chan struct{})}
+	server, err := NewServer(WithServerAddress("127.0.0.1:0"), WithServerStore(store))
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.conn.Close()
+
+	enqueued := make(chan *Job, 1)
+	go func() { enqueued <- server.enqueueJob("", "c1", "id") }()
+	<-store.writing
+
+	// The job is visible and other clients can queue jobs while it is written
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, ok := server.Job(1); !ok {
+			t.Error("Expected the job being written to be visible")
+		}
+		server.enqueueJob("", "c2", "id")
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Job access blocked behind a store write")
+	}
+
+	// The writer of the first job writes the second one too once the store is released
+	close(store.release)
+	select {
+	case <-store.writing:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the second job to be written")
+	}
+	<-enqueued
+	_, jobs, _ := fileStore.Load()
+	if len(jobs) != 2 {
+		t.Errorf("Expected both jobs to be stored, got %+v", jobs)
+	}
+}
+
+// TestStreamLimits tests the bounds on unauthenticated TLS connections and their frames
+func TestStreamLimits(t *testing.T) {
+	// A frame announcing more data than arrives fails without the whole buffer
+	var frame bytes.Buffer
+	binary.Write(&frame, binary.BigEndian, uint32(300*1024))
+	frame.WriteString("short")
+	if _, err := readFrame(&frame, 320*1024); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected a truncated frame to fail, got %v", err)
+	}
+
+	server, err := NewServer(WithServerAddress("127.0.0.1:0"))
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.conn.Close()
+
+	peers := make([]*streamPeer, maxPendingStreams)
+	for i := range peers {
+		client, remote := net.Pipe()
+		defer remote.Close()
+		peers[i] = &streamPeer{conn: client}
+		if !server.trackStream(context.Background(), peers[i]) {
+			t.Fatalf("Expected connection %d to be accepted", i)
+		}
+	}
+	extra, remote := net.Pipe()
+	defer remote.Close()
+	if server.trackStream(context.Background(), &streamPeer{conn: extra}) {
+		t.Error("Expected connections beyond the unauthenticated limit to be refused")
+	}
+
+	// Authenticated and closed connections make room again
+	server.streamAuthenticated(peers[0])
+	server.untrackStream(peers[1])
+	for i := 0; i < 2; i++ {
+		if !server.trackStream(context.Background(), &streamPeer{conn: extra}) {
+			t.Errorf("Expected connection to be accepted once room was made")
+		}
+	}
+	server.closeStreams()
+}
+
+// TestCancelTransfer tests that cancelling a transfer cancels the chunks it queued
+func TestCancelTransfer(t *testing.T) {
+	server, err := NewServer(WithServerAddress("127.0.0.1:0"))
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.conn.Close()
+	server.clients["c1"] = &ClientInfo{Identifier: "c1", State: ClientStateHealthy}
+
+	source := filepath.Join(t.TempDir(), "app.conf")
+	if err := os.WriteFile(source, make([]byte, 3*transferChunkSize), 0o600); err != nil {
+		t.Fatalf("Failed to write source: %v", err)
+	}
+	started, err := server.Push(SystemOperator, "c1", source, "/srv/app.conf")
+	if err != nil {
+		t.Fatalf("Failed to start transfer: %v", err)
+	}
+
+	// Answer the stat job so the transfer queues its first chunks
+	stat := server.Jobs("c1")[0]
+	server.updateJob("c1", stat.ID, func(job *Job) {
+		job.State = JobStateSucceeded
+		job.Output = `{"path": "/srv/app.conf"}`
+		job.FinishedAt = time.Now()
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for server.queuedJobs("c1") < transferWindow && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if server.queuedJobs("c1") != transferWindow {
+		t.Fatalf("Expected %d queued chunks, got %d", transferWindow, server.queuedJobs("c1"))
+	}
+
+	if err := server.CancelTransfer(SystemOperator, started.ID); err != nil {
+		t.Fatalf("Failed to cancel transfer: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if done, err := server.WaitTransfer(ctx, started.ID); err != nil || done.State != TransferStateCancelled {
+		t.Fatalf("Expected cancelled transfer, got %+v (%v)", done, err)
+	}
+	if queued := server.queuedJobs("c1"); queued != 0 {
+		t.Errorf("Expected the queued chunks to be cancelled, %d are left", queued)
+	}
+	for _, job := range server.Jobs("c1") {
+		if job.ID != stat.ID && job.State != JobStateCancelled {
+			t.Errorf("Expected chunk job %d cancelled, got %s", job.ID, job.State)
+		}
+	}
+
+	// Transfers to a client that never answers fail after the transfer timeout
+	server.config.TransferTimeout = 100 * time.Millisecond
+	started, err = server.Push(SystemOperator, "c1", source, "/srv/app.conf")
+	if err != nil {
+		t.Fatalf("Failed to start transfer: %v", err)
+	}
+	if done, err := server.WaitTransfer(ctx, started.ID); err != nil || done.State != TransferStateFailed || !strings.Contains(done.Error, "did not finish") {
+		t.Errorf("Expected the transfer to time out, got %+v (%v)", done, err)
+	}
+	if queued := server.queuedJobs("c1"); queued != 0 {
+		t.Errorf("Expected the jobs of the timed out transfer to be cancelled, %d are left", queued)
+	}
+}
+
+// TestUpgradeHealthCheck tests that upgrade rollouts check the health of their clients unless turned off
+func TestUpgradeHealthCheck(t *testing.T) {
+	server, err := NewServer(WithServerAddress("127.0.0.1:0"))
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.conn.Close()
+	server.clients["fast"] = &ClientInfo{Identifier: "fast", Tags: []string{"web"}, ProbeInterval: time.Second}
+	server.clients["slow"] = &ClientInfo{Identifier: "slow", Tags: []string{"web"}, ProbeInterval: 10 * time.Second}
+
+	// The slowest client sets how long the check waits
+	if check := server.upgradeHealthCheck([]string{"@web"}); check != 25*time.Second {
+		t.Errorf("Expected a health check of 25s, got %s", check)
+	}
+
+	var opts RolloutOptions
+	if err := json.Unmarshal([]byte(`{"health_check": "off"}`), &opts); err != nil || opts.HealthCheck != HealthCheckOff {
+		t.Errorf("Expected the health check turned off, got %+v (%v)", opts, err)
+	}
+	if data, _ := json.Marshal(opts); !strings.Contains(string(data), `"health_check":"off"`) {
+		t.Errorf("Expected the health check encoded as off, got %s", data)
+	}
+	if err := (RolloutOptions{HealthCheck: -time.Second}).validate(); !errors.Is(err, ErrInvalidRollout) {
+		t.Errorf("Expected a negative health check to be rejected, got %v", err)
+	}
+}
+
+// TestRolloutSkippedClients tests that clients a rollout could not reach count as failures
+func TestRolloutSkippedClients(t *testing.T) {
+	server, err := NewServer(WithServerAddress("127.0.0.1:0"))
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.conn.Close()
+	for _, id := range []string{"a-lost", "b-lost"} {
+		server.clients[id] = &ClientInfo{Identifier: id, Tags: []string{"web"}, State: ClientStateLost}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Lost clients reach the failure threshold
+	rollout, err := server.StartRollout(SystemOperator, "@web", "uptime", RolloutOptions{BatchSize: 1, MaxFailures: 1})
+	if err != nil {
+		t.Fatalf("Failed to start rollout: %v", err)
+	}
+	if done, _ := server.WaitRollout(ctx, rollout.ID); done.State != RolloutStateAborted || done.Skipped != 2 {
+		t.Errorf("Expected the rollout aborted after the first lost client, got %+v", done)
+	}
+
+	// A rollout that reached no client does not pass a wait
+	console := NewConsole(server)
+	console.out = io.Discard
+	console.Execute("execute @web uptime")
+	if console.Execute("wait"); console.err == nil {
+		t.Error("Expected wait to fail for a rollout that skipped every client")
+	}
 }
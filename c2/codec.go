@@ -0,0 +1,147 @@
+package c2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+)
+
+const (
+	// binaryMagic starts every binary encoded message, gob streams never start with it
+	binaryMagic = 0xC2
+	// binaryVersion is the layout of the binary codec this build reads and writes
+	binaryVersion = 1
+	// binaryHeaderSize covers the magic, version, capabilities, type and fixed-width fields
+	binaryHeaderSize = 4 + 8 + 4 + 4 + 2 + 2
+)
+
+var (
+	// ErrMalformedMessage is returned when a binary message is truncated or inconsistent
+	ErrMalformedMessage = errors.New("malformed message")
+	// ErrUnsupportedVersion is returned for binary messages of a newer layout
+	ErrUnsupportedVersion = errors.New("unsupported message version")
+)
+
+// encodeMessage encodes msg with codec, gob unless the binary codec is asked for
+func encodeMessage(msg Message, codec CodecType) ([]byte, error) {
+	if codec == CodecBinary {
+		return encodeBinary(msg), nil
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(msg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeMessage decodes a message of either codec and reports which one it used
+func decodeMessage(data []byte) (Message, CodecType, error) {
+	if len(data) > 0 && data[0] == binaryMagic {
+		msg, err := decodeBinary(data)
+		return msg, CodecBinary, err
+	}
+	var msg Message
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&msg); err != nil {
+		return Message{}, CodecGob, err
+	}
+	return msg, CodecGob, nil
+}
+
+// encodeBinary lays msg out as a fixed header followed by length-prefixed fields:
+//
+//	magic, version, capabilities, type                 1 byte each
+//	timestamp, key epoch, message ID                   8, 4 and 4 bytes, big-endian
+//	fragment index, fragment count                     2 bytes each, big-endian
+//	identifier, public key, payload, signature         uvarint length and bytes each
+func encodeBinary(msg Message) []byte {
+	size := binaryHeaderSize
+	for _, field := range [][]byte{[]byte(msg.Identifier), msg.PublicKey, msg.Payload, msg.Signature} {
+		size += binary.MaxVarintLen64 + len(field)
+	}
+
+	buf := make([]byte, 0, size)
+	buf = append(buf, binaryMagic, binaryVersion, byte(msg.Capabilities), byte(msg.Type))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(msg.Timestamp))
+	buf = binary.BigEndian.AppendUint32(buf, msg.KeyEpoch)
+	buf = binary.BigEndian.AppendUint32(buf, msg.MessageID)
+	buf = binary.BigEndian.AppendUint16(buf, msg.FragmentIndex)
+	buf = binary.BigEndian.AppendUint16(buf, msg.FragmentCount)
+	buf = appendBinaryField(buf, []byte(msg.Identifier))
+	buf = appendBinaryField(buf, msg.PublicKey)
+	buf = appendBinaryField(buf, msg.Payload)
+	buf = appendBinaryField(buf, msg.Signature)
+	return buf
+}
+
+// appendBinaryField appends field prefixed with its uvarint length
+func appendBinaryField(buf []byte, field []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(field)))
+	return append(buf, field...)
+}
+
+// decodeBinary parses a message laid out by encodeBinary, rejecting anything it would not produce
+func decodeBinary(data []byte) (Message, error) {
+	if len(data) < binaryHeaderSize || data[0] != binaryMagic {
+		return Message{}, fmt.Errorf("%w: short header", ErrMalformedMessage)
+	}
+	if data[1] != binaryVersion {
+		return Message{}, fmt.Errorf("%w: %d", ErrUnsupportedVersion, data[1])
+	}
+
+	msg := Message{
+		Capabilities:  Capability(data[2]),
+		Type:          MessageType(data[3]),
+		Timestamp:     int64(binary.BigEndian.Uint64(data[4:])),
+		KeyEpoch:      binary.BigEndian.Uint32(data[12:]),
+		MessageID:     binary.BigEndian.Uint32(data[16:]),
+		FragmentIndex: binary.BigEndian.Uint16(data[20:]),
+		FragmentCount: binary.BigEndian.Uint16(data[22:]),
+	}
+
+	rest := data[binaryHeaderSize:]
+	var identifier []byte
+	for _, field := range []*[]byte{&identifier, &msg.PublicKey, &msg.Payload, &msg.Signature} {
+		var err error
+		if *field, rest, err = readBinaryField(rest); err != nil {
+			return Message{}, err
+		}
+	}
+	if len(rest) > 0 {
+		return Message{}, fmt.Errorf("%w: %d trailing bytes", ErrMalformedMessage, len(rest))
+	}
+	msg.Identifier = string(identifier)
+	return msg, nil
+}
+
+// readBinaryField reads a copy of one length-prefixed field, since receive buffers are
+// reused, returning nil for empty ones like gob does
+func readBinaryField(data []byte) ([]byte, []byte, error) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, nil, fmt.Errorf("%w: bad field length", ErrMalformedMessage)
+	}
+	// Only the shortest encoding is accepted, so every message has a single form
+	if n != uvarintLen(size) {
+		return nil, nil, fmt.Errorf("%w: non-minimal field length", ErrMalformedMessage)
+	}
+	data = data[n:]
+	if size > uint64(len(data)) {
+		return nil, nil, fmt.Errorf("%w: field of %d bytes exceeds message", ErrMalformedMessage, size)
+	}
+	if size == 0 {
+		return nil, data, nil
+	}
+	return bytes.Clone(data[:size]), data[size:], nil
+}
+
+// uvarintLen returns how many bytes the shortest uvarint encoding of v takes
+func uvarintLen(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
@@ -0,0 +1,1157 @@
+package c2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c-bata/go-prompt"
+)
+
+// Console is the interactive operator console layered on top of a Server
+type Console struct {
+	server   *Server
+	out      io.Writer
+	operator string
+
+	// json writes every outcome as one line of JSON instead of text
+	json bool
+	// history holds the commands entered, starting with those of earlier sessions
+	history []string
+	// jobs and rollouts started by the console that wait has not seen yet
+	jobs     []uint64
+	rollouts []uint64
+	// err is why the last command failed, nil if it succeeded
+	err error
+}
+
+// consoleMessage is the JSON form of a console message
+type consoleMessage struct {
+	Message string `json:"message"`
+}
+
+// waitResult is the JSON form of the outcome of wait
+type waitResult struct {
+	Jobs     []Job     `json:"jobs"`
+	Rollouts []Rollout `json:"rollouts,omitempty"`
+}
+
+// NewConsole creates a console for the given server writing to standard output,
+// acting on behalf of the user running the server
+func NewConsole(s *Server) *Console {
+	operator := s.config.ConsoleOperator
+	if operator == "" {
+		operator = "console"
+		if u, err := user.Current(); err == nil {
+			operator = "console:" + u.Username
+		}
+	}
+	c := &Console{
+		server:   s,
+		out:      os.Stdout,
+		operator: operator,
+		json:     s.config.ConsoleOutput == OutputJSON,
+	}
+	if s.config.ConsoleHistory != "" {
+		history, err := loadHistory(s.config.ConsoleHistory)
+		if err != nil {
+			s.config.Logger.Warnf("server: failed to load console history: %v", err)
+		}
+		c.history = history
+	}
+	return c
+}
+
+// Run reads commands from the terminal until the operator quits
+func (c *Console) Run() {
+	fmt.Fprintln(c.out, "C2 Server Console")
+	fmt.Fprintln(c.out, "Type 'help' for available commands, type '?' to show command suggestions")
+
+	quit := false
+	p := prompt.New(
+		func(in string) {
+			if in == "" {
+				return
+			}
+			// Handle ? command for showing suggestions
+			if in == "?" {
+				c.showHelp()
+				return
+			}
+			c.record(in)
+			quit = !c.Execute(in)
+		},
+		c.complete,
+		prompt.OptionPrefix("> "),
+		prompt.OptionHistory(slices.Clone(c.history)),
+		prompt.OptionInputTextColor(prompt.Green),
+		prompt.OptionSuggestionTextColor(prompt.White),
+		prompt.OptionSelectedSuggestionTextColor(prompt.Black),
+		prompt.OptionSelectedSuggestionBGColor(prompt.LightGray),
+		prompt.OptionCompletionOnDown(), // Only show suggestions when pressing Tab or Down
+		prompt.OptionSetExitCheckerOnInput(func(in string, breakline bool) bool {
+			return breakline && quit
+		}),
+	)
+
+	// Start the prompt
+	p.Run()
+}
+
+func (c *Console) complete(d prompt.Document) []prompt.Suggest {
+	// Only show full command list when user types exactly "?"
+	if d.Text == "?" {
+		// Command suggestions
+		return []prompt.Suggest{
+			{Text: "help", Description: "Show help message"},
+			{Text: "show", Description: "Show all connected clients, optionally filtered by key=pattern"},
+			{Text: "info", Description: "Show the host facts of a client"},
+			{Text: "tag", Description: "Show the tags clients advertise, or the clients with a tag"},
+			{Text: "execute", Description: "Send command to client or @group"},
+			{Text: "jobs", Description: "Show the jobs of all clients or of one client"},
+			{Text: "job", Description: "Show a job and its result"},
+			{Text: "result", Description: "Print the output of a finished job"},
+			{Text: "wait", Description: "Wait for jobs, by default those started in this console"},
+			{Text: "cancel", Description: "Cancel a job, killing its command if it runs"},
+			{Text: "upgrade", Description: "Upgrade a client, or groups one after another"},
+			{Text: "operations", Description: "Show the built-in operations"},
+			{Text: "rollouts", Description: "Show group rollouts"},
+			{Text: "rollout", Description: "Show the per-client results of a rollout"},
+			{Text: "cancel-rollout", Description: "Stop a rollout from starting further batches"},
+			{Text: "push", Description: "Copy a local file to a client"},
+			{Text: "pull", Description: "Copy a file of a client to the server"},
+			{Text: "transfers", Description: "Show file transfers and their progress"},
+			{Text: "cancel-transfer", Description: "Stop a file transfer, keeping what was copied"},
+			{Text: "listeners", Description: "Show the UDP sockets of the server and their traffic"},
+			{Text: "assign", Description: "Add a client to a group"},
+			{Text: "unassign", Description: "Remove a client from a group"},
+			{Text: "enrolments", Description: "Show clients awaiting approval"},
+			{Text: "approve", Description: "Approve a pending client key"},
+			{Text: "reject", Description: "Reject a pending client key"},
+			{Text: "rotate-key", Description: "Rotate the key of a client"},
+			{Text: "export", Description: "Write clients, jobs, rollouts or transfers to a JSON file"},
+			{Text: "history", Description: "Show the commands entered in this and earlier sessions"},
+			{Text: "verify-audit", Description: "Verify the audit log hash chain"},
+			{Text: "quit", Description: "Exit the server"},
+			{Text: "exit", Description: "Exit the server"},
+		}
+	}
+
+	// Only show client IDs when completing execute command
+	if word := d.GetWordBeforeCursor(); strings.HasPrefix(word, "execute ") || strings.HasPrefix(word, "rotate-key ") || strings.HasPrefix(word, "info ") ||
+		strings.HasPrefix(word, "push ") || strings.HasPrefix(word, "pull ") || strings.HasPrefix(word, "assign ") || strings.HasPrefix(word, "unassign ") ||
+		strings.HasPrefix(word, "jobs ") || strings.HasPrefix(word, "upgrade ") {
+		clientSuggests := []prompt.Suggest{}
+		for _, client := range c.server.Clients() {
+			clientSuggests = append(clientSuggests, prompt.Suggest{Text: client.Identifier})
+		}
+		return clientSuggests
+	}
+
+	// Show pending identities when completing approve/reject
+	if word := d.GetWordBeforeCursor(); strings.HasPrefix(word, "approve ") || strings.HasPrefix(word, "reject ") {
+		enrolmentSuggests := []prompt.Suggest{}
+		for _, req := range c.server.PendingEnrolments() {
+			enrolmentSuggests = append(enrolmentSuggests, prompt.Suggest{Text: req.Identifier, Description: req.Fingerprint})
+		}
+		return enrolmentSuggests
+	}
+
+	// No suggestions for other cases
+	return nil
+}
+
+// Execute runs a single console command and reports whether the console should keep running.
+// Err returns why the command failed.
+func (c *Console) Execute(input string) bool {
+	c.err = nil
+	args := strings.Fields(input)
+	if len(args) == 0 {
+		return true
+	}
+
+	command := strings.ToLower(args[0])
+
+	switch command {
+	case "help":
+		c.showHelp()
+	case "show":
+		filter, err := ParseClientFilter(args[1:])
+		if err != nil {
+			c.fail(err)
+			return true
+		}
+		c.showClients(filter)
+	case "info":
+		if len(args) != 2 {
+			c.failf("Usage: info <client-identifier>")
+			return true
+		}
+		c.showClient(args[1])
+	case "tag":
+		if len(args) > 2 {
+			c.failf("Usage: tag [<tag>]")
+			return true
+		}
+		c.showTags(args[1:])
+	case "execute":
+		if len(args) < 3 {
+			c.failf("Usage: execute <client-identifier> [--timeout duration] <command>\n" +
+				"       execute @<group> [--batch n] [--pause duration] [--max-failures n] [--timeout duration] <command>")
+			return true
+		}
+		if strings.HasPrefix(args[1], "@") {
+			c.startRollout(args[1], args[2:])
+			return true
+		}
+		c.executeCommand(args[1], args[2:])
+	case "jobs":
+		if len(args) > 2 {
+			c.failf("Usage: jobs [<client-identifier>]")
+			return true
+		}
+		c.showJobs(strings.Join(args[1:], ""))
+	case "job", "result", "cancel":
+		if len(args) != 2 {
+			c.failf("Usage: %s <job-id>", command)
+			return true
+		}
+		id, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			c.failf("Invalid job id: %s", args[1])
+			return true
+		}
+		switch command {
+		case "job":
+			c.showJob(id)
+		case "result":
+			c.showResult(id)
+		default:
+			c.cancelJob(id)
+		}
+	case "wait":
+		c.wait(args[1:])
+	case "upgrade":
+		if len(args) < 2 {
+			c.failf("Usage: upgrade <client-identifier|@group[,@group...]> [options]")
+			return true
+		}
+		c.upgrade(args[1], args[2:])
+	case "operations":
+		c.showOperations()
+	case "rollouts":
+		c.showRollouts()
+	case "rollout", "cancel-rollout":
+		if len(args) != 2 {
+			c.failf("Usage: %s <rollout-id>", command)
+			return true
+		}
+		id, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			c.failf("Invalid rollout id: %s", args[1])
+			return true
+		}
+		if command == "rollout" {
+			c.showRollout(id)
+		} else if err := c.server.CancelRollout(c.operator, id); err != nil {
+			c.fail(err)
+		} else {
+			c.printf("Rollout %d will not start further batches\n", id)
+		}
+	case "push", "pull":
+		if len(args) != 4 {
+			if command == "push" {
+				c.failf("Usage: push <client-identifier> <local-path> <remote-path>")
+			} else {
+				c.failf("Usage: pull <client-identifier> <remote-path> <local-path>")
+			}
+			return true
+		}
+		var transfer Transfer
+		var err error
+		if command == "push" {
+			transfer, err = c.server.Push(c.operator, args[1], args[2], args[3])
+		} else {
+			transfer, err = c.server.Pull(c.operator, args[1], args[2], args[3])
+		}
+		if err != nil {
+			c.fail(err)
+			return true
+		}
+		if c.json {
+			c.writeJSON(transfer)
+			return true
+		}
+		fmt.Fprintf(c.out, "Transfer %d of '%s' on '%s' started, follow it with 'transfers'\n",
+			transfer.ID, transfer.RemotePath, transfer.ClientID)
+	case "transfers":
+		c.showTransfers()
+	case "listeners":
+		c.showListeners()
+	case "cancel-transfer":
+		if len(args) != 2 {
+			c.failf("Usage: cancel-transfer <transfer-id>")
+			return true
+		}
+		id, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			c.failf("Invalid transfer id: %s", args[1])
+			return true
+		}
+		if err := c.server.CancelTransfer(c.operator, id); err != nil {
+			c.fail(err)
+		} else {
+			c.printf("Transfer %d will not copy further chunks, push or pull again to resume\n", id)
+		}
+	case "assign", "unassign":
+		if len(args) != 3 {
+			c.failf("Usage: %s <client-identifier> <group>", command)
+			return true
+		}
+		var err error
+		if command == "assign" {
+			err = c.server.AssignGroup(c.operator, args[1], args[2])
+		} else {
+			err = c.server.UnassignGroup(c.operator, args[1], args[2])
+		}
+		if err != nil {
+			c.fail(err)
+		} else {
+			client, _ := c.server.Client(args[1])
+			c.printf("Client '%s' is now in groups: %s\n", args[1], strings.Join(client.Groups, ","))
+		}
+	case "enrolments":
+		c.showEnrolments()
+	case "approve", "reject":
+		if len(args) != 2 {
+			c.failf("Usage: %s <client-identifier>", command)
+			return true
+		}
+		action := AuditApproveEnrolment
+		if command == "reject" {
+			action = AuditRejectEnrolment
+		}
+		err := c.server.authorizeAdmin(c.operator, action, args[1])
+		if err == nil && command == "approve" {
+			err = c.server.ApproveEnrolment(args[1])
+		} else if err == nil {
+			err = c.server.RejectEnrolment(args[1])
+		}
+		if err != nil {
+			c.fail(err)
+		} else {
+			c.server.audit(AuditEntry{Action: action, Operator: c.operator, ClientID: args[1]})
+			c.printf("Enrolment for '%s' %sd\n", args[1], command)
+		}
+	case "rotate-key":
+		if len(args) != 2 {
+			c.failf("Usage: rotate-key <client-identifier>")
+			return true
+		}
+		err := c.server.authorizeAdmin(c.operator, AuditRotateKey, args[1])
+		if err == nil {
+			err = c.server.RotateKey(args[1])
+		}
+		if err != nil {
+			c.fail(err)
+		} else {
+			c.server.audit(AuditEntry{Action: AuditRotateKey, Operator: c.operator, ClientID: args[1]})
+			c.printf("Key rotation for '%s' will be delivered on its next probe\n", args[1])
+		}
+	case "export":
+		if len(args) != 3 {
+			c.failf("Usage: export <clients|jobs|rollouts|transfers> <path>")
+			return true
+		}
+		c.export(args[1], args[2])
+	case "history":
+		limit := len(c.history)
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if len(args) > 2 || err != nil || n < 0 {
+				c.failf("Usage: history [<count>]")
+				return true
+			}
+			limit = min(n, limit)
+		}
+		c.showHistory(limit)
+	case "verify-audit":
+		c.verifyAudit()
+	case "quit", "exit":
+		c.server.Stop()
+		return false
+	default:
+		c.failf("Unknown command: %s\nType 'help' for available commands", command)
+	}
+
+	return true
+}
+
+// Err returns why the last command failed, nil if it succeeded
+func (c *Console) Err() error {
+	return c.err
+}
+
+// fail reports why the current command failed
+func (c *Console) fail(err error) {
+	c.err = err
+	if c.json {
+		c.writeJSON(errorResponse{Error: err.Error()})
+		return
+	}
+	fmt.Fprintln(c.out, err)
+}
+
+// failf reports a failure of the current command described by a format
+func (c *Console) failf(format string, args ...any) {
+	c.fail(fmt.Errorf(format, args...))
+}
+
+// printf writes a message, wrapped in an object with a message field in JSON mode
+func (c *Console) printf(format string, args ...any) {
+	if c.json {
+		c.writeJSON(consoleMessage{Message: strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")})
+		return
+	}
+	fmt.Fprintf(c.out, format, args...)
+}
+
+// writeJSON writes v as one line of JSON
+func (c *Console) writeJSON(v any) {
+	if err := json.NewEncoder(c.out).Encode(v); err != nil {
+		c.err = err
+	}
+}
+
+func (c *Console) showHelp() {
+	fmt.Fprintln(c.out, "Available commands:")
+	fmt.Fprintln(c.out, "  help                Show this help message")
+	fmt.Fprintln(c.out, "  show [key=pattern]  Show all connected clients, filtered by state, group, tag, hostname,")
+	fmt.Fprintln(c.out, "                      os, arch, kernel, version, machine_id or virtualized")
+	fmt.Fprintln(c.out, "  info <id>           Show the host facts of a client")
+	fmt.Fprintln(c.out, "  tag [<tag>]         Show the tags clients advertise, or the clients with a tag")
+	fmt.Fprintln(c.out, "  execute <id> [--timeout d] <cmd>")
+	fmt.Fprintln(c.out, "                      Send command to client, killing it after the timeout")
+	fmt.Fprintln(c.out, "  execute @<group> [--batch n] [--pause d] [--max-failures n] [--timeout d] [--health-check d] <cmd>")
+	fmt.Fprintln(c.out, "                      Send command to every client in a group or with a tag")
+	fmt.Fprintln(c.out, "  jobs [<id>]         Show the jobs of all clients or of one client")
+	fmt.Fprintln(c.out, "  job <id>            Show a job, its result or the output it streamed so far")
+	fmt.Fprintln(c.out, "  result <id>         Print the output of a finished job, failing unless it succeeded")
+	fmt.Fprintln(c.out, "  wait [--timeout d] [<id>...]")
+	fmt.Fprintln(c.out, "                      Wait for jobs, by default those and the rollouts started in this console")
+	fmt.Fprintln(c.out, "  cancel <id>         Cancel a job, killing its command if it runs")
+	fmt.Fprintln(c.out, "  upgrade <id> [--version v] [--server url] [--timeout d]")
+	fmt.Fprintln(c.out, "                      Upgrade a client and restart it into the new binary")
+	fmt.Fprintln(c.out, "  upgrade @<group>[,@<group>...] [--version v] [--server url] [--batch n] [--pause d]")
+	fmt.Fprintln(c.out, "          [--max-failures n] [--timeout d] [--health-check d]")
+	fmt.Fprintln(c.out, "                      Upgrade groups one after another, halting when upgraded clients stop probing")
+	fmt.Fprintln(c.out, "                      unless the health check is off")
+	fmt.Fprintln(c.out, "  operations          Show the built-in operations, run as execute <id> op:<name> key=value")
+	fmt.Fprintln(c.out, "  rollouts            Show group rollouts")
+	fmt.Fprintln(c.out, "  rollout <id>        Show the per-client results of a rollout")
+	fmt.Fprintln(c.out, "  cancel-rollout <id> Stop a rollout from starting further batches")
+	fmt.Fprintln(c.out, "  push <id> <local> <remote>")
+	fmt.Fprintln(c.out, "                      Copy a local file to a client, resuming an interrupted copy")
+	fmt.Fprintln(c.out, "  pull <id> <remote> <local>")
+	fmt.Fprintln(c.out, "                      Copy a file of a client to the server, resuming an interrupted copy")
+	fmt.Fprintln(c.out, "  transfers           Show file transfers and their progress")
+	fmt.Fprintln(c.out, "  cancel-transfer <id>")
+	fmt.Fprintln(c.out, "                      Stop a file transfer, keeping what was copied")
+	fmt.Fprintln(c.out, "  listeners           Show the UDP sockets of the server and their traffic")
+	fmt.Fprintln(c.out, "  assign <id> <group> Add a client to a group")
+	fmt.Fprintln(c.out, "  unassign <id> <grp> Remove a client from a group")
+	fmt.Fprintln(c.out, "  enrolments          Show clients awaiting approval")
+	fmt.Fprintln(c.out, "  approve <id>        Approve a pending client key")
+	fmt.Fprintln(c.out, "  reject <id>         Reject a pending client key")
+	fmt.Fprintln(c.out, "  rotate-key <id>     Rotate the key of a client")
+	fmt.Fprintln(c.out, "  export <what> <path>")
+	fmt.Fprintln(c.out, "                      Write clients, jobs, rollouts or transfers as JSON to a file, - for the console")
+	fmt.Fprintln(c.out, "  history [<count>]   Show the commands entered in this and earlier sessions")
+	fmt.Fprintln(c.out, "  verify-audit        Verify the audit log hash chain")
+	fmt.Fprintln(c.out, "  quit/exit           Exit the server")
+}
+
+func (c *Console) showClients(filter ClientFilter) {
+	clients := c.server.FilterClients(filter)
+	if c.json {
+		c.writeJSON(clients)
+		return
+	}
+	if len(clients) == 0 {
+		fmt.Fprintln(c.out, "No connected clients")
+		return
+	}
+
+	fmt.Fprintf(c.out, "%-20s %-20s %-20s %-14s %-26s %-8s %-6s %-20s %s\n",
+		"Identifier", "IP Address", "Hostname", "OS", "Last Seen", "State", "Queued", "Groups", "Tags")
+	fmt.Fprintln(c.out, strings.Repeat("-", 150))
+
+	for _, client := range clients {
+		hostname, system := "-", "-"
+		if facts := client.Facts; facts != nil {
+			hostname, system = facts.Hostname, facts.OS+"/"+facts.Arch
+		}
+		fmt.Fprintf(c.out, "%-20s %-20s %-20s %-14s %-26s %-8s %-6d %-20s %s\n",
+			client.Identifier,
+			client.SourceIP.String(),
+			hostname,
+			system,
+			client.LastSeen.Format(time.RFC3339),
+			client.State,
+			c.server.queuedJobs(client.Identifier),
+			strings.Join(client.Groups, ","),
+			strings.Join(client.Tags, ","))
+	}
+}
+
+func (c *Console) showClient(clientID string) {
+	client, exists := c.server.Client(clientID)
+	if !exists {
+		c.failf("Client with identifier '%s' not found", clientID)
+		return
+	}
+	if c.json {
+		c.writeJSON(client)
+		return
+	}
+
+	fmt.Fprintf(c.out, "Identifier:  %s\n", client.Identifier)
+	seen := fmt.Sprintf("%s, last seen %s from %s", client.State, client.LastSeen.Format(time.RFC3339), client.SourceIP)
+	if client.Transport != "" {
+		seen += " over " + string(client.Transport)
+	}
+	if client.Listener != "" {
+		seen += " to " + client.Listener
+	}
+	if client.Codec != "" {
+		seen += " using " + string(client.Codec)
+	}
+	fmt.Fprintf(c.out, "State:       %s\n", seen)
+	if client.ProbeInterval > 0 {
+		fmt.Fprintf(c.out, "Interval:    %s\n", client.ProbeInterval)
+	}
+	fmt.Fprintf(c.out, "Groups:      %s\n", strings.Join(client.Groups, ","))
+	fmt.Fprintf(c.out, "Tags:        %s\n", strings.Join(client.Tags, ","))
+	facts := client.Facts
+	if facts == nil {
+		fmt.Fprintln(c.out, "Host facts not reported yet")
+		return
+	}
+	fmt.Fprintf(c.out, "Hostname:    %s\n", facts.Hostname)
+	fmt.Fprintf(c.out, "OS:          %s/%s, kernel %s\n", facts.OS, facts.Arch, facts.Kernel)
+	fmt.Fprintf(c.out, "Version:     %s\n", facts.Version)
+	fmt.Fprintf(c.out, "Uptime:      %s\n", facts.Uptime(time.Now()))
+	fmt.Fprintf(c.out, "Machine ID:  %s\n", facts.MachineID)
+	fmt.Fprintf(c.out, "Virtualized: %t\n", facts.Virtualized)
+}
+
+// showTags lists the tags clients advertise with the clients advertising them,
+// only the given tag if there is one
+func (c *Console) showTags(only []string) {
+	tags := make(map[string][]string)
+	for _, client := range c.server.Clients() {
+		for _, tag := range client.Tags {
+			if len(only) == 0 || only[0] == tag {
+				tags[tag] = append(tags[tag], client.Identifier)
+			}
+		}
+	}
+	if c.json {
+		c.writeJSON(tags)
+		return
+	}
+	if len(tags) == 0 {
+		fmt.Fprintln(c.out, "No tagged clients")
+		return
+	}
+
+	names := make([]string, 0, len(tags))
+	for tag := range tags {
+		names = append(names, tag)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(c.out, "%-20s %s\n", "Tag", "Clients")
+	fmt.Fprintln(c.out, strings.Repeat("-", 100))
+	for _, tag := range names {
+		fmt.Fprintf(c.out, "%-20s %s\n", tag, strings.Join(tags[tag], ","))
+	}
+}
+
+func (c *Console) showEnrolments() {
+	requests := c.server.PendingEnrolments()
+	if c.json {
+		c.writeJSON(requests)
+		return
+	}
+	if len(requests) == 0 {
+		fmt.Fprintln(c.out, "No pending enrolments")
+		return
+	}
+
+	fmt.Fprintf(c.out, "%-20s %-20s %-18s %-8s %-30s\n", "Identifier", "IP Address", "Fingerprint", "Attempts", "Last Seen")
+	fmt.Fprintln(c.out, strings.Repeat("-", 100))
+
+	for _, req := range requests {
+		id := req.Identifier
+		if req.Conflict {
+			id += " (key changed)"
+		}
+		fmt.Fprintf(c.out, "%-20s %-20s %-18s %-8d %-30s\n",
+			id,
+			req.SourceIP.String(),
+			req.Fingerprint,
+			req.Attempts,
+			req.LastSeen.Format(time.RFC3339))
+	}
+}
+
+func (c *Console) executeCommand(clientID string, args []string) {
+	var opts JobOptions
+	if len(args) > 1 && args[0] == "--timeout" {
+		timeout, err := time.ParseDuration(args[1])
+		if err != nil {
+			c.failf("Invalid option %s %s: %v", args[0], args[1], err)
+			return
+		}
+		opts.Timeout = timeout
+		args = args[2:]
+	}
+	if len(args) == 0 {
+		c.failf("Usage: execute <client-identifier> [--timeout duration] <command>")
+		return
+	}
+	cmd := strings.Join(args, " ")
+
+	client, exists := c.server.Client(clientID)
+	if !exists {
+		c.failf("Client with identifier '%s' not found", clientID)
+		return
+	}
+
+	// Warn when the client missed probes
+	if client.State != ClientStateHealthy && !c.json {
+		fmt.Fprintf(c.out, "Client '%s' is %s, not seen since %s\n", clientID, client.State, client.LastSeen.Format(time.RFC3339))
+		fmt.Fprintln(c.out, "Command will be sent when client sends next probe")
+	}
+
+	// Append to the client's job queue
+	job, err := c.server.EnqueueWith(c.operator, clientID, cmd, opts)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	c.jobs = append(c.jobs, job.ID)
+	if c.json {
+		snapshot, _ := c.server.Job(job.ID)
+		c.writeJSON(snapshot)
+		return
+	}
+	fmt.Fprintf(c.out, "Command '%s' queued for client '%s' as job %d\n", cmd, clientID, job.ID)
+}
+
+// cancelJob cancels a job and tells whether the client still has to kill its command
+func (c *Console) cancelJob(id uint64) {
+	job, err := c.server.CancelJob(c.operator, id)
+	switch {
+	case err != nil:
+		c.fail(err)
+	case c.json:
+		c.writeJSON(job)
+	case job.CancelRequested:
+		fmt.Fprintf(c.out, "Job %d will be killed on '%s' at its next probe\n", id, job.ClientID)
+	case job.State == JobStateCancelled:
+		fmt.Fprintf(c.out, "Job %d cancelled\n", id)
+	default:
+		fmt.Fprintf(c.out, "Job %d already %s\n", id, job.State)
+	}
+}
+
+// startRollout parses the rollout flags following a @group target and starts the rollout
+func (c *Console) startRollout(target string, args []string) {
+	var opts RolloutOptions
+	for len(args) > 1 && strings.HasPrefix(args[0], "--") {
+		if err := setRolloutOption(&opts, args[0], args[1]); err != nil {
+			c.failf("Invalid option %s %s: %v", args[0], args[1], err)
+			return
+		}
+		args = args[2:]
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "--") {
+		c.failf("Usage: execute @<group> [--batch n] [--pause duration] [--max-failures n] [--timeout duration] [--health-check duration] <command>")
+		return
+	}
+
+	rollout, err := c.server.StartRollout(c.operator, target, strings.Join(args, " "), opts)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	c.rollouts = append(c.rollouts, rollout.ID)
+	if c.json {
+		c.writeJSON(rollout)
+		return
+	}
+	batches := rollout.Hosts[len(rollout.Hosts)-1].Batch
+	fmt.Fprintf(c.out, "Rollout %d of '%s' started on %d clients in %d batches, follow it with 'rollout %d'\n",
+		rollout.ID, rollout.Command, len(rollout.Hosts), batches, rollout.ID)
+}
+
+// setRolloutOption sets the rollout option of a console flag
+func setRolloutOption(opts *RolloutOptions, flag string, value string) error {
+	var err error
+	switch flag {
+	case "--batch":
+		opts.BatchSize, err = strconv.Atoi(value)
+	case "--pause":
+		opts.Pause, err = time.ParseDuration(value)
+	case "--max-failures":
+		opts.MaxFailures, err = strconv.Atoi(value)
+	case "--timeout":
+		opts.Timeout, err = time.ParseDuration(value)
+	case "--health-check":
+		opts.HealthCheck, err = parseHealthCheck(value)
+	default:
+		err = fmt.Errorf("unknown option")
+	}
+	return err
+}
+
+// upgrade parses the upgrade flags and queues an upgrade job for a client, or starts
+// an upgrade rollout for targets such as @canary,@web
+func (c *Console) upgrade(target string, args []string) {
+	var req UpgradeRequest
+	var opts RolloutOptions
+	for len(args) > 1 && strings.HasPrefix(args[0], "--") {
+		var err error
+		switch args[0] {
+		case "--version":
+			req.Version = args[1]
+		case "--server":
+			req.Server = args[1]
+		default:
+			err = setRolloutOption(&opts, args[0], args[1])
+		}
+		if err != nil {
+			c.failf("Invalid option %s %s: %v", args[0], args[1], err)
+			return
+		}
+		args = args[2:]
+	}
+	if len(args) > 0 {
+		c.failf("Usage: upgrade <client-identifier|@group[,@group...]> [--version v] [--server url] [--timeout duration]\n" +
+			"       [--batch n] [--pause duration] [--max-failures n] [--health-check duration]")
+		return
+	}
+
+	if !strings.HasPrefix(target, "@") {
+		job, err := c.server.EnqueueUpgrade(c.operator, target, req, JobOptions{Timeout: opts.Timeout})
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.jobs = append(c.jobs, job.ID)
+		if c.json {
+			snapshot, _ := c.server.Job(job.ID)
+			c.writeJSON(snapshot)
+			return
+		}
+		fmt.Fprintf(c.out, "Upgrade of '%s' queued as job %d, follow it with 'job %d'\n", target, job.ID, job.ID)
+		return
+	}
+
+	rollout, err := c.server.StartUpgradeRollout(c.operator, strings.Split(target, ","), req, opts)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	c.rollouts = append(c.rollouts, rollout.ID)
+	if c.json {
+		c.writeJSON(rollout)
+		return
+	}
+	batches := rollout.Hosts[len(rollout.Hosts)-1].Batch
+	fmt.Fprintf(c.out, "Upgrade rollout %d started on %d clients of %s in %d batches, follow it with 'rollout %d'\n",
+		rollout.ID, len(rollout.Hosts), rollout.Target, batches, rollout.ID)
+}
+
+func (c *Console) showRollouts() {
+	rollouts := c.server.Rollouts()
+	if c.json {
+		c.writeJSON(rollouts)
+		return
+	}
+	if len(rollouts) == 0 {
+		fmt.Fprintln(c.out, "No rollouts")
+		return
+	}
+
+	fmt.Fprintf(c.out, "%-6s %-16s %-10s %-9s %-7s %-7s %s\n", "ID", "Target", "State", "Succeeded", "Failed", "Skipped", "Command")
+	fmt.Fprintln(c.out, strings.Repeat("-", 100))
+
+	for _, r := range rollouts {
+		fmt.Fprintf(c.out, "%-6d %-16s %-10s %-9d %-7d %-7d %s\n",
+			r.ID, r.Target, r.State, r.Succeeded, r.Failed, r.Skipped, r.Command)
+	}
+}
+
+func (c *Console) showRollout(id uint64) {
+	r, exists := c.server.Rollout(id)
+	if !exists {
+		c.failf("Rollout %d not found", id)
+		return
+	}
+	if c.json {
+		c.writeJSON(r)
+		return
+	}
+
+	fmt.Fprintf(c.out, "Rollout %d of '%s' to %s by %s: %s, %d succeeded, %d failed, %d skipped of %d clients\n",
+		r.ID, r.Command, r.Target, r.Operator, r.State, r.Succeeded, r.Failed, r.Skipped, len(r.Hosts))
+	fmt.Fprintf(c.out, "%-20s %-5s %-8s %-10s %-5s %s\n", "Identifier", "Batch", "Job", "State", "Exit", "Result")
+	fmt.Fprintln(c.out, strings.Repeat("-", 100))
+
+	for _, host := range r.Hosts {
+		state, result := string(host.State), host.Output+host.Error
+		switch {
+		case host.Skipped != "":
+			state, result = "skipped", host.Skipped
+		case host.Unhealthy != "":
+			state, result = "unhealthy", host.Unhealthy
+		}
+		// Only the first line of the result fits the table
+		result, _, _ = strings.Cut(strings.TrimSpace(result), "\n")
+		fmt.Fprintf(c.out, "%-20s %-5d %-8d %-10s %-5d %s\n",
+			host.ClientID, host.Batch, host.JobID, state, host.ExitCode, result)
+	}
+}
+
+// showJobs lists the jobs of a client, or of all clients if clientID is empty
+func (c *Console) showJobs(clientID string) {
+	jobs := c.server.Jobs(clientID)
+	if c.json {
+		c.writeJSON(jobs)
+		return
+	}
+	if len(jobs) == 0 {
+		fmt.Fprintln(c.out, "No jobs")
+		return
+	}
+
+	fmt.Fprintf(c.out, "%-8s %-20s %-10s %-5s %-26s %s\n", "ID", "Identifier", "State", "Exit", "Created", "Command")
+	fmt.Fprintln(c.out, strings.Repeat("-", 100))
+
+	for _, job := range jobs {
+		exit := "-"
+		if job.Finished() {
+			exit = strconv.Itoa(job.ExitCode)
+		}
+		fmt.Fprintf(c.out, "%-8d %-20s %-10s %-5s %-26s %s\n",
+			job.ID, job.ClientID, job.State, exit, job.CreatedAt.Format(time.RFC3339), job.Command)
+	}
+}
+
+func (c *Console) showJob(id uint64) {
+	job, exists := c.server.Job(id)
+	if !exists {
+		c.failf("Job %d not found", id)
+		return
+	}
+	if c.json {
+		c.writeJSON(job)
+		return
+	}
+
+	fmt.Fprintf(c.out, "Job %d '%s' on '%s' by %s: %s", job.ID, job.Command, job.ClientID, job.Operator, job.State)
+	if job.Finished() {
+		fmt.Fprintf(c.out, ", exit code %d", job.ExitCode)
+	} else if job.CancelRequested {
+		fmt.Fprint(c.out, ", cancelling")
+	} else if job.Progress != nil {
+		fmt.Fprintf(c.out, ", %s", byteSize(job.Progress.Done))
+		if job.Progress.Total > 0 {
+			fmt.Fprintf(c.out, " of %s", byteSize(job.Progress.Total))
+		}
+	}
+	fmt.Fprintln(c.out)
+	if job.Error != "" {
+		fmt.Fprintln(c.out, "Error:", job.Error)
+	}
+	if job.Output == "" {
+		return
+	}
+	// Operations return JSON which reads better as a table
+	if IsOperation(job.Command) && job.ExitCode == 0 {
+		if err := RenderTable(c.out, job.Output); err == nil {
+			return
+		}
+	}
+	fmt.Fprintln(c.out, strings.TrimRight(job.Output, "\n"))
+}
+
+// showResult prints the output of a finished job as it is, so scripts can process it.
+// The command fails unless the job succeeded.
+func (c *Console) showResult(id uint64) {
+	job, exists := c.server.Job(id)
+	switch {
+	case !exists:
+		c.failf("Job %d not found", id)
+		return
+	case !job.Finished():
+		c.failf("Job %d is still %s", id, job.State)
+		return
+	}
+
+	if c.json {
+		c.writeJSON(job)
+	} else {
+		fmt.Fprint(c.out, job.Output)
+	}
+	if job.State != JobStateSucceeded {
+		// The output already went to the console, only report the failure in text mode
+		c.err = fmt.Errorf("job %d %s: %s", id, job.State, job.Error)
+		if !c.json {
+			fmt.Fprintln(c.out, c.err)
+		}
+	}
+}
+
+// wait blocks until the given jobs finish, or the jobs and rollouts the console started
+// since the last wait if none are given. The command fails unless all of them succeeded.
+func (c *Console) wait(args []string) {
+	var timeout time.Duration
+	if len(args) > 1 && args[0] == "--timeout" {
+		var err error
+		if timeout, err = time.ParseDuration(args[1]); err != nil || timeout <= 0 {
+			c.failf("Invalid option %s %s", args[0], args[1])
+			return
+		}
+		args = args[2:]
+	}
+	jobIDs, rolloutIDs := c.jobs, c.rollouts
+	if len(args) > 0 {
+		jobIDs, rolloutIDs = nil, nil
+		for _, arg := range args {
+			id, err := strconv.ParseUint(arg, 10, 64)
+			if err != nil {
+				c.failf("Invalid job id: %s", arg)
+				return
+			}
+			jobIDs = append(jobIDs, id)
+		}
+	} else {
+		c.jobs, c.rollouts = nil, nil
+	}
+
+	// Stop waiting when the server stops
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	stopped := ctx.Done()
+	go func() {
+		select {
+		case <-c.server.stopCh:
+			stop()
+		case <-stopped:
+		}
+	}()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	result := waitResult{Jobs: []Job{}}
+	failed := 0
+	for _, id := range jobIDs {
+		job, err := c.server.Wait(ctx, id)
+		if err != nil {
+			c.failf("Failed to wait for job %d: %v", id, err)
+			return
+		}
+		result.Jobs = append(result.Jobs, *job)
+		if job.State != JobStateSucceeded {
+			failed++
+		}
+	}
+	for _, id := range rolloutIDs {
+		rollout, err := c.server.WaitRollout(ctx, id)
+		if err != nil {
+			c.failf("Failed to wait for rollout %d: %v", id, err)
+			return
+		}
+		result.Rollouts = append(result.Rollouts, rollout)
+		// A rollout that skipped clients did not reach all of them
+		if rollout.State != RolloutStateCompleted || rollout.Failed > 0 || rollout.Skipped > 0 || rollout.Succeeded == 0 {
+			failed++
+		}
+	}
+
+	if c.json {
+		c.writeJSON(result)
+	} else {
+		for _, job := range result.Jobs {
+			fmt.Fprintf(c.out, "Job %d '%s' on '%s': %s, exit code %d\n", job.ID, job.Command, job.ClientID, job.State, job.ExitCode)
+		}
+		for _, r := range result.Rollouts {
+			fmt.Fprintf(c.out, "Rollout %d of '%s' to %s: %s, %d succeeded, %d failed, %d skipped\n",
+				r.ID, r.Command, r.Target, r.State, r.Succeeded, r.Failed, r.Skipped)
+		}
+	}
+	if failed > 0 {
+		c.err = fmt.Errorf("%d of %d did not succeed", failed, len(jobIDs)+len(rolloutIDs))
+		if !c.json {
+			fmt.Fprintln(c.out, c.err)
+		}
+	}
+}
+
+func (c *Console) showOperations() {
+	if c.json {
+		c.writeJSON(Operations())
+		return
+	}
+	fmt.Fprintf(c.out, "%-16s %-40s %s\n", "Operation", "Arguments", "Description")
+	fmt.Fprintln(c.out, strings.Repeat("-", 100))
+
+	for _, op := range Operations() {
+		args := make([]string, 0, len(op.Args))
+		for _, arg := range op.Args {
+			if arg.Required {
+				args = append(args, arg.Name+"=")
+			} else {
+				args = append(args, "["+arg.Name+"=]")
+			}
+		}
+		fmt.Fprintf(c.out, "%-16s %-40s %s\n", OperationPrefix+op.Name, strings.Join(args, " "), op.Description)
+	}
+}
+
+func (c *Console) showTransfers() {
+	transfers := c.server.Transfers()
+	if c.json {
+		c.writeJSON(transfers)
+		return
+	}
+	if len(transfers) == 0 {
+		fmt.Fprintln(c.out, "No transfers")
+		return
+	}
+
+	fmt.Fprintf(c.out, "%-6s %-20s %-4s %-10s %-30s %s\n", "ID", "Identifier", "Dir", "State", "Progress", "Remote path")
+	fmt.Fprintln(c.out, strings.Repeat("-", 100))
+
+	for _, t := range transfers {
+		fmt.Fprintf(c.out, "%-6d %-20s %-4s %-10s %-30s %s\n",
+			t.ID, t.ClientID, t.Direction, t.State, progressBar(t), t.RemotePath)
+		if t.Error != "" {
+			fmt.Fprintf(c.out, "%-6s %s\n", "", t.Error)
+		}
+	}
+}
+
+func (c *Console) showListeners() {
+	listeners := c.server.ListenerStats()
+	if c.json {
+		c.writeJSON(listeners)
+		return
+	}
+
+	fmt.Fprintf(c.out, "%-40s %-8s %-10s %-10s %-10s %-10s %s\n", "Address", "Clients", "Received", "Handled", "Dropped", "In", "Out")
+	fmt.Fprintln(c.out, strings.Repeat("-", 100))
+
+	for _, l := range listeners {
+		fmt.Fprintf(c.out, "%-40s %-8d %-10d %-10d %-10d %-10s %s\n",
+			l.Address, l.Clients, l.Receive.Received, l.Receive.Handled, l.Receive.Dropped(), byteSize(int64(l.BytesIn)), byteSize(int64(l.BytesOut)))
+	}
+}
+
+// progressBar draws how much of a transfer was copied, such as [#####-----] 50% of 2.0 MiB
+func progressBar(t Transfer) string {
+	const width = 10
+	done := int(t.Progress() * width)
+	return fmt.Sprintf("[%s%s] %3d%% of %s", strings.Repeat("#", done), strings.Repeat("-", width-done),
+		int(t.Progress()*100), byteSize(t.Size))
+}
+
+// byteSize formats a number of bytes with a binary unit
+func byteSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, unit := float64(n)/1024, "KiB"
+	for _, next := range []string{"MiB", "GiB", "TiB"} {
+		if value < 1024 {
+			break
+		}
+		value, unit = value/1024, next
+	}
+	return fmt.Sprintf("%.1f %s", value, unit)
+}
+
+// export writes a snapshot of what the server tracks as indented JSON to path,
+// or to the console if path is -
+func (c *Console) export(what string, path string) {
+	var v any
+	switch what {
+	case "clients":
+		v = c.server.Clients()
+	case "jobs":
+		v = c.server.Jobs("")
+	case "rollouts":
+		v = c.server.Rollouts()
+	case "transfers":
+		v = c.server.Transfers()
+	default:
+		c.failf("Cannot export %s, choose clients, jobs, rollouts or transfers", what)
+		return
+	}
+
+	if path == "-" {
+		c.writeJSON(v)
+		return
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o600); err != nil {
+		c.fail(err)
+		return
+	}
+	c.printf("Exported %s to %s\n", what, path)
+}
+
+// showHistory prints the last limit commands entered at the prompt
+func (c *Console) showHistory(limit int) {
+	history := c.history[len(c.history)-limit:]
+	if c.json {
+		c.writeJSON(append([]string{}, history...))
+		return
+	}
+	first := len(c.history) - limit + 1
+	for i, command := range history {
+		fmt.Fprintf(c.out, "%5d  %s\n", first+i, command)
+	}
+}
+
+func (c *Console) verifyAudit() {
+	if c.server.config.AuditFile == "" {
+		c.failf("No audit log configured")
+		return
+	}
+	entries, err := VerifyAuditLog(c.server.config.AuditFile)
+	if err != nil {
+		c.failf("Audit log verification failed after %d entries: %v", entries, err)
+		return
+	}
+	c.printf("Audit log intact, %d entries\n", entries)
+}
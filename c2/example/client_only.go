@@ -12,6 +12,8 @@ import (
 func main() {
 	// Hardcoded parameters
 	protocolType := c2.ProtocolType("none") // Options: none, dns, ntp
+	transport := c2.TransportUDP            // Options: udp, tls
+	serverCA := "server_ca.pem"             // CA of the server certificate for the TLS transport
 	domain := "example.com"                 // Domain for DNS protocol
 	identifier := "test-client"             // Client identifier
 	address := "localhost:9003"             // Server address
@@ -24,6 +26,17 @@ func main() {
 		c2.WithClientIdentifier(identifier),
 		c2.WithClientInterval(interval),
 		c2.WithClientProtocol(protocolType),
+		c2.WithClientIdentityFile("client_identity.pem"), // Approve on the server with 'approve <id>'
+	}
+
+	// The TLS transport verifies the server certificate, obfuscation only applies to UDP
+	if transport == c2.TransportTLS {
+		pool, err := c2.LoadCertPool(serverCA)
+		if err != nil {
+			fmt.Printf("Failed to load server CA: %v\n", err)
+			return
+		}
+		options = append(options, c2.WithClientTransport(transport), c2.WithClientRootCAs(pool))
 	}
 
 	// Add domain option only for DNS protocol
@@ -3,8 +3,11 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"os"
+	"strings"
 
 	"github.com/b1gcat/core/c2"
 )
@@ -13,6 +16,19 @@ func main() {
 	// Define flag parameters
 	key := flag.String("key", "1234567890123456", "Encryption key (must be 16 characters)")
 	address := flag.String("address", "0.0.0.0:123", "Server listen address")
+	listen := flag.String("listen", "", "Further comma separated UDP listen addresses, e.g. [::]:123 (optional)")
+	master := flag.String("master", "", "Master secret for per-client keys (optional)")
+	httpAddress := flag.String("http", "", "HTTP management API address, e.g. :9080 (optional)")
+	token := flag.String("token", "", "Bearer token for the HTTP management API")
+	audit := flag.String("audit", "server_audit.jsonl", "Audit log of operator actions, empty to disable")
+	state := flag.String("state", "server_state.jsonl", "File persisting clients and jobs, empty to keep them in memory")
+	tlsAddress := flag.String("tls", "", "Address of the TLS transport, e.g. 0.0.0.0:9443 (optional)")
+	certFile := flag.String("cert", "", "PEM certificate of the TLS transport, required with -tls")
+	keyFile := flag.String("cert-key", "", "PEM private key of the TLS certificate")
+	clientCA := flag.String("client-ca", "", "PEM CA certificates TLS clients must present a certificate from (optional)")
+	script := flag.String("script", "", "File of console commands to run instead of prompting, - for standard input")
+	output := flag.String("output", "text", "Console output, text or json")
+	history := flag.String("history", ".c2_history", "File keeping console history across sessions, empty to disable")
 	flag.Parse()
 
 	// Validate key length
@@ -22,10 +38,54 @@ func main() {
 	}
 
 	// Create server with flag parameters
-	server, err := c2.NewServer(
+	options := []c2.Option{
 		c2.WithServerKey(*key),
 		c2.WithServerAddress(*address),
-	)
+		c2.WithServerConsoleOutput(c2.OutputFormat(*output)),
+		c2.WithServerConsoleScript(*script),
+		c2.WithServerConsoleHistory(*history),
+	}
+	if *listen != "" {
+		options = append(options, c2.WithServerListenAddress(strings.Split(*listen, ",")...))
+	}
+	if *audit != "" {
+		options = append(options, c2.WithServerAuditFile(*audit))
+	}
+	if *state != "" {
+		options = append(options, c2.WithServerStateFile(*state))
+	}
+	if *master != "" {
+		options = append(options,
+			c2.WithServerMasterKey(*master),
+			c2.WithServerKeyStateFile("server_keys.json"),
+		)
+	}
+	if *tlsAddress != "" {
+		options = append(options, c2.WithServerTLSAddress(*tlsAddress))
+	}
+	if *certFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			fmt.Printf("Failed to load TLS certificate: %v\n", err)
+			return
+		}
+		options = append(options, c2.WithServerCertificate(cert))
+	}
+	if *clientCA != "" {
+		pool, err := c2.LoadCertPool(*clientCA)
+		if err != nil {
+			fmt.Printf("Failed to load client CAs: %v\n", err)
+			return
+		}
+		options = append(options, c2.WithServerClientCAs(pool))
+	}
+	if *httpAddress != "" {
+		options = append(options,
+			c2.WithServerHTTPAddress(*httpAddress),
+			c2.WithServerAPIToken("admin", *token),
+		)
+	}
+	server, err := c2.NewServer(options...)
 	if err != nil {
 		fmt.Printf("Failed to create server: %v\n", err)
 		return
@@ -33,6 +93,7 @@ func main() {
 
 	if err := server.Start(); err != nil {
 		fmt.Printf("Server stopped with error: %v\n", err)
+		os.Exit(1)
 	}
 
 }
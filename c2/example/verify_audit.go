@@ -0,0 +1,24 @@
+//go:build ignore
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/b1gcat/core/c2"
+)
+
+func main() {
+	// Define flag parameters
+	path := flag.String("audit", "server_audit.jsonl", "Audit log to verify")
+	flag.Parse()
+
+	entries, err := c2.VerifyAuditLog(*path)
+	if err != nil {
+		fmt.Printf("Audit log verification failed after %d entries: %v\n", entries, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Audit log intact, %d entries\n", entries)
+}
@@ -0,0 +1,55 @@
+//go:build !windows
+
+package c2
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// shellCommand prepares cmd for the system shell, optionally as another user.
+// The command runs in its own process group so a timeout kills its children too.
+func shellCommand(ctx context.Context, cmd string, runAs string) (*exec.Cmd, error) {
+	c := exec.CommandContext(ctx, "sh", "-c", cmd)
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	c.Cancel = func() error {
+		return syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+	}
+	c.WaitDelay = time.Second
+
+	if runAs == "" {
+		return c, nil
+	}
+
+	u, err := user.Lookup(runAs)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unknown run-as user %s", ErrPolicyViolation, runAs)
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid uid of %s", ErrPolicyViolation, runAs)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid gid of %s", ErrPolicyViolation, runAs)
+	}
+	c.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	c.Dir = u.HomeDir
+	return c, nil
+}
+
+// restartExecutable replaces the process with a new run of its executable, which
+// picks up a binary an upgrade installed
+func restartExecutable() error {
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(path, os.Args, os.Environ())
+}
@@ -0,0 +1,47 @@
+//go:build windows
+
+package c2
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// shellCommand prepares cmd for the system shell. Running as another user
+// is not supported on Windows, so such policies refuse every command.
+// A timeout or cancellation kills the whole process tree of the command.
+func shellCommand(ctx context.Context, cmd string, runAs string) (*exec.Cmd, error) {
+	if runAs != "" {
+		return nil, fmt.Errorf("%w: run-as is not supported on windows", ErrPolicyViolation)
+	}
+	c := exec.CommandContext(ctx, "cmd.exe", "/C", cmd)
+	c.Cancel = func() error {
+		kill := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(c.Process.Pid))
+		if err := kill.Run(); err != nil {
+			return c.Process.Kill()
+		}
+		return nil
+	}
+	c.WaitDelay = time.Second
+	return c, nil
+}
+
+// restartExecutable starts a new run of the executable, which picks up a binary an
+// upgrade installed, and exits. Windows cannot replace a running process.
+func restartExecutable() error {
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
@@ -0,0 +1,162 @@
+package c2
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	machineid "github.com/b1gcat/core/machineID"
+)
+
+// probeAckWantFacts is set in the payload of a probe ack when the server has no host facts of the client
+const probeAckWantFacts byte = 0x01
+
+// HostFacts describes the host a client runs on
+type HostFacts struct {
+	Hostname  string    `json:"hostname,omitempty"`
+	OS        string    `json:"os,omitempty"`
+	Arch      string    `json:"arch,omitempty"`
+	Kernel    string    `json:"kernel,omitempty"`
+	Version   string    `json:"version,omitempty"` // Version of the client binary
+	BootTime  time.Time `json:"boot_time,omitempty"`
+	MachineID string    `json:"machine_id,omitempty"`
+	// Virtualized is set when the host is a virtual machine or container
+	Virtualized bool `json:"virtualized"`
+}
+
+// Uptime returns how long the host has been running at now, zero if unknown
+func (f *HostFacts) Uptime(now time.Time) time.Duration {
+	if f == nil || f.BootTime.IsZero() {
+		return 0
+	}
+	return now.Sub(f.BootTime).Truncate(time.Second)
+}
+
+// staticFacts caches the facts that are slow to collect and cannot change while the client runs
+var staticFacts = sync.OnceValue(func() HostFacts {
+	facts := HostFacts{
+		OS:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		Virtualized: machineid.IsVm(),
+	}
+	facts.MachineID, _ = machineid.GetMachineID()
+	return facts
+})
+
+// collectHostFacts returns the current facts of the host the client runs on
+func collectHostFacts(version string) HostFacts {
+	facts := staticFacts()
+	facts.Version = version
+	facts.Hostname, _ = os.Hostname()
+	facts.Kernel = kernelVersion()
+	facts.BootTime = bootTime()
+	return facts
+}
+
+// buildVersion returns the module version the client binary was built from
+func buildVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		return info.Main.Version
+	}
+	return ""
+}
+
+// clientFilterKeys lists the keys clients can be filtered by
+var clientFilterKeys = []string{"state", "group", "tag", "hostname", "os", "arch", "kernel", "version", "machine_id", "virtualized"}
+
+// ClientFilter selects clients by glob patterns of their state, groups, tags and host facts
+type ClientFilter map[string]string
+
+// ParseClientFilter parses terms of the form key=pattern, for example "os=linux" or "hostname=web-*"
+func ParseClientFilter(terms []string) (ClientFilter, error) {
+	filter := make(ClientFilter, len(terms))
+	for _, term := range terms {
+		key, pattern, ok := strings.Cut(term, "=")
+		if !ok || !slices.Contains(clientFilterKeys, key) {
+			return nil, fmt.Errorf("invalid filter %q, expected key=pattern with key one of %s",
+				term, strings.Join(clientFilterKeys, ", "))
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid filter %q: %w", term, err)
+		}
+		filter[key] = pattern
+	}
+	return filter, nil
+}
+
+// Matches reports whether client satisfies every term of the filter
+func (f ClientFilter) Matches(client ClientInfo) bool {
+	for key, pattern := range f {
+		var values []string
+		switch key {
+		case "state":
+			values = []string{string(client.State)}
+		case "group":
+			// Groups match tags as well, like rollout targets
+			values = append(slices.Clone(client.Groups), client.Tags...)
+		case "tag":
+			values = client.Tags
+		}
+		if facts := client.Facts; facts != nil {
+			switch key {
+			case "hostname":
+				values = []string{facts.Hostname}
+			case "os":
+				values = []string{facts.OS}
+			case "arch":
+				values = []string{facts.Arch}
+			case "kernel":
+				values = []string{facts.Kernel}
+			case "version":
+				values = []string{facts.Version}
+			case "machine_id":
+				values = []string{facts.MachineID}
+			case "virtualized":
+				values = []string{strconv.FormatBool(facts.Virtualized)}
+			}
+		}
+
+		if !slices.ContainsFunc(values, func(value string) bool {
+			ok, _ := path.Match(pattern, value)
+			return ok
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterClients returns the clients matching filter sorted by identifier
+func (s *Server) FilterClients(filter ClientFilter) []ClientInfo {
+	var clients []ClientInfo
+	for _, client := range s.Clients() {
+		if filter.Matches(client) {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// setClientFacts records the host facts and probe interval a client reported on its probe
+func (s *Server) setClientFacts(clientID string, facts HostFacts, interval time.Duration) {
+	s.clientsMu.Lock()
+	client, exists := s.clients[clientID]
+	if !exists || (client.Facts != nil && *client.Facts == facts && client.ProbeInterval == interval) {
+		s.clientsMu.Unlock()
+		return
+	}
+	client.Facts = &facts
+	client.ProbeInterval = interval
+	snapshot := *client
+	s.clientsMu.Unlock()
+
+	s.config.Logger.Debugf("server: %s reported host facts: %s %s/%s %s", clientID, facts.Hostname, facts.OS, facts.Arch, facts.Kernel)
+	s.persistClient(snapshot)
+}
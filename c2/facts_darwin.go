@@ -0,0 +1,27 @@
+//go:build darwin
+
+package c2
+
+import (
+	"encoding/binary"
+	"syscall"
+	"time"
+)
+
+// kernelVersion returns the release of the running kernel
+func kernelVersion() string {
+	release, err := syscall.Sysctl("kern.osrelease")
+	if err != nil {
+		return ""
+	}
+	return release
+}
+
+// bootTime returns when the host booted, read from the kern.boottime timeval
+func bootTime() time.Time {
+	raw, err := syscall.Sysctl("kern.boottime")
+	if err != nil || len(raw) < 8 {
+		return time.Time{}
+	}
+	return time.Unix(int64(binary.LittleEndian.Uint64([]byte(raw[:8]))), 0)
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !windows
+
+package c2
+
+import "time"
+
+// kernelVersion is unknown on this platform
+func kernelVersion() string {
+	return ""
+}
+
+// bootTime is unknown on this platform
+func bootTime() time.Time {
+	return time.Time{}
+}
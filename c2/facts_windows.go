@@ -0,0 +1,30 @@
+//go:build windows
+
+package c2
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+)
+
+var procGetTickCount64 = syscall.NewLazyDLL("kernel32.dll").NewProc("GetTickCount64")
+
+// kernelVersion returns the version of the running Windows kernel
+func kernelVersion() string {
+	v, err := syscall.GetVersion()
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d.%d.%d", byte(v), byte(v>>8), uint16(v>>16))
+}
+
+// bootTime returns when the host booted, derived from the milliseconds since boot
+func bootTime() time.Time {
+	ms, _, _ := procGetTickCount64.Call()
+	if ms == 0 {
+		return time.Time{}
+	}
+	// Round so the boot time stays the same across calls
+	return time.Now().Add(-time.Duration(ms) * time.Millisecond).Round(time.Minute)
+}
@@ -0,0 +1,273 @@
+package c2
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxDatagramSize is the largest UDP payload we ever read
+	maxDatagramSize = 65535
+	// fragmentWindow is how many fragments are sent before waiting for acknowledgements
+	fragmentWindow = 32
+	// fragmentRetries is how many times unacknowledged fragments are retransmitted
+	fragmentRetries = 5
+	// fragmentAckTimeout is how long to wait for acknowledgements before retransmitting
+	fragmentAckTimeout = 1 * time.Second
+	// maxPartialMessages is how many incomplete messages one identifier may have in flight
+	maxPartialMessages = 16
+)
+
+// fragmenter splits large payloads into acknowledged fragments
+type fragmenter struct {
+	size    int
+	nextID  atomic.Uint32
+	mu      sync.Mutex
+	pending map[uint32]*outgoing
+}
+
+// outgoing tracks the acknowledgements of one fragmented message
+type outgoing struct {
+	mu        sync.Mutex
+	acked     []bool
+	remaining int
+	progress  chan struct{}
+	done      chan struct{}
+}
+
+// reassembler collects fragments into complete payloads
+type reassembler struct {
+	maxSize int
+	timeout time.Duration
+	mu      sync.Mutex
+	partial map[string]*partialMessage
+	// inflight counts the incomplete messages of each identifier
+	inflight map[string]int
+}
+
+// partialMessage holds the fragments of one message received so far
+type partialMessage struct {
+	identifier string
+	parts      [][]byte
+	// have marks the fragments received, parts alone cannot tell an empty fragment from a missing one
+	have     []bool
+	received int
+	size     int
+	updated  time.Time
+	// complete entries are kept until they expire so duplicates are not delivered twice
+	complete bool
+}
+
+// newFragmenter creates a fragmenter producing fragments of at most size payload bytes
+func newFragmenter(size int) *fragmenter {
+	f := &fragmenter{
+		size:    size,
+		pending: make(map[uint32]*outgoing),
+	}
+	// Random start so message IDs do not repeat across restarts
+	var seed [4]byte
+	rand.Read(seed[:])
+	f.nextID.Store(binary.BigEndian.Uint32(seed[:]))
+	return f
+}
+
+// send writes msg, fragmenting its payload and retransmitting until every fragment is acknowledged
+func (f *fragmenter) send(msg Message, write func(Message) error) error {
+	payload := msg.Payload
+	if len(payload) <= f.size {
+		return write(msg)
+	}
+
+	count := (len(payload) + f.size - 1) / f.size
+	if count > math.MaxUint16 {
+		return fmt.Errorf("fragment: payload of %d bytes is too large", len(payload))
+	}
+
+	id := f.nextID.Add(1)
+	out := &outgoing{
+		acked:     make([]bool, count),
+		remaining: count,
+		progress:  make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	f.mu.Lock()
+	f.pending[id] = out
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		delete(f.pending, id)
+		f.mu.Unlock()
+	}()
+
+	for attempt := 0; attempt <= fragmentRetries; attempt++ {
+		sent := 0
+		for i := 0; i < count; i++ {
+			if out.isAcked(i) {
+				continue
+			}
+
+			fragment := msg
+			fragment.MessageID = id
+			fragment.FragmentIndex = uint16(i)
+			fragment.FragmentCount = uint16(count)
+			fragment.Payload = payload[i*f.size : min((i+1)*f.size, len(payload))]
+			if err := write(fragment); err != nil {
+				return err
+			}
+
+			// Pace the sender so a burst does not overrun the receiver
+			sent++
+			if sent%fragmentWindow == 0 {
+				out.waitProgress(fragmentAckTimeout)
+			}
+		}
+
+		select {
+		case <-out.done:
+			return nil
+		case <-time.After(fragmentAckTimeout):
+		}
+	}
+
+	return fmt.Errorf("fragment: message %d not acknowledged after %d attempts", id, fragmentRetries+1)
+}
+
+// ack records the acknowledgement of one fragment
+func (f *fragmenter) ack(id uint32, index uint16) {
+	f.mu.Lock()
+	out, exists := f.pending[id]
+	f.mu.Unlock()
+	if exists {
+		out.ack(int(index))
+	}
+}
+
+// isAcked reports whether fragment i was acknowledged
+func (o *outgoing) isAcked(i int) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.acked[i]
+}
+
+// ack marks fragment i acknowledged and signals waiting senders
+func (o *outgoing) ack(i int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if i >= len(o.acked) || o.acked[i] {
+		return
+	}
+	o.acked[i] = true
+	o.remaining--
+	if o.remaining == 0 {
+		close(o.done)
+	}
+	select {
+	case o.progress <- struct{}{}:
+	default:
+	}
+}
+
+// waitProgress blocks until an acknowledgement arrives or the timeout passes
+func (o *outgoing) waitProgress(timeout time.Duration) {
+	select {
+	case <-o.progress:
+	case <-o.done:
+	case <-time.After(timeout):
+	}
+}
+
+// newReassembler creates a reassembler limited to maxSize bytes per message
+func newReassembler(maxSize int, timeout time.Duration) *reassembler {
+	return &reassembler{
+		maxSize:  maxSize,
+		timeout:  timeout,
+		partial:  make(map[string]*partialMessage),
+		inflight: make(map[string]int),
+	}
+}
+
+// add stores a fragment and returns the payload once the message is complete
+func (r *reassembler) add(msg Message, now time.Time) ([]byte, bool, error) {
+	count := int(msg.FragmentCount)
+	index := int(msg.FragmentIndex)
+	if count == 0 || index >= count {
+		return nil, false, fmt.Errorf("fragment: invalid fragment %d of %d", index, count)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expire(now)
+
+	key := fmt.Sprintf("%s/%d", msg.Identifier, msg.MessageID)
+	p, exists := r.partial[key]
+	if !exists {
+		if r.inflight[msg.Identifier] >= maxPartialMessages {
+			return nil, false, fmt.Errorf("fragment: too many incomplete messages from %s", msg.Identifier)
+		}
+		p = &partialMessage{identifier: msg.Identifier, parts: make([][]byte, count), have: make([]bool, count)}
+		r.partial[key] = p
+		r.inflight[msg.Identifier]++
+	}
+	p.updated = now
+
+	if p.complete {
+		// Retransmission of a message we already delivered
+		return nil, false, nil
+	}
+	if len(p.parts) != count {
+		return nil, false, fmt.Errorf("fragment: inconsistent fragment count for message %d", msg.MessageID)
+	}
+	if p.have[index] {
+		return nil, false, nil
+	}
+
+	p.size += len(msg.Payload)
+	if p.size > r.maxSize {
+		r.remove(key, p)
+		return nil, false, fmt.Errorf("fragment: message %d exceeds %d bytes", msg.MessageID, r.maxSize)
+	}
+	p.parts[index] = append([]byte(nil), msg.Payload...)
+	p.have[index] = true
+	p.received++
+	if p.received < count {
+		return nil, false, nil
+	}
+
+	payload := bytes.Join(p.parts, nil)
+	p.parts, p.have = nil, nil
+	p.complete = true
+	r.release(p.identifier)
+	return payload, true, nil
+}
+
+// expire drops messages that saw no fragment within the timeout; mu must be held
+func (r *reassembler) expire(now time.Time) {
+	for key, p := range r.partial {
+		if now.Sub(p.updated) > r.timeout {
+			r.remove(key, p)
+		}
+	}
+}
+
+// remove drops a message; mu must be held
+func (r *reassembler) remove(key string, p *partialMessage) {
+	delete(r.partial, key)
+	if !p.complete {
+		r.release(p.identifier)
+	}
+}
+
+// release stops counting an incomplete message of identifier; mu must be held
+func (r *reassembler) release(identifier string) {
+	r.inflight[identifier]--
+	if r.inflight[identifier] <= 0 {
+		delete(r.inflight, identifier)
+	}
+}
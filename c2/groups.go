@@ -0,0 +1,95 @@
+package c2
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	// AuditAssignGroup records an operator adding a client to a group
+	AuditAssignGroup AuditAction = "assign_group"
+	// AuditUnassignGroup records an operator removing a client from a group
+	AuditUnassignGroup AuditAction = "unassign_group"
+)
+
+// ErrInvalidGroup is returned for malformed group names and removals of groups a client is not in
+var ErrInvalidGroup = errors.New("invalid group")
+
+// AssignGroup adds a client to a group on behalf of operator, who needs an admin role
+func (s *Server) AssignGroup(operator string, clientID string, group string) error {
+	return s.changeGroup(operator, AuditAssignGroup, clientID, group)
+}
+
+// UnassignGroup removes a client from a group it was assigned to on behalf of operator.
+// Groups matched by configured identifier patterns cannot be removed.
+func (s *Server) UnassignGroup(operator string, clientID string, group string) error {
+	return s.changeGroup(operator, AuditUnassignGroup, clientID, group)
+}
+
+// changeGroup applies a group assignment, persists the client and audits the change
+func (s *Server) changeGroup(operator string, action AuditAction, clientID string, group string) error {
+	if group == "" || strings.ContainsAny(group, "@ \t") {
+		return fmt.Errorf("server: %w: %q", ErrInvalidGroup, group)
+	}
+	if err := s.authorizeAdmin(operator, action, clientID); err != nil {
+		return err
+	}
+
+	s.clientsMu.Lock()
+	client, exists := s.clients[clientID]
+	if !exists {
+		s.clientsMu.Unlock()
+		return fmt.Errorf("server: %w: %s", ErrUnknownClient, clientID)
+	}
+	assigned := slices.Contains(client.AssignedGroups, group)
+	// Build new slices, snapshots handed out earlier share the old ones
+	switch {
+	case action == AuditAssignGroup && !assigned:
+		client.AssignedGroups = append(slices.Clip(client.AssignedGroups), group)
+		slices.Sort(client.AssignedGroups)
+	case action == AuditUnassignGroup && assigned:
+		client.AssignedGroups = slices.DeleteFunc(slices.Clone(client.AssignedGroups), func(g string) bool { return g == group })
+	case action == AuditUnassignGroup:
+		s.clientsMu.Unlock()
+		return fmt.Errorf("server: %w: %s was not assigned to %s", ErrInvalidGroup, clientID, group)
+	}
+	client.Groups = s.groupsFor(clientID, client.AssignedGroups)
+	snapshot := *client
+	s.clientsMu.Unlock()
+
+	s.persistClient(snapshot)
+	s.audit(AuditEntry{Action: action, Operator: operator, ClientID: clientID, Detail: group})
+	return nil
+}
+
+// setClientTags records the tags a client advertised on its probe
+func (s *Server) setClientTags(clientID string, tags []string) {
+	tags = slices.Clone(tags)
+	slices.Sort(tags)
+	tags = slices.Compact(tags)
+
+	s.clientsMu.Lock()
+	client, exists := s.clients[clientID]
+	if !exists || slices.Equal(client.Tags, tags) {
+		s.clientsMu.Unlock()
+		return
+	}
+	client.Tags = tags
+	snapshot := *client
+	s.clientsMu.Unlock()
+
+	s.persistClient(snapshot)
+}
+
+// Members returns the clients in a group or carrying a tag, sorted by identifier
+func (s *Server) Members(name string) []ClientInfo {
+	var members []ClientInfo
+	for _, client := range s.Clients() {
+		if slices.Contains(client.Groups, name) || slices.Contains(client.Tags, name) {
+			members = append(members, client)
+		}
+	}
+	return members
+}
@@ -0,0 +1,562 @@
+package c2
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+const (
+	// maxJobWait is the longest a request may block waiting for a job or rollout to finish
+	maxJobWait = 5 * time.Minute
+	// eventKeepAlive is how often idle event streams send a comment to keep proxies open
+	eventKeepAlive = 15 * time.Second
+	// eventBuffer is how many events a stream may fall behind before events are dropped
+	eventBuffer = 64
+)
+
+// clientResponse is the API representation of a client
+type clientResponse struct {
+	ClientInfo
+	SourceIP      string `json:"source_ip"`
+	QueuedJobs    int    `json:"queued_jobs"`
+	UptimeSeconds int64  `json:"uptime_seconds,omitempty"`
+	// ProbeInterval shadows the nanoseconds of ClientInfo with seconds
+	ProbeInterval float64 `json:"probe_interval,omitempty"`
+}
+
+// enqueueRequest is the body of a request queueing a command
+type enqueueRequest struct {
+	Command string `json:"command"`
+	// Timeout is a duration such as "10m" after which the client kills the command
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// upgradeRequest is the body of a request upgrading one client
+type upgradeRequest struct {
+	UpgradeRequest
+	// Timeout is a duration such as "10m" after which the client gives up the upgrade
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// upgradeRolloutRequest is the body of a request upgrading groups one after another
+type upgradeRolloutRequest struct {
+	UpgradeRequest
+	Targets []string       `json:"targets"`
+	Options RolloutOptions `json:"options"`
+}
+
+// rolloutRequest is the body of a request fanning a command out to a group
+type rolloutRequest struct {
+	Target  string         `json:"target"`
+	Command string         `json:"command"`
+	Options RolloutOptions `json:"options"`
+}
+
+// errorResponse is the body of every failed API request
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// operatorHandler is an API handler that knows which token authorised the request
+type operatorHandler func(w http.ResponseWriter, r *http.Request, operator string)
+
+// HTTPHandler returns the management API so it can be mounted on an existing HTTP server
+func (s *Server) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/openapi.json", s.handleOpenAPI)
+	mux.Handle("GET /api/v1/clients", s.authorize(s.handleListClients))
+	mux.Handle("GET /api/v1/clients/{id}", s.authorize(s.handleGetClient))
+	mux.Handle("GET /api/v1/clients/{id}/jobs", s.authorize(s.handleListClientJobs))
+	mux.Handle("POST /api/v1/clients/{id}/jobs", s.authorize(s.handleEnqueue))
+	mux.Handle("POST /api/v1/clients/{id}/upgrade", s.authorize(s.handleUpgrade))
+	mux.Handle("PUT /api/v1/clients/{id}/groups/{group}", s.authorize(s.handleAssignGroup))
+	mux.Handle("DELETE /api/v1/clients/{id}/groups/{group}", s.authorize(s.handleAssignGroup))
+	mux.Handle("GET /api/v1/jobs", s.authorize(s.handleListJobs))
+	mux.Handle("GET /api/v1/jobs/{id}", s.authorize(s.handleGetJob))
+	mux.Handle("POST /api/v1/jobs/{id}/cancel", s.authorize(s.handleCancelJob))
+	mux.Handle("GET /api/v1/rollouts", s.authorize(s.handleListRollouts))
+	mux.Handle("POST /api/v1/rollouts", s.authorize(s.handleStartRollout))
+	mux.Handle("GET /api/v1/rollouts/{id}", s.authorize(s.handleGetRollout))
+	mux.Handle("POST /api/v1/rollouts/{id}/cancel", s.authorize(s.handleCancelRollout))
+	mux.Handle("POST /api/v1/upgrades", s.authorize(s.handleStartUpgradeRollout))
+	mux.Handle("GET /api/v1/events", s.authorize(s.handleEvents))
+	mux.Handle("GET /api/v1/metrics", s.authorize(func(w http.ResponseWriter, r *http.Request, operator string) {
+		s.MetricsHandler().ServeHTTP(w, r)
+	}))
+	return mux
+}
+
+// serveHTTP serves the management API on listener until ctx is done
+func (s *Server) serveHTTP(ctx context.Context, listener net.Listener) {
+	srv := &http.Server{
+		Handler:           s.HTTPHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		// Event streams end when the server stops
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	s.config.Logger.Infof("server: HTTP API listening on %s", listener.Addr())
+	if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.config.Logger.Errorf("server: HTTP API stopped: %v", err)
+	}
+}
+
+// authorize wraps h so it only runs for requests carrying a configured bearer token
+func (s *Server) authorize(h operatorHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="c2"`)
+			writeError(w, http.StatusUnauthorized, errors.New("missing bearer token"))
+			return
+		}
+		operator, ok := s.operatorForToken(token)
+		if !ok {
+			s.config.Logger.Warnf("server: api: rejected token from %s", r.RemoteAddr)
+			writeError(w, http.StatusUnauthorized, errors.New("invalid bearer token"))
+			return
+		}
+		h(w, r, operator)
+	})
+}
+
+// operatorForToken returns the name of the token matching token
+func (s *Server) operatorForToken(token string) (string, bool) {
+	// Compare digests so neither content nor length leaks through timing
+	sum := sha256.Sum256([]byte(token))
+	operator, found := "", false
+	for name, candidate := range s.config.APITokens {
+		want := sha256.Sum256([]byte(candidate))
+		if subtle.ConstantTimeCompare(sum[:], want[:]) == 1 {
+			operator, found = name, true
+		}
+	}
+	return operator, found
+}
+
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+func (s *Server) handleListClients(w http.ResponseWriter, r *http.Request, operator string) {
+	// Every filter key given as a query parameter narrows the list
+	var terms []string
+	for _, key := range clientFilterKeys {
+		if pattern := r.URL.Query().Get(key); pattern != "" {
+			terms = append(terms, key+"="+pattern)
+		}
+	}
+	filter, err := ParseClientFilter(terms)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	clients := s.FilterClients(filter)
+	response := make([]clientResponse, 0, len(clients))
+	for _, client := range clients {
+		if s.canView(operator, client.Identifier) {
+			response = append(response, s.clientResponse(client))
+		}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) handleGetClient(w http.ResponseWriter, r *http.Request, operator string) {
+	client, exists := s.Client(r.PathValue("id"))
+	if !exists || !s.canView(operator, client.Identifier) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%w: %s", ErrUnknownClient, r.PathValue("id")))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.clientResponse(client))
+}
+
+func (s *Server) handleListClientJobs(w http.ResponseWriter, r *http.Request, operator string) {
+	clientID := r.PathValue("id")
+	if _, exists := s.Client(clientID); !exists || !s.canView(operator, clientID) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%w: %s", ErrUnknownClient, clientID))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.Jobs(clientID))
+}
+
+func (s *Server) handleEnqueue(w http.ResponseWriter, r *http.Request, operator string) {
+	var req enqueueRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	if strings.TrimSpace(req.Command) == "" {
+		writeError(w, http.StatusBadRequest, errors.New("command must not be empty"))
+		return
+	}
+
+	var opts JobOptions
+	if req.Timeout != "" {
+		timeout, err := time.ParseDuration(req.Timeout)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid timeout: %s", req.Timeout))
+			return
+		}
+		opts.Timeout = timeout
+	}
+
+	clientID := r.PathValue("id")
+	job, err := s.EnqueueWith(operator, clientID, req.Command, opts)
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+
+	s.config.Logger.Infof("server: api: %s queued job %d for %s: %s", operator, job.ID, clientID, req.Command)
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/jobs/%d", job.ID))
+	snapshot, _ := s.Job(job.ID)
+	writeJSON(w, http.StatusAccepted, snapshot)
+}
+
+func (s *Server) handleUpgrade(w http.ResponseWriter, r *http.Request, operator string) {
+	var req upgradeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	var opts JobOptions
+	if req.Timeout != "" {
+		timeout, err := time.ParseDuration(req.Timeout)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid timeout: %s", req.Timeout))
+			return
+		}
+		opts.Timeout = timeout
+	}
+
+	clientID := r.PathValue("id")
+	job, err := s.EnqueueUpgrade(operator, clientID, req.UpgradeRequest, opts)
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+
+	s.config.Logger.Infof("server: api: %s queued upgrade job %d for %s: %s", operator, job.ID, clientID, job.Command)
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/jobs/%d", job.ID))
+	snapshot, _ := s.Job(job.ID)
+	writeJSON(w, http.StatusAccepted, snapshot)
+}
+
+// handleAssignGroup adds a client to a group on PUT and removes it on DELETE
+func (s *Server) handleAssignGroup(w http.ResponseWriter, r *http.Request, operator string) {
+	clientID, group := r.PathValue("id"), r.PathValue("group")
+	var err error
+	if r.Method == http.MethodDelete {
+		err = s.UnassignGroup(operator, clientID, group)
+	} else {
+		err = s.AssignGroup(operator, clientID, group)
+	}
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	client, _ := s.Client(clientID)
+	writeJSON(w, http.StatusOK, s.clientResponse(client))
+}
+
+func (s *Server) handleListJobs(w http.ResponseWriter, r *http.Request, operator string) {
+	jobs := slices.DeleteFunc(s.Jobs(r.URL.Query().Get("client")), func(job Job) bool {
+		return !s.canView(operator, job.ClientID)
+	})
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func (s *Server) handleGetJob(w http.ResponseWriter, r *http.Request, operator string) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid job id: %s", r.PathValue("id")))
+		return
+	}
+
+	// Jobs of clients the operator may not see do not exist for it
+	if job, exists := s.Job(id); !exists || !s.canView(operator, job.ClientID) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%w: %d", ErrUnknownJob, id))
+		return
+	}
+
+	// Optionally block until the job finishes
+	timeout, err := parseWait(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		if _, err := s.Wait(ctx, id); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			writeError(w, statusFor(err), err)
+			return
+		}
+	}
+
+	job, exists := s.Job(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%w: %d", ErrUnknownJob, id))
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func (s *Server) handleCancelJob(w http.ResponseWriter, r *http.Request, operator string) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid job id: %s", r.PathValue("id")))
+		return
+	}
+	job, err := s.CancelJob(operator, id)
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func (s *Server) handleListRollouts(w http.ResponseWriter, r *http.Request, operator string) {
+	rollouts := slices.DeleteFunc(s.Rollouts(), func(rollout Rollout) bool {
+		return !s.canViewRollout(operator, rollout)
+	})
+	writeJSON(w, http.StatusOK, rollouts)
+}
+
+func (s *Server) handleStartRollout(w http.ResponseWriter, r *http.Request, operator string) {
+	var req rolloutRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	if strings.TrimSpace(req.Command) == "" || strings.TrimPrefix(req.Target, "@") == "" {
+		writeError(w, http.StatusBadRequest, errors.New("target and command must not be empty"))
+		return
+	}
+
+	rollout, err := s.StartRollout(operator, req.Target, req.Command, req.Options)
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/rollouts/%d", rollout.ID))
+	writeJSON(w, http.StatusAccepted, rollout)
+}
+
+func (s *Server) handleStartUpgradeRollout(w http.ResponseWriter, r *http.Request, operator string) {
+	var req upgradeRolloutRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	if len(req.Targets) == 0 || slices.ContainsFunc(req.Targets, func(target string) bool { return strings.TrimPrefix(target, "@") == "" }) {
+		writeError(w, http.StatusBadRequest, errors.New("targets must not be empty"))
+		return
+	}
+
+	rollout, err := s.StartUpgradeRollout(operator, req.Targets, req.UpgradeRequest, req.Options)
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/rollouts/%d", rollout.ID))
+	writeJSON(w, http.StatusAccepted, rollout)
+}
+
+func (s *Server) handleGetRollout(w http.ResponseWriter, r *http.Request, operator string) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid rollout id: %s", r.PathValue("id")))
+		return
+	}
+	if rollout, exists := s.Rollout(id); !exists || !s.canViewRollout(operator, rollout) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%w: %d", ErrUnknownRollout, id))
+		return
+	}
+
+	// Optionally block until the rollout finishes
+	timeout, err := parseWait(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		if _, err := s.WaitRollout(ctx, id); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			writeError(w, statusFor(err), err)
+			return
+		}
+	}
+
+	rollout, exists := s.Rollout(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%w: %d", ErrUnknownRollout, id))
+		return
+	}
+	writeJSON(w, http.StatusOK, rollout)
+}
+
+func (s *Server) handleCancelRollout(w http.ResponseWriter, r *http.Request, operator string) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid rollout id: %s", r.PathValue("id")))
+		return
+	}
+	if err := s.CancelRollout(operator, id); err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	rollout, _ := s.Rollout(id)
+	writeJSON(w, http.StatusOK, rollout)
+}
+
+// handleEvents streams server events as server-sent events, optionally filtered by client or job
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request, operator string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming not supported"))
+		return
+	}
+
+	clientID := r.URL.Query().Get("client")
+	var jobID uint64
+	if job := r.URL.Query().Get("job"); job != "" {
+		var err error
+		if jobID, err = strconv.ParseUint(job, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid job id: %s", job))
+			return
+		}
+	}
+
+	events, unsubscribe := s.Subscribe(eventBuffer)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if clientID != "" && event.ClientID != clientID {
+				continue
+			}
+			if !s.canViewEvent(operator, event) {
+				continue
+			}
+			if jobID != 0 && !eventOfJob(event, jobID) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
+
+// eventOfJob reports whether an event is about the job with the given ID
+func eventOfJob(event Event, jobID uint64) bool {
+	switch {
+	case event.Job != nil:
+		return event.Job.ID == jobID
+	case event.Output != nil:
+		return event.Output.JobID == jobID
+	}
+	return false
+}
+
+// clientResponse builds the API representation of a client
+func (s *Server) clientResponse(client ClientInfo) clientResponse {
+	response := clientResponse{
+		ClientInfo: client,
+		QueuedJobs: s.queuedJobs(client.Identifier),
+	}
+	if client.SourceIP != nil {
+		response.SourceIP = client.SourceIP.String()
+	}
+	response.UptimeSeconds = int64(client.Facts.Uptime(time.Now()).Seconds())
+	response.ProbeInterval = client.ProbeInterval.Seconds()
+	return response
+}
+
+// parseWait returns how long a request asked to block, capped at maxJobWait
+func parseWait(r *http.Request) (time.Duration, error) {
+	wait := r.URL.Query().Get("wait")
+	if wait == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(wait)
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("invalid wait duration: %s", wait)
+	}
+	return min(timeout, maxJobWait), nil
+}
+
+// statusFor maps API errors to HTTP status codes
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, ErrUnknownClient), errors.Is(err, ErrUnknownJob), errors.Is(err, ErrUnknownRollout), errors.Is(err, ErrNoTargets):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidRollout), errors.Is(err, ErrInvalidGroup), errors.Is(err, ErrInvalidOperation),
+		errors.Is(err, ErrInvalidJob):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// writeJSON writes v as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes err as a JSON error response
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
@@ -0,0 +1,443 @@
+package c2
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/b1gcat/core/pki"
+)
+
+// JobState describes where a job is in its lifecycle
+type JobState string
+
+const (
+	// JobStateQueued means the job waits for the client's next probe
+	JobStateQueued JobState = "queued"
+	// JobStateSent means the command was sent but not yet acknowledged
+	JobStateSent JobState = "sent"
+	// JobStateRunning means the client reported it started the command
+	JobStateRunning JobState = "running"
+	// JobStateSucceeded means the command exited with status 0
+	JobStateSucceeded JobState = "succeeded"
+	// JobStateFailed means the command failed or exited with a non-zero status
+	JobStateFailed JobState = "failed"
+	// JobStateExpired means the job was not completed within its time to live
+	JobStateExpired JobState = "expired"
+	// JobStateRejected means the client policy refused to run the command
+	JobStateRejected JobState = "rejected"
+	// JobStateTimedOut means the client killed the command at its timeout
+	JobStateTimedOut JobState = "timed_out"
+	// JobStateCancelled means an operator cancelled the job before it finished
+	JobStateCancelled JobState = "cancelled"
+)
+
+// jobResendAfter is how long a sent job waits for a status, and a running job for its
+// result, before it is sent again
+const jobResendAfter = 30 * time.Second
+
+// jobTimeoutGrace is how long past its timeout the server waits for the result of a running job
+const jobTimeoutGrace = time.Minute
+
+// Job represents a command queued for a client and its outcome
+type Job struct {
+	ID         uint64    `json:"id"`
+	ClientID   string    `json:"client_id"`
+	Operator   string    `json:"operator,omitempty"`
+	Command    string    `json:"command"`
+	State      JobState  `json:"state"`
+	CreatedAt  time.Time `json:"created_at"`
+	SentAt     time.Time `json:"sent_at,omitempty"`
+	StartedAt  time.Time `json:"started_at,omitempty"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+	ExitCode   int       `json:"exit_code"`
+	Output     string    `json:"output,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Attempts   int       `json:"attempts,omitempty"`
+	// Timeout is how long the command may run on the client, the limit of its policy if zero
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// CancelRequested is set while the client is asked to kill the running command
+	CancelRequested bool `json:"cancel_requested,omitempty"`
+	// Progress is how far a long operation such as an upgrade download got, nil if not reported
+	Progress *JobProgress `json:"progress,omitempty"`
+	// HasData is set for jobs sent with a payload, which is kept in memory only
+	HasData bool `json:"has_data,omitempty"`
+}
+
+// JobProgress counts the bytes a running operation processed
+type JobProgress struct {
+	Done int64 `json:"done"`
+	// Total is zero if the size is unknown
+	Total int64 `json:"total,omitempty"`
+}
+
+// JobOptions controls how a queued command runs
+type JobOptions struct {
+	// Timeout is how long the command may run, the runtime limit of the client policy
+	// applies if it is zero or shorter. The server times the job out itself if the client
+	// sends no result within a minute past it.
+	Timeout time.Duration
+}
+
+// JobOutput is output a running command produced, streamed before its result
+type JobOutput struct {
+	JobID  uint64 `json:"job_id"`
+	Stream string `json:"stream"`
+	Data   string `json:"data"`
+}
+
+// Finished reports whether the job reached a final state
+func (j *Job) Finished() bool {
+	switch j.State {
+	case JobStateSucceeded, JobStateFailed, JobStateExpired, JobStateRejected, JobStateTimedOut, JobStateCancelled:
+		return true
+	}
+	return false
+}
+
+// enqueueJob appends a command of an operator to the FIFO queue of a client
+func (s *Server) enqueueJob(operator string, clientID string, cmd string) *Job {
+	return s.enqueueJobData(operator, clientID, cmd, JobOptions{}, nil)
+}
+
+// enqueueJobData queues a command with a payload sent along with it. The payload is
+// kept in memory only until the job finishes.
+func (s *Server) enqueueJobData(operator string, clientID string, cmd string, opts JobOptions, data []byte) *Job {
+	s.jobsMu.Lock()
+	defer s.unlockJobs()
+
+	s.nextJobID++
+	job := &Job{
+		ID:        s.nextJobID,
+		ClientID:  clientID,
+		Operator:  operator,
+		Command:   cmd,
+		State:     JobStateQueued,
+		CreatedAt: time.Now(),
+		Timeout:   opts.Timeout,
+		HasData:   data != nil,
+	}
+	s.jobs[job.ID] = job
+	s.jobDone[job.ID] = make(chan struct{})
+	if data != nil {
+		s.jobData[job.ID] = data
+	}
+	s.queues[clientID] = append(s.queues[clientID], job.ID)
+
+	s.jobChanged(*job)
+	entry := AuditEntry{
+		Time:     job.CreatedAt,
+		Action:   AuditEnqueue,
+		Operator: operator,
+		ClientID: clientID,
+		JobID:    job.ID,
+		Command:  cmd,
+	}
+	s.afterJobs(func() { s.audit(entry) })
+	return job
+}
+
+// Job returns a snapshot of the job with the given ID
+func (s *Server) Job(id uint64) (Job, bool) {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+
+	job, exists := s.jobs[id]
+	if !exists {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// jobPayload returns the payload sent along with a job, nil if it has none
+func (s *Server) jobPayload(id uint64) []byte {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+	return s.jobData[id]
+}
+
+// Jobs returns snapshots of the jobs of a client, or of all clients if clientID is empty
+func (s *Server) Jobs(clientID string) []Job {
+	s.jobsMu.Lock()
+	defer s.unlockJobs()
+
+	s.expireJobs(time.Now())
+	jobs := make([]Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		if clientID == "" || job.ClientID == clientID {
+			jobs = append(jobs, *job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return jobs
+}
+
+// queuedJobs returns the number of unfinished jobs of a client
+func (s *Server) queuedJobs(clientID string) int {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+	return len(s.queues[clientID])
+}
+
+// nextJob returns the job to send to a client now, if any
+func (s *Server) nextJob(clientID string) (*Job, bool) {
+	s.jobsMu.Lock()
+	defer s.unlockJobs()
+
+	now := time.Now()
+	s.expireJobs(now)
+
+	queue := s.queues[clientID]
+	if len(queue) == 0 {
+		return nil, false
+	}
+
+	// Jobs run one at a time in FIFO order
+	job := s.jobs[queue[0]]
+	switch job.State {
+	case JobStateQueued:
+	case JobStateSent:
+		// The command or its status was lost, the client ignores duplicates
+		if now.Sub(job.SentAt) < jobResendAfter {
+			return nil, false
+		}
+	case JobStateRunning:
+		// The result may have been lost, the client answers a duplicate with its status
+		// or the result it kept. A client that restarted runs the command again.
+		if now.Sub(job.SentAt) < jobResendAfter {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+
+	if job.State == JobStateQueued {
+		job.State = JobStateSent
+	}
+	job.SentAt = now
+	job.Attempts++
+	snapshot := *job
+	s.jobChanged(snapshot)
+	return &snapshot, true
+}
+
+// expireJobs marks jobs that outlived their time to live as expired and running jobs
+// whose client never reported back within their timeout as timed out; jobsMu must be held
+func (s *Server) expireJobs(now time.Time) {
+	for clientID, queue := range s.queues {
+		kept := queue[:0]
+		for _, id := range queue {
+			job := s.jobs[id]
+			switch {
+			case now.Sub(job.CreatedAt) > s.config.JobTTL:
+				s.config.Logger.Warnf("server: job %d for %s expired in state %s", job.ID, clientID, job.State)
+				job.State = JobStateExpired
+			case job.State == JobStateRunning && job.Timeout > 0 && now.Sub(job.StartedAt) > job.Timeout+jobTimeoutGrace:
+				s.config.Logger.Warnf("server: job %d for %s sent no result within its timeout of %s", job.ID, clientID, job.Timeout)
+				job.State = JobStateTimedOut
+				job.Error = "no result from the client within the timeout"
+			default:
+				kept = append(kept, id)
+				continue
+			}
+			job.FinishedAt = now
+			s.finishJob(job)
+			s.jobChanged(*job)
+		}
+		if len(kept) == 0 {
+			delete(s.queues, clientID)
+		} else {
+			s.queues[clientID] = kept
+		}
+	}
+}
+
+// updateJob applies fn to a job of the given client and reports whether it was found
+func (s *Server) updateJob(clientID string, id uint64, fn func(job *Job)) (Job, bool) {
+	s.jobsMu.Lock()
+	defer s.unlockJobs()
+
+	job, exists := s.jobs[id]
+	if !exists || job.ClientID != clientID || job.Finished() {
+		return Job{}, false
+	}
+	previous := *job
+	fn(job)
+	if *job != previous {
+		s.jobChanged(*job)
+	}
+
+	// Finished jobs leave the queue so the next one can be sent
+	if job.Finished() {
+		s.finishJob(job)
+		queue := s.queues[clientID]
+		for i, queued := range queue {
+			if queued == id {
+				s.queues[clientID] = append(queue[:i:i], queue[i+1:]...)
+				break
+			}
+		}
+		if len(s.queues[clientID]) == 0 {
+			delete(s.queues, clientID)
+		}
+	}
+	return *job, true
+}
+
+// jobChanged publishes and persists a job snapshot once jobsMu is released; jobsMu must be held
+func (s *Server) jobChanged(job Job) {
+	s.afterJobs(func() {
+		s.emit(Event{Type: EventJobUpdated, ClientID: job.ClientID, Job: &job})
+		if s.config.Store != nil {
+			if err := s.config.Store.PutJob(job); err != nil {
+				s.config.Logger.Errorf("server: failed to persist job %d: %v", job.ID, err)
+			}
+		}
+	})
+}
+
+// afterJobs queues fn to run once jobsMu is released; jobsMu must be held
+func (s *Server) afterJobs(fn func()) {
+	s.jobEffects = append(s.jobEffects, fn)
+}
+
+// unlockJobs releases jobsMu and runs the effects queued while it was held, so events
+// and disk writes do not hold up the jobs of every other client. Effects run in the
+// order they were queued, by whichever caller finds them pending first.
+func (s *Server) unlockJobs() {
+	if s.flushingJobs {
+		s.jobsMu.Unlock()
+		return
+	}
+	s.flushingJobs = true
+	for len(s.jobEffects) > 0 {
+		effects := s.jobEffects
+		s.jobEffects = nil
+		s.jobsMu.Unlock()
+		for _, effect := range effects {
+			effect()
+		}
+		s.jobsMu.Lock()
+	}
+	s.flushingJobs = false
+	s.jobsMu.Unlock()
+}
+
+// finishJob audits the outcome of a job and wakes everyone waiting for it; jobsMu must be held
+func (s *Server) finishJob(job *Job) {
+	finished := *job
+	s.afterJobs(func() { s.auditJobFinished(finished) })
+	s.metrics.jobFinished(job)
+	delete(s.jobData, job.ID)
+	delete(s.outputSeq, job.ID)
+	if done, exists := s.jobDone[job.ID]; exists {
+		close(done)
+		delete(s.jobDone, job.ID)
+	}
+}
+
+// dispatchJob sends the next queued job of a client, if any
+func (s *Server) dispatchJob(clientID string, to peer) {
+	job, ok := s.nextJob(clientID)
+	if !ok {
+		return
+	}
+	s.sendCommandToClient(clientID, to, job)
+}
+
+// handleStatus records the state a client reports for a job
+func (s *Server) handleStatus(msg Message, from peer) {
+	var status CommandStatus
+	if err := s.decryptPayload(msg, &status); err != nil {
+		s.config.Logger.Errorf("server: failed to read status from %s: %v", from.remoteAddr(), err)
+		return
+	}
+
+	s.updateJob(msg.Identifier, status.JobID, func(job *Job) {
+		if status.State == JobStateRunning && job.State == JobStateSent {
+			job.State = JobStateRunning
+			job.StartedAt = time.Now()
+		}
+		// Datagrams may be reordered, progress never goes back
+		if status.Progress != nil && job.State == JobStateRunning && (job.Progress == nil || status.Progress.Done >= job.Progress.Done) {
+			job.Progress = status.Progress
+		}
+	})
+}
+
+// handleOutput appends output a running command streamed to its job
+func (s *Server) handleOutput(msg Message, from peer) {
+	var output CommandOutput
+	if err := s.decryptPayload(msg, &output); err != nil {
+		s.config.Logger.Errorf("server: failed to read output from %s: %v", from.remoteAddr(), err)
+		return
+	}
+
+	s.jobsMu.Lock()
+	job, exists := s.jobs[output.JobID]
+	if !exists || job.ClientID != msg.Identifier || job.Finished() || output.Seq < s.outputSeq[job.ID] {
+		s.jobsMu.Unlock()
+		return
+	}
+	s.outputSeq[job.ID] = output.Seq + 1
+	// Keep what a result could hold, the result replaces it when the command ends
+	if room := s.config.MaxResultSize - len(job.Output); room > 0 {
+		job.Output += output.Data[:min(room, len(output.Data))]
+	}
+	s.jobsMu.Unlock()
+
+	s.emit(Event{
+		Type:     EventJobOutput,
+		ClientID: msg.Identifier,
+		Output:   &JobOutput{JobID: output.JobID, Stream: output.Stream, Data: output.Data},
+	})
+}
+
+// dispatchCancel asks a client to kill its running command if an operator cancelled it
+func (s *Server) dispatchCancel(clientID string, to peer) {
+	s.jobsMu.Lock()
+	var id uint64
+	if queue := s.queues[clientID]; len(queue) > 0 && s.jobs[queue[0]].CancelRequested {
+		id = queue[0]
+	}
+	s.jobsMu.Unlock()
+	if id == 0 {
+		return
+	}
+
+	key, epoch, err := s.clientKey(clientID)
+	if err != nil {
+		s.config.Logger.Errorf("server: failed to derive key for %s: %v", clientID, err)
+		return
+	}
+	plain, err := json.Marshal(CommandCancel{JobID: id})
+	if err != nil {
+		return
+	}
+	sealed, err := pki.Encrypt(key, plain)
+	if err != nil {
+		s.config.Logger.Errorf("server: failed to encrypt cancel for %s: %v", clientID, err)
+		return
+	}
+	if s.sendMessage(clientID, to, Message{Type: MessageTypeCancel, Identifier: clientID, KeyEpoch: epoch, Payload: sealed}) {
+		s.config.Logger.Infof("server: asked %s to cancel job %d", clientID, id)
+	}
+}
+
+// decryptPayload decrypts a message payload with the client's key and decodes it as JSON
+func (s *Server) decryptPayload(msg Message, v interface{}) error {
+	key, err := s.keyFor(msg.Identifier, msg.KeyEpoch)
+	if err != nil {
+		return fmt.Errorf("failed to derive key: %w", err)
+	}
+	plain, err := pki.Decrypt(key, msg.Payload)
+	if err != nil {
+		s.metrics.decryptFailures.Add(1)
+		return fmt.Errorf("failed to decrypt payload: %w", err)
+	}
+	if err := json.Unmarshal(plain, v); err != nil {
+		return fmt.Errorf("failed to decode payload: %w", err)
+	}
+	return nil
+}
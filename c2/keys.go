@@ -0,0 +1,271 @@
+package c2
+
+import (
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/b1gcat/core/pki"
+)
+
+// ErrStaleKey is returned when a client uses a key epoch that is no longer accepted
+var ErrStaleKey = errors.New("key epoch no longer accepted")
+
+// clientKeyState tracks the key epochs of one client on the server
+type clientKeyState struct {
+	// Epoch is the newest epoch assigned to the client
+	Epoch uint32 `json:"epoch"`
+	// PreviousEpoch stays accepted while a rotation is pending or within the grace period
+	PreviousEpoch uint32 `json:"previous_epoch"`
+	// Pending is set until the client first uses the new epoch
+	Pending bool `json:"pending,omitempty"`
+	// AdoptedAt is when the client switched to Epoch
+	AdoptedAt time.Time `json:"adopted_at,omitempty"`
+	// ClientEpoch is the epoch the client last used
+	ClientEpoch uint32 `json:"client_epoch"`
+	// PublicKey is the identity key pinned at enrolment
+	PublicKey ed25519.PublicKey `json:"public_key,omitempty"`
+}
+
+// clientKeyFile is the on-disk format of a client's current key
+type clientKeyFile struct {
+	Epoch uint32 `json:"epoch"`
+	Key   string `json:"key"`
+}
+
+// DeriveClientKey derives the 16-byte key of a client from the master secret
+func DeriveClientKey(master []byte, identifier string, epoch uint32) ([]byte, error) {
+	info := make([]byte, 4, 4+len(identifier))
+	binary.BigEndian.PutUint32(info, epoch)
+	info = append(info, identifier...)
+	key, err := hkdf.Key(sha256.New, master, []byte("c2-client-key"), string(info), 16)
+	if err != nil {
+		return nil, fmt.Errorf("keys: failed to derive client key: %w", err)
+	}
+	return key, nil
+}
+
+// accepts reports whether epoch may be used by the client at time now
+func (k *clientKeyState) accepts(epoch uint32, grace time.Duration, now time.Time) bool {
+	if epoch == k.Epoch {
+		return true
+	}
+	if epoch != k.PreviousEpoch {
+		return false
+	}
+	return k.Pending || now.Sub(k.AdoptedAt) < grace
+}
+
+// keyState returns the key state of a client, creating it at epoch 0; keysMu must be held
+func (s *Server) keyState(identifier string) *clientKeyState {
+	state, exists := s.keys[identifier]
+	if !exists {
+		state = &clientKeyState{}
+		s.keys[identifier] = state
+	}
+	return state
+}
+
+// keyFor returns the key a client uses at the given epoch
+func (s *Server) keyFor(identifier string, epoch uint32) ([]byte, error) {
+	if s.config.MasterKey == nil {
+		// Legacy mode, every client shares the configured key
+		return s.config.Key, nil
+	}
+	return DeriveClientKey(s.config.MasterKey, identifier, epoch)
+}
+
+// clientKey returns the key and epoch to use for messages sent to a client
+func (s *Server) clientKey(identifier string) ([]byte, uint32, error) {
+	s.keysMu.Lock()
+	epoch := s.keyState(identifier).ClientEpoch
+	s.keysMu.Unlock()
+
+	key, err := s.keyFor(identifier, epoch)
+	return key, epoch, err
+}
+
+// observeKeyEpoch checks the epoch of an authenticated message and records rotation progress
+func (s *Server) observeKeyEpoch(identifier string, epoch uint32) error {
+	if s.config.MasterKey == nil {
+		return nil
+	}
+
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+
+	state := s.keyState(identifier)
+	if !state.accepts(epoch, s.config.KeyGracePeriod, time.Now()) {
+		return ErrStaleKey
+	}
+	// Late packets under the previous key must not move the client back
+	if epoch <= state.ClientEpoch {
+		return nil
+	}
+
+	state.ClientEpoch = epoch
+	if state.Pending && epoch == state.Epoch {
+		state.Pending = false
+		state.AdoptedAt = time.Now()
+		s.config.Logger.Infof("server: client %s adopted key epoch %d", identifier, epoch)
+	}
+	s.saveKeyStates()
+	return nil
+}
+
+// RotateKey starts an in-band rotation of a client's key to the next epoch
+func (s *Server) RotateKey(identifier string) error {
+	if s.config.MasterKey == nil {
+		return fmt.Errorf("server: key rotation requires a master key")
+	}
+
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+
+	state := s.keyState(identifier)
+	if state.Pending {
+		return fmt.Errorf("server: key rotation for %s already pending", identifier)
+	}
+	state.PreviousEpoch = state.Epoch
+	state.Epoch++
+	state.Pending = true
+	s.saveKeyStates()
+
+	s.config.Logger.Infof("server: rotating key of %s to epoch %d", identifier, state.Epoch)
+	return nil
+}
+
+// pendingRotation returns the rotation payload to deliver to a client, if any
+func (s *Server) pendingRotation(identifier string) ([]byte, bool, error) {
+	if s.config.MasterKey == nil {
+		return nil, false, nil
+	}
+
+	s.keysMu.Lock()
+	state := s.keyState(identifier)
+	pending, epoch, clientEpoch := state.Pending, state.Epoch, state.ClientEpoch
+	s.keysMu.Unlock()
+	if !pending {
+		return nil, false, nil
+	}
+
+	newKey, err := s.keyFor(identifier, epoch)
+	if err != nil {
+		return nil, false, err
+	}
+	oldKey, err := s.keyFor(identifier, clientEpoch)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Payload is the new epoch followed by the new key, sealed with the current key
+	plain := make([]byte, 4, 4+len(newKey))
+	binary.BigEndian.PutUint32(plain, epoch)
+	plain = append(plain, newKey...)
+	sealed, err := pki.Encrypt(oldKey, plain)
+	if err != nil {
+		return nil, false, err
+	}
+	return sealed, true, nil
+}
+
+// loadKeyStates restores persisted key epochs and pinned identity keys
+func (s *Server) loadKeyStates() error {
+	if s.config.KeyStateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.config.KeyStateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("server: failed to read key state: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.keys); err != nil {
+		return fmt.Errorf("server: failed to parse key state: %w", err)
+	}
+	for identifier, state := range s.keys {
+		// Pre-provisioned keys take precedence over keys pinned at enrolment
+		if _, provisioned := s.trusted[identifier]; !provisioned && len(state.PublicKey) == ed25519.PublicKeySize {
+			s.trusted[identifier] = state.PublicKey
+		}
+	}
+	return nil
+}
+
+// saveKeyStates persists key epochs and pinned identity keys; keysMu must be held
+func (s *Server) saveKeyStates() {
+	if s.config.KeyStateFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(s.keys, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(s.config.KeyStateFile, data, 0600)
+	}
+	if err != nil {
+		s.config.Logger.Errorf("server: failed to persist key state: %v", err)
+	}
+}
+
+// loadClientKey restores the key of a client from its key file
+func loadClientKey(path string) ([]byte, uint32, bool, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, 0, false, nil
+	}
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("failed to read key file: %w", err)
+	}
+	var file clientKeyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, 0, false, fmt.Errorf("failed to parse key file: %w", err)
+	}
+	key, err := hex.DecodeString(file.Key)
+	if err != nil || len(key) != 16 {
+		return nil, 0, false, fmt.Errorf("key file holds an invalid key")
+	}
+	return key, file.Epoch, true, nil
+}
+
+// saveClientKey persists the key of a client to its key file
+func saveClientKey(path string, key []byte, epoch uint32) error {
+	data, err := json.Marshal(clientKeyFile{Epoch: epoch, Key: hex.EncodeToString(key)})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0600)
+}
+
+// writeFileAtomic replaces path with data via a temporary file and rename
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
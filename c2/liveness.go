@@ -0,0 +1,124 @@
+package c2
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/b1gcat/core/alert"
+)
+
+// alertQueueSize is how many alerts may wait for delivery before new ones are dropped
+const alertQueueSize = 64
+
+// alertMessage is an alert waiting for delivery
+type alertMessage struct {
+	level   alert.AlertLevel
+	title   string
+	content string
+}
+
+// livenessState returns the state of a client at now. Clients that announced their
+// probe interval are late or lost after missing that many probes, others fall back
+// to the client timeout.
+func (s *Server) livenessState(client *ClientInfo, now time.Time) ClientState {
+	late, lost := s.livenessThresholds(client)
+	switch silent := now.Sub(client.LastSeen); {
+	case silent > lost:
+		return ClientStateLost
+	case silent > late:
+		return ClientStateLate
+	}
+	return ClientStateHealthy
+}
+
+// livenessThresholds returns how long a client may stay silent before it is late and lost
+func (s *Server) livenessThresholds(client *ClientInfo) (time.Duration, time.Duration) {
+	if client.ProbeInterval > 0 {
+		// Half an interval of slack absorbs jitter and network delay
+		late := time.Duration((float64(s.config.LateProbes) + 0.5) * float64(client.ProbeInterval))
+		lost := time.Duration((float64(s.config.LostProbes) + 0.5) * float64(client.ProbeInterval))
+		return late, lost
+	}
+	return s.config.ClientTimeout / 2, s.config.ClientTimeout
+}
+
+// updateLiveness marks clients that stopped probing as late or lost
+func (s *Server) updateLiveness(now time.Time) {
+	type transition struct {
+		client ClientInfo
+		state  ClientState
+	}
+	var transitions []transition
+
+	s.clientsMu.Lock()
+	for _, client := range s.clients {
+		state := s.livenessState(client, now)
+		// Only probes bring a client back, so states only get worse here
+		if state == client.State || state == ClientStateHealthy || client.State == ClientStateLost {
+			continue
+		}
+		client.State = state
+		transitions = append(transitions, transition{*client, state})
+	}
+	s.clientsMu.Unlock()
+
+	for _, t := range transitions {
+		silent := now.Sub(t.client.LastSeen).Round(time.Millisecond)
+		if t.state == ClientStateLate {
+			s.config.Logger.Infof("server: client %s late, not seen for %s", t.client.Identifier, silent)
+			s.emit(Event{Type: EventClientLate, Time: now, ClientID: t.client.Identifier})
+			continue
+		}
+		s.config.Logger.Warnf("server: client %s lost, not seen for %s", t.client.Identifier, silent)
+		s.emit(Event{Type: EventClientLost, Time: now, ClientID: t.client.Identifier})
+		s.sendAlert(alert.AlertLevelWarning, "c2 client lost", fmt.Sprintf("Client %s%s has not probed since %s",
+			t.client.Identifier, describeHost(t.client), t.client.LastSeen.Format(time.RFC3339)))
+	}
+}
+
+// clientReturned reports a lost client that started probing again
+func (s *Server) clientReturned(client ClientInfo, lastSeen time.Time) {
+	offline := client.LastSeen.Sub(lastSeen).Round(time.Millisecond)
+	s.config.Logger.Infof("server: client %s is back after %s", client.Identifier, offline)
+	s.sendAlert(alert.AlertLevelInfo, "c2 client returned", fmt.Sprintf("Client %s%s is probing again after %s offline",
+		client.Identifier, describeHost(client), offline))
+}
+
+// describeHost returns the hostname and groups of a client for alerts
+func describeHost(client ClientInfo) string {
+	description := ""
+	if client.Facts != nil && client.Facts.Hostname != "" {
+		description += " on " + client.Facts.Hostname
+	}
+	if len(client.Groups) > 0 {
+		description += fmt.Sprintf(" (groups %v)", client.Groups)
+	}
+	return description
+}
+
+// sendAlert queues an alert for the configured alert client without blocking
+func (s *Server) sendAlert(level alert.AlertLevel, title string, content string) {
+	if s.alerts == nil {
+		return
+	}
+	select {
+	case s.alerts <- alertMessage{level: level, title: title, content: content}:
+	default:
+		s.config.Logger.Warnf("server: dropped alert %q, delivery is falling behind", title)
+	}
+}
+
+// alertLoop delivers queued alerts one at a time until ctx is done
+func (s *Server) alertLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-s.alerts:
+			if err := s.config.AlertClient.SendAlert(string(msg.level), msg.title, msg.content); err != nil {
+				s.config.Logger.Errorf("server: failed to send alert %q: %v", msg.title, err)
+			}
+		}
+	}
+}
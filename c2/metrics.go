@@ -0,0 +1,229 @@
+package c2
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// jobLatencyBuckets are the upper bounds in seconds of the job latency histogram
+var jobLatencyBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900, 3600}
+
+// Metrics is a snapshot of how the server behaves, see MetricsHandler for the
+// Prometheus exposition of the same values
+type Metrics struct {
+	// Clients counts the known clients by state
+	Clients map[ClientState]int `json:"clients"`
+	// Probes counts the probes received by the protocol disguising them
+	Probes map[ProtocolType]uint64 `json:"probes"`
+	// DecodeFailures counts messages that could not be decoded
+	DecodeFailures uint64 `json:"decode_failures"`
+	// DecryptFailures counts payloads that could not be decrypted with the client's key
+	DecryptFailures uint64 `json:"decrypt_failures"`
+	// Jobs counts the jobs the server keeps by state
+	Jobs map[JobState]int `json:"jobs"`
+	// JobLatency is how long finished jobs took from being queued to finishing
+	JobLatency Histogram `json:"job_latency"`
+	// BytesIn and BytesOut count the bytes received from and sent to clients
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+	// Receive counts the datagrams received, handled and dropped
+	Receive ReceiveStats `json:"receive"`
+	// Listeners counts the same per UDP socket
+	Listeners []ListenerStats `json:"listeners"`
+}
+
+// Histogram is a cumulative distribution of observed values
+type Histogram struct {
+	// Bounds are the upper bounds of the buckets, Counts the observations at or below each
+	Bounds []float64 `json:"bounds"`
+	Counts []uint64  `json:"counts"`
+	Count  uint64    `json:"count"`
+	Sum    float64   `json:"sum"`
+}
+
+// observe adds a value to the buckets it falls into
+func (h *Histogram) observe(v float64) {
+	if h.Counts == nil {
+		h.Counts = make([]uint64, len(h.Bounds))
+	}
+	for i, bound := range h.Bounds {
+		if v <= bound {
+			h.Counts[i]++
+		}
+	}
+	h.Count++
+	h.Sum += v
+}
+
+// metricCounters are the live counters behind Metrics
+type metricCounters struct {
+	decodeFailures  atomic.Uint64
+	decryptFailures atomic.Uint64
+	bytesIn         atomic.Uint64
+	bytesOut        atomic.Uint64
+
+	// mu guards the probes and the latency histogram
+	mu         sync.Mutex
+	probes     map[ProtocolType]uint64
+	jobLatency Histogram
+}
+
+// probeReceived counts a probe disguised as protocol
+func (m *metricCounters) probeReceived(protocol ProtocolType) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.probes == nil {
+		m.probes = make(map[ProtocolType]uint64)
+	}
+	m.probes[protocol]++
+}
+
+// jobFinished records how long a job took from being queued to finishing
+func (m *metricCounters) jobFinished(job *Job) {
+	if job.FinishedAt.IsZero() {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.jobLatency.Bounds == nil {
+		m.jobLatency.Bounds = jobLatencyBuckets
+	}
+	m.jobLatency.observe(job.FinishedAt.Sub(job.CreatedAt).Seconds())
+}
+
+// Metrics returns the current values of the server metrics
+func (s *Server) Metrics() Metrics {
+	m := Metrics{
+		Clients:         make(map[ClientState]int),
+		Probes:          make(map[ProtocolType]uint64),
+		DecodeFailures:  s.metrics.decodeFailures.Load(),
+		DecryptFailures: s.metrics.decryptFailures.Load(),
+		Jobs:            make(map[JobState]int),
+		BytesIn:         s.metrics.bytesIn.Load(),
+		BytesOut:        s.metrics.bytesOut.Load(),
+		Receive:         s.ReceiveStats(),
+		Listeners:       s.ListenerStats(),
+	}
+
+	s.clientsMu.RLock()
+	for _, client := range s.clients {
+		m.Clients[client.State]++
+	}
+	s.clientsMu.RUnlock()
+
+	s.jobsMu.Lock()
+	for _, job := range s.jobs {
+		m.Jobs[job.State]++
+	}
+	s.jobsMu.Unlock()
+
+	s.metrics.mu.Lock()
+	for protocol, n := range s.metrics.probes {
+		m.Probes[protocol] = n
+	}
+	m.JobLatency = Histogram{
+		Bounds: jobLatencyBuckets,
+		Counts: make([]uint64, len(jobLatencyBuckets)),
+		Count:  s.metrics.jobLatency.Count,
+		Sum:    s.metrics.jobLatency.Sum,
+	}
+	copy(m.JobLatency.Counts, s.metrics.jobLatency.Counts)
+	s.metrics.mu.Unlock()
+	return m
+}
+
+// MetricsHandler returns a handler serving the server metrics in the Prometheus text format.
+// It is mounted on the management API as /api/v1/metrics and can be served on its own.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		out := bufio.NewWriter(w)
+		writeMetrics(out, s.Metrics())
+		out.Flush()
+	})
+}
+
+// writeMetrics writes m in the Prometheus text format
+func writeMetrics(w *bufio.Writer, m Metrics) {
+	clients := make(map[string]float64)
+	for _, state := range []ClientState{ClientStateHealthy, ClientStateLate, ClientStateLost} {
+		clients[string(state)] = float64(m.Clients[state])
+	}
+	writeFamily(w, "c2_clients", "gauge", "Known clients by state.", "state", clients)
+
+	probes := make(map[string]float64)
+	for protocol, n := range m.Probes {
+		probes[string(protocol)] = float64(n)
+	}
+	writeFamily(w, "c2_probes_received_total", "counter", "Probes received by the protocol disguising them.", "protocol", probes)
+
+	writeFamily(w, "c2_decode_failures_total", "counter", "Messages that could not be decoded.", "", map[string]float64{"": float64(m.DecodeFailures)})
+	writeFamily(w, "c2_decrypt_failures_total", "counter", "Payloads that could not be decrypted.", "", map[string]float64{"": float64(m.DecryptFailures)})
+
+	jobs := make(map[string]float64)
+	for _, state := range []JobState{JobStateQueued, JobStateSent, JobStateRunning, JobStateSucceeded, JobStateFailed,
+		JobStateExpired, JobStateRejected, JobStateTimedOut, JobStateCancelled} {
+		jobs[string(state)] = float64(m.Jobs[state])
+	}
+	writeFamily(w, "c2_jobs", "gauge", "Jobs kept by the server by state.", "state", jobs)
+
+	fmt.Fprintln(w, "# HELP c2_job_latency_seconds Time jobs took from being queued to finishing.")
+	fmt.Fprintln(w, "# TYPE c2_job_latency_seconds histogram")
+	for i, bound := range m.JobLatency.Bounds {
+		fmt.Fprintf(w, "c2_job_latency_seconds_bucket{le=%q} %d\n", formatFloat(bound), m.JobLatency.Counts[i])
+	}
+	fmt.Fprintf(w, "c2_job_latency_seconds_bucket{le=\"+Inf\"} %d\n", m.JobLatency.Count)
+	fmt.Fprintf(w, "c2_job_latency_seconds_sum %s\n", formatFloat(m.JobLatency.Sum))
+	fmt.Fprintf(w, "c2_job_latency_seconds_count %d\n", m.JobLatency.Count)
+
+	writeFamily(w, "c2_received_bytes_total", "counter", "Bytes received from clients.", "", map[string]float64{"": float64(m.BytesIn)})
+	writeFamily(w, "c2_sent_bytes_total", "counter", "Bytes sent to clients.", "", map[string]float64{"": float64(m.BytesOut)})
+
+	received, handled, listenerClients := make(map[string]float64), make(map[string]float64), make(map[string]float64)
+	for _, l := range m.Listeners {
+		received[l.Address] = float64(l.Receive.Received)
+		handled[l.Address] = float64(l.Receive.Handled)
+		listenerClients[l.Address] = float64(l.Clients)
+	}
+	writeFamily(w, "c2_datagrams_received_total", "counter", "Datagrams read from a UDP socket.", "listener", received)
+	writeFamily(w, "c2_datagrams_handled_total", "counter", "Datagrams handled by a worker.", "listener", handled)
+	fmt.Fprintln(w, "# HELP c2_datagrams_dropped_total Datagrams dropped before a worker handled them.")
+	fmt.Fprintln(w, "# TYPE c2_datagrams_dropped_total counter")
+	for _, l := range m.Listeners {
+		fmt.Fprintf(w, "c2_datagrams_dropped_total{listener=%q,reason=\"queue_full\"} %d\n", l.Address, l.Receive.QueueFull)
+		fmt.Fprintf(w, "c2_datagrams_dropped_total{listener=%q,reason=\"rate_limited\"} %d\n", l.Address, l.Receive.RateLimited)
+	}
+	writeFamily(w, "c2_listener_clients", "gauge", "Known clients by the UDP socket they last reached.", "listener", listenerClients)
+}
+
+// writeFamily writes a metric with one sample per label value, sorted by value.
+// A metric without a label has a single sample under the empty value.
+func writeFamily(w *bufio.Writer, name string, kind string, help string, label string, samples map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	values := make([]string, 0, len(samples))
+	for value := range samples {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		if label == "" {
+			fmt.Fprintf(w, "%s %s\n", name, formatFloat(samples[value]))
+		} else {
+			fmt.Fprintf(w, "%s{%s=%q} %s\n", name, label, value, formatFloat(samples[value]))
+		}
+	}
+}
+
+// formatFloat formats a sample value the way Prometheus expects it
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,609 @@
+package c2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/sirupsen/logrus"
+)
+
+// OperationPrefix starts commands naming a built-in operation instead of a shell command
+const OperationPrefix = "op:"
+
+const (
+	// defaultLogLines is how many lines the log operations return unless asked otherwise
+	defaultLogLines = 100
+	// maxLogLines bounds how many lines the log operations return
+	maxLogLines = 1000
+	// maxLogLineSize bounds the length of a single log line
+	maxLogLineSize = 64 * 1024
+)
+
+// ErrInvalidOperation is returned for unknown operations and malformed arguments
+var ErrInvalidOperation = errors.New("invalid operation")
+
+// Operation is a built-in operation and its arguments, written as
+// op:name key=value ... with values quoted like Go strings where needed
+type Operation struct {
+	Name string
+	Args map[string]string
+}
+
+// OperationArg describes an argument of a built-in operation
+type OperationArg struct {
+	Name        string `json:"name"`
+	Required    bool   `json:"required,omitempty"`
+	Description string `json:"description"`
+}
+
+// OperationInfo describes a built-in operation
+type OperationInfo struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Args        []OperationArg `json:"args,omitempty"`
+}
+
+// operationFunc runs an operation on the client, data is the payload sent along with the command
+type operationFunc func(ctx context.Context, c *Client, args map[string]string, data []byte) (any, error)
+
+// operationSpec is a registered operation and how the client runs it
+type operationSpec struct {
+	OperationInfo
+	run operationFunc
+}
+
+// operations is the registry of built-in operations by name
+var operations = map[string]operationSpec{}
+
+// registerOperation adds an operation to the registry
+func registerOperation(info OperationInfo, run operationFunc) {
+	operations[info.Name] = operationSpec{OperationInfo: info, run: run}
+}
+
+func init() {
+	registerOperation(OperationInfo{
+		Name:        "sysinfo",
+		Description: "Show the host facts, CPUs and memory",
+	}, func(ctx context.Context, c *Client, args map[string]string, data []byte) (any, error) {
+		return collectSystemInfo(c.config.Version), nil
+	})
+	registerOperation(OperationInfo{
+		Name:        "processes",
+		Description: "List running processes",
+		Args:        []OperationArg{{Name: "name", Description: "Only processes whose name contains this"}},
+	}, func(ctx context.Context, c *Client, args map[string]string, data []byte) (any, error) {
+		processes, err := listProcesses()
+		if err != nil {
+			return nil, err
+		}
+		if name := args["name"]; name != "" {
+			processes = slices.DeleteFunc(processes, func(p processInfo) bool { return !strings.Contains(p.Name, name) })
+		}
+		sort.Slice(processes, func(i, j int) bool { return processes[i].PID < processes[j].PID })
+		return processes, nil
+	})
+	registerOperation(OperationInfo{
+		Name:        "disk_usage",
+		Description: "Show the size and free space of mounted filesystems",
+		Args:        []OperationArg{{Name: "path", Description: "Only the filesystem holding this path"}},
+	}, func(ctx context.Context, c *Client, args map[string]string, data []byte) (any, error) {
+		return diskUsages(args["path"])
+	})
+	registerOperation(OperationInfo{
+		Name:        "service_status",
+		Description: "Show the state of a system service",
+		Args:        []OperationArg{{Name: "name", Required: true, Description: "Service name"}},
+	}, func(ctx context.Context, c *Client, args map[string]string, data []byte) (any, error) {
+		return serviceStatus(ctx, args["name"])
+	})
+	registerOperation(OperationInfo{
+		Name:        "tail_log",
+		Description: "Show the last lines of a permitted log file",
+		Args: []OperationArg{
+			{Name: "path", Required: true, Description: "Log file, one of the client's log files"},
+			{Name: "lines", Description: fmt.Sprintf("Number of lines, %d by default", defaultLogLines)},
+		},
+	}, func(ctx context.Context, c *Client, args map[string]string, data []byte) (any, error) {
+		lines, err := intArg(args, "lines", defaultLogLines, 1, maxLogLines)
+		if err != nil {
+			return nil, err
+		}
+		return c.readLog(args["path"], 0, lines)
+	})
+	registerOperation(OperationInfo{
+		Name:        "read_log",
+		Description: "Show lines of a permitted log file from an offset",
+		Args: []OperationArg{
+			{Name: "path", Required: true, Description: "Log file, one of the client's log files"},
+			{Name: "offset", Description: "First line, counted from 1"},
+			{Name: "limit", Description: fmt.Sprintf("Number of lines, %d by default", defaultLogLines)},
+		},
+	}, func(ctx context.Context, c *Client, args map[string]string, data []byte) (any, error) {
+		offset, err := intArg(args, "offset", 1, 1, 1<<31)
+		if err != nil {
+			return nil, err
+		}
+		limit, err := intArg(args, "limit", defaultLogLines, 1, maxLogLines)
+		if err != nil {
+			return nil, err
+		}
+		return c.readLog(args["path"], offset, limit)
+	})
+	registerOperation(OperationInfo{
+		Name:        "log_level",
+		Description: "Change the clog and client log level",
+		Args:        []OperationArg{{Name: "level", Required: true, Description: "none, panic, fatal, error, warn, info, debug or trace"}},
+	}, func(ctx context.Context, c *Client, args map[string]string, data []byte) (any, error) {
+		return c.setLogLevel(args["level"])
+	})
+	registerOperation(OperationInfo{
+		Name:        "upgrade",
+		Description: "Upgrade the client binary through its upgrade server",
+		Args: []OperationArg{
+			{Name: "version", Description: "Target version, the latest if empty"},
+			{Name: "server", Description: "Upgrade server URL, the configured one if empty"},
+			{Name: "restart", Description: "true to restart into the new binary once the result is sent"},
+		},
+	}, func(ctx context.Context, c *Client, args map[string]string, data []byte) (any, error) {
+		restart, err := boolArg(args, "restart")
+		if err != nil {
+			return nil, err
+		}
+		return c.upgrade(ctx, args["version"], args["server"], restart)
+	})
+}
+
+// Operations returns the built-in operations sorted by name
+func Operations() []OperationInfo {
+	infos := make([]OperationInfo, 0, len(operations))
+	for _, spec := range operations {
+		infos = append(infos, spec.OperationInfo)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// IsOperation reports whether cmd names a built-in operation
+func IsOperation(cmd string) bool {
+	return strings.HasPrefix(strings.TrimSpace(cmd), OperationPrefix)
+}
+
+// ParseOperation parses and validates a command naming a built-in operation
+func ParseOperation(cmd string) (Operation, error) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(cmd), OperationPrefix)
+	if !ok {
+		return Operation{}, fmt.Errorf("%w: missing %q prefix", ErrInvalidOperation, OperationPrefix)
+	}
+	name, rest, _ := strings.Cut(rest, " ")
+	op := Operation{Name: name, Args: make(map[string]string)}
+
+	for rest = strings.TrimLeft(rest, " "); rest != ""; rest = strings.TrimLeft(rest, " ") {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok || key == "" || strings.Contains(key, " ") {
+			return Operation{}, fmt.Errorf("%w: expected key=value at %q", ErrInvalidOperation, rest)
+		}
+		rest = value
+		if strings.HasPrefix(rest, `"`) {
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				return Operation{}, fmt.Errorf("%w: bad quoting of %s", ErrInvalidOperation, key)
+			}
+			value, _ = strconv.Unquote(quoted)
+			rest = rest[len(quoted):]
+			if rest != "" && rest[0] != ' ' {
+				return Operation{}, fmt.Errorf("%w: expected space after %s", ErrInvalidOperation, key)
+			}
+		} else {
+			value, rest, _ = strings.Cut(rest, " ")
+		}
+		if _, exists := op.Args[key]; exists {
+			return Operation{}, fmt.Errorf("%w: duplicate argument %s", ErrInvalidOperation, key)
+		}
+		op.Args[key] = value
+	}
+
+	if err := op.validate(); err != nil {
+		return Operation{}, err
+	}
+	return op, nil
+}
+
+// validate checks the operation exists and its arguments match its description
+func (o Operation) validate() error {
+	spec, exists := operations[o.Name]
+	if !exists {
+		return fmt.Errorf("%w: unknown operation %q", ErrInvalidOperation, o.Name)
+	}
+	for key := range o.Args {
+		if !slices.ContainsFunc(spec.Args, func(arg OperationArg) bool { return arg.Name == key }) {
+			return fmt.Errorf("%w: %s takes no argument %s", ErrInvalidOperation, o.Name, key)
+		}
+	}
+	for _, arg := range spec.Args {
+		if arg.Required && o.Args[arg.Name] == "" {
+			return fmt.Errorf("%w: %s requires argument %s", ErrInvalidOperation, o.Name, arg.Name)
+		}
+	}
+	return nil
+}
+
+// String returns the canonical command of the operation, arguments sorted by name
+func (o Operation) String() string {
+	var b strings.Builder
+	b.WriteString(OperationPrefix + o.Name)
+	keys := make([]string, 0, len(o.Args))
+	for key := range o.Args {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := o.Args[key]
+		if value == "" || strings.ContainsAny(value, " \"=") || !strconv.CanBackquote(value) {
+			value = strconv.Quote(value)
+		}
+		b.WriteString(" " + key + "=" + value)
+	}
+	return b.String()
+}
+
+// normalizeCommand returns the canonical form of operations, so roles and policies
+// match them reliably, and shell commands unchanged
+func normalizeCommand(cmd string) (string, error) {
+	if !IsOperation(cmd) {
+		return cmd, nil
+	}
+	op, err := ParseOperation(cmd)
+	if err != nil {
+		return "", fmt.Errorf("server: %w", err)
+	}
+	return op.String(), nil
+}
+
+// intArg returns the integer argument key within [lower, upper], fallback if it is absent
+func intArg(args map[string]string, key string, fallback, lower, upper int) (int, error) {
+	value, exists := args[key]
+	if !exists {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < lower || n > upper {
+		return 0, fmt.Errorf("%w: %s must be a number from %d to %d", ErrInvalidOperation, key, lower, upper)
+	}
+	return n, nil
+}
+
+// boolArg returns the boolean argument key, false if it is absent
+func boolArg(args map[string]string, key string) (bool, error) {
+	value, exists := args[key]
+	if !exists {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%w: %s must be true or false", ErrInvalidOperation, key)
+	}
+	return b, nil
+}
+
+// jobIDKey is the context key of the job an operation runs for
+type jobIDKey struct{}
+
+// runOperation executes a built-in operation with the data sent along within the timeout
+// of its job, recording its JSON encoded result in res
+func (c *Client) runOperation(ctx context.Context, request CommandRequest, res *CommandResult) {
+	op, err := ParseOperation(request.Command)
+	if err != nil {
+		res.ExitCode = -1
+		res.Error = err.Error()
+		return
+	}
+
+	timeout := c.jobTimeout(request)
+	ctx, cancel := context.WithTimeout(context.WithValue(ctx, jobIDKey{}, request.JobID), timeout)
+	defer cancel()
+	value, err := operations[op.Name].run(ctx, c, op.Args, request.Data)
+	if interrupted(ctx, timeout, res) {
+		return
+	}
+	if err != nil {
+		res.ExitCode = 1
+		res.Error = fmt.Sprintf("Operation %s failed: %v", op.Name, err)
+		return
+	}
+	output, err := json.Marshal(value)
+	if err != nil {
+		res.ExitCode = 1
+		res.Error = fmt.Sprintf("Operation %s failed to encode its result: %v", op.Name, err)
+		return
+	}
+	res.Output = string(output)
+}
+
+// systemInfo is the result of the sysinfo operation
+type systemInfo struct {
+	HostFacts
+	CPUs            int    `json:"cpus"`
+	MemoryTotal     uint64 `json:"memory_total,omitempty"`
+	MemoryAvailable uint64 `json:"memory_available,omitempty"`
+	GoVersion       string `json:"go_version"`
+	PID             int    `json:"pid"`
+}
+
+// collectSystemInfo returns the host facts along with the resources of the host
+func collectSystemInfo(version string) systemInfo {
+	info := systemInfo{
+		HostFacts: collectHostFacts(version),
+		CPUs:      runtime.NumCPU(),
+		GoVersion: runtime.Version(),
+		PID:       os.Getpid(),
+	}
+	info.MemoryTotal, info.MemoryAvailable = memoryInfo()
+	return info
+}
+
+// processInfo is a row of the processes operation
+type processInfo struct {
+	PID  int    `json:"pid"`
+	PPID int    `json:"ppid"`
+	Name string `json:"name"`
+	User string `json:"user,omitempty"`
+	RSS  uint64 `json:"rss,omitempty"` // Resident memory in bytes
+}
+
+// diskInfo is a row of the disk_usage operation
+type diskInfo struct {
+	Path        string  `json:"path"`
+	Total       uint64  `json:"total"`
+	Free        uint64  `json:"free"`
+	Used        uint64  `json:"used"`
+	UsedPercent float64 `json:"used_percent"`
+}
+
+// newDiskInfo fills in the used space of a filesystem of total bytes with free available
+func newDiskInfo(path string, total, free uint64) diskInfo {
+	info := diskInfo{Path: path, Total: total, Free: free, Used: total - min(free, total)}
+	if total > 0 {
+		info.UsedPercent = float64(int(float64(info.Used)/float64(total)*1000)) / 10
+	}
+	return info
+}
+
+// diskUsages returns the filesystem holding path, or every mounted one if path is empty
+func diskUsages(path string) ([]diskInfo, error) {
+	if path != "" {
+		info, err := diskUsage(path)
+		if err != nil {
+			return nil, err
+		}
+		return []diskInfo{info}, nil
+	}
+
+	mounts, err := mountPoints()
+	if err != nil {
+		return nil, err
+	}
+	var disks []diskInfo
+	for _, mount := range mounts {
+		// Pseudo filesystems have no blocks, unreadable ones are skipped
+		if info, err := diskUsage(mount); err == nil && info.Total > 0 {
+			disks = append(disks, info)
+		}
+	}
+	return disks, nil
+}
+
+// serviceInfo is the result of the service_status operation
+type serviceInfo struct {
+	Name   string `json:"name"`
+	State  string `json:"state"`
+	Detail string `json:"detail,omitempty"`
+	PID    int    `json:"pid,omitempty"`
+}
+
+// logLine is a row of the log operations
+type logLine struct {
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+// logFile returns where path leads if it is one of the log files of the client
+func (c *Client) logFile(path string) (string, error) {
+	if len(c.config.LogFiles) == 0 {
+		return "", fmt.Errorf("no log files are readable by operations")
+	}
+	return permittedPath(c.config.LogFiles, "log file", path)
+}
+
+// permittedPath returns where path leads if both path and that file match one of
+// patterns. Files that do not exist yet are resolved through their directory.
+func permittedPath(patterns []string, kind string, path string) (string, error) {
+	path = filepath.Clean(path)
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("%s %s must be an absolute path", kind, path)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if errors.Is(err, os.ErrNotExist) {
+		var dir string
+		if dir, err = filepath.EvalSymlinks(filepath.Dir(path)); err == nil {
+			resolved = filepath.Join(dir, filepath.Base(path))
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	permitted := func(p string) bool {
+		return slices.ContainsFunc(patterns, func(pattern string) bool {
+			matched, _ := filepath.Match(pattern, p)
+			return matched
+		})
+	}
+	// Links must not lead out of the permitted files
+	if !permitted(path) || !permitted(resolved) {
+		return "", fmt.Errorf("%s %s is not permitted", kind, path)
+	}
+	return resolved, nil
+}
+
+// readLog returns limit lines of a permitted log file starting at line offset,
+// or the last limit lines if offset is zero
+func (c *Client) readLog(path string, offset int, limit int) ([]logLine, error) {
+	resolved, err := c.logFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(resolved)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lines := []logLine{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 4096), maxLogLineSize)
+	for n := 1; scanner.Scan(); n++ {
+		if n < offset {
+			continue
+		}
+		lines = append(lines, logLine{Line: n, Text: scanner.Text()})
+		if offset == 0 && len(lines) > limit {
+			// Keep the last limit lines only
+			lines = lines[1:]
+		} else if offset > 0 && len(lines) == limit {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return slices.Clip(lines), nil
+}
+
+// logLevelResult is the result of the log_level operation
+type logLevelResult struct {
+	Previous string `json:"previous"`
+	Level    string `json:"level"`
+}
+
+// setLogLevel changes the level of the client logger and, through CLOG_LOGLEVEL, of clog
+func (c *Client) setLogLevel(level string) (logLevelResult, error) {
+	level = strings.ToLower(level)
+	// The client logger keeps logging panics only when logging is off
+	parsed := logrus.PanicLevel
+	if level != "none" {
+		var err error
+		if parsed, err = logrus.ParseLevel(level); err != nil {
+			return logLevelResult{}, fmt.Errorf("%w: unknown log level %s", ErrInvalidOperation, level)
+		}
+	}
+
+	result := logLevelResult{Previous: os.Getenv("CLOG_LOGLEVEL"), Level: level}
+	if result.Previous == "" {
+		result.Previous = "none"
+	}
+	// clog picks the new level up within seconds
+	if err := os.Setenv("CLOG_LOGLEVEL", level); err != nil {
+		return logLevelResult{}, err
+	}
+	c.config.Logger.SetLevel(parsed)
+	return result, nil
+}
+
+// RenderTable writes the JSON result of an operation as an aligned table, a row per
+// element of an array of objects or a row per field of a single object
+func RenderTable(w io.Writer, output string) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	data := []byte(output)
+
+	var rows []json.RawMessage
+	if err := json.Unmarshal(data, &rows); err != nil {
+		keys, fields, err := objectFields(data)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			fmt.Fprintf(tw, "%s\t%s\n", key, tableCell(fields[key]))
+		}
+		return tw.Flush()
+	}
+
+	// Columns appear in the order fields were first seen
+	var columns []string
+	records := make([]map[string]json.RawMessage, len(rows))
+	for i, row := range rows {
+		keys, fields, err := objectFields(row)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if !slices.Contains(columns, key) {
+				columns = append(columns, key)
+			}
+		}
+		records[i] = fields
+	}
+	fmt.Fprintln(tw, strings.ToUpper(strings.Join(columns, "\t")))
+	for _, record := range records {
+		cells := make([]string, len(columns))
+		for i, column := range columns {
+			cells[i] = tableCell(record[column])
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	return tw.Flush()
+}
+
+// objectFields decodes a JSON object keeping the order of its keys
+func objectFields(data []byte) ([]string, map[string]json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, nil, fmt.Errorf("result is not a JSON object or array of objects")
+	}
+	var keys []string
+	fields := make(map[string]json.RawMessage)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		key := tok.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, nil, err
+		}
+		if _, exists := fields[key]; !exists {
+			keys = append(keys, key)
+		}
+		fields[key] = value
+	}
+	return keys, fields, nil
+}
+
+// tableCell renders a JSON value on a single line, strings unquoted
+func tableCell(value json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+		return strings.NewReplacer("\n", " ", "\t", " ").Replace(s)
+	}
+	if len(value) == 0 || string(value) == "null" {
+		return "-"
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, value); err != nil {
+		return string(value)
+	}
+	return compact.String()
+}
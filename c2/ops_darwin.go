@@ -0,0 +1,106 @@
+//go:build darwin
+
+package c2
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// memoryInfo returns the total memory in bytes, the available memory is not reported
+func memoryInfo() (uint64, uint64) {
+	raw, err := syscall.Sysctl("hw.memsize")
+	if err != nil {
+		return 0, 0
+	}
+	// Sysctl drops the trailing zero byte of the little-endian value
+	buf := make([]byte, 8)
+	copy(buf, raw)
+	return binary.LittleEndian.Uint64(buf), 0
+}
+
+// listProcesses reads the running processes from the kern.proc.all sysctl
+func listProcesses() ([]processInfo, error) {
+	procs, err := unix.SysctlKinfoProcSlice("kern.proc.all")
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[uint32]string)
+	processes := make([]processInfo, 0, len(procs))
+	for _, proc := range procs {
+		uid := proc.Eproc.Ucred.Uid
+		if _, cached := users[uid]; !cached {
+			users[uid] = strconv.FormatUint(uint64(uid), 10)
+			if u, err := user.LookupId(users[uid]); err == nil {
+				users[uid] = u.Username
+			}
+		}
+		name, _, _ := bytes.Cut(proc.Proc.P_comm[:], []byte{0})
+		processes = append(processes, processInfo{
+			PID:  int(proc.Proc.P_pid),
+			PPID: int(proc.Eproc.Ppid),
+			Name: string(name),
+			User: users[uid],
+		})
+	}
+	return processes, nil
+}
+
+// mountPoints returns the mounted filesystems
+func mountPoints() ([]string, error) {
+	n, err := unix.Getfsstat(nil, unix.MNT_NOWAIT)
+	if err != nil {
+		return nil, err
+	}
+	stats := make([]unix.Statfs_t, n)
+	if n, err = unix.Getfsstat(stats, unix.MNT_NOWAIT); err != nil {
+		return nil, err
+	}
+	mounts := make([]string, 0, n)
+	for _, st := range stats[:n] {
+		mount, _, _ := bytes.Cut(st.Mntonname[:], []byte{0})
+		mounts = append(mounts, string(mount))
+	}
+	return mounts, nil
+}
+
+// diskUsage returns the size and free space of the filesystem holding path
+func diskUsage(path string) (diskInfo, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return diskInfo{}, err
+	}
+	return newDiskInfo(path, st.Blocks*uint64(st.Bsize), st.Bavail*uint64(st.Bsize)), nil
+}
+
+// serviceStatus looks a launchd job up in the table of launchctl list
+func serviceStatus(ctx context.Context, name string) (serviceInfo, error) {
+	output, err := exec.CommandContext(ctx, "launchctl", "list").Output()
+	if err != nil {
+		return serviceInfo{}, fmt.Errorf("launchctl: %w", err)
+	}
+
+	// Rows are the PID, the last exit status and the label
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[2] != name {
+			continue
+		}
+		info := serviceInfo{Name: name, State: "stopped", Detail: "last exit status " + fields[1]}
+		if pid, err := strconv.Atoi(fields[0]); err == nil {
+			info.State, info.PID = "running", pid
+		}
+		return info, nil
+	}
+	return serviceInfo{}, fmt.Errorf("service %s not found", name)
+}
@@ -0,0 +1,146 @@
+//go:build linux
+
+package c2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// memoryInfo returns the total and available memory in bytes, read from /proc/meminfo
+func memoryInfo() (uint64, uint64) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+
+	var total, available uint64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), ":")
+		kb, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+		if err != nil {
+			continue
+		}
+		switch key {
+		case "MemTotal":
+			total = kb * 1024
+		case "MemAvailable":
+			available = kb * 1024
+		}
+	}
+	return total, available
+}
+
+// listProcesses reads the running processes from /proc
+func listProcesses() ([]processInfo, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]string)
+	pageSize := uint64(os.Getpagesize())
+	var processes []processInfo
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		// Processes may exit while they are listed
+		stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			continue
+		}
+		// The name is in parentheses and may itself contain spaces or parentheses
+		open, end := bytes.IndexByte(stat, '('), bytes.LastIndexByte(stat, ')')
+		if open < 0 || end < open {
+			continue
+		}
+		fields := strings.Fields(string(stat[end+1:]))
+		if len(fields) < 22 {
+			continue
+		}
+		p := processInfo{PID: pid, Name: string(stat[open+1 : end])}
+		p.PPID, _ = strconv.Atoi(fields[1])
+		if rss, err := strconv.ParseUint(fields[21], 10, 64); err == nil {
+			p.RSS = rss * pageSize
+		}
+
+		if info, err := os.Stat(fmt.Sprintf("/proc/%d", pid)); err == nil {
+			if st, ok := info.Sys().(*syscall.Stat_t); ok {
+				uid := strconv.FormatUint(uint64(st.Uid), 10)
+				if _, cached := users[uid]; !cached {
+					users[uid] = uid
+					if u, err := user.LookupId(uid); err == nil {
+						users[uid] = u.Username
+					}
+				}
+				p.User = users[uid]
+			}
+		}
+		processes = append(processes, p)
+	}
+	return processes, nil
+}
+
+// mountPoints returns the mounted filesystems listed in /proc/self/mounts
+func mountPoints() ([]string, error) {
+	data, err := os.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return nil, err
+	}
+	var mounts []string
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || seen[fields[1]] {
+			continue
+		}
+		// Spaces and other special characters are octal escaped
+		mount := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(fields[1])
+		seen[fields[1]] = true
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
+
+// diskUsage returns the size and free space of the filesystem holding path
+func diskUsage(path string) (diskInfo, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return diskInfo{}, err
+	}
+	return newDiskInfo(path, st.Blocks*uint64(st.Bsize), st.Bavail*uint64(st.Bsize)), nil
+}
+
+// serviceStatus asks systemd for the state of a unit
+func serviceStatus(ctx context.Context, name string) (serviceInfo, error) {
+	output, err := exec.CommandContext(ctx, "systemctl", "show",
+		"--property=LoadState,ActiveState,SubState,MainPID", "--", name).Output()
+	if err != nil {
+		return serviceInfo{}, fmt.Errorf("systemctl: %w", err)
+	}
+
+	properties := make(map[string]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		if key, value, ok := strings.Cut(line, "="); ok {
+			properties[key] = value
+		}
+	}
+	if properties["LoadState"] == "not-found" {
+		return serviceInfo{}, fmt.Errorf("service %s not found", name)
+	}
+	info := serviceInfo{Name: name, State: properties["ActiveState"], Detail: properties["SubState"]}
+	info.PID, _ = strconv.Atoi(properties["MainPID"])
+	return info, nil
+}
@@ -0,0 +1,37 @@
+//go:build !linux && !darwin && !windows
+
+package c2
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+)
+
+// errUnsupportedOperation is returned by operations this platform has no implementation of
+var errUnsupportedOperation = fmt.Errorf("not supported on %s", runtime.GOOS)
+
+// memoryInfo is unknown on this platform
+func memoryInfo() (uint64, uint64) {
+	return 0, 0
+}
+
+// listProcesses is not supported on this platform
+func listProcesses() ([]processInfo, error) {
+	return nil, errUnsupportedOperation
+}
+
+// mountPoints is not supported on this platform
+func mountPoints() ([]string, error) {
+	return nil, errUnsupportedOperation
+}
+
+// diskUsage is not supported on this platform
+func diskUsage(path string) (diskInfo, error) {
+	return diskInfo{}, errUnsupportedOperation
+}
+
+// serviceStatus is not supported on this platform
+func serviceStatus(ctx context.Context, name string) (serviceInfo, error) {
+	return serviceInfo{}, errUnsupportedOperation
+}
@@ -0,0 +1,129 @@
+//go:build windows
+
+package c2
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+var procGlobalMemoryStatusEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GlobalMemoryStatusEx")
+
+// memoryStatusEx is the MEMORYSTATUSEX structure
+type memoryStatusEx struct {
+	Length               uint32
+	MemoryLoad           uint32
+	TotalPhys            uint64
+	AvailPhys            uint64
+	TotalPageFile        uint64
+	AvailPageFile        uint64
+	TotalVirtual         uint64
+	AvailVirtual         uint64
+	AvailExtendedVirtual uint64
+}
+
+// memoryInfo returns the total and available physical memory in bytes
+func memoryInfo() (uint64, uint64) {
+	status := memoryStatusEx{Length: uint32(unsafe.Sizeof(memoryStatusEx{}))}
+	if ok, _, _ := procGlobalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&status))); ok == 0 {
+		return 0, 0
+	}
+	return status.TotalPhys, status.AvailPhys
+}
+
+// listProcesses walks a toolhelp snapshot of the running processes
+func listProcesses() ([]processInfo, error) {
+	snapshot, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer windows.CloseHandle(snapshot)
+
+	var processes []processInfo
+	entry := windows.ProcessEntry32{Size: uint32(unsafe.Sizeof(windows.ProcessEntry32{}))}
+	for err = windows.Process32First(snapshot, &entry); err == nil; err = windows.Process32Next(snapshot, &entry) {
+		processes = append(processes, processInfo{
+			PID:  int(entry.ProcessID),
+			PPID: int(entry.ParentProcessID),
+			Name: windows.UTF16ToString(entry.ExeFile[:]),
+		})
+	}
+	if err != windows.ERROR_NO_MORE_FILES {
+		return nil, err
+	}
+	return processes, nil
+}
+
+// mountPoints returns the root of every logical drive
+func mountPoints() ([]string, error) {
+	buf := make([]uint16, 512)
+	n, err := windows.GetLogicalDriveStrings(uint32(len(buf)), &buf[0])
+	if err != nil {
+		return nil, err
+	}
+	// The drives are separated by zero characters
+	var mounts []string
+	for _, drive := range strings.Split(windows.UTF16ToString(buf[:n]), "\x00") {
+		if drive != "" {
+			mounts = append(mounts, drive)
+		}
+	}
+	return mounts, nil
+}
+
+// diskUsage returns the size and free space of the volume holding path
+func diskUsage(path string) (diskInfo, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return diskInfo{}, err
+	}
+	var available, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(name, &available, &total, &free); err != nil {
+		return diskInfo{}, err
+	}
+	return newDiskInfo(path, total, available), nil
+}
+
+// serviceStates names the states of the service control manager
+var serviceStates = map[svc.State]string{
+	svc.Stopped:         "stopped",
+	svc.StartPending:    "start pending",
+	svc.StopPending:     "stop pending",
+	svc.Running:         "running",
+	svc.ContinuePending: "continue pending",
+	svc.PausePending:    "pause pending",
+	svc.Paused:          "paused",
+}
+
+// serviceStatus queries the service control manager for the state of a service.
+// It asks only for the rights it needs so that it also works without administrator rights.
+func serviceStatus(ctx context.Context, name string) (serviceInfo, error) {
+	manager, err := windows.OpenSCManager(nil, nil, windows.SC_MANAGER_CONNECT)
+	if err != nil {
+		return serviceInfo{}, fmt.Errorf("service manager: %w", err)
+	}
+	defer windows.CloseServiceHandle(manager)
+
+	serviceName, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return serviceInfo{}, fmt.Errorf("service %s: %w", name, err)
+	}
+	handle, err := windows.OpenService(manager, serviceName, windows.SERVICE_QUERY_STATUS)
+	if err != nil {
+		return serviceInfo{}, fmt.Errorf("service %s: %w", name, err)
+	}
+	s := &mgr.Service{Name: name, Handle: handle}
+	defer s.Close()
+	status, err := s.Query()
+	if err != nil {
+		return serviceInfo{}, fmt.Errorf("service %s: %w", name, err)
+	}
+	return serviceInfo{Name: name, State: serviceStates[status.State], PID: int(status.ProcessId)}, nil
+}
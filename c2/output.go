@@ -0,0 +1,105 @@
+package c2
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// outputFlushInterval is how often a running command streams its new output
+	outputFlushInterval = 500 * time.Millisecond
+	// maxOutputChunk bounds the output of a stream sent per flush, the rest is
+	// dropped from the stream but kept for the result
+	maxOutputChunk = 16 * 1024
+)
+
+// outputStreams names the streams a command writes to
+var outputStreams = [2]string{"stdout", "stderr"}
+
+// outputCollector keeps the output of a running command for its result and what
+// arrived since the last flush for streaming
+type outputCollector struct {
+	mu      sync.Mutex
+	limit   int
+	kept    [2]bytes.Buffer
+	pending [2]bytes.Buffer
+}
+
+// newOutputCollector returns a collector keeping at most limit bytes of each stream
+func newOutputCollector(limit int) *outputCollector {
+	return &outputCollector{limit: limit}
+}
+
+// writer returns the writer of a stream, 0 for stdout and 1 for stderr
+func (o *outputCollector) writer(stream int) io.Writer {
+	return outputWriter{collector: o, stream: stream}
+}
+
+// take returns the output written since the last call, one chunk per stream
+func (o *outputCollector) take() []CommandOutput {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var chunks []CommandOutput
+	for i := range o.pending {
+		if o.pending[i].Len() == 0 {
+			continue
+		}
+		chunks = append(chunks, CommandOutput{Stream: outputStreams[i], Data: o.pending[i].String()})
+		o.pending[i].Reset()
+	}
+	return chunks
+}
+
+// output returns what the command wrote to a stream, up to the limit
+func (o *outputCollector) output(stream int) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.kept[stream].String()
+}
+
+// outputWriter writes to one stream of a collector
+type outputWriter struct {
+	collector *outputCollector
+	stream    int
+}
+
+func (w outputWriter) Write(p []byte) (int, error) {
+	o := w.collector
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if room := o.limit - o.kept[w.stream].Len(); room > 0 {
+		o.kept[w.stream].Write(p[:min(room, len(p))])
+	}
+	if room := maxOutputChunk - o.pending[w.stream].Len(); room > 0 {
+		o.pending[w.stream].Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+// streamOutput sends the output of a running job to the server until done is closed
+func (c *Client) streamOutput(jobID uint64, output *outputCollector, done <-chan struct{}) {
+	ticker := time.NewTicker(outputFlushInterval)
+	defer ticker.Stop()
+
+	var seq uint64
+	for {
+		select {
+		case <-done:
+			// The result carries the rest of the output
+			return
+		case <-ticker.C:
+		}
+		for _, chunk := range output.take() {
+			chunk.JobID = jobID
+			chunk.Seq = seq
+			seq++
+			if err := c.sendPayload(MessageTypeOutput, chunk); err != nil {
+				c.config.Logger.Debugf("Client failed to stream output of job %d: %v", jobID, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package c2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// defaultMaxRuntime is how long a command may run when the policy sets no limit
+const defaultMaxRuntime = 10 * time.Second
+
+// ErrPolicyViolation is returned when a command breaks the client policy
+var ErrPolicyViolation = errors.New("policy violation")
+
+// CommandPolicy restricts the commands a client executes. It is configured
+// locally on the endpoint so a compromised server cannot lift it.
+type CommandPolicy struct {
+	// Allow lists patterns of permitted commands, each matched against the whole command.
+	// Every command is permitted if empty.
+	Allow []string `json:"allow,omitempty"`
+	// ForbiddenPaths lists paths that may not appear anywhere in a command
+	ForbiddenPaths []string `json:"forbidden_paths,omitempty"`
+	// MaxRuntime is how long a command may run, for example "30s"
+	MaxRuntime string `json:"max_runtime,omitempty"`
+	// MaxOutput is the largest output in bytes returned to the server
+	MaxOutput int `json:"max_output,omitempty"`
+	// RunAs is the user shell commands are executed as. Built-in operations run as the
+	// client's own user, so none are permitted with RunAs set unless listed in Operations.
+	RunAs string `json:"run_as,omitempty"`
+	// Operations lists the built-in operations permitted despite RunAs, for example "sysinfo"
+	Operations []string `json:"operations,omitempty"`
+
+	allow      []*regexp.Regexp
+	maxRuntime time.Duration
+}
+
+// LoadCommandPolicy reads and validates the JSON policy file at path
+func LoadCommandPolicy(path string) (*CommandPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("policy: failed to read %s: %w", path, err)
+	}
+
+	var policy CommandPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("policy: failed to parse %s: %w", path, err)
+	}
+	if err := policy.compile(); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// compile validates the policy and prepares its patterns
+func (p *CommandPolicy) compile() error {
+	p.allow = p.allow[:0]
+	for _, pattern := range p.Allow {
+		// Anchor patterns so an allowed command cannot be chained with others
+		re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+		if err != nil {
+			return fmt.Errorf("policy: invalid allow pattern %q: %w", pattern, err)
+		}
+		p.allow = append(p.allow, re)
+	}
+
+	p.maxRuntime = defaultMaxRuntime
+	if p.MaxRuntime != "" {
+		d, err := time.ParseDuration(p.MaxRuntime)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("policy: invalid max runtime %q", p.MaxRuntime)
+		}
+		p.maxRuntime = d
+	}
+
+	if p.MaxOutput < 0 {
+		return fmt.Errorf("policy: max output must not be negative")
+	}
+	return nil
+}
+
+// check reports why cmd may not run, or nil if it may
+func (p *CommandPolicy) check(cmd string) error {
+	if p == nil {
+		return nil
+	}
+
+	for _, path := range p.ForbiddenPaths {
+		if path != "" && strings.Contains(cmd, path) {
+			return fmt.Errorf("%w: command references forbidden path %s", ErrPolicyViolation, path)
+		}
+	}
+
+	// Operations would not be confined to the run-as user
+	if p.RunAs != "" && IsOperation(cmd) {
+		name, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimSpace(cmd), OperationPrefix), " ")
+		if !slices.Contains(p.Operations, name) {
+			return fmt.Errorf("%w: operation %s does not run as %s", ErrPolicyViolation, name, p.RunAs)
+		}
+	}
+
+	if len(p.allow) == 0 {
+		return nil
+	}
+	trimmed := strings.TrimSpace(cmd)
+	for _, re := range p.allow {
+		if re.MatchString(trimmed) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: command not in allow list", ErrPolicyViolation)
+}
+
+// runtime returns how long a command may run
+func (p *CommandPolicy) runtime() time.Duration {
+	if p == nil {
+		return defaultMaxRuntime
+	}
+	return p.maxRuntime
+}
+
+// runAs returns the user commands run as, empty for the client's own user
+func (p *CommandPolicy) runAs() string {
+	if p == nil {
+		return ""
+	}
+	return p.RunAs
+}
+
+// limitOutput truncates output to the maximum size of the policy
+func (p *CommandPolicy) limitOutput(output string) string {
+	if p == nil || p.MaxOutput == 0 || len(output) <= p.MaxOutput {
+		return output
+	}
+	return output[:p.MaxOutput] + truncatedSuffix
+}
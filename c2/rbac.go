@@ -0,0 +1,225 @@
+package c2
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+)
+
+// AuditDenied records an operator action refused by access control
+const AuditDenied AuditAction = "denied"
+
+// ErrForbidden is returned when an operator may not perform an action
+var ErrForbidden = errors.New("operation not permitted")
+
+// Role scopes the clients an operator may target and the commands they may issue
+type Role struct {
+	Name string
+	// Groups lists the client groups the role may target, "*" matches every client
+	Groups []string
+	// Allow lists command patterns the role may issue, every command if empty. A pattern
+	// must match the whole command, as in the client policy.
+	Allow []string
+	// Deny lists command patterns the role may never issue, checked before Allow. A pattern
+	// matches anywhere in the command so a denied command cannot hide behind another.
+	Deny []string
+	// Admin permits approving enrolments and rotating keys
+	Admin bool
+}
+
+// Operator is an account using the console or the management API
+type Operator struct {
+	Name string
+	// Token authenticates the operator on the management API, console only if empty
+	Token string
+	Roles []string
+}
+
+// compiledRole is a role with its patterns compiled
+type compiledRole struct {
+	Role
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+// compileRoles compiles the command patterns of every role
+func compileRoles(roles map[string]Role) (map[string]*compiledRole, error) {
+	compiled := make(map[string]*compiledRole, len(roles))
+	for name, role := range roles {
+		c := &compiledRole{Role: role}
+		for _, pattern := range role.Allow {
+			// Anchor patterns so an allowed command cannot be chained with others
+			re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+			if err != nil {
+				return nil, fmt.Errorf("role %s: invalid allow pattern: %w", name, err)
+			}
+			c.allow = append(c.allow, re)
+		}
+		for _, pattern := range role.Deny {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("role %s: invalid deny pattern: %w", name, err)
+			}
+			c.deny = append(c.deny, re)
+		}
+		compiled[name] = c
+	}
+	return compiled, nil
+}
+
+// targets reports whether the role may target a client in groups
+func (r *compiledRole) targets(groups []string) bool {
+	for _, allowed := range r.Groups {
+		if allowed == "*" {
+			return true
+		}
+		for _, group := range groups {
+			if group == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// permits reports whether the role may issue cmd
+func (r *compiledRole) permits(cmd string) bool {
+	for _, re := range r.deny {
+		if re.MatchString(cmd) {
+			return false
+		}
+	}
+	if len(r.allow) == 0 {
+		return true
+	}
+	for _, re := range r.allow {
+		if re.MatchString(cmd) {
+			return true
+		}
+	}
+	return false
+}
+
+// accessControlled reports whether operators are restricted by roles
+func (s *Server) accessControlled() bool {
+	return len(s.roles) > 0
+}
+
+// operatorRoles returns the roles of an operator
+func (s *Server) operatorRoles(operator string) []*compiledRole {
+	account, exists := s.config.Operators[operator]
+	if !exists {
+		return nil
+	}
+	roles := make([]*compiledRole, 0, len(account.Roles))
+	for _, name := range account.Roles {
+		if role, exists := s.roles[name]; exists {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// authorizeCommand checks that operator may run cmd on a client and audits refusals.
+// The system operator acts for the embedding program and is never restricted.
+func (s *Server) authorizeCommand(operator string, clientID string, cmd string) error {
+	if !s.accessControlled() || operator == SystemOperator {
+		return nil
+	}
+
+	// Only server-side groups count, tags are chosen by the client itself
+	client, _ := s.Client(clientID)
+	groups := client.Groups
+	reason := fmt.Sprintf("no role of %s may target %s", operator, clientID)
+	for _, role := range s.operatorRoles(operator) {
+		if !role.targets(groups) {
+			continue
+		}
+		if role.permits(cmd) {
+			return nil
+		}
+		reason = fmt.Sprintf("command not permitted for %s on %s", operator, clientID)
+	}
+	return s.deny(AuditEntry{Operator: operator, ClientID: clientID, Command: cmd, Detail: reason})
+}
+
+// canView reports whether operator may see a client, its jobs and their output, which
+// it may for the clients one of its roles can target
+func (s *Server) canView(operator string, clientID string) bool {
+	if !s.accessControlled() || operator == SystemOperator {
+		return true
+	}
+	client, _ := s.Client(clientID)
+	for _, role := range s.operatorRoles(operator) {
+		if role.targets(client.Groups) {
+			return true
+		}
+	}
+	return false
+}
+
+// canViewRollout reports whether operator may see a rollout, which it may for its own
+// rollouts and those whose every host it can see
+func (s *Server) canViewRollout(operator string, rollout Rollout) bool {
+	if rollout.Operator == operator {
+		return true
+	}
+	for _, host := range rollout.Hosts {
+		if !s.canView(operator, host.ClientID) {
+			return false
+		}
+	}
+	return true
+}
+
+// canViewEvent reports whether operator may see an event
+func (s *Server) canViewEvent(operator string, event Event) bool {
+	if event.Rollout != nil && !s.canViewRollout(operator, *event.Rollout) {
+		return false
+	}
+	return event.ClientID == "" || s.canView(operator, event.ClientID)
+}
+
+// authorizeAdmin checks that operator may perform an administrative action and audits refusals
+func (s *Server) authorizeAdmin(operator string, action AuditAction, clientID string) error {
+	if !s.accessControlled() || operator == SystemOperator {
+		return nil
+	}
+	for _, role := range s.operatorRoles(operator) {
+		if role.Admin {
+			return nil
+		}
+	}
+	return s.deny(AuditEntry{
+		Operator: operator,
+		ClientID: clientID,
+		Detail:   fmt.Sprintf("%s requires an admin role", action),
+	})
+}
+
+// deny audits a refused action and returns the error reported to the operator
+func (s *Server) deny(entry AuditEntry) error {
+	entry.Action = AuditDenied
+	s.audit(entry)
+	s.config.Logger.Warnf("server: denied %s: %s", entry.Operator, entry.Detail)
+	return fmt.Errorf("server: %w: %s", ErrForbidden, entry.Detail)
+}
+
+// groupsFor returns the sorted groups whose identifier patterns match a client,
+// merged with the groups an operator assigned it to
+func (s *Server) groupsFor(identifier string, assigned []string) []string {
+	groups := slices.Clone(assigned)
+	for group, patterns := range s.config.ClientGroups {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, identifier); ok {
+				groups = append(groups, group)
+				break
+			}
+		}
+	}
+	sort.Strings(groups)
+	return slices.Compact(groups)
+}
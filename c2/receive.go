@@ -0,0 +1,317 @@
+package c2
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// pooledBufferSize is the capacity of pooled datagram buffers, larger datagrams are allocated
+	pooledBufferSize = 2048
+	// maxRateBuckets bounds how many source addresses the rate limiter tracks
+	maxRateBuckets = 1 << 16
+)
+
+// bufferPool recycles the buffers datagrams wait in for a worker
+var bufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, pooledBufferSize)
+		return &buf
+	},
+}
+
+// datagram is a received datagram waiting for a worker
+type datagram struct {
+	buf      *[]byte
+	n        int
+	addr     net.Addr
+	listener *udpListener
+}
+
+// udpListener is one UDP socket of the server, clients reaching it get their replies from it
+type udpListener struct {
+	conn     net.PacketConn
+	received receiveCounters
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+}
+
+// ListenerStats counts what went through one UDP socket of the server
+type ListenerStats struct {
+	// Address is the local address the socket is bound to
+	Address string `json:"address"`
+	// Clients counts the known clients that last reached the server on this socket
+	Clients  int          `json:"clients"`
+	Receive  ReceiveStats `json:"receive"`
+	BytesIn  uint64       `json:"bytes_in"`
+	BytesOut uint64       `json:"bytes_out"`
+}
+
+// ReceiveStats counts the datagrams the server received, handled and dropped
+type ReceiveStats struct {
+	Received    uint64 `json:"received"`
+	Handled     uint64 `json:"handled"`
+	QueueFull   uint64 `json:"dropped_queue_full"`
+	RateLimited uint64 `json:"dropped_rate_limited"`
+}
+
+// Dropped returns how many datagrams were dropped for any reason
+func (r ReceiveStats) Dropped() uint64 {
+	return r.QueueFull + r.RateLimited
+}
+
+// receiveCounters are the live counters behind ReceiveStats
+type receiveCounters struct {
+	received    atomic.Uint64
+	handled     atomic.Uint64
+	queueFull   atomic.Uint64
+	rateLimited atomic.Uint64
+}
+
+// stats returns the counters of the listener
+func (l *udpListener) stats() ReceiveStats {
+	return ReceiveStats{
+		Received:    l.received.received.Load(),
+		Handled:     l.received.handled.Load(),
+		QueueFull:   l.received.queueFull.Load(),
+		RateLimited: l.received.rateLimited.Load(),
+	}
+}
+
+// ReceiveStats returns the datagram counters of all listeners since the server was created
+func (s *Server) ReceiveStats() ReceiveStats {
+	var total ReceiveStats
+	for _, l := range s.listeners {
+		stats := l.stats()
+		total.Received += stats.Received
+		total.Handled += stats.Handled
+		total.QueueFull += stats.QueueFull
+		total.RateLimited += stats.RateLimited
+	}
+	return total
+}
+
+// ListenerStats returns the counters of each UDP listener, in the order they were configured
+func (s *Server) ListenerStats() []ListenerStats {
+	clients := make(map[string]int)
+	s.clientsMu.RLock()
+	for _, client := range s.clients {
+		clients[client.Listener]++
+	}
+	s.clientsMu.RUnlock()
+
+	stats := make([]ListenerStats, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		address := l.conn.LocalAddr().String()
+		stats = append(stats, ListenerStats{
+			Address:  address,
+			Clients:  clients[address],
+			Receive:  l.stats(),
+			BytesIn:  l.bytesIn.Load(),
+			BytesOut: l.bytesOut.Load(),
+		})
+	}
+	return stats
+}
+
+// closeListeners closes the UDP sockets, which unblocks their pending reads
+func (s *Server) closeListeners() {
+	for _, l := range s.listeners {
+		l.conn.Close()
+	}
+}
+
+// udpListenLoop reads datagrams from every listener until ctx is done or the sockets are
+// closed, handing them to a fixed pool of workers through a bounded queue
+func (s *Server) udpListenLoop(ctx context.Context) {
+	queue := make(chan datagram, s.config.ReceiveQueue)
+	var workers sync.WaitGroup
+	for i := 0; i < s.config.ReceiveWorkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s.receiveWorker(queue)
+		}()
+	}
+
+	var readers sync.WaitGroup
+	for _, l := range s.listeners {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			s.readLoop(ctx, l, queue)
+		}()
+	}
+	readers.Wait()
+	close(queue)
+	workers.Wait()
+}
+
+// readLoop queues the datagrams of one listener until ctx is done or its socket is closed
+func (s *Server) readLoop(ctx context.Context, l *udpListener, queue chan<- datagram) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		// Set read deadline for UDP reads
+		l.conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			s.config.Logger.Errorf("server: failed to read from UDP %s: %v", l.conn.LocalAddr(), err)
+			continue
+		}
+		l.received.received.Add(1)
+		l.bytesIn.Add(uint64(n))
+		s.metrics.bytesIn.Add(uint64(n))
+
+		if !s.rateLimiter.allow(sourceIP(addr), time.Now()) {
+			l.received.rateLimited.Add(1)
+			continue
+		}
+
+		// Copy the datagram, buf is reused by the next read
+		packet := datagram{buf: getBuffer(n), n: n, addr: addr, listener: l}
+		copy(*packet.buf, buf[:n])
+		select {
+		case queue <- packet:
+		default:
+			// Shed load rather than stall the socket when workers fall behind
+			putBuffer(packet.buf)
+			l.received.queueFull.Add(1)
+		}
+	}
+}
+
+// sourceIP returns the IP a datagram came from, the zero address if addr has none
+func sourceIP(addr net.Addr) netip.Addr {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.AddrPort().Addr()
+	}
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addrPort.Addr()
+}
+
+// receiveWorker handles queued datagrams until the queue is closed
+func (s *Server) receiveWorker(queue <-chan datagram) {
+	for packet := range queue {
+		s.handleUDPMessage((*packet.buf)[:packet.n], packet.addr, packet.listener)
+		putBuffer(packet.buf)
+		packet.listener.received.handled.Add(1)
+	}
+}
+
+// getBuffer returns a buffer of at least n bytes, pooled if it is small enough
+func getBuffer(n int) *[]byte {
+	if n > pooledBufferSize {
+		buf := make([]byte, n)
+		return &buf
+	}
+	return bufferPool.Get().(*[]byte)
+}
+
+// putBuffer returns a buffer to the pool, oversized ones are left to the garbage collector
+func putBuffer(buf *[]byte) {
+	if cap(*buf) == pooledBufferSize {
+		bufferPool.Put(buf)
+	}
+}
+
+// reportDrops logs how many datagrams were dropped since the last report
+func (s *Server) reportDrops() {
+	stats := s.ReceiveStats()
+	last := s.reportedDrops
+	s.reportedDrops = stats
+	if stats.Dropped() == last.Dropped() {
+		return
+	}
+	s.config.Logger.Warnf("server: dropped %d datagrams, %d with the receive queue full and %d rate limited",
+		stats.Dropped()-last.Dropped(), stats.QueueFull-last.QueueFull, stats.RateLimited-last.RateLimited)
+}
+
+// rateLimiter is a token bucket per source address, a nil limiter allows everything
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	mu      sync.Mutex
+	buckets map[netip.Addr]*tokenBucket
+}
+
+// tokenBucket holds the tokens one source has left
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// newRateLimiter allows rate datagrams per second with bursts of burst, nil if rate is not positive
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[netip.Addr]*tokenBucket),
+	}
+}
+
+// allow takes a token of addr at now and reports whether one was left
+func (l *rateLimiter) allow(addr netip.Addr, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	addr = addr.Unmap()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket, exists := l.buckets[addr]
+	if !exists {
+		// Sources beyond the limit share the fate of a flood
+		if len(l.buckets) >= maxRateBuckets {
+			l.pruneLocked(now)
+			if len(l.buckets) >= maxRateBuckets {
+				return false
+			}
+		}
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[addr] = bucket
+	}
+
+	bucket.tokens = min(l.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate)
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// prune forgets sources whose bucket refilled completely
+func (l *rateLimiter) prune(now time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pruneLocked(now)
+}
+
+// pruneLocked forgets sources whose bucket refilled completely; mu must be held
+func (l *rateLimiter) pruneLocked(now time.Time) {
+	for addr, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, addr)
+		}
+	}
+}
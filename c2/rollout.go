@@ -0,0 +1,546 @@
+package c2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// AuditRollout records an operator fanning a command out to a group
+	AuditRollout AuditAction = "rollout"
+	// AuditCancelRollout records an operator cancelling a rollout
+	AuditCancelRollout AuditAction = "cancel_rollout"
+)
+
+var (
+	// ErrUnknownRollout is returned when a rollout ID does not exist
+	ErrUnknownRollout = errors.New("unknown rollout")
+	// ErrNoTargets is returned when no client is in the targeted group or carries the tag
+	ErrNoTargets = errors.New("no clients match target")
+	// ErrInvalidRollout is returned for malformed rollout options
+	ErrInvalidRollout = errors.New("invalid rollout")
+)
+
+// RolloutState describes where a rollout is in its lifecycle
+type RolloutState string
+
+const (
+	// RolloutStateRunning means batches are still being sent
+	RolloutStateRunning RolloutState = "running"
+	// RolloutStateCompleted means every batch was sent and finished
+	RolloutStateCompleted RolloutState = "completed"
+	// RolloutStateAborted means the failure threshold stopped the rollout
+	RolloutStateAborted RolloutState = "aborted"
+	// RolloutStateCancelled means an operator or server shutdown stopped the rollout
+	RolloutStateCancelled RolloutState = "cancelled"
+	// RolloutStateHalted means clients of a batch failed the health check
+	RolloutStateHalted RolloutState = "halted"
+)
+
+// RolloutOptions controls how a command is fanned out
+type RolloutOptions struct {
+	// BatchSize is how many clients run the command at once, all of them if 0
+	BatchSize int
+	// Pause is how long to wait between batches
+	Pause time.Duration
+	// MaxFailures stops the rollout once this many clients failed or were skipped because
+	// they were lost or refused the command, never if 0
+	MaxFailures int
+	// Timeout is how long the command may run on each client, see JobOptions
+	Timeout time.Duration
+	// HealthCheck is how long after a batch its clients must keep probing before the
+	// next batch starts, the rollout halts if one stops. Disabled if 0, except for upgrade
+	// rollouts which then check for as long as their clients take to turn late.
+	// HealthCheckOff disables it for upgrade rollouts too.
+	HealthCheck time.Duration
+}
+
+// HealthCheckOff disables the health check of a rollout, "off" in JSON and the console
+const HealthCheckOff time.Duration = -1
+
+// rolloutOptionsJSON is the wire form of RolloutOptions with readable durations
+type rolloutOptionsJSON struct {
+	BatchSize   int    `json:"batch_size,omitempty"`
+	Pause       string `json:"pause,omitempty"`
+	MaxFailures int    `json:"max_failures,omitempty"`
+	Timeout     string `json:"timeout,omitempty"`
+	HealthCheck string `json:"health_check,omitempty"`
+}
+
+// MarshalJSON encodes the durations as strings such as "30s"
+func (o RolloutOptions) MarshalJSON() ([]byte, error) {
+	wire := rolloutOptionsJSON{BatchSize: o.BatchSize, MaxFailures: o.MaxFailures}
+	if o.Pause > 0 {
+		wire.Pause = o.Pause.String()
+	}
+	if o.Timeout > 0 {
+		wire.Timeout = o.Timeout.String()
+	}
+	if o.HealthCheck > 0 {
+		wire.HealthCheck = o.HealthCheck.String()
+	} else if o.HealthCheck == HealthCheckOff {
+		wire.HealthCheck = "off"
+	}
+	return json.Marshal(wire)
+}
+
+// UnmarshalJSON decodes options with the durations given as strings
+func (o *RolloutOptions) UnmarshalJSON(data []byte) error {
+	var wire rolloutOptionsJSON
+	if err := json.Unmarshal(data, &wire); err != nil {
+		return err
+	}
+	*o = RolloutOptions{BatchSize: wire.BatchSize, MaxFailures: wire.MaxFailures}
+	if wire.Pause != "" {
+		pause, err := time.ParseDuration(wire.Pause)
+		if err != nil {
+			return fmt.Errorf("invalid pause: %w", err)
+		}
+		o.Pause = pause
+	}
+	if wire.Timeout != "" {
+		timeout, err := time.ParseDuration(wire.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid timeout: %w", err)
+		}
+		o.Timeout = timeout
+	}
+	if wire.HealthCheck != "" {
+		healthCheck, err := parseHealthCheck(wire.HealthCheck)
+		if err != nil {
+			return fmt.Errorf("invalid health check: %w", err)
+		}
+		o.HealthCheck = healthCheck
+	}
+	return nil
+}
+
+// parseHealthCheck parses a health check duration, or off to disable it
+func parseHealthCheck(value string) (time.Duration, error) {
+	if value == "off" {
+		return HealthCheckOff, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// validate rejects negative options
+func (o RolloutOptions) validate() error {
+	if o.BatchSize < 0 || o.Pause < 0 || o.MaxFailures < 0 || o.Timeout < 0 || (o.HealthCheck < 0 && o.HealthCheck != HealthCheckOff) {
+		return fmt.Errorf("server: %w: batch size, pause, max failures, timeout and health check must not be negative other than HealthCheckOff", ErrInvalidRollout)
+	}
+	return nil
+}
+
+// RolloutHost is the outcome of a rollout on one client
+type RolloutHost struct {
+	ClientID string `json:"client_id"`
+	// Group is the group or tag of the stage the client was reached through
+	Group    string   `json:"group"`
+	Batch    int      `json:"batch"`
+	JobID    uint64   `json:"job_id,omitempty"`
+	State    JobState `json:"state,omitempty"`
+	ExitCode int      `json:"exit_code"`
+	Output   string   `json:"output,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	// Skipped explains why the command was never queued for the client
+	Skipped string `json:"skipped,omitempty"`
+	// Unhealthy explains why the client failed the health check after its batch
+	Unhealthy string `json:"unhealthy,omitempty"`
+}
+
+// Rollout is a command fanned out to every member of one or more groups in batches
+type Rollout struct {
+	ID       uint64 `json:"id"`
+	Operator string `json:"operator,omitempty"`
+	// Target lists the groups or tags of the stages, separated by commas
+	Target  string `json:"target"`
+	Command string `json:"command"`
+	// Version is the release an upgrade rollout installs, the health check expects
+	// clients to report it. Empty for other rollouts.
+	Version    string         `json:"version,omitempty"`
+	Options    RolloutOptions `json:"options"`
+	State      RolloutState   `json:"state"`
+	CreatedAt  time.Time      `json:"created_at"`
+	FinishedAt time.Time      `json:"finished_at,omitempty"`
+	Hosts      []RolloutHost  `json:"hosts"`
+	Succeeded  int            `json:"succeeded"`
+	Failed     int            `json:"failed"`
+	Skipped    int            `json:"skipped"`
+}
+
+// Finished reports whether the rollout stopped sending batches
+func (r *Rollout) Finished() bool {
+	return r.State != RolloutStateRunning
+}
+
+// snapshot returns a copy of the rollout that does not share its hosts
+func (r *Rollout) snapshot() Rollout {
+	snapshot := *r
+	snapshot.Hosts = slices.Clone(r.Hosts)
+	return snapshot
+}
+
+// count recomputes the summary of the rollout from its hosts
+func (r *Rollout) count() {
+	r.Succeeded, r.Failed, r.Skipped = 0, 0, 0
+	for _, host := range r.Hosts {
+		switch {
+		case host.Skipped != "":
+			r.Skipped++
+		case host.Unhealthy != "":
+			r.Failed++
+		case host.State == JobStateSucceeded:
+			r.Succeeded++
+		case host.State != "" && (&Job{State: host.State}).Finished():
+			r.Failed++
+		}
+	}
+}
+
+// StartRollout fans cmd out to every client in the group or with the tag named by
+// target, on behalf of operator. The rollout is refused if the operator may not run
+// the command on any of the clients. It runs in the background, see WaitRollout.
+func (s *Server) StartRollout(operator string, target string, cmd string, opts RolloutOptions) (Rollout, error) {
+	return s.startRollout(operator, []string{target}, cmd, "", opts)
+}
+
+// startRollout fans cmd out to the members of each target in turn, a stage per target.
+// Batches never span stages and clients in several targets run in the first one only.
+func (s *Server) startRollout(operator string, targets []string, cmd string, version string, opts RolloutOptions) (Rollout, error) {
+	if err := opts.validate(); err != nil {
+		return Rollout{}, err
+	}
+	cmd, err := normalizeCommand(cmd)
+	if err != nil {
+		return Rollout{}, err
+	}
+
+	r := &Rollout{
+		Operator:  operator,
+		Command:   cmd,
+		Version:   version,
+		Options:   opts,
+		State:     RolloutStateRunning,
+		CreatedAt: time.Now(),
+	}
+	names := make([]string, len(targets))
+	seen := make(map[string]bool)
+	batch := 0
+	for i, target := range targets {
+		name := strings.TrimPrefix(target, "@")
+		names[i] = "@" + name
+		members := s.Members(name)
+		if len(members) == 0 {
+			return Rollout{}, fmt.Errorf("server: %w: @%s", ErrNoTargets, name)
+		}
+		members = slices.DeleteFunc(members, func(member ClientInfo) bool { return seen[member.Identifier] })
+		for _, member := range members {
+			if err := s.authorizeCommand(operator, member.Identifier, cmd); err != nil {
+				return Rollout{}, err
+			}
+			seen[member.Identifier] = true
+		}
+
+		batchSize := opts.BatchSize
+		if batchSize == 0 {
+			batchSize = len(members)
+		}
+		for j, member := range members {
+			r.Hosts = append(r.Hosts, RolloutHost{ClientID: member.Identifier, Group: names[i], Batch: batch + j/batchSize + 1})
+		}
+		if len(r.Hosts) > 0 {
+			batch = r.Hosts[len(r.Hosts)-1].Batch
+		}
+	}
+	if len(r.Hosts) == 0 {
+		return Rollout{}, fmt.Errorf("server: %w: %s", ErrNoTargets, strings.Join(names, ","))
+	}
+	r.Target = strings.Join(names, ",")
+	batchSize := opts.BatchSize
+	if batchSize == 0 {
+		batchSize = len(r.Hosts)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.rolloutsMu.Lock()
+	s.nextRolloutID++
+	r.ID = s.nextRolloutID
+	s.rollouts[r.ID] = r
+	s.rolloutCancel[r.ID] = cancel
+	s.rolloutDone[r.ID] = make(chan struct{})
+	snapshot := r.snapshot()
+	s.rolloutsMu.Unlock()
+
+	s.audit(AuditEntry{
+		Action:   AuditRollout,
+		Operator: operator,
+		Command:  cmd,
+		Detail: fmt.Sprintf("rollout %d to %s on %d clients, batch size %d, pause %s, max failures %d",
+			r.ID, r.Target, len(r.Hosts), batchSize, opts.Pause, opts.MaxFailures),
+	})
+	s.config.Logger.Infof("server: %s started rollout %d of '%s' to %s on %d clients", operator, r.ID, cmd, r.Target, len(r.Hosts))
+
+	// Server shutdown cancels rollouts that are still running
+	go func() {
+		select {
+		case <-s.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	go s.runRollout(ctx, r)
+	return snapshot, nil
+}
+
+// runRollout sends the batches of a rollout one after another until all are done,
+// the failure threshold is reached or ctx is cancelled
+func (s *Server) runRollout(ctx context.Context, r *Rollout) {
+	batches := r.Hosts[len(r.Hosts)-1].Batch
+	state := RolloutStateCompleted
+	// Clients skipped because they were lost or refused the job count as failures
+	skipped := 0
+
+	for batch := 1; batch <= batches && state == RolloutStateCompleted; batch++ {
+		if batch > 1 && r.Options.Pause > 0 {
+			timer := time.NewTimer(r.Options.Pause)
+			select {
+			case <-ctx.Done():
+			case <-timer.C:
+			}
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			state = RolloutStateCancelled
+			break
+		}
+
+		// Queue the batch, then wait for every job in it
+		jobs := make(map[int]uint64)
+		for i, host := range r.Hosts {
+			if host.Batch != batch {
+				continue
+			}
+			reason := ""
+			if client, exists := s.Client(host.ClientID); !exists {
+				reason = "client forgotten"
+			} else if client.State == ClientStateLost {
+				reason = "client lost"
+			} else if job, err := s.EnqueueWith(r.Operator, host.ClientID, r.Command, JobOptions{Timeout: r.Options.Timeout}); err != nil {
+				reason = err.Error()
+			} else {
+				jobs[i] = job.ID
+			}
+			if reason != "" {
+				skipped++
+			}
+			s.updateRollout(r.ID, func(r *Rollout) {
+				r.Hosts[i].JobID = jobs[i]
+				r.Hosts[i].Skipped = reason
+			})
+		}
+		for i, id := range jobs {
+			job, err := s.Wait(ctx, id)
+			if err != nil {
+				// Record how far the job got, it keeps running on the client
+				snapshot, _ := s.Job(id)
+				job = &snapshot
+				state = RolloutStateCancelled
+			}
+			s.updateRollout(r.ID, func(r *Rollout) {
+				r.Hosts[i].State = job.State
+				r.Hosts[i].ExitCode = job.ExitCode
+				r.Hosts[i].Output = job.Output
+				r.Hosts[i].Error = job.Error
+			})
+		}
+
+		if state == RolloutStateCompleted && r.Options.HealthCheck > 0 {
+			if unhealthy := s.checkHealth(ctx, r, batch); ctx.Err() != nil {
+				state = RolloutStateCancelled
+			} else if unhealthy > 0 {
+				s.config.Logger.Warnf("server: rollout %d halted, %d clients of batch %d failed the health check", r.ID, unhealthy, batch)
+				state = RolloutStateHalted
+			}
+		}
+
+		snapshot, _ := s.Rollout(r.ID)
+		s.emit(Event{Type: EventRolloutUpdated, Rollout: &snapshot})
+		if failures := snapshot.Failed + skipped; state == RolloutStateCompleted && r.Options.MaxFailures > 0 && failures >= r.Options.MaxFailures {
+			s.config.Logger.Warnf("server: rollout %d aborted after %d failures", r.ID, failures)
+			state = RolloutStateAborted
+		}
+	}
+
+	s.finishRollout(r.ID, state)
+}
+
+// checkHealth waits for the health check period of a rollout and marks the clients of a
+// batch whose job succeeded but that stopped probing since, or run another version than
+// the one the rollout installs. It returns how many clients it marked.
+func (s *Server) checkHealth(ctx context.Context, r *Rollout, batch int) int {
+	timer := time.NewTimer(r.Options.HealthCheck)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return 0
+	case <-timer.C:
+	}
+
+	snapshot, _ := s.Rollout(r.ID)
+	unhealthy := make(map[int]string)
+	for i, host := range snapshot.Hosts {
+		if host.Batch != batch || host.State != JobStateSucceeded {
+			continue
+		}
+		job, _ := s.Job(host.JobID)
+		client, exists := s.Client(host.ClientID)
+		switch {
+		case !exists:
+			unhealthy[i] = "client forgotten"
+		case client.State != ClientStateHealthy || !client.LastSeen.After(job.FinishedAt):
+			unhealthy[i] = fmt.Sprintf("stopped probing, last seen %s", client.LastSeen.Format(time.RFC3339))
+		case r.Version != "" && (client.Facts == nil || client.Facts.Version != r.Version):
+			running := "an unknown version"
+			if client.Facts != nil {
+				running = client.Facts.Version
+			}
+			unhealthy[i] = fmt.Sprintf("runs %s instead of %s", running, r.Version)
+		}
+	}
+	if len(unhealthy) > 0 {
+		s.updateRollout(r.ID, func(r *Rollout) {
+			for i, reason := range unhealthy {
+				r.Hosts[i].Unhealthy = reason
+			}
+		})
+	}
+	return len(unhealthy)
+}
+
+// updateRollout applies fn to a rollout and recomputes its summary
+func (s *Server) updateRollout(id uint64, fn func(r *Rollout)) {
+	s.rolloutsMu.Lock()
+	defer s.rolloutsMu.Unlock()
+	if r, exists := s.rollouts[id]; exists {
+		fn(r)
+		r.count()
+	}
+}
+
+// finishRollout marks the clients never reached as skipped and ends the rollout
+func (s *Server) finishRollout(id uint64, state RolloutState) {
+	s.rolloutsMu.Lock()
+	r := s.rollouts[id]
+	for i, host := range r.Hosts {
+		if host.JobID == 0 && host.Skipped == "" {
+			r.Hosts[i].Skipped = "rollout " + string(state)
+		}
+	}
+	r.State = state
+	r.FinishedAt = time.Now()
+	r.count()
+	snapshot := r.snapshot()
+	if cancel, exists := s.rolloutCancel[id]; exists {
+		cancel()
+		delete(s.rolloutCancel, id)
+	}
+	close(s.rolloutDone[id])
+	delete(s.rolloutDone, id)
+	s.rolloutsMu.Unlock()
+
+	s.config.Logger.Infof("server: rollout %d %s: %d succeeded, %d failed, %d skipped",
+		id, state, snapshot.Succeeded, snapshot.Failed, snapshot.Skipped)
+	s.emit(Event{Type: EventRolloutUpdated, Rollout: &snapshot})
+}
+
+// Rollout returns a snapshot of the rollout with the given ID
+func (s *Server) Rollout(id uint64) (Rollout, bool) {
+	s.rolloutsMu.Lock()
+	defer s.rolloutsMu.Unlock()
+
+	r, exists := s.rollouts[id]
+	if !exists {
+		return Rollout{}, false
+	}
+	return r.snapshot(), true
+}
+
+// Rollouts returns snapshots of all rollouts sorted by ID
+func (s *Server) Rollouts() []Rollout {
+	s.rolloutsMu.Lock()
+	defer s.rolloutsMu.Unlock()
+
+	rollouts := make([]Rollout, 0, len(s.rollouts))
+	for _, r := range s.rollouts {
+		rollouts = append(rollouts, r.snapshot())
+	}
+	sort.Slice(rollouts, func(i, j int) bool { return rollouts[i].ID < rollouts[j].ID })
+	return rollouts
+}
+
+// WaitRollout blocks until the rollout finishes or ctx is done and returns its final snapshot
+func (s *Server) WaitRollout(ctx context.Context, id uint64) (Rollout, error) {
+	s.rolloutsMu.Lock()
+	r, exists := s.rollouts[id]
+	if !exists {
+		s.rolloutsMu.Unlock()
+		return Rollout{}, fmt.Errorf("server: %w: %d", ErrUnknownRollout, id)
+	}
+	if r.Finished() {
+		snapshot := r.snapshot()
+		s.rolloutsMu.Unlock()
+		return snapshot, nil
+	}
+	done := s.rolloutDone[id]
+	s.rolloutsMu.Unlock()
+
+	select {
+	case <-done:
+		snapshot, _ := s.Rollout(id)
+		return snapshot, nil
+	case <-ctx.Done():
+		return Rollout{}, ctx.Err()
+	}
+}
+
+// CancelRollout stops a rollout from sending further batches on behalf of operator.
+// Jobs already queued keep running. Only the operator who started the rollout or an
+// admin may cancel it.
+func (s *Server) CancelRollout(operator string, id uint64) error {
+	r, exists := s.Rollout(id)
+	if !exists {
+		return fmt.Errorf("server: %w: %d", ErrUnknownRollout, id)
+	}
+	if operator != r.Operator {
+		if err := s.authorizeAdmin(operator, AuditCancelRollout, ""); err != nil {
+			return err
+		}
+	}
+
+	s.rolloutsMu.Lock()
+	cancel, running := s.rolloutCancel[id]
+	s.rolloutsMu.Unlock()
+	if !running {
+		return nil
+	}
+	cancel()
+	s.audit(AuditEntry{Action: AuditCancelRollout, Operator: operator, Detail: fmt.Sprintf("rollout %d", id)})
+	return nil
+}
+
+// pruneRollouts drops finished rollouts that outlived the retention period
+func (s *Server) pruneRollouts(now time.Time) {
+	s.rolloutsMu.Lock()
+	defer s.rolloutsMu.Unlock()
+	for id, r := range s.rollouts {
+		if r.Finished() && now.Sub(r.FinishedAt) > s.config.Retention {
+			delete(s.rollouts, id)
+		}
+	}
+}
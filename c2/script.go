@@ -0,0 +1,88 @@
+package c2
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// historyLimit is how many commands the console history file keeps
+const historyLimit = 1000
+
+// RunScript runs the commands read from r, one per line, skipping blank lines and
+// comments starting with #. It stops at quit and returns an error at the first
+// command that fails.
+func (c *Console) RunScript(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		input := strings.TrimSpace(scanner.Text())
+		if input == "" || strings.HasPrefix(input, "#") {
+			continue
+		}
+		running := c.Execute(input)
+		if c.err != nil {
+			return fmt.Errorf("console: line %d: %s: %w", line, input, c.err)
+		}
+		if !running {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("console: failed to read script: %w", err)
+	}
+	return nil
+}
+
+// record adds a command entered at the prompt to the history and its file
+func (c *Console) record(input string) {
+	c.history = append(c.history, input)
+	if len(c.history) > historyLimit {
+		c.history = c.history[len(c.history)-historyLimit:]
+	}
+
+	path := c.server.config.ConsoleHistory
+	if path == "" {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		c.server.config.Logger.Warnf("server: failed to save console history: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, input); err != nil {
+		c.server.config.Logger.Warnf("server: failed to save console history: %v", err)
+	}
+}
+
+// loadHistory reads the last commands of a history file, none if it does not exist yet.
+// The file is rewritten when it grew well beyond the commands kept.
+func loadHistory(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var history []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			history = append(history, line)
+		}
+	}
+	if len(history) <= historyLimit {
+		return history, nil
+	}
+	trimmed := len(history) > 2*historyLimit
+	history = history[len(history)-historyLimit:]
+	if trimmed {
+		if err := os.WriteFile(path, []byte(strings.Join(history, "\n")+"\n"), 0o600); err != nil {
+			return history, err
+		}
+	}
+	return history, nil
+}
@@ -1,63 +1,307 @@
 package c2
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
-	"os"
-	"strings"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/b1gcat/core/alert"
 	"github.com/b1gcat/core/pki"
-	"github.com/c-bata/go-prompt"
 	"github.com/sirupsen/logrus"
 )
 
-// Server represents a UDP server with interactive console
+// Server represents a c2 server with interactive console
 type Server struct {
 	config    *Config
-	conn      *net.UDPConn
+	conn      net.PacketConn
 	clients   map[string]*ClientInfo
 	clientsMu sync.RWMutex
-	consoleCh chan string
+
+	// Receive pipeline of the UDP sockets, conn is the one bound to Address
+	listeners   []*udpListener
+	rateLimiter *rateLimiter
+	// reportedDrops are the counters at the last drop report, used by the maintenance loop only
+	reportedDrops ReceiveStats
+	metrics       metricCounters
+
+	// Clients of the TLS transport, tlsListener is nil if it is disabled
+	tlsListener net.Listener
+	streamsMu   sync.Mutex
+	streams     map[*streamPeer]struct{}
+	// pendingStreams counts the connections without an authenticated message
+	pendingStreams int
+
+	// Lifecycle of Run
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	running  atomic.Bool
+
+	// Event subscribers, guarded by subsMu
+	subsMu      sync.Mutex
+	subscribers map[uint64]chan Event
+	nextSubID   uint64
+
+	// Identity verification state, guarded by authMu
+	authMu     sync.Mutex
+	trusted    map[string]ed25519.PublicKey
+	enrolments map[string]*EnrolmentRequest
+	replay     map[string]*replayWindow
+
+	// Per-client key epochs, guarded by keysMu
+	keysMu sync.Mutex
+	keys   map[string]*clientKeyState
+
+	fragments  *fragmenter
+	reassembly *reassembler
+
+	// Job queues, guarded by jobsMu
+	jobsMu    sync.Mutex
+	jobs      map[uint64]*Job
+	queues    map[string][]uint64
+	jobDone   map[uint64]chan struct{}
+	jobData   map[uint64][]byte // Payloads sent along with unfinished jobs
+	outputSeq map[uint64]uint64 // Next output message expected of running jobs
+	nextJobID uint64
+	// jobEffects are the events and store writes of job changes, run once jobsMu is released
+	jobEffects   []func()
+	flushingJobs bool
+
+	// File transfers, guarded by transfersMu
+	transfersMu    sync.Mutex
+	transfers      map[uint64]*Transfer
+	transferCancel map[uint64]context.CancelFunc
+	transferDone   map[uint64]chan struct{}
+	nextTransferID uint64
+
+	// Fan-out rollouts, guarded by rolloutsMu
+	rolloutsMu    sync.Mutex
+	rollouts      map[uint64]*Rollout
+	rolloutCancel map[uint64]context.CancelFunc
+	rolloutDone   map[uint64]chan struct{}
+	nextRolloutID uint64
+
+	// persistedAt is when each client was last written to the store, guarded by clientsMu
+	persistedAt map[string]time.Time
+	// ownsStore is set when the server opened the store and closes it on exit
+	ownsStore bool
+
+	auditLog *AuditLog
+	// alerts queues notifications for config.AlertClient, nil when alerting is disabled
+	alerts chan alertMessage
+
+	// roles holds the compiled roles of config.Roles
+	roles map[string]*compiledRole
 }
 
-// NewServer creates a new UDP server with the given options
+// NewServer creates a new server with the given options
 func NewServer(opts ...Option) (*Server, error) {
 	config := &Config{
-		Key:     make([]byte, 16), // Default 16-byte key
-		Address: "0.0.0.0:9001",   // Default server address
-		Logger:  logrus.New(),     // Default logger
+		Key:       make([]byte, 16), // Default 16-byte key
+		Address:   "0.0.0.0:9001",   // Default server address
+		Logger:    logrus.New(),     // Default logger
+		Enrolment: EnrolmentManual,  // Default operator approval for new clients
+		Codec:     CodecBinary,      // Default compact encoding for clients supporting it
+
+		ConsoleOutput: OutputText, // Default console tables and messages
+
+		KeyGracePeriod: 10 * time.Minute, // Default grace period for replaced keys
+		KeepAlive:      30 * time.Second, // Default TCP keepalive period of the TLS transport
+
+		PacketTransport: UDPTransport{}, // Default real UDP sockets
+
+		ReceiveWorkers: 4 * runtime.GOMAXPROCS(0), // Default workers per CPU handling datagrams
+		ReceiveQueue:   4096,                      // Default datagrams waiting for a worker
+		RateLimit:      1000,                      // Default datagrams per second from one source IP
+		RateBurst:      2000,                      // Default burst from one source IP
+
+		FragmentSize:      512,              // Default fragment payload size
+		MaxResultSize:     256 * 1024,       // Default 256 KiB result limit
+		ReassemblyTimeout: 30 * time.Second, // Default reassembly timeout
+
+		JobTTL:          24 * time.Hour,     // Default job time to live
+		ClientTimeout:   2 * time.Minute,    // Default time before a silent client is lost
+		LateProbes:      2,                  // Default missed probes before a client is late
+		LostProbes:      5,                  // Default missed probes before a client is lost
+		TransferTimeout: 5 * time.Minute,    // Default wait for a transfer job before the transfer fails
+		Retention:       7 * 24 * time.Hour, // Default one week of history
 	}
 
 	for _, opt := range opts {
 		opt(config)
 	}
 
-	if len(config.Key) != 16 {
+	if config.MasterKey != nil {
+		if len(config.MasterKey) < 16 {
+			return nil, fmt.Errorf("server: master key must be at least 16 bytes long")
+		}
+	} else if len(config.Key) != 16 {
 		return nil, fmt.Errorf("server: key must be 16 bytes long")
 	}
 
-	// Parse server address
-	addr, err := net.ResolveUDPAddr("udp", config.Address)
-	if err != nil {
-		return nil, fmt.Errorf("server: failed to resolve UDP address: %w", err)
+	if config.FragmentSize <= 0 || config.MaxResultSize <= 0 {
+		return nil, fmt.Errorf("server: fragment and result sizes must be positive")
+	}
+
+	if config.Codec != CodecGob && config.Codec != CodecBinary {
+		return nil, fmt.Errorf("server: unknown codec %q", config.Codec)
+	}
+
+	if config.ConsoleOutput != OutputText && config.ConsoleOutput != OutputJSON {
+		return nil, fmt.Errorf("server: unknown console output %q", config.ConsoleOutput)
+	}
+
+	if config.HTTPAddress != "" {
+		if len(config.APITokens) == 0 {
+			return nil, fmt.Errorf("server: HTTP API requires at least one API token")
+		}
+		// Bind to localhost unless a host is given explicitly
+		host, port, err := net.SplitHostPort(config.HTTPAddress)
+		if err != nil {
+			return nil, fmt.Errorf("server: invalid HTTP address: %w", err)
+		}
+		if host == "" {
+			config.HTTPAddress = net.JoinHostPort("127.0.0.1", port)
+		}
+	}
+
+	if config.ReceiveWorkers < 1 || config.ReceiveQueue < 1 {
+		return nil, fmt.Errorf("server: receive workers and queue must be positive")
+	}
+	if config.RateLimit < 0 || (config.RateLimit > 0 && config.RateBurst < 1) {
+		return nil, fmt.Errorf("server: rate limit must not be negative and allow bursts of at least one datagram")
 	}
 
-	// Create UDP connection
-	conn, err := net.ListenUDP("udp", addr)
+	if config.LateProbes < 1 || config.LostProbes <= config.LateProbes {
+		return nil, fmt.Errorf("server: late probes must be positive and less than lost probes")
+	}
+	if config.TransferTimeout <= 0 {
+		return nil, fmt.Errorf("server: transfer timeout must be positive")
+	}
+
+	roles, err := compileRoles(config.Roles)
 	if err != nil {
-		return nil, fmt.Errorf("server: failed to create UDP listener: %w", err)
+		return nil, fmt.Errorf("server: %w", err)
+	}
+	for name, operator := range config.Operators {
+		for _, role := range operator.Roles {
+			if _, exists := config.Roles[role]; !exists {
+				return nil, fmt.Errorf("server: operator %s has unknown role %s", name, role)
+			}
+		}
+	}
+
+	if config.PacketTransport == nil {
+		return nil, fmt.Errorf("server: packet transport must be set")
+	}
+
+	// Create the UDP sockets
+	var listeners []*udpListener
+	for _, address := range append([]string{config.Address}, config.ListenAddresses...) {
+		conn, err := config.PacketTransport.Listen(address)
+		if err != nil {
+			for _, l := range listeners {
+				l.conn.Close()
+			}
+			return nil, fmt.Errorf("server: %s: %w", address, err)
+		}
+		listeners = append(listeners, &udpListener{conn: conn})
+	}
+
+	trusted := make(map[string]ed25519.PublicKey, len(config.TrustedClients))
+	for id, pub := range config.TrustedClients {
+		trusted[id] = pub
+	}
+
+	s := &Server{
+		config:      config,
+		conn:        listeners[0].conn,
+		listeners:   listeners,
+		clients:     make(map[string]*ClientInfo),
+		streams:     make(map[*streamPeer]struct{}),
+		stopCh:      make(chan struct{}),
+		subscribers: make(map[uint64]chan Event),
+		trusted:     trusted,
+		enrolments:  make(map[string]*EnrolmentRequest),
+		replay:      make(map[string]*replayWindow),
+		keys:        make(map[string]*clientKeyState),
+		fragments:   newFragmenter(config.FragmentSize),
+		// Encryption pads results by up to one block
+		reassembly: newReassembler(config.MaxResultSize+8, config.ReassemblyTimeout),
+		jobs:       make(map[uint64]*Job),
+		queues:     make(map[string][]uint64),
+		jobDone:    make(map[uint64]chan struct{}),
+		jobData:    make(map[uint64][]byte),
+		outputSeq:  make(map[uint64]uint64),
+
+		rollouts:      make(map[uint64]*Rollout),
+		rolloutCancel: make(map[uint64]context.CancelFunc),
+		rolloutDone:   make(map[uint64]chan struct{}),
+
+		transfers:      make(map[uint64]*Transfer),
+		transferCancel: make(map[uint64]context.CancelFunc),
+		transferDone:   make(map[uint64]chan struct{}),
+
+		rateLimiter: newRateLimiter(config.RateLimit, config.RateBurst),
+		persistedAt: make(map[string]time.Time),
+		roles:       roles,
+	}
+
+	if config.AlertClient != nil {
+		s.alerts = make(chan alertMessage, alertQueueSize)
 	}
 
-	return &Server{
-		config:    config,
-		conn:      conn,
-		clients:   make(map[string]*ClientInfo),
-		consoleCh: make(chan string),
-	}, nil
+	// Restore key epochs and pinned keys so clients keep working after a restart
+	if err := s.loadKeyStates(); err != nil {
+		s.closeListeners()
+		return nil, err
+	}
+
+	// Refuse to extend an audit trail that was tampered with
+	if config.AuditFile != "" {
+		s.auditLog, err = OpenAuditLog(config.AuditFile)
+		if err != nil {
+			s.closeListeners()
+			return nil, fmt.Errorf("server: %w", err)
+		}
+	}
+
+	// Restore clients and jobs from the previous run
+	if config.Store == nil && config.StateFile != "" {
+		store, err := OpenFileStore(config.StateFile)
+		if err != nil {
+			s.closeListeners()
+			return nil, fmt.Errorf("server: %w", err)
+		}
+		config.Store = store
+		s.ownsStore = true
+	}
+	if err := s.restoreState(time.Now()); err != nil {
+		s.closeListeners()
+		s.closeStore()
+		s.closeAudit()
+		return nil, err
+	}
+
+	// Listen for stream clients alongside the UDP socket
+	if config.TLSAddress != "" {
+		if s.tlsListener, err = listenTLS(config); err != nil {
+			s.closeListeners()
+			s.closeStore()
+			s.closeAudit()
+			return nil, fmt.Errorf("server: %w", err)
+		}
+	}
+
+	return s, nil
 }
 
 // WithServerKey sets the encryption key for the server
@@ -74,6 +318,14 @@ func WithServerAddress(address string) Option {
 	}
 }
 
+// WithServerListenAddress adds UDP addresses the server listens on besides its address.
+// A literal IPv4 or IPv6 host binds that family only, so 0.0.0.0 and [::] can share a port.
+func WithServerListenAddress(addresses ...string) Option {
+	return func(cfg *Config) {
+		cfg.ListenAddresses = append(cfg.ListenAddresses, addresses...)
+	}
+}
+
 // WithServerLogger sets the logger for server output
 func WithServerLogger(logger *logrus.Logger) Option {
 	return func(cfg *Config) {
@@ -81,65 +333,309 @@ func WithServerLogger(logger *logrus.Logger) Option {
 	}
 }
 
-// Start begins the server's main loop
-func (s *Server) Start() error {
-	// Start UDP listener
-	go s.udpListenLoop()
+// WithServerMasterKey enables per-client keys derived from the given secret
+func WithServerMasterKey(secret string) Option {
+	return func(cfg *Config) {
+		cfg.MasterKey = []byte(secret)
+	}
+}
 
-	// Start console processing automatically
-	go s.StartConsole()
+// WithServerKeyStateFile sets the file persisting client key epochs and the identity
+// keys pinned at enrolment, which are otherwise enrolled again after a restart
+func WithServerKeyStateFile(path string) Option {
+	return func(cfg *Config) {
+		cfg.KeyStateFile = path
+	}
+}
 
-	// Server runs continuously, we'll exit directly via Stop()
-	select {}
+// WithServerKeyGracePeriod sets how long a replaced client key stays accepted
+func WithServerKeyGracePeriod(grace time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.KeyGracePeriod = grace
+	}
 }
 
-// Stop terminates the server
-func (s *Server) Stop() {
-	// Exit directly as requested
-	os.Exit(0)
+// WithServerFragmentSize sets the largest payload sent in a single datagram
+func WithServerFragmentSize(size int) Option {
+	return func(cfg *Config) {
+		cfg.FragmentSize = size
+	}
 }
 
-func (s *Server) udpListenLoop() {
-	buf := make([]byte, 1024)
+// WithServerMaxResultSize sets the largest command result the server accepts
+func WithServerMaxResultSize(size int) Option {
+	return func(cfg *Config) {
+		cfg.MaxResultSize = size
+	}
+}
 
-	for {
-		// Set read deadline for UDP reads
-		s.conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-		n, addr, err := s.conn.ReadFromUDP(buf)
-		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				continue
-			}
-			s.config.Logger.Errorf("server: failed to read from UDP: %v", err)
-			continue
+// WithServerReassemblyTimeout sets how long partially received messages are kept
+func WithServerReassemblyTimeout(timeout time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.ReassemblyTimeout = timeout
+	}
+}
+
+// WithServerJobTTL sets how long a job may take from queueing to completion
+func WithServerJobTTL(ttl time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.JobTTL = ttl
+	}
+}
+
+// WithServerTransferTimeout sets how long a file transfer waits for one of its chunks
+// before it fails, so transfers to clients that went away stop early
+func WithServerTransferTimeout(timeout time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.TransferTimeout = timeout
+	}
+}
+
+// WithServerClientTimeout sets how long a client may stay silent before it is considered lost
+func WithServerClientTimeout(timeout time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.ClientTimeout = timeout
+	}
+}
+
+// WithServerLiveness sets how many probes a client may miss before it is late and lost
+func WithServerLiveness(late int, lost int) Option {
+	return func(cfg *Config) {
+		cfg.LateProbes = late
+		cfg.LostProbes = lost
+	}
+}
+
+// WithServerTLSAddress additionally accepts clients over TLS on address
+func WithServerTLSAddress(address string) Option {
+	return func(cfg *Config) {
+		cfg.TLSAddress = address
+	}
+}
+
+// WithServerCertificate sets the certificate of the TLS transport, which is required with a TLS address
+func WithServerCertificate(cert tls.Certificate) Option {
+	return func(cfg *Config) {
+		cfg.Certificate = &cert
+	}
+}
+
+// WithServerClientCAs requires TLS clients to present a certificate issued by one of the CAs in pool
+func WithServerClientCAs(pool *x509.CertPool) Option {
+	return func(cfg *Config) {
+		cfg.ClientCAs = pool
+	}
+}
+
+// WithServerKeepAlive sets the TCP keepalive period of the TLS transport
+func WithServerKeepAlive(period time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.KeepAlive = period
+	}
+}
+
+// WithServerCodec sets the message encoding offered to clients, CodecGob keeps every client on the legacy encoding
+func WithServerCodec(codec CodecType) Option {
+	return func(cfg *Config) {
+		cfg.Codec = codec
+	}
+}
+
+// WithServerPacketTransport sets the transport the UDP socket is opened with
+func WithServerPacketTransport(transport PacketTransport) Option {
+	return func(cfg *Config) {
+		cfg.PacketTransport = transport
+	}
+}
+
+// WithServerReceiveWorkers sets how many workers handle datagrams and how many may wait for one
+func WithServerReceiveWorkers(workers int, queue int) Option {
+	return func(cfg *Config) {
+		cfg.ReceiveWorkers = workers
+		cfg.ReceiveQueue = queue
+	}
+}
+
+// WithServerRateLimit sets how many datagrams per second one source IP may send, zero disables the limit
+func WithServerRateLimit(perSecond float64, burst int) Option {
+	return func(cfg *Config) {
+		cfg.RateLimit = perSecond
+		cfg.RateBurst = burst
+	}
+}
+
+// WithServerHTTPAddress enables the HTTP management API; addresses without a host bind to localhost
+func WithServerHTTPAddress(address string) Option {
+	return func(cfg *Config) {
+		cfg.HTTPAddress = address
+	}
+}
+
+// WithServerAPIToken adds a bearer token for the HTTP API, named after the operator using it
+func WithServerAPIToken(operator string, token string) Option {
+	return func(cfg *Config) {
+		if cfg.APITokens == nil {
+			cfg.APITokens = make(map[string]string)
 		}
+		cfg.APITokens[operator] = token
+	}
+}
 
-		go s.handleUDPMessage(buf[:n], addr)
+// WithServerStore sets the store persisting clients and jobs across restarts
+func WithServerStore(store Store) Option {
+	return func(cfg *Config) {
+		cfg.Store = store
 	}
 }
 
-func (s *Server) handleUDPMessage(data []byte, addr *net.UDPAddr) {
-	// Detect and unwrap protocol if needed
-	protocol := DetectProtocol(data)
-	if protocol != ProtocolNone {
-		wrapper := GetProtocolWrapper(protocol)
-		if wrapper != nil {
-			var err error
-			data, err = wrapper.Unwrap(data)
-			if err != nil {
-				s.config.Logger.Errorf("server: failed to unwrap message from %s: %v", addr.String(), err)
-				return
+// WithServerStateFile persists clients and jobs in the file-based store at path
+func WithServerStateFile(path string) Option {
+	return func(cfg *Config) {
+		cfg.StateFile = path
+	}
+}
+
+// WithServerRetention sets how long finished jobs and lost clients are kept
+func WithServerRetention(retention time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.Retention = retention
+	}
+}
+
+// WithServerAuditFile records operator actions and job outcomes in a hash-chained log at path
+func WithServerAuditFile(path string) Option {
+	return func(cfg *Config) {
+		cfg.AuditFile = path
+	}
+}
+
+// WithServerAlertClient sends an alert through client whenever a client is lost or returns
+func WithServerAlertClient(client alert.AlertClient) Option {
+	return func(cfg *Config) {
+		cfg.AlertClient = client
+	}
+}
+
+// WithServerRole adds a role operators can be granted
+func WithServerRole(role Role) Option {
+	return func(cfg *Config) {
+		if cfg.Roles == nil {
+			cfg.Roles = make(map[string]Role)
+		}
+		cfg.Roles[role.Name] = role
+	}
+}
+
+// WithServerOperator adds an operator account; a non-empty token also grants API access
+func WithServerOperator(name string, token string, roles ...string) Option {
+	return func(cfg *Config) {
+		if cfg.Operators == nil {
+			cfg.Operators = make(map[string]Operator)
+		}
+		cfg.Operators[name] = Operator{Name: name, Token: token, Roles: roles}
+		if token != "" {
+			if cfg.APITokens == nil {
+				cfg.APITokens = make(map[string]string)
 			}
+			cfg.APITokens[name] = token
 		}
 	}
+}
 
-	// Decode message
-	var msg Message
-	dec := gob.NewDecoder(bytes.NewReader(data))
-	if err := dec.Decode(&msg); err != nil {
+// WithServerClientGroup assigns clients whose identifiers match any of the patterns to a group
+func WithServerClientGroup(group string, patterns ...string) Option {
+	return func(cfg *Config) {
+		if cfg.ClientGroups == nil {
+			cfg.ClientGroups = make(map[string][]string)
+		}
+		cfg.ClientGroups[group] = append(cfg.ClientGroups[group], patterns...)
+	}
+}
+
+// WithServerConsoleOperator sets the operator account the interactive console acts as
+func WithServerConsoleOperator(name string) Option {
+	return func(cfg *Config) {
+		cfg.ConsoleOperator = name
+	}
+}
+
+// WithServerConsoleOutput sets how the console writes the outcome of commands
+func WithServerConsoleOutput(format OutputFormat) Option {
+	return func(cfg *Config) {
+		cfg.ConsoleOutput = format
+	}
+}
+
+// WithServerConsoleScript makes the console run the commands of a file instead of
+// prompting, - reads them from standard input
+func WithServerConsoleScript(path string) Option {
+	return func(cfg *Config) {
+		cfg.ConsoleScript = path
+	}
+}
+
+// WithServerConsoleHistory keeps the commands entered at the console in a file across sessions
+func WithServerConsoleHistory(path string) Option {
+	return func(cfg *Config) {
+		cfg.ConsoleHistory = path
+	}
+}
+
+// WithServerTrustedClient pre-provisions the public key of a client
+func WithServerTrustedClient(identifier string, publicKey ed25519.PublicKey) Option {
+	return func(cfg *Config) {
+		if cfg.TrustedClients == nil {
+			cfg.TrustedClients = make(map[string]ed25519.PublicKey)
+		}
+		cfg.TrustedClients[identifier] = publicKey
+	}
+}
+
+// WithServerEnrolment sets how the server handles probes from unknown identities
+func WithServerEnrolment(policy EnrolmentPolicy) Option {
+	return func(cfg *Config) {
+		cfg.Enrolment = policy
+	}
+}
+
+func (s *Server) handleUDPMessage(data []byte, addr net.Addr, listener *udpListener) {
+	// Detect and unwrap protocol, then decode message
+	msg, protocol, codec, err := decodePacket(data)
+	if err != nil {
+		s.metrics.decodeFailures.Add(1)
 		s.config.Logger.Errorf("server: failed to decode message from %s: %v", addr.String(), err)
 		return
 	}
+	s.handleMessage(msg, protocol, codec, udpPeer{listener: listener, addr: addr})
+}
+
+// handleMessage authenticates and dispatches a message that arrived from a client
+// in the given protocol and codec, and reports whether it passed authentication
+func (s *Server) handleMessage(msg Message, protocol ProtocolType, codec CodecType, from peer) bool {
+	addr := from.remoteAddr()
+
+	// Verify the identity proof before trusting the claimed identifier
+	if err := s.authenticate(&msg, addr); err != nil {
+		if errors.Is(err, ErrEnrolmentPending) {
+			s.config.Logger.Debugf("server: probe from %s (%s) awaiting enrolment", msg.Identifier, addr.String())
+		} else {
+			s.config.Logger.Warnf("server: rejected message from %s (%s): %v", msg.Identifier, addr.String(), err)
+		}
+		return false
+	}
+	if err := s.observeKeyEpoch(msg.Identifier, msg.KeyEpoch); err != nil {
+		s.config.Logger.Warnf("server: rejected message from %s (%s): %v", msg.Identifier, addr.String(), err)
+		return false
+	}
+
+	// Probes negotiate the codec, other messages keep the one the client is using
+	if msg.Type == MessageTypeProbe {
+		s.metrics.probeReceived(protocol)
+		codec = CodecGob
+		if msg.Capabilities&s.capabilities()&CapabilityBinaryCodec != 0 {
+			codec = CodecBinary
+		}
+	}
 
 	// Update client protocol information
 	s.clientsMu.Lock()
@@ -149,6 +645,10 @@ func (s *Server) handleUDPMessage(data []byte, addr *net.UDPAddr) {
 			Identifier: msg.Identifier,
 			SourceIP:   addr,
 			Protocol:   protocol,
+			Groups:     s.groupsFor(msg.Identifier, nil),
+			Transport:  from.transport(),
+			Listener:   from.localAddr().String(),
+			Codec:      codec,
 		}
 		s.clients[msg.Identifier] = client
 	} else {
@@ -157,255 +657,279 @@ func (s *Server) handleUDPMessage(data []byte, addr *net.UDPAddr) {
 			client.Protocol = protocol
 		}
 	}
+	previous, lastSeen := client.State, client.LastSeen
+	seen := !exists || previous != ClientStateHealthy
+	client.State = ClientStateHealthy
 	client.LastSeen = time.Now()
 	client.SourceIP = addr
+	client.Transport = from.transport()
+	client.Listener = from.localAddr().String()
+	client.Codec = codec
+	// Persist registrations, and last-seen times at a bounded rate
+	persist := seen || client.LastSeen.Sub(s.persistedAt[msg.Identifier]) >= storeSeenInterval
+	if persist {
+		s.persistedAt[msg.Identifier] = client.LastSeen
+	}
+	snapshot := *client
 	s.clientsMu.Unlock()
 
+	if persist {
+		s.persistClient(snapshot)
+	}
+	if seen {
+		s.emit(Event{Type: EventClientSeen, ClientID: msg.Identifier})
+	}
+	if exists && previous == ClientStateLost {
+		s.clientReturned(snapshot, lastSeen)
+	}
+
+	// Reassemble fragmented messages, acknowledging every fragment
+	if msg.FragmentCount > 0 {
+		ack := Message{
+			Type:          MessageTypeAck,
+			Identifier:    msg.Identifier,
+			MessageID:     msg.MessageID,
+			FragmentIndex: msg.FragmentIndex,
+		}
+		if err := s.writeMessage(msg.Identifier, from, ack); err != nil {
+			s.config.Logger.Debugf("server: failed to acknowledge fragment from %s: %v", addr.String(), err)
+		}
+		payload, complete, err := s.reassembly.add(msg, time.Now())
+		if err != nil {
+			s.config.Logger.Errorf("server: failed to reassemble message from %s: %v", addr.String(), err)
+			return true
+		}
+		if !complete {
+			return true
+		}
+		msg.Payload = payload
+	}
+
 	// Handle message based on type
 	switch msg.Type {
+	case MessageTypeAck:
+		s.fragments.ack(msg.MessageID, msg.FragmentIndex)
 	case MessageTypeProbe:
-		s.handleProbe(msg, addr)
+		s.handleProbe(msg, from)
 	case MessageTypeResult:
-		s.handleResult(msg, addr)
+		s.handleResult(msg, from)
+	case MessageTypeStatus:
+		s.handleStatus(msg, from)
+	case MessageTypeOutput:
+		s.handleOutput(msg, from)
 	default:
 		s.config.Logger.Errorf("server: unknown message type %d from %s", msg.Type, addr.String())
 	}
+	return true
 }
 
-func (s *Server) handleProbe(msg Message, addr *net.UDPAddr) {
-	// Check if there's a pending command
-	s.clientsMu.Lock()
-	client, exists := s.clients[msg.Identifier]
-	var pendingCmd string
-	if exists && client.PendingCmd != "" {
-		pendingCmd = client.PendingCmd
-		client.PendingCmd = "" // Clear pending command
+// decodePacket unwraps and decodes a datagram. Plain messages can pass the
+// loose protocol detection, so the raw packet is tried when unwrapping fails.
+func decodePacket(data []byte) (Message, ProtocolType, CodecType, error) {
+	protocol := DetectProtocol(data)
+	if protocol != ProtocolNone {
+		wrapper := GetProtocolWrapper(protocol)
+		if wrapper != nil {
+			if payload, err := wrapper.Unwrap(data); err == nil {
+				if msg, codec, err := decodeMessage(payload); err == nil {
+					return msg, protocol, codec, nil
+				}
+			}
+		}
 	}
-	s.clientsMu.Unlock()
 
-	// If there's a pending command, send it back to the client
-	if pendingCmd != "" {
-		s.sendCommandToClient(msg.Identifier, addr, pendingCmd)
+	msg, codec, err := decodeMessage(data)
+	if err != nil {
+		return Message{}, ProtocolNone, "", err
 	}
+	return msg, ProtocolNone, codec, nil
 }
 
-func (s *Server) handleResult(msg Message, addr *net.UDPAddr) {
-	// Decrypt result
-	decryptedResult, err := pki.Decrypt(s.config.Key, msg.Payload)
-	if err != nil {
-		s.config.Logger.Errorf("server: failed to decrypt result from %s: %v", addr.String(), err)
-		return
+// capabilities returns the protocol features the server offers to clients
+func (s *Server) capabilities() Capability {
+	if s.config.Codec == CodecBinary {
+		return CapabilityBinaryCodec
 	}
-
-	s.config.Logger.Infof("server: command result from %s:\n%s", msg.Identifier, decryptedResult)
+	return 0
 }
 
-func (s *Server) sendCommandToClient(identifier string, addr *net.UDPAddr, cmd string) {
-	// Encrypt command
-	encryptedCmd, err := pki.Encrypt(s.config.Key, []byte(cmd))
-	if err != nil {
-		s.config.Logger.Errorf("server: failed to encrypt command for %s: %v", identifier, err)
-		return
+func (s *Server) handleProbe(msg Message, from peer) {
+	// Record the tags and host facts the client advertises, if any
+	if len(msg.Payload) > 0 {
+		var info ProbeInfo
+		if err := s.decryptPayload(msg, &info); err != nil {
+			s.config.Logger.Errorf("server: failed to read probe info from %s: %v", from.remoteAddr(), err)
+		} else {
+			s.setClientTags(msg.Identifier, info.Tags)
+			if info.Facts != nil {
+				s.setClientFacts(msg.Identifier, *info.Facts, info.Interval)
+			}
+		}
 	}
 
-	// Create command message
-	cmdMsg := Message{
-		Type:       MessageTypeCommand,
-		Identifier: identifier,
-		Payload:    encryptedCmd,
+	// Confirm the probe so the client knows the server is reachable,
+	// asking for host facts the server does not know yet
+	ack := Message{Type: MessageTypeProbeAck, Identifier: msg.Identifier, Capabilities: s.capabilities()}
+	if client, _ := s.Client(msg.Identifier); client.Facts == nil {
+		ack.Payload = []byte{probeAckWantFacts}
 	}
+	s.sendMessage(msg.Identifier, from, ack)
 
-	// Encode message
-	var buf bytes.Buffer
-	en := gob.NewEncoder(&buf)
-	if err := en.Encode(cmdMsg); err != nil {
-		s.config.Logger.Errorf("server: failed to encode command for %s: %v", identifier, err)
-		return
+	// Deliver a pending key rotation until the client adopts the new epoch
+	rotation, pending, err := s.pendingRotation(msg.Identifier)
+	if err != nil {
+		s.config.Logger.Errorf("server: failed to prepare key rotation for %s: %v", msg.Identifier, err)
+	} else if pending {
+		s.sendMessage(msg.Identifier, from, Message{
+			Type:       MessageTypeRotateKey,
+			Identifier: msg.Identifier,
+			KeyEpoch:   msg.KeyEpoch,
+			Payload:    rotation,
+		})
 	}
 
-	// Get client's protocol type
-	s.clientsMu.RLock()
-	client, exists := s.clients[identifier]
-	protocol := ProtocolNone
-	if exists {
-		protocol = client.Protocol
-	}
-	s.clientsMu.RUnlock()
+	// Ask the client to kill a command an operator cancelled until its result arrives
+	s.dispatchCancel(msg.Identifier, from)
 
-	// Apply protocol obfuscation if needed
-	data := buf.Bytes()
-	if protocol != ProtocolNone {
-		wrapper := GetProtocolWrapper(protocol)
-		if wrapper != nil {
-			var err error
-			data, err = wrapper.Wrap(data)
-			if err != nil {
-				s.config.Logger.Errorf("server: failed to wrap command for %s: %v", identifier, err)
-				return
-			}
-		}
-	}
+	// Send the next queued job, if any
+	s.dispatchJob(msg.Identifier, from)
+}
 
-	// Send message
-	_, err = s.conn.WriteToUDP(data, addr)
-	if err != nil {
-		s.config.Logger.Errorf("server: failed to send command to %s: %v", addr.String(), err)
+func (s *Server) handleResult(msg Message, from peer) {
+	// Decrypt result with the key of the epoch the client used
+	var result CommandResult
+	if err := s.decryptPayload(msg, &result); err != nil {
+		s.config.Logger.Errorf("server: failed to read result from %s: %v", from.remoteAddr(), err)
 		return
 	}
 
-	s.config.Logger.Infof("server: sent command to %s: %s", identifier, cmd)
-}
-
-func (s *Server) consoleLoop() {
-	fmt.Println("C2 Server Console")
-	fmt.Println("Type 'help' for available commands, type '?' to show command suggestions")
-
-	p := prompt.New(
-		func(in string) {
-			if in == "" {
-				return
-			}
-			// Handle ? command for showing suggestions
-			if in == "?" {
-				s.showHelp()
-				return
-			}
-			// Send command to processing channel
-			s.consoleCh <- in
-		},
-		func(d prompt.Document) []prompt.Suggest {
-			// Only show full command list when user types exactly "?"
-			if d.Text == "?" {
-				// Command suggestions
-				return []prompt.Suggest{
-					{Text: "help", Description: "Show help message"},
-					{Text: "show", Description: "Show all connected clients"},
-					{Text: "execute", Description: "Send command to client"},
-					{Text: "quit", Description: "Exit the server"},
-					{Text: "exit", Description: "Exit the server"},
-				}
-			}
-
-			// Only show client IDs when completing execute command
-			if strings.HasPrefix(d.GetWordBeforeCursor(), "execute ") {
-				clientSuggests := []prompt.Suggest{}
-				s.clientsMu.RLock()
-				for id := range s.clients {
-					clientSuggests = append(clientSuggests, prompt.Suggest{Text: id})
-				}
-				s.clientsMu.RUnlock()
-
-				return clientSuggests
-			}
-
-			// No suggestions for other cases
-			return nil
-		},
-		prompt.OptionPrefix("> "),
-		prompt.OptionInputTextColor(prompt.Green),
-		prompt.OptionSuggestionTextColor(prompt.White),
-		prompt.OptionSelectedSuggestionTextColor(prompt.Black),
-		prompt.OptionSelectedSuggestionBGColor(prompt.LightGray),
-		prompt.OptionCompletionOnDown(), // Only show suggestions when pressing Tab or Down
-	)
+	job, ok := s.updateJob(msg.Identifier, result.JobID, func(job *Job) {
+		job.ExitCode = result.ExitCode
+		job.Output = result.Output
+		job.Error = result.Error
+		job.FinishedAt = time.Now()
+		job.CancelRequested = false
+		if job.StartedAt.IsZero() {
+			job.StartedAt = job.SentAt
+		}
+		switch {
+		case result.Violation != "":
+			job.State = JobStateRejected
+			job.Error = result.Violation
+		case result.Cancelled:
+			job.State = JobStateCancelled
+		case result.TimedOut:
+			job.State = JobStateTimedOut
+		case result.ExitCode == 0 && result.Error == "":
+			job.State = JobStateSucceeded
+		default:
+			job.State = JobStateFailed
+		}
+	})
+	if !ok {
+		// Duplicate result of a job that already finished
+		s.config.Logger.Debugf("server: ignoring result for unknown or finished job %d from %s", result.JobID, msg.Identifier)
+		return
+	}
 
-	// Start the prompt
-	p.Run()
+	s.config.Logger.Infof("server: job %d on %s %s (exit code %d):\n%s%s",
+		job.ID, msg.Identifier, job.State, job.ExitCode, job.Output, job.Error)
+	s.emit(Event{Type: EventResultReceived, ClientID: msg.Identifier, Job: &job})
 
-	// When prompt exits, stop the server directly
-	s.Stop()
+	// The client is reachable right now, send its next job without waiting for a probe
+	s.dispatchJob(msg.Identifier, from)
 }
 
-// StartConsole starts the server's console processing
-func (s *Server) StartConsole() {
-	// Start console input loop
-	go s.consoleLoop()
-
-	// Process console commands continuously
-	for input := range s.consoleCh {
-		s.processConsoleCommand(input)
+func (s *Server) sendCommandToClient(identifier string, to peer, job *Job) {
+	key, epoch, err := s.clientKey(identifier)
+	if err != nil {
+		s.config.Logger.Errorf("server: failed to derive key for %s: %v", identifier, err)
+		return
 	}
-}
 
-func (s *Server) processConsoleCommand(input string) {
-	args := strings.Split(input, " ")
-	if len(args) == 0 {
-		fmt.Print("> ")
+	// Encrypt command
+	request, err := json.Marshal(CommandRequest{JobID: job.ID, Command: job.Command, Data: s.jobPayload(job.ID), Timeout: job.Timeout})
+	if err != nil {
+		s.config.Logger.Errorf("server: failed to encode command for %s: %v", identifier, err)
+		return
+	}
+	encryptedCmd, err := pki.Encrypt(key, request)
+	if err != nil {
+		s.config.Logger.Errorf("server: failed to encrypt command for %s: %v", identifier, err)
 		return
 	}
 
-	command := strings.ToLower(args[0])
+	// Create command message
+	cmdMsg := Message{
+		Type:       MessageTypeCommand,
+		Identifier: identifier,
+		KeyEpoch:   epoch,
+		Payload:    encryptedCmd,
+	}
 
-	switch command {
-	case "help":
-		s.showHelp()
-	case "show":
-		s.showClients()
-	case "execute":
-		if len(args) < 3 {
-			fmt.Println("Usage: execute <client-identifier> <command>")
-			fmt.Print("> ")
-			return
+	send := func() {
+		if s.sendMessage(identifier, to, cmdMsg) {
+			s.config.Logger.Infof("server: sent job %d to %s: %s", job.ID, identifier, job.Command)
 		}
-		clientID := args[1]
-		cmd := strings.Join(args[2:], " ")
-		s.executeCommand(clientID, cmd)
-	case "quit", "exit":
-		s.Stop()
+	}
+	// Fragments wait for acknowledgements, which need a free receive worker
+	if to.transport() == TransportUDP && len(encryptedCmd) > s.config.FragmentSize {
+		go send()
 		return
-	default:
-		fmt.Printf("Unknown command: %s\n", command)
-		fmt.Println("Type 'help' for available commands")
 	}
-
-	fmt.Print("> ")
+	send()
 }
 
-func (s *Server) showHelp() {
-	fmt.Println("Available commands:")
-	fmt.Println("  help                Show this help message")
-	fmt.Println("  show                Show all connected clients")
-	fmt.Println("  execute <id> <cmd>  Send command to client")
-	fmt.Println("  quit/exit           Exit the server")
+// sendMessage sends a message to a client, fragmenting large payloads
+func (s *Server) sendMessage(identifier string, to peer, msg Message) bool {
+	var err error
+	if to.transport() == TransportUDP {
+		err = s.fragments.send(msg, func(m Message) error {
+			return s.writeMessage(identifier, to, m)
+		})
+	} else {
+		// Streams deliver whole messages in order, only datagrams need fragments
+		err = s.writeMessage(identifier, to, msg)
+	}
+	if err != nil {
+		s.config.Logger.Errorf("server: failed to send message to %s: %v", identifier, err)
+		return false
+	}
+	return true
 }
 
-func (s *Server) showClients() {
+// writeMessage encodes, wraps and writes a single message to a client
+func (s *Server) writeMessage(identifier string, to peer, msg Message) error {
+	// Get client's protocol type and codec
 	s.clientsMu.RLock()
-	defer s.clientsMu.RUnlock()
-
-	if len(s.clients) == 0 {
-		fmt.Println("No connected clients")
-		return
+	client, exists := s.clients[identifier]
+	protocol, codec := ProtocolNone, CodecGob
+	if exists {
+		protocol, codec = client.Protocol, client.Codec
 	}
+	s.clientsMu.RUnlock()
 
-	fmt.Printf("%-20s %-20s %-30s\n", "Identifier", "IP Address", "Last Seen")
-	fmt.Println(strings.Repeat("-", 70))
-
-	for _, client := range s.clients {
-		fmt.Printf("%-20s %-20s %-30s\n",
-			client.Identifier,
-			client.SourceIP.String(),
-			client.LastSeen.Format(time.RFC3339))
+	// Encode message
+	data, err := encodeMessage(msg, codec)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
 	}
-}
 
-func (s *Server) executeCommand(clientID string, cmd string) {
-	s.clientsMu.Lock()
-	defer s.clientsMu.Unlock()
-
-	client, exists := s.clients[clientID]
-	if !exists {
-		fmt.Printf("Client with identifier '%s' not found\n", clientID)
-		return
+	// Apply protocol obfuscation if needed, streams are never disguised
+	if protocol != ProtocolNone && to.transport() == TransportUDP {
+		wrapper := GetProtocolWrapper(protocol)
+		if wrapper != nil {
+			data, err = wrapper.Wrap(data)
+			if err != nil {
+				return fmt.Errorf("failed to wrap message: %w", err)
+			}
+		}
 	}
 
-	// Check if client has been seen recently (within 2 minutes)
-	if time.Since(client.LastSeen) > 2*time.Minute {
-		fmt.Printf("Client '%s' has not been seen in over 2 minutes\n", clientID)
-		fmt.Println("Command will be sent when client sends next probe")
+	// Send message
+	if err := to.write(data); err != nil {
+		return fmt.Errorf("failed to write to %s: %w", to.remoteAddr(), err)
 	}
-
-	// Store pending command
-	client.PendingCmd = cmd
-	fmt.Printf("Command '%s' queued for client '%s'\n", cmd, clientID)
+	s.metrics.bytesOut.Add(uint64(len(data)))
+	return nil
 }
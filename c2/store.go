@@ -0,0 +1,451 @@
+package c2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Store persists clients and jobs so they survive server restarts
+type Store interface {
+	// Load returns every stored client and job
+	Load() ([]ClientInfo, []Job, error)
+	// PutClient stores or replaces a client
+	PutClient(client ClientInfo) error
+	// PutJob stores or replaces a job
+	PutJob(job Job) error
+	// DeleteClient removes a client
+	DeleteClient(identifier string) error
+	// DeleteJob removes a job
+	DeleteJob(id uint64) error
+	// Close releases the store
+	Close() error
+}
+
+const (
+	// storeSeenInterval is how often the last-seen time of an active client is persisted
+	storeSeenInterval = 1 * time.Minute
+	// compactMinRecords is how many records the log holds before compaction is considered
+	compactMinRecords = 1024
+	// maxStoreRecord is the largest record accepted when reading the log
+	maxStoreRecord = 16 * 1024 * 1024
+)
+
+// storeOp identifies what a log record does
+type storeOp string
+
+const (
+	storeOpClient       storeOp = "client"
+	storeOpJob          storeOp = "job"
+	storeOpDeleteClient storeOp = "delete_client"
+	storeOpDeleteJob    storeOp = "delete_job"
+)
+
+// storedClient is the persisted form of a client
+type storedClient struct {
+	Identifier string       `json:"identifier"`
+	SourceIP   string       `json:"source_ip,omitempty"`
+	LastSeen   time.Time    `json:"last_seen"`
+	Protocol   ProtocolType `json:"protocol,omitempty"`
+	// AssignedGroups are kept, unlike pattern groups and tags which are derived again
+	AssignedGroups []string `json:"assigned_groups,omitempty"`
+}
+
+// storeRecord is one line of the append-only log
+type storeRecord struct {
+	Op         storeOp       `json:"op"`
+	Client     *storedClient `json:"client,omitempty"`
+	Job        *Job          `json:"job,omitempty"`
+	Identifier string        `json:"identifier,omitempty"`
+	JobID      uint64        `json:"job_id,omitempty"`
+}
+
+// FileStore is a Store keeping an append-only JSON log that is compacted
+// once most of its records are superseded
+type FileStore struct {
+	path    string
+	mu      sync.Mutex
+	file    *os.File
+	clients map[string]storedClient
+	jobs    map[uint64]Job
+	// records is the number of lines in the log
+	records int
+}
+
+// OpenFileStore opens or creates the log at path and compacts it
+func OpenFileStore(path string) (*FileStore, error) {
+	fs := &FileStore{
+		path:    path,
+		clients: make(map[string]storedClient),
+		jobs:    make(map[uint64]Job),
+	}
+	if err := fs.replay(); err != nil {
+		return nil, err
+	}
+	if err := fs.compact(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// replay rebuilds the live records from the log
+func (fs *FileStore) replay() error {
+	file, err := os.Open(fs.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("store: failed to open log: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		data, err := readRecord(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("store: failed to read log: %w", err)
+		}
+
+		var record storeRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			// A crash can leave the last record half written
+			if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("store: corrupt record on line %d: %w", line, err)
+		}
+		fs.apply(record)
+	}
+}
+
+// readRecord reads one line of at most maxStoreRecord bytes
+func readRecord(reader *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxStoreRecord {
+			return nil, fmt.Errorf("record exceeds %d bytes", maxStoreRecord)
+		}
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && len(line) > 0:
+			return line, nil
+		case err != nil:
+			return nil, err
+		}
+		return bytes.TrimSuffix(line, []byte("\n")), nil
+	}
+}
+
+// apply updates the live records with one log record
+func (fs *FileStore) apply(record storeRecord) {
+	fs.records++
+	switch record.Op {
+	case storeOpClient:
+		if record.Client != nil {
+			fs.clients[record.Client.Identifier] = *record.Client
+		}
+	case storeOpJob:
+		if record.Job != nil {
+			fs.jobs[record.Job.ID] = *record.Job
+		}
+	case storeOpDeleteClient:
+		delete(fs.clients, record.Identifier)
+	case storeOpDeleteJob:
+		delete(fs.jobs, record.JobID)
+	}
+}
+
+// Load returns every stored client and job
+func (fs *FileStore) Load() ([]ClientInfo, []Job, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	clients := make([]ClientInfo, 0, len(fs.clients))
+	for _, stored := range fs.clients {
+		client := ClientInfo{
+			Identifier: stored.Identifier,
+			LastSeen:   stored.LastSeen,
+			Protocol:   stored.Protocol,
+
+			AssignedGroups: stored.AssignedGroups,
+		}
+		if stored.SourceIP != "" {
+			if addr, err := net.ResolveUDPAddr("udp", stored.SourceIP); err == nil {
+				client.SourceIP = addr
+			}
+		}
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Identifier < clients[j].Identifier })
+
+	jobs := make([]Job, 0, len(fs.jobs))
+	for _, job := range fs.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return clients, jobs, nil
+}
+
+// PutClient stores or replaces a client
+func (fs *FileStore) PutClient(client ClientInfo) error {
+	stored := storedClient{
+		Identifier: client.Identifier,
+		LastSeen:   client.LastSeen,
+		Protocol:   client.Protocol,
+
+		AssignedGroups: client.AssignedGroups,
+	}
+	if client.SourceIP != nil {
+		stored.SourceIP = client.SourceIP.String()
+	}
+	return fs.append(storeRecord{Op: storeOpClient, Client: &stored})
+}
+
+// PutJob stores or replaces a job
+func (fs *FileStore) PutJob(job Job) error {
+	return fs.append(storeRecord{Op: storeOpJob, Job: &job})
+}
+
+// DeleteClient removes a client
+func (fs *FileStore) DeleteClient(identifier string) error {
+	return fs.append(storeRecord{Op: storeOpDeleteClient, Identifier: identifier})
+}
+
+// DeleteJob removes a job
+func (fs *FileStore) DeleteJob(id uint64) error {
+	return fs.append(storeRecord{Op: storeOpDeleteJob, JobID: id})
+}
+
+// Close closes the log
+func (fs *FileStore) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.file == nil {
+		return nil
+	}
+	err := fs.file.Close()
+	fs.file = nil
+	return err
+}
+
+// Compact rewrites the log so it only holds live records
+func (fs *FileStore) Compact() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.compact()
+}
+
+// append writes a record to the log and compacts it once mostly superseded
+func (fs *FileStore) append(record storeRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("store: failed to encode record: %w", err)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.file == nil {
+		return errors.New("store: closed")
+	}
+	if _, err := fs.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("store: failed to append record: %w", err)
+	}
+	fs.apply(record)
+
+	live := len(fs.clients) + len(fs.jobs)
+	if fs.records > compactMinRecords && fs.records > 2*live {
+		return fs.compact()
+	}
+	return nil
+}
+
+// compact rewrites the log from the live records; mu must be held
+func (fs *FileStore) compact() error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+
+	ids := make([]string, 0, len(fs.clients))
+	for id := range fs.clients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		client := fs.clients[id]
+		if err := encoder.Encode(storeRecord{Op: storeOpClient, Client: &client}); err != nil {
+			return fmt.Errorf("store: failed to encode record: %w", err)
+		}
+	}
+
+	jobIDs := make([]uint64, 0, len(fs.jobs))
+	for id := range fs.jobs {
+		jobIDs = append(jobIDs, id)
+	}
+	sort.Slice(jobIDs, func(i, j int) bool { return jobIDs[i] < jobIDs[j] })
+	for _, id := range jobIDs {
+		job := fs.jobs[id]
+		if err := encoder.Encode(storeRecord{Op: storeOpJob, Job: &job}); err != nil {
+			return fmt.Errorf("store: failed to encode record: %w", err)
+		}
+	}
+
+	if err := writeFileAtomic(fs.path, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("store: failed to compact log: %w", err)
+	}
+
+	// Reopen the replaced file for appending
+	if fs.file != nil {
+		fs.file.Close()
+	}
+	file, err := os.OpenFile(fs.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		fs.file = nil
+		return fmt.Errorf("store: failed to open log: %w", err)
+	}
+	fs.file = file
+	fs.records = len(ids) + len(jobIDs)
+	return nil
+}
+
+// restoreState loads clients and jobs from the store, dropping what outlived the retention period
+func (s *Server) restoreState(now time.Time) error {
+	if s.config.Store == nil {
+		return nil
+	}
+	clients, jobs, err := s.config.Store.Load()
+	if err != nil {
+		return fmt.Errorf("server: failed to load state: %w", err)
+	}
+
+	restoredJobs := 0
+	for _, stored := range jobs {
+		if stored.Finished() && now.Sub(stored.FinishedAt) > s.config.Retention {
+			s.deleteStoredJob(stored.ID)
+			continue
+		}
+		job := stored
+		if !job.Finished() && job.HasData {
+			// The payload did not survive the restart, so the job cannot be sent again
+			job.State = JobStateExpired
+			job.Error = "payload lost in a server restart"
+			job.FinishedAt = now
+			if err := s.config.Store.PutJob(job); err != nil {
+				s.config.Logger.Errorf("server: failed to persist job %d: %v", job.ID, err)
+			}
+		}
+		s.jobs[job.ID] = &job
+		s.nextJobID = max(s.nextJobID, job.ID)
+		if !job.Finished() {
+			// Unfinished jobs are queued again in their original order
+			s.jobDone[job.ID] = make(chan struct{})
+			s.queues[job.ClientID] = append(s.queues[job.ClientID], job.ID)
+		}
+		restoredJobs++
+	}
+
+	for _, stored := range clients {
+		if now.Sub(stored.LastSeen) > s.config.Retention && len(s.queues[stored.Identifier]) == 0 {
+			s.deleteStoredClient(stored.Identifier)
+			continue
+		}
+		client := stored
+		client.Groups = s.groupsFor(client.Identifier, client.AssignedGroups)
+		client.State = s.livenessState(&client, now)
+		s.clients[client.Identifier] = &client
+		s.persistedAt[client.Identifier] = client.LastSeen
+	}
+
+	s.config.Logger.Infof("server: restored %d clients and %d jobs", len(s.clients), restoredJobs)
+	return nil
+}
+
+// pruneHistory drops finished jobs and lost clients that outlived the retention period
+func (s *Server) pruneHistory(now time.Time) {
+	var jobs []uint64
+	s.jobsMu.Lock()
+	for id, job := range s.jobs {
+		if job.Finished() && now.Sub(job.FinishedAt) > s.config.Retention {
+			delete(s.jobs, id)
+			jobs = append(jobs, id)
+		}
+	}
+	s.jobsMu.Unlock()
+
+	var clients []string
+	s.clientsMu.Lock()
+	for id, client := range s.clients {
+		if client.State == ClientStateLost && now.Sub(client.LastSeen) > s.config.Retention && s.queuedJobs(id) == 0 {
+			delete(s.clients, id)
+			delete(s.persistedAt, id)
+			clients = append(clients, id)
+		}
+	}
+	s.clientsMu.Unlock()
+
+	s.pruneRollouts(now)
+	s.pruneTransfers(now)
+
+	for _, id := range jobs {
+		s.deleteStoredJob(id)
+	}
+	for _, id := range clients {
+		s.config.Logger.Infof("server: forgetting client %s, not seen since retention period", id)
+		s.deleteStoredClient(id)
+		s.emit(Event{Type: EventClientEvicted, Time: now, ClientID: id})
+	}
+}
+
+// persistClient writes a client snapshot to the store
+func (s *Server) persistClient(client ClientInfo) {
+	if s.config.Store == nil {
+		return
+	}
+	if err := s.config.Store.PutClient(client); err != nil {
+		s.config.Logger.Errorf("server: failed to persist client %s: %v", client.Identifier, err)
+	}
+}
+
+// deleteStoredClient removes a client from the store
+func (s *Server) deleteStoredClient(identifier string) {
+	if s.config.Store == nil {
+		return
+	}
+	if err := s.config.Store.DeleteClient(identifier); err != nil {
+		s.config.Logger.Errorf("server: failed to delete client %s: %v", identifier, err)
+	}
+}
+
+// deleteStoredJob removes a job from the store
+func (s *Server) deleteStoredJob(id uint64) {
+	if s.config.Store == nil {
+		return
+	}
+	if err := s.config.Store.DeleteJob(id); err != nil {
+		s.config.Logger.Errorf("server: failed to delete job %d: %v", id, err)
+	}
+}
+
+// closeStore closes the store if the server opened it
+func (s *Server) closeStore() {
+	if !s.ownsStore {
+		return
+	}
+	if err := s.config.Store.Close(); err != nil {
+		s.config.Logger.Errorf("server: failed to close store: %v", err)
+	}
+}
@@ -0,0 +1,350 @@
+package c2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// streamFrameOverhead bounds the encoded size of a message beyond its payload
+	streamFrameOverhead = 64 * 1024
+	// streamWriteTimeout is how long writing a frame may take before the connection is dropped
+	streamWriteTimeout = 10 * time.Second
+	// streamHandshakeTimeout is how long a TLS handshake may take
+	streamHandshakeTimeout = 10 * time.Second
+	// streamAuthTimeout is how long a new connection may take to send an authenticated message
+	streamAuthTimeout = 10 * time.Second
+	// maxPendingStreams bounds the connections that have not sent an authenticated message yet
+	maxPendingStreams = 256
+)
+
+// ErrFrameTooLarge is returned when a stream frame exceeds the size limit
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// writeFrame writes data prefixed with its big-endian length in a single write
+func writeFrame(w io.Writer, data []byte) error {
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readFrame reads one length-prefixed frame of at most limit bytes
+func readFrame(r io.Reader, limit int) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if uint64(size) > uint64(limit) {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, size)
+	}
+	// Grow the buffer as data arrives rather than trusting the announced size
+	var data bytes.Buffer
+	if _, err := io.CopyN(&data, r, int64(size)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
+// LoadCertPool reads the PEM encoded CA certificates in path
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificates: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no CA certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// peer is the remote end a message arrived from, replies go back the same way
+type peer interface {
+	// remoteAddr returns the network address of the client
+	remoteAddr() net.Addr
+	// transport returns how the client reached the server
+	transport() TransportType
+	// localAddr returns the server address the client reached
+	localAddr() net.Addr
+	// write sends one encoded message to the client
+	write(data []byte) error
+}
+
+// udpPeer is a client that sent a datagram to one of the server sockets
+type udpPeer struct {
+	listener *udpListener
+	addr     net.Addr
+}
+
+func (p udpPeer) remoteAddr() net.Addr     { return p.addr }
+func (p udpPeer) transport() TransportType { return TransportUDP }
+func (p udpPeer) localAddr() net.Addr      { return p.listener.conn.LocalAddr() }
+
+func (p udpPeer) write(data []byte) error {
+	// Replies leave from the socket the client reached, its NAT and firewall expect that address
+	n, err := p.listener.conn.WriteTo(data, p.addr)
+	p.listener.bytesOut.Add(uint64(n))
+	return err
+}
+
+// streamPeer is a client connected over the TLS transport
+type streamPeer struct {
+	conn net.Conn
+	// writeMu keeps the write deadline together with the frame it guards
+	writeMu sync.Mutex
+	// identifier is the client the connection is bound to by its first message
+	identifier string
+	// authenticated is set once a message passed authentication, guarded by streamsMu
+	authenticated bool
+}
+
+func (p *streamPeer) remoteAddr() net.Addr     { return p.conn.RemoteAddr() }
+func (p *streamPeer) transport() TransportType { return TransportTLS }
+func (p *streamPeer) localAddr() net.Addr      { return p.conn.LocalAddr() }
+
+func (p *streamPeer) write(data []byte) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	p.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	return writeFrame(p.conn, data)
+}
+
+// listenTLS opens the listener of the TLS transport
+func listenTLS(config *Config) (net.Listener, error) {
+	// Clients must be able to verify the certificate for as long as the server runs
+	if config.Certificate == nil {
+		return nil, errors.New("the TLS transport requires a certificate")
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{*config.Certificate},
+	}
+	if config.ClientCAs != nil {
+		tlsConfig.ClientCAs = config.ClientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	lc := net.ListenConfig{KeepAlive: config.KeepAlive}
+	listener, err := lc.Listen(context.Background(), "tcp", config.TLSAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for TLS clients: %w", err)
+	}
+	return tls.NewListener(listener, tlsConfig), nil
+}
+
+// streamAcceptLoop accepts TLS clients until ctx is done or the listener is closed
+func (s *Server) streamAcceptLoop(ctx context.Context) {
+	for {
+		conn, err := s.tlsListener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.config.Logger.Errorf("server: failed to accept TLS client: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go s.serveStream(ctx, conn)
+	}
+}
+
+// serveStream handles the messages of one TLS client until the connection fails
+func (s *Server) serveStream(ctx context.Context, conn net.Conn) {
+	p := &streamPeer{conn: conn}
+	if !s.trackStream(ctx, p) {
+		conn.Close()
+		return
+	}
+	defer s.untrackStream(p)
+
+	// Clients without a valid certificate fail here rather than on their first message
+	handshakeCtx, cancel := context.WithTimeout(ctx, streamHandshakeTimeout)
+	err := conn.(*tls.Conn).HandshakeContext(handshakeCtx)
+	cancel()
+	if err != nil {
+		s.config.Logger.Warnf("server: TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	limit := s.config.MaxResultSize + streamFrameOverhead
+	for {
+		// Connections are dropped once idle for as long as a silent client is lost
+		timeout := max(s.config.ClientTimeout, streamAuthTimeout)
+		if !p.authenticated {
+			timeout = streamAuthTimeout
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+
+		data, err := readFrame(reader, limit)
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.config.Logger.Debugf("server: TLS client %s disconnected: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		s.metrics.bytesIn.Add(uint64(len(data)))
+		msg, codec, err := decodeMessage(data)
+		if err != nil {
+			s.metrics.decodeFailures.Add(1)
+			s.config.Logger.Errorf("server: failed to decode message from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+
+		// A connection carries the messages of a single client
+		if p.identifier == "" {
+			p.identifier = msg.Identifier
+		} else if msg.Identifier != p.identifier {
+			s.config.Logger.Warnf("server: dropping TLS connection of %s from %s sending as %s",
+				p.identifier, conn.RemoteAddr(), msg.Identifier)
+			return
+		}
+		if s.handleMessage(msg, ProtocolNone, codec, p) && !p.authenticated {
+			s.streamAuthenticated(p)
+		}
+	}
+}
+
+// trackStream registers an open connection so Run can close it on exit, returning
+// false once the server is shutting down or too many connections are unauthenticated
+func (s *Server) trackStream(ctx context.Context, p *streamPeer) bool {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+	if ctx.Err() != nil {
+		return false
+	}
+	if s.pendingStreams >= maxPendingStreams {
+		s.config.Logger.Debugf("server: refusing TLS connection from %s, too many unauthenticated", p.remoteAddr())
+		return false
+	}
+	s.streams[p] = struct{}{}
+	s.pendingStreams++
+	return true
+}
+
+// streamAuthenticated stops counting a connection against the unauthenticated ones
+func (s *Server) streamAuthenticated(p *streamPeer) {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+	p.authenticated = true
+	s.pendingStreams--
+}
+
+// untrackStream closes a connection and forgets it
+func (s *Server) untrackStream(p *streamPeer) {
+	s.streamsMu.Lock()
+	delete(s.streams, p)
+	if !p.authenticated {
+		s.pendingStreams--
+	}
+	s.streamsMu.Unlock()
+	p.conn.Close()
+}
+
+// closeStreams closes every open TLS connection
+func (s *Server) closeStreams() {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+	for p := range s.streams {
+		p.conn.Close()
+	}
+}
+
+// dialStream returns the TLS connection to the server, dialing a new one if there is none
+func (c *Client) dialStream() (net.Conn, error) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	if c.stream != nil {
+		return c.stream, nil
+	}
+	if c.runCtx == nil {
+		return nil, fmt.Errorf("client: not running")
+	}
+
+	dialer := tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: probeAckTimeout, KeepAlive: c.config.KeepAlive},
+		Config:    c.tlsConfig,
+	}
+	conn, err := dialer.DialContext(c.runCtx, "tcp", c.config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("client: failed to connect to %s: %w", c.config.Address, err)
+	}
+	c.config.Logger.Debugf("Client connected to %s over TLS", c.config.Address)
+
+	c.stream = conn
+	c.readers.Add(1)
+	go func() {
+		defer c.readers.Done()
+		c.streamReadLoop(conn)
+	}()
+	return conn, nil
+}
+
+// writeStream writes one encoded message to the server over TLS
+func (c *Client) writeStream(data []byte) error {
+	conn, err := c.dialStream()
+	if err != nil {
+		return err
+	}
+
+	c.streamWriteMu.Lock()
+	conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	err = writeFrame(conn, data)
+	c.streamWriteMu.Unlock()
+	if err != nil {
+		// The next message dials a new connection
+		c.dropStream(conn)
+		return fmt.Errorf("client: failed to write message: %w", err)
+	}
+	return nil
+}
+
+// streamReadLoop reads and dispatches server messages until the connection fails
+func (c *Client) streamReadLoop(conn net.Conn) {
+	defer c.dropStream(conn)
+
+	reader := bufio.NewReader(conn)
+	limit := c.config.MaxResultSize + streamFrameOverhead
+	for {
+		data, err := readFrame(reader, limit)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				c.config.Logger.Debugf("Client lost connection to server: %v", err)
+			}
+			return
+		}
+		if err := c.handleResponse(data); err != nil {
+			c.config.Logger.Debugf("Client failed to handle response: %v", err)
+		}
+	}
+}
+
+// dropStream closes conn and forgets it if it is still the current connection
+func (c *Client) dropStream(conn net.Conn) {
+	c.connMu.Lock()
+	if c.stream == conn {
+		c.stream = nil
+	}
+	c.connMu.Unlock()
+	conn.Close()
+}
@@ -0,0 +1,869 @@
+package c2
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// AuditTransfer records an operator pushing a file to or pulling a file from a client
+	AuditTransfer AuditAction = "transfer"
+	// AuditCancelTransfer records an operator cancelling a file transfer
+	AuditCancelTransfer AuditAction = "cancel_transfer"
+)
+
+const (
+	// transferChunkSize is how many bytes of a file one job carries
+	transferChunkSize = 32 * 1024
+	// maxTransferChunk bounds the chunks clients read, so results stay small
+	maxTransferChunk = 64 * 1024
+	// transferWindow is how many chunk jobs are queued at once, so the next chunk is
+	// sent as soon as the result of the previous one arrives
+	transferWindow = 2
+)
+
+var (
+	// ErrUnknownTransfer is returned when a transfer ID does not exist
+	ErrUnknownTransfer = errors.New("unknown transfer")
+	// ErrInvalidTransfer is returned when the local file of a transfer cannot be used
+	ErrInvalidTransfer = errors.New("invalid transfer")
+)
+
+// TransferDirection tells whether a file goes to or comes from a client
+type TransferDirection string
+
+const (
+	// TransferPush copies a file of the server to a client
+	TransferPush TransferDirection = "push"
+	// TransferPull copies a file of a client to the server
+	TransferPull TransferDirection = "pull"
+)
+
+// TransferState describes where a transfer is in its lifecycle
+type TransferState string
+
+const (
+	// TransferStateRunning means chunks are still being copied
+	TransferStateRunning TransferState = "running"
+	// TransferStateSucceeded means the file was verified and renamed into place
+	TransferStateSucceeded TransferState = "succeeded"
+	// TransferStateFailed means a chunk or the verification failed, the partial file is kept for resuming
+	TransferStateFailed TransferState = "failed"
+	// TransferStateCancelled means an operator or server shutdown stopped the transfer
+	TransferStateCancelled TransferState = "cancelled"
+)
+
+// Transfer is a file copied between the server and a client in chunks. The copy is
+// written to a partial file named after its SHA-256 checksum, so starting the same
+// transfer again resumes where an interrupted one stopped.
+type Transfer struct {
+	ID         uint64            `json:"id"`
+	ClientID   string            `json:"client_id"`
+	Operator   string            `json:"operator,omitempty"`
+	Direction  TransferDirection `json:"direction"`
+	LocalPath  string            `json:"local_path"`
+	RemotePath string            `json:"remote_path"`
+	Size       int64             `json:"size"`
+	SHA256     string            `json:"sha256,omitempty"`
+	// Transferred is how many bytes reached the destination, including resumed ones
+	Transferred int64 `json:"transferred"`
+	// Resumed is how many bytes an earlier transfer left at the destination
+	Resumed    int64         `json:"resumed,omitempty"`
+	State      TransferState `json:"state"`
+	Error      string        `json:"error,omitempty"`
+	CreatedAt  time.Time     `json:"created_at"`
+	FinishedAt time.Time     `json:"finished_at,omitempty"`
+}
+
+// Finished reports whether the transfer stopped copying chunks
+func (t *Transfer) Finished() bool {
+	return t.State != TransferStateRunning
+}
+
+// Progress returns the fraction of the file at the destination, from 0 to 1
+func (t *Transfer) Progress() float64 {
+	if t.Size == 0 {
+		if t.State == TransferStateSucceeded {
+			return 1
+		}
+		return 0
+	}
+	return float64(t.Transferred) / float64(t.Size)
+}
+
+// fileStat is the result of the file_stat and file_commit operations
+type fileStat struct {
+	Path   string `json:"path"`
+	Exists bool   `json:"exists"`
+	Size   int64  `json:"size,omitempty"`
+	Mode   string `json:"mode,omitempty"`
+	// SHA256 is left out for files larger than the client transfers
+	SHA256 string `json:"sha256,omitempty"`
+	// Partial is how many bytes of a file with the requested checksum were received so far
+	Partial int64 `json:"partial,omitempty"`
+}
+
+// fileProgress is the result of the file_write operation
+type fileProgress struct {
+	Written int64 `json:"written"`
+}
+
+// fileChunk is the result of the file_read operation
+type fileChunk struct {
+	Offset int64  `json:"offset"`
+	Data   []byte `json:"data"`
+}
+
+func init() {
+	registerOperation(OperationInfo{
+		Name:        "file_stat",
+		Description: "Show the size, mode and SHA-256 checksum of a transferable file",
+		Args: []OperationArg{
+			{Name: "path", Required: true, Description: "File, one of the client's transfer paths"},
+			{Name: "sha256", Description: "Checksum of a file being pushed, to report how much of it was received"},
+		},
+	}, func(ctx context.Context, c *Client, args map[string]string, data []byte) (any, error) {
+		return c.statFile(args)
+	})
+	registerOperation(OperationInfo{
+		Name:        "file_write",
+		Description: "Write a chunk of a pushed file, sent along with the command",
+		Args: []OperationArg{
+			{Name: "path", Required: true, Description: "Destination, one of the client's transfer paths"},
+			{Name: "offset", Required: true, Description: "Position of the chunk in the file"},
+			{Name: "length", Required: true, Description: "Length of the chunk"},
+			{Name: "size", Required: true, Description: "Size of the whole file"},
+			{Name: "sha256", Required: true, Description: "Checksum of the whole file"},
+		},
+	}, func(ctx context.Context, c *Client, args map[string]string, data []byte) (any, error) {
+		return c.writeChunk(args, data)
+	})
+	registerOperation(OperationInfo{
+		Name:        "file_commit",
+		Description: "Verify a pushed file and rename it into place",
+		Args: []OperationArg{
+			{Name: "path", Required: true, Description: "Destination, one of the client's transfer paths"},
+			{Name: "size", Required: true, Description: "Size of the whole file"},
+			{Name: "sha256", Required: true, Description: "Checksum of the whole file"},
+			{Name: "mode", Description: "Octal permissions without group and other write, those of the replaced file or 0644 by default"},
+		},
+	}, func(ctx context.Context, c *Client, args map[string]string, data []byte) (any, error) {
+		return c.commitFile(args)
+	})
+	registerOperation(OperationInfo{
+		Name:        "file_read",
+		Description: "Read a chunk of a transferable file",
+		Args: []OperationArg{
+			{Name: "path", Required: true, Description: "File, one of the client's transfer paths"},
+			{Name: "offset", Required: true, Description: "Position of the chunk in the file"},
+			{Name: "limit", Required: true, Description: fmt.Sprintf("Length of the chunk, at most %d", maxTransferChunk)},
+		},
+	}, func(ctx context.Context, c *Client, args map[string]string, data []byte) (any, error) {
+		return c.readChunk(args)
+	})
+}
+
+// transferPath returns where path leads if it matches the transfer paths of the client
+func (c *Client) transferPath(path string) (string, error) {
+	if len(c.config.TransferPaths) == 0 {
+		return "", fmt.Errorf("no files may be transferred")
+	}
+	return permittedPath(c.config.TransferPaths, "transfer path", path)
+}
+
+// transferSize returns the size argument key, refusing files larger than the client transfers
+func (c *Client) transferSize(args map[string]string, key string) (int64, error) {
+	size, err := intArg(args, key, 0, 0, math.MaxInt)
+	if err != nil {
+		return 0, err
+	}
+	if int64(size) > c.config.MaxTransferSize {
+		return 0, fmt.Errorf("file of %d bytes exceeds the transfer limit of %d bytes", size, c.config.MaxTransferSize)
+	}
+	return int64(size), nil
+}
+
+// checksumArg returns the SHA-256 checksum argument key, empty if it is absent
+func checksumArg(args map[string]string, key string) (string, error) {
+	sum, exists := args[key]
+	if !exists {
+		return "", nil
+	}
+	if decoded, err := hex.DecodeString(sum); err != nil || len(decoded) != sha256.Size {
+		return "", fmt.Errorf("%w: %s must be a hex encoded SHA-256 checksum", ErrInvalidOperation, key)
+	}
+	return sum, nil
+}
+
+// partialPath returns the file a copy of path with the given checksum is written to
+// before it is verified and renamed into place
+func partialPath(path string, sum string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+"."+sum[:16]+".part")
+}
+
+// openPartial opens the partial copy of path with the given checksum. It refuses
+// anything but a regular file, so a link planted under the partial name cannot
+// redirect the write elsewhere.
+func openPartial(path string, sum string, flag int) (*os.File, error) {
+	partial := partialPath(path, sum)
+	if _, err := permittedPath([]string{filepath.Join(filepath.Dir(path), ".*.part")}, "partial file", partial); err != nil {
+		return nil, err
+	}
+	if info, err := os.Lstat(partial); err == nil && !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("partial file %s is not a regular file", partial)
+	}
+	f, err := os.OpenFile(partial, flag|openNoFollow, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		f.Close()
+		return nil, fmt.Errorf("partial file %s is not a regular file", partial)
+	}
+	return f, nil
+}
+
+// fileChecksum returns the hex encoded SHA-256 checksum of the content of f
+func fileChecksum(f io.ReadSeeker) (string, int64, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// statFile describes a transferable file and how much of a pushed copy was received
+func (c *Client) statFile(args map[string]string) (fileStat, error) {
+	path, err := c.transferPath(args["path"])
+	if err != nil {
+		return fileStat{}, err
+	}
+	sum, err := checksumArg(args, "sha256")
+	if err != nil {
+		return fileStat{}, err
+	}
+
+	stat := fileStat{Path: args["path"]}
+	f, err := os.Open(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return fileStat{}, err
+	default:
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return fileStat{}, err
+		}
+		if !info.Mode().IsRegular() {
+			return fileStat{}, fmt.Errorf("%s is not a regular file", args["path"])
+		}
+		stat.Exists, stat.Size, stat.Mode = true, info.Size(), fmt.Sprintf("%04o", info.Mode().Perm())
+		if stat.Size <= c.config.MaxTransferSize {
+			if stat.SHA256, _, err = fileChecksum(f); err != nil {
+				return fileStat{}, err
+			}
+		}
+	}
+
+	if sum != "" {
+		if info, err := os.Lstat(partialPath(path, sum)); err == nil && info.Mode().IsRegular() {
+			stat.Partial = info.Size()
+		}
+	}
+	return stat, nil
+}
+
+// writeChunk writes data at offset into the partial copy of a pushed file
+func (c *Client) writeChunk(args map[string]string, data []byte) (fileProgress, error) {
+	path, err := c.transferPath(args["path"])
+	if err != nil {
+		return fileProgress{}, err
+	}
+	size, err := c.transferSize(args, "size")
+	if err != nil {
+		return fileProgress{}, err
+	}
+	offset, err := intArg(args, "offset", 0, 0, int(size))
+	if err != nil {
+		return fileProgress{}, err
+	}
+	length, err := intArg(args, "length", 0, 0, int(size)-offset)
+	if err != nil {
+		return fileProgress{}, err
+	}
+	if len(data) != length {
+		return fileProgress{}, fmt.Errorf("expected %d bytes of data, got %d", length, len(data))
+	}
+	sum, err := checksumArg(args, "sha256")
+	if err != nil {
+		return fileProgress{}, err
+	}
+
+	f, err := openPartial(path, sum, os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return fileProgress{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fileProgress{}, err
+	}
+	if int64(offset) > info.Size() {
+		return fileProgress{}, fmt.Errorf("chunk at offset %d leaves a gap after %d bytes", offset, info.Size())
+	}
+	if _, err := f.WriteAt(data, int64(offset)); err != nil {
+		return fileProgress{}, err
+	}
+	// Chunks sent again overwrite what followed them
+	end := int64(offset + length)
+	if err := f.Truncate(end); err != nil {
+		return fileProgress{}, err
+	}
+	return fileProgress{Written: end}, f.Close()
+}
+
+// commitFile verifies the partial copy of a pushed file and atomically renames it into place
+func (c *Client) commitFile(args map[string]string) (fileStat, error) {
+	path, err := c.transferPath(args["path"])
+	if err != nil {
+		return fileStat{}, err
+	}
+	size, err := c.transferSize(args, "size")
+	if err != nil {
+		return fileStat{}, err
+	}
+	sum, err := checksumArg(args, "sha256")
+	if err != nil {
+		return fileStat{}, err
+	}
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if value, exists := args["mode"]; exists {
+		parsed, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || parsed > 0o777 {
+			return fileStat{}, fmt.Errorf("%w: mode must be octal permissions such as 0644", ErrInvalidOperation)
+		}
+		mode = os.FileMode(parsed)
+	}
+	// The server must not make files of the client writable by others
+	mode &^= 0o022
+
+	// Empty files never receive a chunk
+	partial := partialPath(path, sum)
+	f, err := openPartial(path, sum, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return fileStat{}, err
+	}
+	defer f.Close()
+	actual, n, err := fileChecksum(f)
+	if err != nil {
+		return fileStat{}, err
+	}
+	if n != size {
+		return fileStat{}, fmt.Errorf("received %d of %d bytes", n, size)
+	}
+	if actual != sum {
+		f.Close()
+		os.Remove(partial)
+		return fileStat{}, fmt.Errorf("checksum mismatch, got %s, the partial file was discarded", actual)
+	}
+	if err := f.Sync(); err != nil {
+		return fileStat{}, err
+	}
+	if err := f.Chmod(mode); err != nil {
+		return fileStat{}, err
+	}
+	if err := f.Close(); err != nil {
+		return fileStat{}, err
+	}
+	if err := os.Rename(partial, path); err != nil {
+		return fileStat{}, err
+	}
+	return fileStat{Path: args["path"], Exists: true, Size: n, Mode: fmt.Sprintf("%04o", mode), SHA256: sum}, nil
+}
+
+// readChunk reads up to limit bytes at offset of a transferable file
+func (c *Client) readChunk(args map[string]string) (fileChunk, error) {
+	path, err := c.transferPath(args["path"])
+	if err != nil {
+		return fileChunk{}, err
+	}
+	offset, err := intArg(args, "offset", 0, 0, math.MaxInt)
+	if err != nil {
+		return fileChunk{}, err
+	}
+	limit, err := intArg(args, "limit", 0, 1, maxTransferChunk)
+	if err != nil {
+		return fileChunk{}, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fileChunk{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fileChunk{}, err
+	}
+	if info.Size() > c.config.MaxTransferSize {
+		return fileChunk{}, fmt.Errorf("file of %d bytes exceeds the transfer limit of %d bytes", info.Size(), c.config.MaxTransferSize)
+	}
+	buf := make([]byte, limit)
+	n, err := f.ReadAt(buf, int64(offset))
+	if err != nil && err != io.EOF {
+		return fileChunk{}, err
+	}
+	return fileChunk{Offset: int64(offset), Data: buf[:n]}, nil
+}
+
+// Push copies a local file of the server to remotePath on a client on behalf of operator.
+// The client refuses paths outside its transfer paths and files larger than its limit.
+// It runs in the background, see WaitTransfer.
+func (s *Server) Push(operator string, clientID string, localPath string, remotePath string) (Transfer, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return Transfer{}, fmt.Errorf("server: %w: %v", ErrInvalidTransfer, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return Transfer{}, fmt.Errorf("server: %w: %v", ErrInvalidTransfer, err)
+	}
+	if !info.Mode().IsRegular() {
+		return Transfer{}, fmt.Errorf("server: %w: %s is not a regular file", ErrInvalidTransfer, localPath)
+	}
+	sum, size, err := fileChecksum(f)
+	if err != nil {
+		return Transfer{}, fmt.Errorf("server: %w: %v", ErrInvalidTransfer, err)
+	}
+
+	t := &Transfer{
+		ClientID:   clientID,
+		Operator:   operator,
+		Direction:  TransferPush,
+		LocalPath:  localPath,
+		RemotePath: remotePath,
+		Size:       size,
+		SHA256:     sum,
+	}
+	return s.startTransfer(t, Operation{Name: "file_stat", Args: map[string]string{"path": remotePath, "sha256": sum}})
+}
+
+// Pull copies remotePath of a client to a local file of the server on behalf of operator.
+// The client refuses paths outside its transfer paths and files larger than its limit.
+// It runs in the background, see WaitTransfer.
+func (s *Server) Pull(operator string, clientID string, remotePath string, localPath string) (Transfer, error) {
+	localPath, err := filepath.Abs(localPath)
+	if err != nil {
+		return Transfer{}, fmt.Errorf("server: %w: %v", ErrInvalidTransfer, err)
+	}
+	if info, err := os.Stat(filepath.Dir(localPath)); err != nil || !info.IsDir() {
+		return Transfer{}, fmt.Errorf("server: %w: no directory to write %s to", ErrInvalidTransfer, localPath)
+	}
+
+	t := &Transfer{
+		ClientID:   clientID,
+		Operator:   operator,
+		Direction:  TransferPull,
+		LocalPath:  localPath,
+		RemotePath: remotePath,
+	}
+	return s.startTransfer(t, Operation{Name: "file_stat", Args: map[string]string{"path": remotePath}})
+}
+
+// startTransfer queues the first operation of a transfer and copies the file in the background
+func (s *Server) startTransfer(t *Transfer, stat Operation) (Transfer, error) {
+	// Queueing the first job checks the client and the roles of the operator
+	job, err := s.enqueueAs(t.Operator, t.ClientID, stat.String(), JobOptions{}, nil)
+	if err != nil {
+		return Transfer{}, err
+	}
+	t.State = TransferStateRunning
+	t.CreatedAt = time.Now()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.transfersMu.Lock()
+	s.nextTransferID++
+	t.ID = s.nextTransferID
+	s.transfers[t.ID] = t
+	s.transferCancel[t.ID] = cancel
+	s.transferDone[t.ID] = make(chan struct{})
+	snapshot := *t
+	s.transfersMu.Unlock()
+
+	s.audit(AuditEntry{
+		Action:   AuditTransfer,
+		Operator: t.Operator,
+		ClientID: t.ClientID,
+		Detail:   fmt.Sprintf("transfer %d: %s of %s to %s", t.ID, t.Direction, t.LocalPath, t.RemotePath),
+	})
+	s.config.Logger.Infof("server: %s started %s %d of %s on %s", t.Operator, t.Direction, t.ID, t.RemotePath, t.ClientID)
+
+	// Server shutdown cancels transfers that are still running
+	go func() {
+		select {
+		case <-s.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	go func() {
+		var err error
+		if t.Direction == TransferPush {
+			err = s.runPush(ctx, snapshot, job.ID)
+		} else {
+			err = s.runPull(ctx, snapshot, job.ID)
+		}
+		s.finishTransfer(t.ID, err)
+	}()
+	return snapshot, nil
+}
+
+// transferResult waits for a job of a transfer and decodes its JSON result into v. The
+// transfer fails if the job does not finish within the transfer timeout.
+func (s *Server) transferResult(ctx context.Context, id uint64, v any) error {
+	waitCtx, cancel := context.WithTimeout(ctx, s.config.TransferTimeout)
+	defer cancel()
+	job, err := s.Wait(waitCtx, id)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return fmt.Errorf("job %d did not finish within %s", id, s.config.TransferTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	if job.State != JobStateSucceeded {
+		return fmt.Errorf("job %d %s: %s", job.ID, job.State, job.Error)
+	}
+	if err := json.Unmarshal([]byte(job.Output), v); err != nil {
+		return fmt.Errorf("job %d returned an unexpected result: %w", job.ID, err)
+	}
+	return nil
+}
+
+// runPush sends the chunks of a local file the client does not have yet and commits them
+func (s *Server) runPush(ctx context.Context, t Transfer, statJob uint64) error {
+	pending := []uint64{statJob}
+	defer func() { s.cancelTransferJobs(t, pending) }()
+
+	var stat fileStat
+	if err := s.transferResult(ctx, statJob, &stat); err != nil {
+		return err
+	}
+	pending = nil
+	if stat.Exists && stat.SHA256 == t.SHA256 {
+		s.updateTransfer(t.ID, func(t *Transfer) { t.Transferred, t.Resumed = t.Size, t.Size })
+		return nil
+	}
+
+	f, err := os.Open(t.LocalPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	offset := min(stat.Partial, t.Size)
+	s.updateTransfer(t.ID, func(t *Transfer) { t.Transferred, t.Resumed = offset, offset })
+	for offset < t.Size || len(pending) > 0 {
+		for offset < t.Size && len(pending) < transferWindow {
+			chunk := make([]byte, min(transferChunkSize, t.Size-offset))
+			if _, err := f.ReadAt(chunk, offset); err != nil {
+				return fmt.Errorf("failed to read %s: %w", t.LocalPath, err)
+			}
+			write := Operation{Name: "file_write", Args: map[string]string{
+				"path":   t.RemotePath,
+				"offset": strconv.FormatInt(offset, 10),
+				"length": strconv.Itoa(len(chunk)),
+				"size":   strconv.FormatInt(t.Size, 10),
+				"sha256": t.SHA256,
+			}}
+			job, err := s.enqueueAs(t.Operator, t.ClientID, write.String(), JobOptions{}, chunk)
+			if err != nil {
+				return err
+			}
+			pending = append(pending, job.ID)
+			offset += int64(len(chunk))
+		}
+
+		var progress fileProgress
+		if err := s.transferResult(ctx, pending[0], &progress); err != nil {
+			return err
+		}
+		pending = pending[1:]
+		s.updateTransfer(t.ID, func(t *Transfer) { t.Transferred = progress.Written })
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	commit := Operation{Name: "file_commit", Args: map[string]string{
+		"path":   t.RemotePath,
+		"size":   strconv.FormatInt(t.Size, 10),
+		"sha256": t.SHA256,
+		"mode":   fmt.Sprintf("%04o", info.Mode().Perm()),
+	}}
+	job, err := s.enqueueAs(t.Operator, t.ClientID, commit.String(), JobOptions{}, nil)
+	if err != nil {
+		return err
+	}
+	pending = append(pending, job.ID)
+	if err := s.transferResult(ctx, job.ID, &stat); err != nil {
+		return err
+	}
+	pending = nil
+	return nil
+}
+
+// runPull reads the chunks of a client file missing from the local partial copy, then
+// verifies the copy and renames it into place
+func (s *Server) runPull(ctx context.Context, t Transfer, statJob uint64) error {
+	pending := []uint64{statJob}
+	defer func() { s.cancelTransferJobs(t, pending) }()
+
+	var stat fileStat
+	if err := s.transferResult(ctx, statJob, &stat); err != nil {
+		return err
+	}
+	pending = nil
+	switch {
+	case !stat.Exists:
+		return fmt.Errorf("%s does not exist", t.RemotePath)
+	case stat.SHA256 == "":
+		return fmt.Errorf("%s of %d bytes exceeds the transfer limit of the client", t.RemotePath, stat.Size)
+	}
+	// A client must not make files of the server executable or writable by others
+	mode, err := strconv.ParseUint(stat.Mode, 8, 32)
+	if err != nil {
+		mode = 0o644
+	}
+	mode &= 0o644
+
+	partial := partialPath(t.LocalPath, stat.SHA256)
+	f, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	offset := min(info.Size(), stat.Size)
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	s.updateTransfer(t.ID, func(t *Transfer) {
+		t.Size, t.SHA256 = stat.Size, stat.SHA256
+		t.Transferred, t.Resumed = offset, offset
+	})
+
+	requested := offset
+	for offset < stat.Size {
+		for requested < stat.Size && len(pending) < transferWindow {
+			read := Operation{Name: "file_read", Args: map[string]string{
+				"path":   t.RemotePath,
+				"offset": strconv.FormatInt(requested, 10),
+				"limit":  strconv.Itoa(transferChunkSize),
+			}}
+			job, err := s.enqueueAs(t.Operator, t.ClientID, read.String(), JobOptions{}, nil)
+			if err != nil {
+				return err
+			}
+			pending = append(pending, job.ID)
+			requested += min(transferChunkSize, stat.Size-requested)
+		}
+
+		var chunk fileChunk
+		if err := s.transferResult(ctx, pending[0], &chunk); err != nil {
+			return err
+		}
+		pending = pending[1:]
+		if chunk.Offset != offset || len(chunk.Data) == 0 {
+			return fmt.Errorf("%s changed during the transfer", t.RemotePath)
+		}
+		if _, err := f.WriteAt(chunk.Data, offset); err != nil {
+			return err
+		}
+		offset += int64(len(chunk.Data))
+		s.updateTransfer(t.ID, func(t *Transfer) { t.Transferred = offset })
+	}
+
+	sum, n, err := fileChecksum(f)
+	if err != nil {
+		return err
+	}
+	if n != stat.Size || sum != stat.SHA256 {
+		f.Close()
+		os.Remove(partial)
+		return fmt.Errorf("checksum mismatch, %s changed during the transfer", t.RemotePath)
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Chmod(os.FileMode(mode)); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(partial, t.LocalPath)
+}
+
+// cancelTransferJobs cancels the jobs a stopped transfer queued but no longer waits for,
+// so chunks are not copied after the transfer ended
+func (s *Server) cancelTransferJobs(t Transfer, pending []uint64) {
+	for _, id := range pending {
+		s.cancelJob(t.ClientID, id)
+	}
+}
+
+// updateTransfer applies fn to a transfer and publishes its progress
+func (s *Server) updateTransfer(id uint64, fn func(t *Transfer)) {
+	s.transfersMu.Lock()
+	t, exists := s.transfers[id]
+	if !exists {
+		s.transfersMu.Unlock()
+		return
+	}
+	fn(t)
+	snapshot := *t
+	s.transfersMu.Unlock()
+	s.emit(Event{Type: EventTransferUpdated, ClientID: snapshot.ClientID, Transfer: &snapshot})
+}
+
+// finishTransfer ends a transfer with the outcome of its copy
+func (s *Server) finishTransfer(id uint64, err error) {
+	s.transfersMu.Lock()
+	t := s.transfers[id]
+	switch {
+	case err == nil:
+		t.State = TransferStateSucceeded
+	case errors.Is(err, context.Canceled):
+		t.State = TransferStateCancelled
+	default:
+		t.State = TransferStateFailed
+		t.Error = err.Error()
+	}
+	t.FinishedAt = time.Now()
+	snapshot := *t
+	if cancel, exists := s.transferCancel[id]; exists {
+		cancel()
+		delete(s.transferCancel, id)
+	}
+	close(s.transferDone[id])
+	delete(s.transferDone, id)
+	s.transfersMu.Unlock()
+
+	if err != nil && snapshot.State == TransferStateFailed {
+		s.config.Logger.Warnf("server: %s %d of %s on %s failed after %d of %d bytes: %v",
+			snapshot.Direction, id, snapshot.RemotePath, snapshot.ClientID, snapshot.Transferred, snapshot.Size, err)
+	} else {
+		s.config.Logger.Infof("server: %s %d of %s on %s %s", snapshot.Direction, id, snapshot.RemotePath, snapshot.ClientID, snapshot.State)
+	}
+	s.emit(Event{Type: EventTransferUpdated, ClientID: snapshot.ClientID, Transfer: &snapshot})
+}
+
+// Transfer returns a snapshot of the transfer with the given ID
+func (s *Server) Transfer(id uint64) (Transfer, bool) {
+	s.transfersMu.Lock()
+	defer s.transfersMu.Unlock()
+
+	t, exists := s.transfers[id]
+	if !exists {
+		return Transfer{}, false
+	}
+	return *t, true
+}
+
+// Transfers returns snapshots of all transfers sorted by ID
+func (s *Server) Transfers() []Transfer {
+	s.transfersMu.Lock()
+	defer s.transfersMu.Unlock()
+
+	transfers := make([]Transfer, 0, len(s.transfers))
+	for _, t := range s.transfers {
+		transfers = append(transfers, *t)
+	}
+	sort.Slice(transfers, func(i, j int) bool { return transfers[i].ID < transfers[j].ID })
+	return transfers
+}
+
+// WaitTransfer blocks until the transfer finishes or ctx is done and returns its final snapshot
+func (s *Server) WaitTransfer(ctx context.Context, id uint64) (Transfer, error) {
+	s.transfersMu.Lock()
+	t, exists := s.transfers[id]
+	if !exists {
+		s.transfersMu.Unlock()
+		return Transfer{}, fmt.Errorf("server: %w: %d", ErrUnknownTransfer, id)
+	}
+	if t.Finished() {
+		snapshot := *t
+		s.transfersMu.Unlock()
+		return snapshot, nil
+	}
+	done := s.transferDone[id]
+	s.transfersMu.Unlock()
+
+	select {
+	case <-done:
+		snapshot, _ := s.Transfer(id)
+		return snapshot, nil
+	case <-ctx.Done():
+		return Transfer{}, ctx.Err()
+	}
+}
+
+// CancelTransfer stops a transfer on behalf of operator, cancelling the chunks it queued.
+// The partial file is kept, so starting the transfer again resumes it. Only the
+// operator who started the transfer or an admin may cancel it.
+func (s *Server) CancelTransfer(operator string, id uint64) error {
+	t, exists := s.Transfer(id)
+	if !exists {
+		return fmt.Errorf("server: %w: %d", ErrUnknownTransfer, id)
+	}
+	if operator != t.Operator {
+		if err := s.authorizeAdmin(operator, AuditCancelTransfer, t.ClientID); err != nil {
+			return err
+		}
+	}
+
+	s.transfersMu.Lock()
+	cancel, running := s.transferCancel[id]
+	s.transfersMu.Unlock()
+	if !running {
+		return nil
+	}
+	cancel()
+	s.audit(AuditEntry{Action: AuditCancelTransfer, Operator: operator, ClientID: t.ClientID, Detail: fmt.Sprintf("transfer %d", id)})
+	return nil
+}
+
+// pruneTransfers drops finished transfers that outlived the retention period
+func (s *Server) pruneTransfers(now time.Time) {
+	s.transfersMu.Lock()
+	defer s.transfersMu.Unlock()
+	for id, t := range s.transfers {
+		if t.Finished() && now.Sub(t.FinishedAt) > s.config.Retention {
+			delete(s.transfers, id)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package c2
+
+import "syscall"
+
+// openNoFollow makes opening a partial file fail if it is a symbolic link
+const openNoFollow = syscall.O_NOFOLLOW
@@ -0,0 +1,6 @@
+//go:build windows
+
+package c2
+
+// openNoFollow is not supported on Windows, partial files are checked with Lstat only
+const openNoFollow = 0
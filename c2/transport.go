@@ -0,0 +1,404 @@
+package c2
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PacketTransport opens the datagram sockets of clients and servers
+type PacketTransport interface {
+	// Listen opens the server socket bound to address
+	Listen(address string) (net.PacketConn, error)
+	// Dial opens a client socket and resolves the server address it sends to
+	Dial(address string) (net.PacketConn, net.Addr, error)
+}
+
+// UDPTransport is the PacketTransport of real UDP sockets
+type UDPTransport struct{}
+
+// Listen opens a UDP socket bound to address, see listenNetwork for the address families
+func (UDPTransport) Listen(address string) (net.PacketConn, error) {
+	network := listenNetwork(address)
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve UDP address: %w", err)
+	}
+	conn, err := net.ListenUDP(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create UDP listener: %w", err)
+	}
+	return conn, nil
+}
+
+// listenNetwork returns the network a server socket bound to address uses. A literal
+// IPv4 or IPv6 host binds that family only, so 0.0.0.0 and [::] can listen on the same
+// port side by side; an empty host or a name binds both families where the system can.
+func listenNetwork(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return "udp"
+	}
+	ip, err := netip.ParseAddr(host)
+	switch {
+	case err != nil:
+		return "udp"
+	case ip.Is4():
+		return "udp4"
+	default:
+		return "udp6"
+	}
+}
+
+// Dial opens a UDP socket connected to address, so only the server's datagrams are read
+func (UDPTransport) Dial(address string) (net.PacketConn, net.Addr, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to resolve UDP address: %w", err)
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create UDP connection: %w", err)
+	}
+	return connectedUDPConn{conn}, addr, nil
+}
+
+// connectedUDPConn is a connected UDP socket, which rejects WriteTo with an address
+type connectedUDPConn struct {
+	*net.UDPConn
+}
+
+// WriteTo writes to the connected address, addr is the same one
+func (c connectedUDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.Write(p)
+}
+
+// memoryQueueSize is how many datagrams a memory socket buffers before dropping new ones
+const memoryQueueSize = 1024
+
+// MemoryNetwork is a PacketTransport delivering datagrams between sockets of one process
+type MemoryNetwork struct {
+	mu       sync.Mutex
+	conns    map[string]*memoryConn
+	nextPort int
+}
+
+// NewMemoryNetwork creates an empty in-memory network
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		conns:    make(map[string]*memoryConn),
+		nextPort: 40000,
+	}
+}
+
+// memoryAddr is the address of a memory socket
+type memoryAddr string
+
+func (a memoryAddr) Network() string { return "memory" }
+func (a memoryAddr) String() string  { return string(a) }
+
+// Listen opens a socket bound to address, a zero port picks a free one
+func (n *MemoryNetwork) Listen(address string) (net.PacketConn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid memory address: %w", err)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if port == "0" {
+		port = n.allocatePort()
+	}
+	addr := memoryAddr(net.JoinHostPort(host, port))
+	if _, exists := n.conns[string(addr)]; exists {
+		return nil, fmt.Errorf("memory address %s already in use", addr)
+	}
+
+	conn := &memoryConn{
+		network: n,
+		addr:    addr,
+		inbox:   make(chan memoryPacket, memoryQueueSize),
+		closed:  make(chan struct{}),
+	}
+	n.conns[string(addr)] = conn
+	return conn, nil
+}
+
+// Dial opens a socket on a free loopback port for sending to address
+func (n *MemoryNetwork) Dial(address string) (net.PacketConn, net.Addr, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, nil, fmt.Errorf("invalid memory address: %w", err)
+	}
+	conn, err := n.Listen("127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, memoryAddr(address), nil
+}
+
+// allocatePort returns the next port not in use; mu must be held
+func (n *MemoryNetwork) allocatePort() string {
+	for {
+		port := strconv.Itoa(n.nextPort)
+		n.nextPort++
+		if _, exists := n.conns[net.JoinHostPort("127.0.0.1", port)]; !exists {
+			return port
+		}
+	}
+}
+
+// deliver queues a copy of data for the socket at to, dropping it like UDP if there is none or it is full
+func (n *MemoryNetwork) deliver(from memoryAddr, to net.Addr, data []byte) {
+	n.mu.Lock()
+	conn, exists := n.conns[to.String()]
+	n.mu.Unlock()
+	if !exists {
+		return
+	}
+	select {
+	case conn.inbox <- memoryPacket{data: append([]byte(nil), data...), from: from}:
+	default:
+	}
+}
+
+// memoryPacket is a datagram waiting in a memory socket
+type memoryPacket struct {
+	data []byte
+	from memoryAddr
+}
+
+// memoryConn is a socket of a MemoryNetwork
+type memoryConn struct {
+	network *MemoryNetwork
+	addr    memoryAddr
+	inbox   chan memoryPacket
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+// ReadFrom waits for the next datagram until the read deadline passes or the socket is closed
+func (c *memoryConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case packet := <-c.inbox:
+		return copy(p, packet.data), packet.from, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+// WriteTo sends a datagram to addr, delivery is not guaranteed
+func (c *memoryConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	c.network.deliver(c.addr, addr, p)
+	return len(p), nil
+}
+
+// Close releases the address of the socket
+func (c *memoryConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.network.mu.Lock()
+		delete(c.network.conns, string(c.addr))
+		c.network.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *memoryConn) LocalAddr() net.Addr { return c.addr }
+
+func (c *memoryConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline is a no-op, writes never block
+func (c *memoryConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// reorderTimeout is how long a held back datagram waits for a successor before it is sent anyway
+const reorderTimeout = 20 * time.Millisecond
+
+// FaultConfig describes the faults a FaultyTransport injects into written datagrams
+type FaultConfig struct {
+	Loss      float64       // Probability a datagram is dropped
+	Duplicate float64       // Probability a datagram is delivered twice
+	Reorder   float64       // Probability a datagram is held back until after the next one
+	Delay     time.Duration // Extra latency of every datagram
+	MTU       int           // Datagrams are truncated to this many bytes, unlimited if zero
+	Seed      uint64        // Seed of the random faults, so runs can be reproduced
+}
+
+// FaultStats counts the faults a FaultyTransport injected
+type FaultStats struct {
+	Written    uint64
+	Lost       uint64
+	Duplicated uint64
+	Reordered  uint64
+	Truncated  uint64
+}
+
+// FaultyTransport wraps a PacketTransport and injects faults into every datagram written through it
+type FaultyTransport struct {
+	transport PacketTransport
+	faults    FaultConfig
+
+	mu    sync.Mutex
+	rng   *rand.Rand
+	stats FaultStats
+}
+
+// NewFaultyTransport wraps transport, injecting faults into the datagrams its sockets write
+func NewFaultyTransport(transport PacketTransport, faults FaultConfig) *FaultyTransport {
+	return &FaultyTransport{
+		transport: transport,
+		faults:    faults,
+		rng:       rand.New(rand.NewPCG(faults.Seed, faults.Seed)),
+	}
+}
+
+// Listen opens a faulty server socket
+func (t *FaultyTransport) Listen(address string) (net.PacketConn, error) {
+	conn, err := t.transport.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyConn{PacketConn: conn, transport: t}, nil
+}
+
+// Dial opens a faulty client socket
+func (t *FaultyTransport) Dial(address string) (net.PacketConn, net.Addr, error) {
+	conn, addr, err := t.transport.Dial(address)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &faultyConn{PacketConn: conn, transport: t}, addr, nil
+}
+
+// Stats returns the faults injected so far
+func (t *FaultyTransport) Stats() FaultStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
+
+// faultPlan is what happens to one written datagram
+type faultPlan struct {
+	copies  int
+	reorder bool
+}
+
+// plan draws the faults of the next datagram and counts them
+func (t *FaultyTransport) plan() faultPlan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stats.Written++
+	plan := faultPlan{copies: 1}
+	switch {
+	case t.rng.Float64() < t.faults.Loss:
+		t.stats.Lost++
+		return faultPlan{}
+	case t.rng.Float64() < t.faults.Duplicate:
+		t.stats.Duplicated++
+		plan.copies = 2
+	}
+	if t.rng.Float64() < t.faults.Reorder {
+		t.stats.Reordered++
+		plan.reorder = true
+	}
+	return plan
+}
+
+// faultyConn is a socket whose writes go through the faults of its transport
+type faultyConn struct {
+	net.PacketConn
+	transport *FaultyTransport
+
+	// held is the datagram waiting to be sent after its successor
+	mu   sync.Mutex
+	held func()
+}
+
+// WriteTo applies the configured faults to p before sending it to addr
+func (c *faultyConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n := len(p)
+	faults := c.transport.faults
+	if faults.MTU > 0 && len(p) > faults.MTU {
+		p = p[:faults.MTU]
+		c.transport.mu.Lock()
+		c.transport.stats.Truncated++
+		c.transport.mu.Unlock()
+	}
+
+	plan := c.transport.plan()
+	data := append([]byte(nil), p...)
+	send := func() {
+		for i := 0; i < plan.copies; i++ {
+			if faults.Delay > 0 {
+				time.AfterFunc(faults.Delay, func() { c.PacketConn.WriteTo(data, addr) })
+			} else {
+				c.PacketConn.WriteTo(data, addr)
+			}
+		}
+	}
+
+	c.mu.Lock()
+	previous := c.held
+	c.held = nil
+	if plan.reorder && previous == nil {
+		// Hold the datagram back until the next write, or send it late if there is none
+		c.held = send
+		c.mu.Unlock()
+		time.AfterFunc(reorderTimeout, c.flush)
+		return n, nil
+	}
+	c.mu.Unlock()
+
+	send()
+	if previous != nil {
+		previous()
+	}
+	return n, nil
+}
+
+// flush sends a held back datagram that found no successor
+func (c *faultyConn) flush() {
+	c.mu.Lock()
+	held := c.held
+	c.held = nil
+	c.mu.Unlock()
+	if held != nil {
+		held()
+	}
+}
@@ -1,9 +1,13 @@
 package c2
 
 import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
 	"net"
 	"time"
 
+	"github.com/b1gcat/core/alert"
 	"github.com/sirupsen/logrus"
 )
 
@@ -19,13 +23,66 @@ const (
 	ProtocolNTP ProtocolType = "ntp"
 )
 
+// TransportType selects how a client reaches the server
+type TransportType string
+
+const (
+	// TransportUDP sends datagrams, optionally disguised by a protocol
+	TransportUDP TransportType = "udp"
+	// TransportTLS keeps a TLS 1.3 connection over TCP open to the server
+	TransportTLS TransportType = "tls"
+)
+
+// CodecType selects how messages are encoded on the wire
+type CodecType string
+
+const (
+	// CodecGob encodes messages with encoding/gob, understood by every version
+	CodecGob CodecType = "gob"
+	// CodecBinary encodes messages in a compact versioned layout, negotiated on probes
+	CodecBinary CodecType = "binary"
+)
+
+// OutputFormat selects how the console writes the outcome of commands
+type OutputFormat string
+
+const (
+	// OutputText writes tables and messages for people
+	OutputText OutputFormat = "text"
+	// OutputJSON writes the outcome of every command as one line of JSON for scripts
+	OutputJSON OutputFormat = "json"
+)
+
+// Capability flags the protocol features a client or server supports
+type Capability uint8
+
+const (
+	// CapabilityBinaryCodec means the sender reads and writes CodecBinary
+	CapabilityBinaryCodec Capability = 1 << 0
+)
+
 // ClientInfo represents a connected client's information
 type ClientInfo struct {
 	Identifier string       `json:"identifier"`
 	SourceIP   net.Addr     `json:"source_ip"`
 	LastSeen   time.Time    `json:"last_seen"`
-	PendingCmd string       `json:"pending_cmd,omitempty"`
 	Protocol   ProtocolType `json:"protocol,omitempty"`
+	State      ClientState  `json:"state"`
+	Groups     []string     `json:"groups,omitempty"`
+	// Tags are advertised by the client itself and never grant access
+	Tags []string `json:"tags,omitempty"`
+	// AssignedGroups are the groups an operator added the client to at runtime
+	AssignedGroups []string `json:"assigned_groups,omitempty"`
+	// Facts describe the host of the client, nil until it reported them
+	Facts *HostFacts `json:"facts,omitempty"`
+	// ProbeInterval is how often the client announced it probes, zero if unknown
+	ProbeInterval time.Duration `json:"probe_interval,omitempty"`
+	// Transport is how the client last reached the server
+	Transport TransportType `json:"transport,omitempty"`
+	// Listener is the server address the client last reached, replies leave from it
+	Listener string `json:"listener,omitempty"`
+	// Codec is how messages to the client are encoded
+	Codec CodecType `json:"codec,omitempty"`
 }
 
 // MessageType defines the type of message
@@ -35,6 +92,18 @@ const (
 	MessageTypeProbe   MessageType = 0x01
 	MessageTypeCommand MessageType = 0x02
 	MessageTypeResult  MessageType = 0x03
+	// MessageTypeRotateKey carries a new key epoch sealed with the current key
+	MessageTypeRotateKey MessageType = 0x04
+	// MessageTypeAck acknowledges one fragment of a fragmented message
+	MessageTypeAck MessageType = 0x05
+	// MessageTypeStatus reports the progress of a job
+	MessageTypeStatus MessageType = 0x06
+	// MessageTypeProbeAck tells the client its probe reached the server
+	MessageTypeProbeAck MessageType = 0x07
+	// MessageTypeOutput carries output a running command produced since the last one
+	MessageTypeOutput MessageType = 0x08
+	// MessageTypeCancel asks the client to kill a running command
+	MessageTypeCancel MessageType = 0x09
 )
 
 // Message represents a UDP message structure
@@ -42,6 +111,72 @@ type Message struct {
 	Type       MessageType `json:"type"`
 	Identifier string      `json:"identifier"`
 	Payload    []byte      `json:"payload,omitempty"`
+	Timestamp  int64       `json:"timestamp,omitempty"`  // Unix nanoseconds, used for replay protection
+	PublicKey  []byte      `json:"public_key,omitempty"` // Client public key, carried on probes for enrolment
+	KeyEpoch   uint32      `json:"key_epoch,omitempty"`  // Epoch of the key protecting the payload
+	// Fragmentation fields, set when the payload is split across datagrams
+	MessageID     uint32 `json:"message_id,omitempty"`
+	FragmentIndex uint16 `json:"fragment_index,omitempty"`
+	FragmentCount uint16 `json:"fragment_count,omitempty"`
+	Signature     []byte `json:"signature,omitempty"` // Ed25519 signature over the fields above
+	// Capabilities are the protocol features the sender supports, announced on probes and
+	// their acks. Signed too, but only when set so signatures of older clients stay valid.
+	Capabilities Capability `json:"capabilities,omitempty"`
+}
+
+// ProbeInfo is the encrypted payload of a probe message
+type ProbeInfo struct {
+	Tags []string `json:"tags,omitempty"`
+	// Facts are only sent when they changed or the server asked for them
+	Facts *HostFacts `json:"facts,omitempty"`
+	// Interval is the configured probe interval, sent along with the facts
+	Interval time.Duration `json:"interval,omitempty"`
+}
+
+// CommandRequest is the encrypted payload of a command message
+type CommandRequest struct {
+	JobID   uint64 `json:"job_id"`
+	Command string `json:"command"`
+	// Data is sent along with operations that need a payload, such as file chunks
+	Data []byte `json:"data,omitempty"`
+	// Timeout is how long the command may run, shortening the runtime limit of the client policy
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// CommandOutput is the encrypted payload of an output message
+type CommandOutput struct {
+	JobID uint64 `json:"job_id"`
+	// Seq counts the output messages of a job, so duplicates are dropped
+	Seq    uint64 `json:"seq"`
+	Stream string `json:"stream"` // stdout or stderr
+	Data   string `json:"data"`
+}
+
+// CommandCancel is the encrypted payload of a cancel message
+type CommandCancel struct {
+	JobID uint64 `json:"job_id"`
+}
+
+// CommandStatus is the encrypted payload of a status message
+type CommandStatus struct {
+	JobID uint64   `json:"job_id"`
+	State JobState `json:"state"`
+	// Progress reports how far a long operation got, nil for a plain state change
+	Progress *JobProgress `json:"progress,omitempty"`
+}
+
+// CommandResult is the encrypted payload of a result message
+type CommandResult struct {
+	JobID    uint64 `json:"job_id"`
+	ExitCode int    `json:"exit_code"`
+	Output   string `json:"output,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// Violation is set when the client policy refused the command
+	Violation string `json:"violation,omitempty"`
+	// TimedOut is set when the command was killed at its timeout
+	TimedOut bool `json:"timed_out,omitempty"`
+	// Cancelled is set when the command was killed on request of the server
+	Cancelled bool `json:"cancelled,omitempty"`
 }
 
 // Config defines the configuration for client and server
@@ -50,9 +185,79 @@ type Config struct {
 	Address    string
 	Identifier string
 	Interval   time.Duration
+	Transport  TransportType // How the client reaches the server, UDP by default
+	Codec      CodecType     // Preferred message encoding, gob if the peer does not support it
 	Protocol   ProtocolType
 	Domain     string
+	Tags       []string       // Labels the client advertises on every probe
+	Version    string         // Client version reported in host facts, the build version if empty
 	Logger     *logrus.Logger // Logger to use for output
+
+	SigningKey     ed25519.PrivateKey           // Client identity used to sign messages
+	IdentityFile   string                       // Client identity file, created if missing
+	TrustedClients map[string]ed25519.PublicKey // Pre-provisioned client keys on the server
+	Enrolment      EnrolmentPolicy              // How the server handles unknown identities
+
+	MasterKey      []byte        // Server secret that per-client keys are derived from
+	KeyEpoch       uint32        // Epoch of the client key
+	KeyFile        string        // Client file persisting rotated keys
+	KeyStateFile   string        // Server file persisting key epochs and pinned keys
+	KeyGracePeriod time.Duration // How long a replaced key stays accepted
+
+	FragmentSize      int           // Largest payload sent in a single datagram
+	MaxResultSize     int           // Largest command result accepted or sent
+	ReassemblyTimeout time.Duration // How long partial messages are kept
+
+	ReceiveWorkers int     // Goroutines handling received datagrams
+	ReceiveQueue   int     // Datagrams waiting for a worker before new ones are dropped
+	RateLimit      float64 // Datagrams per second accepted from one source IP, unlimited if zero
+	RateBurst      int     // Datagrams one source IP may send at once
+
+	JobTTL          time.Duration // How long a job may take from queueing to completion
+	ClientTimeout   time.Duration // How long a client may stay silent before it is lost
+	LateProbes      int           // Missed probes after which a client is late
+	LostProbes      int           // Missed probes after which a client is lost
+	TransferTimeout time.Duration // How long a transfer waits for one of its jobs before it fails
+
+	Jitter           float64       // Fraction the probe interval is randomly spread by
+	MaxBackoff       time.Duration // Longest probe interval while the server is unreachable
+	FastPollInterval time.Duration // Probe interval while a job is in flight
+
+	PacketTransport PacketTransport // Sockets of the UDP transport, real UDP sockets by default
+	ListenAddresses []string        // UDP addresses the server listens on besides Address
+
+	TLSAddress  string           // Server address of the TLS transport, disabled if empty
+	Certificate *tls.Certificate // Server certificate, required with TLSAddress, or client certificate for servers requiring one
+	RootCAs     *x509.CertPool   // CAs the client verifies the server with, the system roots if nil
+	ServerName  string           // Name the client expects in the server certificate
+	ClientCAs   *x509.CertPool   // CAs client certificates must chain to, none required if nil
+	KeepAlive   time.Duration    // TCP keepalive period of TLS connections
+
+	HTTPAddress string            // Address of the HTTP management API, disabled if empty
+	APITokens   map[string]string // Bearer tokens of the HTTP API by operator name
+
+	Store     Store         // Persistence of clients and jobs, in memory only if nil
+	StateFile string        // File backing the default store when Store is nil
+	Retention time.Duration // How long finished jobs and lost clients are kept
+
+	AuditFile   string            // Hash-chained log of operator actions, disabled if empty
+	AlertClient alert.AlertClient // Notified when clients are lost or return, disabled if nil
+
+	Roles           map[string]Role     // Roles by name, operators are unrestricted if empty
+	Operators       map[string]Operator // Operator accounts by name
+	ClientGroups    map[string][]string // Identifier patterns of each client group
+	ConsoleOperator string              // Account used by the console, the OS user if empty
+	ConsoleOutput   OutputFormat        // How the console writes the outcome of commands
+	ConsoleScript   string              // File of commands the console runs instead of prompting, - for standard input
+	ConsoleHistory  string              // File keeping console history across sessions, disabled if empty
+
+	PolicyFile string       // Client file restricting the commands the client runs
+	LogFiles   []string     // Path patterns of the log files operations may read, none if empty
+	Upgrader   Upgrader     // Replaces the client binary on upgrade operations, disabled if nil
+	Restart    func() error // Restarts the client into its upgraded binary, re-executing it if nil
+
+	TransferPaths   []string // Path patterns of the files that may be pushed or pulled, none if empty
+	MaxTransferSize int64    // Largest file the client pushes or pulls
 }
 
 // Option is a function type for configuring client/server
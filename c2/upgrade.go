@@ -0,0 +1,189 @@
+package c2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// upgradeResultEnv hands the result of the upgrade job that restarted a client to its new process
+const upgradeResultEnv = "C2_UPGRADE_RESULT"
+
+// Upgrader replaces the client binary with a newer release, satisfied by *upgrade.Upgrader
+type Upgrader interface {
+	// StartUpgrade installs the latest release if it is newer than the running one
+	StartUpgrade() error
+	// UpgradeToVersion installs the given release
+	UpgradeToVersion(version string) error
+}
+
+// sourcedUpgrader is an Upgrader that can install a release from another upgrade server
+// and report how far its download got, such as *upgrade.Upgrader. Both only apply to the
+// upgrade at hand.
+type sourcedUpgrader interface {
+	UpgradeFrom(version string, server string, progress func(downloaded, total int64)) error
+}
+
+// UpgradeRequest describes the release an upgrade job installs
+type UpgradeRequest struct {
+	// Version is the release to install, the latest if empty
+	Version string `json:"version,omitempty"`
+	// Server is the URL of the upgrade server, the one the client is configured with if empty.
+	// An upgrader with credentials refuses other servers unless it was allowed to use them.
+	Server string `json:"server,omitempty"`
+}
+
+// command returns the operation an upgrade job runs, restarting the client once it succeeded
+func (r UpgradeRequest) command() (string, error) {
+	args := map[string]string{"restart": "true"}
+	if r.Version != "" {
+		args["version"] = r.Version
+	}
+	if r.Server != "" {
+		u, err := url.Parse(r.Server)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "", fmt.Errorf("server: %w: upgrade server must be an http or https URL", ErrInvalidOperation)
+		}
+		args["server"] = r.Server
+	}
+	return Operation{Name: "upgrade", Args: args}.String(), nil
+}
+
+// EnqueueUpgrade queues an upgrade job for a client on behalf of operator. The client
+// reports the download progress in the job, then restarts into the new binary.
+func (s *Server) EnqueueUpgrade(operator string, clientID string, req UpgradeRequest, opts JobOptions) (*Job, error) {
+	cmd, err := req.command()
+	if err != nil {
+		return nil, err
+	}
+	return s.EnqueueWith(operator, clientID, cmd, opts)
+}
+
+// StartUpgradeRollout upgrades the clients of each target group or tag in turn, in batches
+// as StartRollout does. The rollout halts once an upgraded client stops probing or does
+// not report the requested version. Without a health check period it waits as long as
+// the slowest client takes to turn late, HealthCheckOff skips the check.
+func (s *Server) StartUpgradeRollout(operator string, targets []string, req UpgradeRequest, opts RolloutOptions) (Rollout, error) {
+	if len(targets) == 0 {
+		return Rollout{}, fmt.Errorf("server: %w: no target", ErrInvalidRollout)
+	}
+	cmd, err := req.command()
+	if err != nil {
+		return Rollout{}, err
+	}
+	if opts.HealthCheck == 0 {
+		opts.HealthCheck = s.upgradeHealthCheck(targets)
+	}
+	return s.startRollout(operator, targets, cmd, req.Version, opts)
+}
+
+// upgradeHealthCheck returns how long the members of targets take to turn late once
+// they stop probing, the longest of them
+func (s *Server) upgradeHealthCheck(targets []string) time.Duration {
+	var check time.Duration
+	for _, target := range targets {
+		for _, member := range s.Members(strings.TrimPrefix(target, "@")) {
+			late, _ := s.livenessThresholds(&member)
+			check = max(check, late)
+		}
+	}
+	return check
+}
+
+// upgradeResult is the result of the upgrade operation
+type upgradeResult struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Server  string `json:"server,omitempty"`
+	Restart bool   `json:"restart,omitempty"`
+}
+
+// upgrade installs the given or latest release through the configured upgrader, from
+// another upgrade server if one is given. The release takes effect when the client
+// restarts, right after the result is sent if restart is set.
+func (c *Client) upgrade(ctx context.Context, version string, server string, restart bool) (upgradeResult, error) {
+	if c.config.Upgrader == nil {
+		return upgradeResult{}, fmt.Errorf("self-upgrade is not configured")
+	}
+	result := upgradeResult{From: c.config.Version, To: version, Server: server, Restart: restart}
+	if version == "" {
+		result.To = "latest"
+	}
+
+	var err error
+	if sourced, ok := c.config.Upgrader.(sourcedUpgrader); ok {
+		jobID, _ := ctx.Value(jobIDKey{}).(uint64)
+		err = sourced.UpgradeFrom(version, server, c.progressReporter(jobID))
+	} else if server != "" {
+		return result, fmt.Errorf("%w: the upgrader cannot change its upgrade server", ErrInvalidOperation)
+	} else if version == "" {
+		err = c.config.Upgrader.StartUpgrade()
+	} else {
+		err = c.config.Upgrader.UpgradeToVersion(version)
+	}
+	if err == nil && restart {
+		c.restartPending.Store(true)
+	}
+	return result, err
+}
+
+// progressReporter returns a download progress callback reporting the progress of a job
+// to the server, at most once per output flush interval
+func (c *Client) progressReporter(jobID uint64) func(downloaded, total int64) {
+	var last time.Time
+	return func(downloaded, total int64) {
+		now := time.Now()
+		if now.Sub(last) < outputFlushInterval && downloaded != total {
+			return
+		}
+		last = now
+		status := CommandStatus{JobID: jobID, State: JobStateRunning, Progress: &JobProgress{Done: downloaded, Total: max(total, 0)}}
+		if err := c.sendPayload(MessageTypeStatus, status); err != nil {
+			c.config.Logger.Debugf("Client failed to report progress of job %d: %v", jobID, err)
+		}
+	}
+}
+
+// restart starts the upgraded binary in place of the client, handing it the result
+// of the upgrade job so it can report it again
+func (c *Client) restart(res CommandResult) {
+	data, err := json.Marshal(res)
+	if err != nil {
+		c.config.Logger.Errorf("client: failed to encode upgrade result: %v", err)
+		return
+	}
+	os.Setenv(upgradeResultEnv, string(data))
+
+	c.config.Logger.Infof("Client restarting into the upgraded binary after job %d", res.JobID)
+	restart := c.config.Restart
+	if restart == nil {
+		restart = restartExecutable
+	}
+	if err := restart(); err != nil {
+		os.Unsetenv(upgradeResultEnv)
+		c.config.Logger.Errorf("client: failed to restart after upgrade: %v", err)
+	}
+}
+
+// resumeUpgrade takes over the result of the upgrade job that restarted the client, so
+// the job is not run again if the server re-sends it and its result is reported on Run
+func (c *Client) resumeUpgrade() {
+	data, exists := os.LookupEnv(upgradeResultEnv)
+	if !exists {
+		return
+	}
+	os.Unsetenv(upgradeResultEnv)
+
+	var res CommandResult
+	if err := json.Unmarshal([]byte(data), &res); err != nil || res.JobID == 0 {
+		c.config.Logger.Warnf("client: ignoring invalid upgrade result %q", data)
+		return
+	}
+	c.recordJob(res.JobID)
+	c.finishJob(res)
+	c.upgraded.Store(&res)
+}
@@ -183,6 +183,11 @@ func Decrypt(key []byte, ciphertext []byte) ([]byte, error) {
 		iv[i] = 0 // Zero IV for simplicity
 	}
 
+	// CryptBlocks panics on partial blocks
+	if len(ciphertext)%xteaBlockSize != 0 {
+		return nil, errors.New("xtea: ciphertext is not a multiple of the block size")
+	}
+
 	mode := cipher.NewCBCDecrypter(xtea, iv)
 	plaintext := make([]byte, len(ciphertext))
 	mode.CryptBlocks(plaintext, ciphertext)
@@ -77,3 +77,12 @@ func TestXTEAEmptyData(t *testing.T) {
 		t.Errorf("Decrypted data should be empty. Got: %q", decrypted)
 	}
 }
+
+func TestXTEAPartialBlock(t *testing.T) {
+	key := []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f}
+
+	// Truncated ciphertext is rejected rather than crashing the caller
+	if _, err := Decrypt(key, []byte("garbage")); err == nil {
+		t.Error("Decrypt should return error for a partial block")
+	}
+}
@@ -51,7 +51,7 @@ func RunExec(cmd *exec.Cmd) (*string, error) {
 		if errorOutput != "" {
 			output += "\n" + errorOutput
 		}
-		return nil, fmt.Errorf("%v:%v", output, err)
+		return nil, fmt.Errorf("%v:%w", output, err)
 	}
 
 	return &output, nil
@@ -99,6 +99,13 @@ func WithProgressCallback(progressCallback ProgressCallback) Option {
 	}
 }
 
+// WithServerOverride allow upgrades from servers given per upgrade, which are sent the credentials too
+func WithServerOverride(allowed bool) Option {
+	return func(c *Config) {
+		c.AllowServerOverride = allowed
+	}
+}
+
 // Config upgrade module configuration struct
 type Config struct {
 	// AppName application name
@@ -127,6 +134,8 @@ type Config struct {
 	Logger func(format string, args ...interface{})
 	// ProgressCallback download progress callback
 	ProgressCallback ProgressCallback
+	// AllowServerOverride allow upgrades from servers given per upgrade
+	AllowServerOverride bool
 }
 
 // Validate validate if the configuration is valid
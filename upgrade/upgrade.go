@@ -1,14 +1,21 @@
 package upgrade
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
+// ErrServerOverride is returned when an upgrade would send the credentials to another server
+var ErrServerOverride = errors.New("upgrade server override not allowed")
+
 // Upgrader self-upgrade core structure
 type Upgrader struct {
+	// mu serializes upgrades and guards config
+	mu     sync.Mutex
 	config *Config
 }
 
@@ -34,7 +41,15 @@ func NewUpgrader(options ...Option) (*Upgrader, error) {
 
 // CheckUpgrade check if there's a new version
 func (u *Upgrader) CheckUpgrade() (*VersionInfo, error) {
-	u.config.Logger("Start checking for updates...")
+	u.mu.Lock()
+	config := *u.config
+	u.mu.Unlock()
+	return checkUpgrade(&config)
+}
+
+// checkUpgrade check if there's a new version with the given configuration
+func checkUpgrade(config *Config) (*VersionInfo, error) {
+	config.Logger("Start checking for updates...")
 
 	// Check if install tool exists
 	hasInstallTool, err := checkInstallTool()
@@ -46,11 +61,11 @@ func (u *Upgrader) CheckUpgrade() (*VersionInfo, error) {
 	}
 
 	// Construct version info URL
-	versionURL := fmt.Sprintf("%s/list.txt", u.config.UpgradeServerURL)
-	u.config.Logger("Fetch version info: %s", versionURL)
+	versionURL := fmt.Sprintf("%s/list.txt", config.UpgradeServerURL)
+	config.Logger("Fetch version info: %s", versionURL)
 
 	// Fetch version info
-	versionContent, err := fetchWithAuth(versionURL, u.config.Username, u.config.Password)
+	versionContent, err := fetchWithAuth(versionURL, config.Username, config.Password)
 	if err != nil {
 		return nil, fmt.Errorf("fetch version info failed: %w", err)
 	}
@@ -93,13 +108,22 @@ func (u *Upgrader) CheckUpgrade() (*VersionInfo, error) {
 	}
 
 	// Check if upgrade is needed
-	needUpgrade, err := needsUpgrade(u.config.CurrentVersion, latestVersion)
+	needUpgrade, err := needsUpgrade(config.CurrentVersion, latestVersion)
 	if err != nil {
 		return nil, fmt.Errorf("compare versions failed: %w", err)
 	}
 
+	// A specified version is installed whenever it differs from the current one
+	if config.UpgradeOption == UpgradeOptionSpecified && config.TargetVersion != "" {
+		if !hasVersion(upgradeMap, config.TargetVersion) {
+			return nil, fmt.Errorf("version %s not found in upgrade list", config.TargetVersion)
+		}
+		latestVersion = config.TargetVersion
+		needUpgrade = latestVersion != config.CurrentVersion
+	}
+
 	if !needUpgrade {
-		u.config.Logger("Current is already the latest version: %s", u.config.CurrentVersion)
+		config.Logger("Current is already the latest version: %s", config.CurrentVersion)
 		return nil, nil
 	}
 
@@ -109,16 +133,34 @@ func (u *Upgrader) CheckUpgrade() (*VersionInfo, error) {
 		UpgradeMap: upgradeMap,
 	}
 
-	u.config.Logger("Found new version: %s", versionInfo.Version)
+	config.Logger("Found new version: %s", versionInfo.Version)
 	return versionInfo, nil
 }
 
+// hasVersion check if the upgrade list has a package of version
+func hasVersion(upgradeMap map[string]string, version string) bool {
+	for filename := range upgradeMap {
+		if strings.HasSuffix(filename, ".v"+version) {
+			return true
+		}
+	}
+	return false
+}
+
 // StartUpgrade start the upgrade process
 func (u *Upgrader) StartUpgrade() error {
-	u.config.Logger("Start upgrading...")
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	config := *u.config
+	return startUpgrade(&config)
+}
+
+// startUpgrade run the upgrade process with the given configuration
+func startUpgrade(config *Config) error {
+	config.Logger("Start upgrading...")
 
 	// Check if there's a new version
-	versionInfo, err := u.CheckUpgrade()
+	versionInfo, err := checkUpgrade(config)
 	if err != nil {
 		return fmt.Errorf("check upgrade failed: %w", err)
 	}
@@ -127,8 +169,8 @@ func (u *Upgrader) StartUpgrade() error {
 	}
 
 	// Call callback to confirm upgrade
-	if !u.config.Callback(versionInfo.Version) {
-		u.config.Logger("User cancelled upgrade")
+	if !config.Callback(versionInfo.Version) {
+		config.Logger("User cancelled upgrade")
 		return nil
 	}
 
@@ -139,24 +181,24 @@ func (u *Upgrader) StartUpgrade() error {
 	}
 
 	// Construct upgrade package URL
-	appName := u.config.AppName
-	upgradePackageName := fmt.Sprintf("%s-%s-%s.v%s", u.config.OS, u.config.Arch, appName, versionInfo.Version)
-	upgradePackageURL := fmt.Sprintf("%s/%s", u.config.UpgradeServerURL, upgradePackageName)
-	u.config.Logger("Download upgrade package: %s", upgradePackageURL)
+	appName := config.AppName
+	upgradePackageName := fmt.Sprintf("%s-%s-%s.v%s", config.OS, config.Arch, appName, versionInfo.Version)
+	upgradePackageURL := fmt.Sprintf("%s/%s", config.UpgradeServerURL, upgradePackageName)
+	config.Logger("Download upgrade package: %s", upgradePackageURL)
 
 	// Download upgrade package to temporary directory
 	tempFilePath := getTempFilePath(upgradePackageName)
 	defer os.Remove(tempFilePath)
 
-	u.config.Logger("Temporary file path: %s", tempFilePath)
+	config.Logger("Temporary file path: %s", tempFilePath)
 
-	if err := downloadFileWithAuth(upgradePackageURL, u.config.Username, u.config.Password, tempFilePath, u.config.ProgressCallback); err != nil {
+	if err := downloadFileWithAuth(upgradePackageURL, config.Username, config.Password, tempFilePath, config.ProgressCallback); err != nil {
 		return fmt.Errorf("download upgrade package failed: %s, %w",
 			upgradePackageURL, err)
 	}
 
 	// Verify upgrade package integrity
-	u.config.Logger("Verify upgrade package integrity...")
+	config.Logger("Verify upgrade package integrity...")
 	expectedHash, exists := versionInfo.UpgradeMap[upgradePackageName]
 	if !exists {
 		return fmt.Errorf("upgrade package not found in upgrade list: %s", upgradePackageName)
@@ -171,20 +213,22 @@ func (u *Upgrader) StartUpgrade() error {
 		return fmt.Errorf("SHA256 check failed: expected %s, got %s", expectedHash, actualHash)
 	}
 
-	u.config.Logger("升级包验证通过")
+	config.Logger("升级包验证通过")
 
 	// Install upgrade package
-	u.config.Logger("Install upgrade package...")
+	config.Logger("Install upgrade package...")
 	if err := installFile(tempFilePath, execPath); err != nil {
 		return fmt.Errorf("install upgrade package failed: %w", err)
 	}
 
-	u.config.Logger("Upgrade completed: %s -> %s", u.config.CurrentVersion, versionInfo.Version)
+	config.Logger("Upgrade completed: %s -> %s", config.CurrentVersion, versionInfo.Version)
 	return nil
 }
 
 // SetUpgradeOption set upgrade strategy
 func (u *Upgrader) SetUpgradeOption(option UpgradeOption) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 	u.config.UpgradeOption = option
 	return nil
 }
@@ -194,13 +238,43 @@ func (u *Upgrader) SetDailyUpgradeTime(hour, minute int) error {
 	if hour < 0 || hour > 23 || minute < 0 || minute > 59 {
 		return fmt.Errorf("invalid time: hour must be 0-23, minute must be 0-59")
 	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
 	u.config.DailyUpgradeTime = time.Date(0, 1, 1, hour, minute, 0, 0, time.UTC)
 	return nil
 }
 
 // UpgradeToVersion upgrade to specified version
 func (u *Upgrader) UpgradeToVersion(version string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 	u.config.TargetVersion = version
 	u.config.UpgradeOption = UpgradeOptionSpecified
-	return u.StartUpgrade()
+	config := *u.config
+	return startUpgrade(&config)
+}
+
+// UpgradeFrom upgrade to version, the latest if empty, from server, the configured one if
+// empty, reporting the download to progress if not nil. The configuration of later upgrades
+// is left as it is. The credentials are only sent to another server if WithServerOverride
+// allowed it.
+func (u *Upgrader) UpgradeFrom(version string, server string, progress func(downloaded, total int64)) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	config := *u.config
+	config.TargetVersion = version
+	if version != "" {
+		config.UpgradeOption = UpgradeOptionSpecified
+	}
+	if server = strings.TrimSuffix(server, "/"); server != "" && server != strings.TrimSuffix(config.UpgradeServerURL, "/") {
+		if !config.AllowServerOverride && (config.Username != "" || config.Password != "") {
+			return fmt.Errorf("%w: %s", ErrServerOverride, server)
+		}
+		config.UpgradeServerURL = server
+	}
+	if progress != nil {
+		config.ProgressCallback = progress
+	}
+	return startUpgrade(&config)
 }
@@ -1,6 +1,7 @@
 package upgrade
 
 import (
+	"errors"
 	"strings"
 	"testing"
 )
@@ -129,3 +130,39 @@ func TestFindLatestVersion(t *testing.T) {
 		t.Errorf("expected latest version %s, got %s", expectedLatestVersion, latestVersion)
 	}
 }
+
+// TestHasVersion test looking up a specified version in the upgrade list
+func TestHasVersion(t *testing.T) {
+	upgradeMap := map[string]string{
+		"linux-amd64-app.v1.0.3":   "a4c9f929",
+		"linux-amd64-app.v1.0.300": "f733d663",
+	}
+	if !hasVersion(upgradeMap, "1.0.3") || !hasVersion(upgradeMap, "1.0.300") {
+		t.Error("expected listed versions to be found")
+	}
+	if hasVersion(upgradeMap, "1.0.30") || hasVersion(upgradeMap, "2.0.0") {
+		t.Error("expected unlisted versions not to be found")
+	}
+}
+
+// TestUpgradeFromServerOverride test that the credentials are not sent to another server unless allowed
+func TestUpgradeFromServerOverride(t *testing.T) {
+	upgrader, err := NewUpgrader(
+		WithAppName("app"),
+		WithCurrentVersion("1.0.0"),
+		WithOS("linux"),
+		WithArch("amd64"),
+		WithUpgradeServerURL("https://releases.example.com"),
+		WithUsername("user"),
+		WithPassword("secret"),
+	)
+	if err != nil {
+		t.Fatalf("NewUpgrader failed: %v", err)
+	}
+	if err := upgrader.UpgradeFrom("2.0.0", "https://elsewhere.example.com", nil); !errors.Is(err, ErrServerOverride) {
+		t.Errorf("expected ErrServerOverride, got %v", err)
+	}
+	if upgrader.config.UpgradeServerURL != "https://releases.example.com" || upgrader.config.TargetVersion != "" {
+		t.Errorf("expected the configuration to stay unchanged, got %+v", upgrader.config)
+	}
+}